@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime/debug"
 	"strings"
+	"syscall"
 	"time"
 
 	form_courier "github.com/nazarhussain/form-courier/internal"
@@ -17,35 +24,211 @@ func main() {
 
 	config := form_courier.GetConfig()
 	form_courier.LogConfig(logger, config)
+	if config.RateStateFile != "" {
+		if n, err := form_courier.LoadBuckets(config.RateStateFile); err != nil {
+			logger.Warn("rate limit state not restored, starting fresh", "err", err)
+		} else {
+			logger.Info("rate limit state restored", "buckets", n)
+		}
+	}
+	if config.WarmupStateFile != "" {
+		if n, err := form_courier.LoadWarmup(config.WarmupStateFile); err != nil {
+			logger.Warn("warmup state not restored, starting fresh", "err", err)
+		} else {
+			logger.Info("warmup state restored", "sites", n)
+		}
+	}
+	if config.DigestStateFile != "" {
+		n, err := form_courier.LoadDigests(config.DigestStateFile)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			logger.Info("no digest state yet, starting empty", "path", config.DigestStateFile)
+		case err != nil:
+			// Starting empty would overwrite the file, and with it
+			// submissions already acknowledged, on the first flush
+			logger.Error("digest state not restored; fix or move the file aside", "err", err)
+			os.Exit(1)
+		default:
+			logger.Info("digest state restored", "submissions", n)
+		}
+	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/health", form_courier.HandleHealth)
-
-	// POST /v1/contact/{siteKey}
-	mux.HandleFunc("/v1/contact/", form_courier.HandleContact)
-
-	handler := loggingMiddleware(logger, secHeaders(mux))
+	mux := newMux(config)
+	handler := loggingMiddleware(logger, headerLimits(config, config.MaxHeaderCount, config.MaxHeaderKB*1024, secHeaders(config.SecurityHeaders, mux)))
 
 	s := &http.Server{
 		Addr:              config.ListenAddr,
 		Handler:           handler,
 		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+	if config.MaxHeaderKB*1024 > http.DefaultMaxHeaderBytes {
+		// Let headerLimits, rather than the server, have the last word
+		s.MaxHeaderBytes = config.MaxHeaderKB * 1024
+	}
+	if config.EnableH2C {
+		// Serve HTTP/1.1 and prior-knowledge HTTP/2 cleartext on the same listener
+		s.Protocols = new(http.Protocols)
+		s.Protocols.SetHTTP1(true)
+		s.Protocols.SetUnencryptedHTTP2(true)
 	}
 
-	logger.Info("form-mailer listening", "addr", config.ListenAddr, "sites", len(config.Sites))
+	var certs *form_courier.CertReloader
+	if config.TLSCertFile != "" {
+		var err error
+		if certs, err = form_courier.NewCertReloader(config.TLSCertFile, config.TLSKeyFile); err != nil {
+			logger.Error("loading TLS certificate failed", "err", err)
+			os.Exit(1)
+		}
+		s.TLSConfig = form_courier.ServerTLSConfig(certs, config.TLSMinVersion)
+		// Offer HTTP/2 over TLS explicitly; setting Protocols for h2c would
+		// otherwise leave it out
+		if s.Protocols == nil {
+			s.Protocols = new(http.Protocols)
+			s.Protocols.SetHTTP1(true)
+		}
+		s.Protocols.SetHTTP2(true)
+	}
+
+	go reloadOnHangup(logger, certs)
+	go form_courier.RunDigests(context.Background(), logger)
+	stopped := make(chan struct{})
+	go shutdownOnSignal(logger, s, stopped)
+
+	logger.Info("form-mailer listening", "addr", config.ListenAddr, "tls", certs != nil, "sites", len(config.SiteKeys))
 
-	if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	ln, err := net.Listen("tcp", config.ListenAddr)
+	if err != nil {
+		logger.Error("listen failed", "err", err)
+		os.Exit(1)
+	}
+	if config.EnableProxyProtocol {
+		ln = form_courier.ProxyProtoListener(ln)
+	}
+	if certs != nil {
+		err = s.ServeTLS(ln, "", "")
+	} else {
+		err = s.Serve(ln)
+	}
+	if err != nil && err != http.ErrServerClosed {
 		logger.Error("server failed", "err", err)
 		os.Exit(1)
 	}
+	<-stopped
 }
 
-func secHeaders(next http.Handler) http.Handler {
+// newMux registers the service's routes. Requests no route claims get
+// notFound's JSON answers instead of the mux's plain-text ones.
+func newMux(config *form_courier.Config) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", form_courier.HandleHealth)
+	mux.HandleFunc("/health/ready", form_courier.HandleReady)
+	if config.MetricsEnabled {
+		mux.HandleFunc("GET /metrics", form_courier.HandleMetrics)
+	}
+
+	// POST /v1/contact/{siteKey}
+	mux.HandleFunc("/v1/contact/", form_courier.HandleContact)
+	if config.SiteKeySource != "path" {
+		// POST /submit with the site key in the Host or a header
+		mux.HandleFunc("/submit", form_courier.HandleContact)
+	}
+	mux.HandleFunc("GET /v1/contact/{siteKey}/token", form_courier.HandleFormToken)
+	mux.HandleFunc("POST /v1/contact/{siteKey}/batch", form_courier.HandleBatch)
+	mux.HandleFunc("OPTIONS /v1/contact/{siteKey}/batch", form_courier.HandleBatch)
+	mux.HandleFunc("POST /v1/contact/{siteKey}/test", form_courier.HandleTestEmail)
+	mux.HandleFunc("GET /v1/contact/{siteKey}/echo", form_courier.HandleEcho)
+	mux.HandleFunc("GET /v1/admin/sites", form_courier.HandleListSites)
+	mux.HandleFunc("POST /v1/admin/ratelimit/reset", form_courier.HandleRateLimitReset)
+	mux.HandleFunc("GET /v1/stats", form_courier.HandleStats)
+	mux.Handle("/", notFound(mux))
+	return mux
+}
+
+// shutdownOnSignal drains in-flight requests and the shadow deliveries they
+// started on SIGTERM or SIGINT, then mails any buffered digests and saves
+// the rate-limit state before closing stopped.
+func shutdownOnSignal(logger *slog.Logger, s *http.Server, stopped chan<- struct{}) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	logger.Info("shutting down", "signal", (<-sig).String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		logger.Warn("shutdown incomplete", "err", err)
+	}
+	if err := form_courier.WaitShadowDeliveries(ctx); err != nil {
+		logger.Warn("shadow deliveries still running at exit", "err", err)
+	}
+	if err := form_courier.WaitAutoReplies(ctx); err != nil {
+		logger.Warn("auto-replies still running at exit", "err", err)
+	}
+	form_courier.FlushDigests(context.Background(), logger, true)
+	if path := form_courier.GetConfig().RateStateFile; path != "" {
+		if err := form_courier.SaveBuckets(path); err != nil {
+			logger.Error("saving rate limit state failed", "err", err)
+		} else {
+			logger.Info("rate limit state saved", "buckets", form_courier.BucketCount())
+		}
+	}
+	close(stopped)
+}
+
+// reloadOnHangup reloads the configuration, and the TLS certificate when
+// serving HTTPS, each time the process gets SIGHUP.
+func reloadOnHangup(logger *slog.Logger, certs *form_courier.CertReloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		logger.Info("reloading configuration")
+		if cfg, err := form_courier.ReloadConfig(); err != nil {
+			logger.Error("reloading configuration failed, keeping the current one", "err", err)
+		} else {
+			form_courier.LogConfig(logger, cfg)
+		}
+		if certs == nil {
+			continue
+		}
+		if err := certs.Reload(); err != nil {
+			logger.Error("reloading TLS certificate failed, keeping the current one", "err", err)
+		} else {
+			logger.Info("TLS certificate reloaded")
+		}
+	}
+}
+
+func secHeaders(headers map[string]string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range headers {
+			w.Header().Set(name, value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// headerLimits answers 431 to requests with more than maxCount header
+// fields or more than maxBytes of them, counted as on the wire, before they
+// reach a handler. Zero disables a limit. The server reads the headers
+// anyway, bounded by MaxHeaderBytes; this makes the limits ours to tune
+// and shows the rejections in the access log.
+func headerLimits(cfg *form_courier.Config, maxCount, maxBytes int, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Referrer-Policy", "no-referrer-when-downgrade")
-		w.Header().Set("X-Content-Type-Options", "nosniff")
-		w.Header().Set("X-Frame-Options", "DENY")
-		w.Header().Set("X-XSS-Protection", "0")
+		count, size := 0, 0
+		for name, values := range r.Header {
+			for _, v := range values {
+				count++
+				size += len(name) + len(v) + 4 // ": " and CRLF
+			}
+		}
+		if (maxCount > 0 && count > maxCount) || (maxBytes > 0 && size > maxBytes) {
+			form_courier.LoggerFromContext(r.Context()).Warn("request headers too large",
+				"reason_code", form_courier.RejectHeadersTooLarge, "count", count, "bytes", size)
+			form_courier.Reject(w, r, cfg, form_courier.RejectHeadersTooLarge, "request header fields too large", http.StatusRequestHeaderFieldsTooLarge)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
@@ -53,12 +236,18 @@ func secHeaders(next http.Handler) http.Handler {
 func loggingMiddleware(baseLogger *slog.Logger, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
+		defer form_courier.TrackInFlight()()
+		requestID := form_courier.RequestID(r)
+		w.Header().Set("X-Request-ID", requestID)
 		requestLogger := baseLogger.With(
+			"request_id", requestID,
 			"method", r.Method,
 			"path", r.URL.Path,
 		)
 
+		info := &form_courier.RequestInfo{RequestID: requestID}
 		ctx := form_courier.ContextWithLogger(r.Context(), requestLogger)
+		ctx = form_courier.ContextWithRequestInfo(ctx, info)
 		r = r.WithContext(ctx)
 
 		lrw := &loggingResponseWriter{ResponseWriter: w, status: http.StatusOK}
@@ -70,7 +259,18 @@ func loggingMiddleware(baseLogger *slog.Logger, next http.Handler) http.Handler
 					"type", fmt.Sprintf("%T", rec),
 					"stack", string(debug.Stack()),
 				)
-				lrw.WriteHeader(http.StatusInternalServerError)
+				info.SetOutcome(form_courier.OutcomePanic)
+				if lrw.wrote {
+					// Part of the response is out; all we can do is
+					// record the failure.
+					lrw.status = http.StatusInternalServerError
+				} else {
+					writePanicResponse(lrw, requestID)
+				}
+			}
+			form_courier.RecordOutcome(info)
+			if info.LogSuppressed && lrw.status < 500 {
+				return
 			}
 			duration := time.Since(start)
 			level := slog.LevelInfo
@@ -84,6 +284,11 @@ func loggingMiddleware(baseLogger *slog.Logger, next http.Handler) http.Handler
 				"status", lrw.status,
 				"duration_ms", duration.Milliseconds(),
 				"bytes", lrw.length,
+				"ip", form_courier.ClientIP(r),
+				"user_agent", r.UserAgent(),
+				"site", info.Site,
+				"submission_id", info.SubmissionID,
+				"reason", info.Reason(),
 			)
 		}()
 
@@ -91,6 +296,52 @@ func loggingMiddleware(baseLogger *slog.Logger, next http.Handler) http.Handler
 	})
 }
 
+// writePanicResponse answers a request whose handler panicked before
+// writing anything. Headers the handler already set for its own body go.
+func writePanicResponse(w http.ResponseWriter, requestID string) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	h.Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInternalServerError)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"ok":         false,
+		"error":      "internal error",
+		"request_id": requestID,
+	})
+}
+
+// notFound answers requests no route on mux claims: a JSON 405 with Allow
+// when the path takes other methods, otherwise a JSON 404, in the same
+// {"ok": false, "error": ...} shape as the handlers' JSON errors.
+func notFound(mux *http.ServeMux) http.Handler {
+	methods := []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var allow []string
+		for _, m := range methods {
+			probe := r.Clone(r.Context())
+			probe.Method = m
+			if _, pattern := mux.Handler(probe); pattern != "/" {
+				allow = append(allow, m)
+			}
+		}
+		status, msg, reason := http.StatusNotFound, "not found", form_courier.RejectNotFound
+		if len(allow) > 0 {
+			status, msg, reason = http.StatusMethodNotAllowed, "method not allowed", form_courier.RejectMethodNotAllowed
+			w.Header().Set("Allow", strings.Join(allow, ", "))
+		}
+		form_courier.RequestInfoFromContext(r.Context()).SetRejected(reason)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"ok":         false,
+			"error":      msg,
+			"code":       reason,
+			"request_id": w.Header().Get("X-Request-ID"),
+		})
+	})
+}
+
 type loggingResponseWriter struct {
 	http.ResponseWriter
 	status int
@@ -116,8 +367,9 @@ func (lrw *loggingResponseWriter) Write(p []byte) (int, error) {
 }
 
 func newLogger() *slog.Logger {
+	// The level is applied in front, where <SITE>_LOG_LEVEL can change it
 	opts := &slog.HandlerOptions{
-		Level: logLevelFromEnv(),
+		Level: slog.LevelDebug,
 	}
 
 	var handler slog.Handler
@@ -126,7 +378,7 @@ func newLogger() *slog.Logger {
 	} else {
 		handler = slog.NewTextHandler(os.Stdout, opts)
 	}
-	logger := slog.New(handler)
+	logger := slog.New(form_courier.NewLevelHandler(handler, logLevelFromEnv()))
 	slog.SetDefault(logger)
 	return logger
 }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	form_courier "github.com/nazarhussain/form-courier/internal"
+)
+
+func TestLoggingMiddlewareRecoversPanic(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	handler := loggingMiddleware(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "5")
+		panic("boom")
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", nil)
+	req.Header.Set("X-Request-ID", "req-123")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("expected a JSON body, got Content-Type %q", ct)
+	}
+	var resp struct {
+		OK        bool   `json:"ok"`
+		Error     string `json:"error"`
+		RequestID string `json:"request_id"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if resp.OK || resp.Error == "" || resp.RequestID != "req-123" {
+		t.Fatalf("unexpected body: %+v", resp)
+	}
+	if got := rec.Header().Get("X-Request-ID"); got != "req-123" {
+		t.Fatalf("X-Request-ID = %q", got)
+	}
+}
+
+func TestLoggingMiddlewarePanicAfterWrite(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	handler := loggingMiddleware(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("partial"))
+		panic("boom")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.Header.Set("X-Request-ID", "bad id\n")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if body := rec.Body.String(); body != "partial" {
+		t.Fatalf("expected the partial body untouched, got %q", body)
+	}
+	if got := rec.Header().Get("X-Request-ID"); got == "" || got == "bad id\n" {
+		t.Fatalf("expected a generated request ID, got %q", got)
+	}
+}
+
+func TestHeaderLimits(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	cfg := &form_courier.Config{}
+	handler := headerLimits(cfg, 5, 200, ok)
+
+	send := func(n int, value string) int {
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", nil)
+		for i := 0; i < n; i++ {
+			req.Header.Add("X-Pad", value)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := send(5, "x"); code != http.StatusOK {
+		t.Fatalf("expected headers within the limits to pass, got %d", code)
+	}
+	if code := send(6, "x"); code != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatalf("expected 431 for too many headers, got %d", code)
+	}
+	if code := send(1, strings.Repeat("x", 200)); code != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatalf("expected 431 for oversized headers, got %d", code)
+	}
+
+	handler = headerLimits(cfg, 0, 0, ok)
+	if code := send(500, "x"); code != http.StatusOK {
+		t.Fatalf("expected zero limits to pass everything, got %d", code)
+	}
+}
+
+func TestNotFoundJSON(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	handler := loggingMiddleware(logger, newMux(&form_courier.Config{SiteKeySource: "path", MetricsEnabled: true}))
+
+	serve := func(method, path string) (*httptest.ResponseRecorder, map[string]any) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		var body map[string]any
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("%s %s: expected a JSON body, got Content-Type %q", method, path, ct)
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatalf("%s %s: decode: %v", method, path, err)
+		}
+		return rec, body
+	}
+
+	rec, body := serve(http.MethodGet, "/nope")
+	if rec.Code != http.StatusNotFound || body["ok"] != false || body["error"] != "not found" || body["request_id"] == "" {
+		t.Fatalf("unexpected 404: %d %v", rec.Code, body)
+	}
+
+	rec, body = serve(http.MethodPost, "/metrics")
+	if rec.Code != http.StatusMethodNotAllowed || body["error"] != "method not allowed" {
+		t.Fatalf("unexpected 405: %d %v", rec.Code, body)
+	}
+	if allow := rec.Header().Get("Allow"); allow != "GET, HEAD" {
+		t.Fatalf("Allow = %q, want GET, HEAD", allow)
+	}
+
+	rec, _ = serve(http.MethodDelete, "/v1/admin/ratelimit/reset")
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "POST" {
+		t.Fatalf("expected a 405 allowing POST, got %d %q", rec.Code, rec.Header().Get("Allow"))
+	}
+}
@@ -1,54 +1,95 @@
 package env
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
-func MustEnv(k string) string {
-	v := os.Getenv(k)
-	if v == "" {
-		log.Fatalf("missing env %s", k)
+// Parser reads typed values like EnvInt and friends, but collects the bad
+// ones as errors instead of exiting, for configuration loaded while the
+// server is running. A bad value reads as the default. Values come from
+// Vars when it is set, e.g. a Snapshot, and from the process environment
+// otherwise.
+type Parser struct {
+	Vars map[string]string
+	errs []error
+}
+
+// Get returns the value of k, or "" when it is unset.
+func (p *Parser) Get(k string) string {
+	if p.Vars != nil {
+		return p.Vars[k]
 	}
-	return v
+	return os.Getenv(k)
 }
 
-func MustEnvInt(k string) int {
-	v := os.Getenv(k)
+// Env returns the value of k, or d when it is unset or empty.
+func (p *Parser) Env(k, d string) string {
+	if v := p.Get(k); v != "" {
+		return v
+	}
+	return d
+}
+
+// Failf records a configuration error.
+func (p *Parser) Failf(format string, args ...any) {
+	p.errs = append(p.errs, fmt.Errorf(format, args...))
+}
+
+// Err returns every error recorded so far, or nil.
+func (p *Parser) Err() error {
+	return errors.Join(p.errs...)
+}
+
+func (p *Parser) Require(k string) string {
+	v := p.Get(k)
 	if v == "" {
-		log.Fatalf("missing env %s", k)
+		p.Failf("missing env %s", k)
 	}
-	n, err := strconv.Atoi(v)
-	if err != nil {
-		log.Fatalf("env %s must be int", k)
+	return v
+}
+
+func (p *Parser) RequireInt(k string) int {
+	if p.Get(k) == "" {
+		p.Failf("missing env %s", k)
+		return 0
 	}
-	return n
+	return p.Int(k, 0)
 }
 
-func Env(k, d string) string {
-	v := os.Getenv(k)
+func (p *Parser) Int(k string, d int) int {
+	v := p.Get(k)
 	if v == "" {
 		return d
 	}
-	return v
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		p.Failf("env %s must be int", k)
+		return d
+	}
+	return n
 }
 
-func EnvInt(k string, d int) int {
-	v := os.Getenv(k)
+func (p *Parser) Duration(k string, d time.Duration) time.Duration {
+	v := p.Get(k)
 	if v == "" {
 		return d
 	}
-	n, err := strconv.Atoi(v)
+	n, err := time.ParseDuration(v)
 	if err != nil {
-		log.Fatalf("env %s must be int", k)
+		p.Failf("env %s must be a duration (e.g. 30s)", k)
+		return d
 	}
 	return n
 }
 
-func EnvBool(k string, d bool) bool {
-	v := os.Getenv(k)
+func (p *Parser) Bool(k string, d bool) bool {
+	v := p.Get(k)
 	if v == "" {
 		return d
 	}
@@ -58,9 +99,50 @@ func EnvBool(k string, d bool) bool {
 	case "0", "f", "false", "n", "no":
 		return false
 	default:
-		log.Fatalf("env %s must be boolean", k)
-		return false
+		p.Failf("env %s must be boolean", k)
+		return d
+	}
+}
+
+// must exits on the first error p recorded.
+func must[T any](v T, p *Parser) T {
+	if err := p.Err(); err != nil {
+		log.Fatal(err)
 	}
+	return v
+}
+
+func MustEnv(k string) string {
+	var p Parser
+	return must(p.Require(k), &p)
+}
+
+func MustEnvInt(k string) int {
+	var p Parser
+	return must(p.RequireInt(k), &p)
+}
+
+func Env(k, d string) string {
+	v := os.Getenv(k)
+	if v == "" {
+		return d
+	}
+	return v
+}
+
+func EnvInt(k string, d int) int {
+	var p Parser
+	return must(p.Int(k, d), &p)
+}
+
+func EnvDuration(k string, d time.Duration) time.Duration {
+	var p Parser
+	return must(p.Duration(k, d), &p)
+}
+
+func EnvBool(k string, d bool) bool {
+	var p Parser
+	return must(p.Bool(k, d), &p)
 }
 
 func ToEnvKey(s string) string {
@@ -75,3 +157,46 @@ func ToEnvKey(s string) string {
 	}
 	return b.String()
 }
+
+// LoadFile reads KEY=VALUE lines from path. Blank lines and lines starting
+// with # are ignored; values may be quoted. The process environment is left
+// alone: lay the result over it with Snapshot.
+func LoadFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	vars := map[string]string{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		k, v, ok := strings.Cut(line, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, i+1)
+		}
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		}
+		vars[k] = v
+	}
+	return vars, nil
+}
+
+// Snapshot returns the process environment with vars laid over it, for a
+// Parser that must keep reading the same values later on.
+func Snapshot(vars map[string]string) map[string]string {
+	snap := map[string]string{}
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			snap[k] = v
+		}
+	}
+	for k, v := range vars {
+		snap[k] = v
+	}
+	return snap
+}
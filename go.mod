@@ -2,4 +2,7 @@ module github.com/nazarhussain/form-courier
 
 go 1.25
 
-require github.com/jordan-wright/email v4.0.1-0.20210109023952-943e75fe5223+incompatible
+require (
+	github.com/jordan-wright/email v4.0.1-0.20210109023952-943e75fe5223+incompatible
+	golang.org/x/text v0.33.0
+)
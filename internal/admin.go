@@ -0,0 +1,125 @@
+package form_mailer
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/jordan-wright/email"
+)
+
+// requireAdmin checks the bearer token against ADMIN_TOKEN. Admin endpoints
+// are hidden (404) when no token is configured.
+func requireAdmin(w http.ResponseWriter, r *http.Request, info *RequestInfo) bool {
+	token := GetConfig().AdminToken
+	if token == "" {
+		reject(w, info, RejectAdminDisabled, "not found", http.StatusNotFound)
+		return false
+	}
+	have, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(have), []byte(token)) != 1 {
+		LoggerFromContext(r.Context()).Warn("admin unauthorized")
+		reject(w, info, RejectAdminUnauthorized, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// HandleTestEmail sends a fixed sample email through the site's real delivery
+// path. POST /v1/contact/{siteKey}/test
+func HandleTestEmail(w http.ResponseWriter, r *http.Request) {
+	logger := LoggerFromContext(r.Context())
+	info := RequestInfoFromContext(r.Context())
+	if !requireAdmin(w, r, info) {
+		return
+	}
+
+	siteKey := r.PathValue("siteKey")
+	cs, err := GetConfig().Site(siteKey)
+	if errors.Is(err, errUnknownSite) {
+		logger.Warn("unknown site", "reason_code", RejectUnknownSite, "site", siteKey)
+		reject(w, info, RejectUnknownSite, "unknown site", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Error("site config invalid", "reason_code", RejectSiteMisconfigured, "site", siteKey, "err", err)
+		reject(w, info, RejectSiteMisconfigured, "site misconfigured", http.StatusInternalServerError)
+		return
+	}
+	logger = logger.With("site", cs.Key)
+	info.Site = cs.Key
+
+	e := email.NewEmail()
+	e.From = cs.FromAddr
+	e.To = []string{cs.To}
+	e.Subject = strings.TrimSpace(cs.SubjectPrefix + " Test email")
+	e.Text = []byte(fmt.Sprintf("This is a test email from form-courier for site %s.\n", cs.Key))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := sendMail(r.Context(), GetConfig(), cs, e); err != nil {
+		logger.Error("test email failed", "err", err)
+		info.SetRejected(RejectSendFailed)
+		w.WriteHeader(http.StatusBadGateway)
+		_ = json.NewEncoder(w).Encode(map[string]any{"ok": false, "error": err.Error()})
+		return
+	}
+
+	logger.Info("test email sent")
+	info.SetOutcome(OutcomeSent)
+	_ = json.NewEncoder(w).Encode(map[string]any{"ok": true})
+}
+
+type siteSummary struct {
+	Key    string `json:"key"`
+	Loaded bool   `json:"loaded"`
+}
+
+// HandleListSites lists the configured site keys without loading lazy sites.
+// GET /v1/admin/sites
+func HandleListSites(w http.ResponseWriter, r *http.Request) {
+	info := RequestInfoFromContext(r.Context())
+	if !requireAdmin(w, r, info) {
+		return
+	}
+	cfg := GetConfig()
+	sites := make([]siteSummary, 0, len(cfg.SiteKeys))
+	for _, key := range cfg.SiteKeys {
+		sites = append(sites, siteSummary{Key: key, Loaded: cfg.SiteLoaded(key)})
+	}
+	info.SetOutcome(OutcomeOK)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"sites": sites})
+}
+
+type rateLimitResetRequest struct {
+	Site string `json:"site"`
+	IP   string `json:"ip"`
+}
+
+// HandleRateLimitReset clears rate-limit buckets for a site and/or IP, or all
+// of them when neither is given. POST /v1/admin/ratelimit/reset
+func HandleRateLimitReset(w http.ResponseWriter, r *http.Request) {
+	logger := LoggerFromContext(r.Context())
+	info := RequestInfoFromContext(r.Context())
+	if !requireAdmin(w, r, info) {
+		return
+	}
+
+	var req rateLimitResetRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil && err != io.EOF {
+		logger.Warn("bad json payload", "reason_code", RejectBadJSON, "err", err)
+		reject(w, info, RejectBadJSON, "bad json", http.StatusBadRequest)
+		return
+	}
+
+	cleared := ResetBuckets(req.Site, req.IP)
+	logger.Info("rate limit reset", "site", req.Site, "ip", req.IP, "cleared", cleared)
+	info.Site = req.Site
+	info.SetOutcome(OutcomeOK)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "cleared": cleared})
+}
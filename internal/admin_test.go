@@ -0,0 +1,197 @@
+package form_mailer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jordan-wright/email"
+)
+
+func serveAdmin(pattern string, handler http.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.HandleFunc(pattern, handler)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHandleTestEmail(t *testing.T) {
+	setupTestConfig(t)
+	conf.AdminToken = "letmein"
+
+	var sendErr error
+	var captured *email.Email
+	sendEmailFunc = func(_ context.Context, site *SiteCfg, e *email.Email) error {
+		captured = e
+		return sendErr
+	}
+
+	send := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme/test", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return serveAdmin("POST /v1/contact/{siteKey}/test", HandleTestEmail, req)
+	}
+
+	if rec := send("wrong"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401, got %d", rec.Code)
+	}
+	if captured != nil {
+		t.Fatal("expected no email without a valid token")
+	}
+
+	if rec := send("letmein"); rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if captured == nil || captured.To[0] != "ops@example.com" {
+		t.Fatalf("unexpected test email: %+v", captured)
+	}
+
+	sendErr = errors.New("535 authentication failed")
+	rec := send("letmein")
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("expected status 502, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "535 authentication failed") {
+		t.Fatalf("expected smtp error in body, got %q", rec.Body.String())
+	}
+
+	conf.AdminToken = ""
+	if rec := send("letmein"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404 with admin disabled, got %d", rec.Code)
+	}
+}
+
+func TestHandleRateLimitReset(t *testing.T) {
+	setupTestConfig(t)
+	conf.AdminToken = "letmein"
+
+	seed := func() {
+		bucketsMu.Lock()
+		buckets = map[string]*Bucket{
+			"acme|1.1.1.1":  {},
+			"acme|2.2.2.2":  {},
+			"other|1.1.1.1": {},
+		}
+		bucketsMu.Unlock()
+	}
+	reset := func(body string) string {
+		req := httptest.NewRequest(http.MethodPost, "/v1/admin/ratelimit/reset", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer letmein")
+		rec := serveAdmin("POST /v1/admin/ratelimit/reset", HandleRateLimitReset, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", rec.Code)
+		}
+		return strings.TrimSpace(rec.Body.String())
+	}
+
+	cases := map[string]string{
+		`{"site":"acme","ip":"1.1.1.1"}`: `{"cleared":1,"ok":true}`,
+		`{"site":"acme"}`:                `{"cleared":2,"ok":true}`,
+		`{"ip":"1.1.1.1"}`:               `{"cleared":2,"ok":true}`,
+		``:                               `{"cleared":3,"ok":true}`,
+	}
+	for body, want := range cases {
+		seed()
+		if got := reset(body); got != want {
+			t.Fatalf("reset(%q) = %s, want %s", body, got, want)
+		}
+	}
+}
+
+func TestHandleEcho(t *testing.T) {
+	setupTestConfig(t)
+	conf.AdminToken = "letmein"
+	conf.RateBurst = 10
+	conf.EchoKeep = 2
+	conf.Sites["acme"].Delivery = deliveryEcho
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error {
+		t.Fatal("echo sites must not send email")
+		return nil
+	}
+	echoMu.Lock()
+	echoes = map[string][]echoedEmail{}
+	echoMu.Unlock()
+
+	for _, msg := range []string{"first", "second", "third"} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(`{"name":"Alice","email":"alice@example.com","message":"`+msg+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/contact/acme/echo", nil)
+	req.Header.Set("Authorization", "Bearer letmein")
+	rec := serveAdmin("GET /v1/contact/{siteKey}/echo", HandleEcho, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	var resp struct {
+		Emails []echoedEmail `json:"emails"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Emails) != 2 {
+		t.Fatalf("expected the last 2 emails, got %d", len(resp.Emails))
+	}
+	if !strings.Contains(resp.Emails[1].Text, "third") || resp.Emails[1].To[0] != "ops@example.com" {
+		t.Fatalf("unexpected last email: %+v", resp.Emails[1])
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/v1/contact/acme/echo", nil)
+	if rec := serveAdmin("GET /v1/contact/{siteKey}/echo", HandleEcho, req); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401 without a token, got %d", rec.Code)
+	}
+}
+
+func TestHandleStats(t *testing.T) {
+	setupTestConfig(t)
+	conf.AdminToken = "letmein"
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return nil }
+	contactStats.Clear()
+	t.Cleanup(func() { contactStats.Clear() })
+
+	for range 3 {
+		postContact(t) // sent twice, then rate_limited
+	}
+	req := httptest.NewRequest(http.MethodPost, "/v1/contact/nope", nil)
+	HandleContact(httptest.NewRecorder(), req) // no site, not counted
+
+	stats := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v1/stats", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return serveAdmin("GET /v1/stats", HandleStats, req)
+	}
+	if rec := stats("wrong"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401, got %d", rec.Code)
+	}
+
+	rec := stats("letmein")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	var resp struct {
+		Uptime *int64                   `json:"uptime_seconds"`
+		Sites  map[string]siteStatsView `json:"sites"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Uptime == nil || *resp.Uptime < 0 {
+		t.Fatalf("expected uptime_seconds, got %v", resp.Uptime)
+	}
+	acme := resp.Sites["acme"]
+	if len(resp.Sites) != 1 || acme.Total != 3 || acme.Sent != 2 || acme.Rejected["rate_limited"] != 1 {
+		t.Fatalf("unexpected stats: %+v", resp.Sites)
+	}
+}
@@ -0,0 +1,49 @@
+package form_mailer
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+)
+
+// Server-to-server integrations often post from one shared egress IP. A
+// request carrying one of the site's <SITE>_API_KEYS in X-Api-Key gets a
+// rate-limit bucket of its own instead of the IP's, so integrations don't
+// throttle each other.
+
+const apiKeyHeader = "X-Api-Key"
+
+var errInvalidAPIKey = errors.New("invalid api key")
+
+// apiKeyID names a key in bucket keys and logs without revealing it.
+func apiKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "apikey:" + hex.EncodeToString(sum[:4])
+}
+
+// rateLimitClient returns the client a request's rate-limit bucket belongs
+// to: the API key's ID when X-Api-Key holds one of the site's keys,
+// otherwise ip. An unknown key falls back to ip, or is errInvalidAPIKey
+// with <SITE>_REJECT_INVALID_API_KEY. Every key is compared, in constant
+// time, so the timing doesn't tell how close a guess came.
+func rateLimitClient(cs *SiteCfg, r *http.Request, ip string) (string, error) {
+	given := r.Header.Get(apiKeyHeader)
+	if given == "" || len(cs.APIKeys) == 0 {
+		return ip, nil
+	}
+	matched := ""
+	for _, key := range cs.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(given)) == 1 && matched == "" {
+			matched = key
+		}
+	}
+	if matched != "" {
+		return apiKeyID(matched), nil
+	}
+	if cs.RejectBadAPIKey {
+		return "", errInvalidAPIKey
+	}
+	return ip, nil
+}
@@ -0,0 +1,58 @@
+package form_mailer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jordan-wright/email"
+)
+
+func TestHandleContactAPIKeyBuckets(t *testing.T) {
+	setupTestConfig(t)
+	conf.Sites["acme"].APIKeys = []string{"key-one", "key-two"}
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return nil }
+
+	post := func(apiKey string) int {
+		body := `{"name":"Alice","email":"alice@example.com","message":"Hello"}`
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if apiKey != "" {
+			req.Header.Set(apiKeyHeader, apiKey)
+		}
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		return rec.Code
+	}
+
+	// RateBurst is 1, and a fresh bucket lets one extra request through
+	for _, key := range []string{"", "key-one", "key-two"} {
+		for i := range 2 {
+			if code := post(key); code != http.StatusOK {
+				t.Fatalf("key %q, request %d: expected status 200, got %d", key, i+1, code)
+			}
+		}
+		if code := post(key); code != http.StatusTooManyRequests {
+			t.Fatalf("key %q: expected its own bucket to run out, got %d", key, code)
+		}
+	}
+
+	// An unknown key shares the IP's spent bucket, or is turned away
+	if code := post("nope"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected an unknown key limited by IP, got %d", code)
+	}
+	conf.Sites["acme"].RejectBadAPIKey = true
+	if code := post("nope"); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for an unknown key, got %d", code)
+	}
+
+	bucketsMu.Lock()
+	defer bucketsMu.Unlock()
+	for key := range buckets {
+		if strings.Contains(key, "key-one") {
+			t.Fatalf("bucket key %q contains the API key", key)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package form_mailer
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/textproto"
+	"strings"
+
+	"github.com/jordan-wright/email"
+)
+
+// <SITE>_BCC_OVERSIZE modes: what the archive copy of an email over
+// <SITE>_BCC_MAX_KB gets in place of its attachments.
+const (
+	bccOversizeNote  = "note"
+	bccOversizeStrip = "strip"
+)
+
+// sendTeamMail sends e, the team email, and archives it to the site's
+// <SITE>_BCC addresses. An email within <SITE>_BCC_MAX_KB is simply Bcc'd;
+// a larger one is sent as is and the archive gets a separate copy without
+// the attachments. The submission is delivered once the team email is
+// sent, so a failed archive copy is only logged. Only the team email counts
+// towards the SEND_RETRY_503 backoff.
+func sendTeamMail(ctx context.Context, logger *slog.Logger, cfg *Config, cs *SiteCfg, e *email.Email) error {
+	archive := archiveCopy(cs, e)
+	if archive == nil {
+		e.Bcc = cs.BCC
+	}
+	err := sendMail(ctx, cfg, cs, e)
+	if cs.Delivery != deliveryEcho && !cs.shadow {
+		noteSendResult(err)
+	}
+	if err != nil {
+		return err
+	}
+	if archive != nil {
+		if err := sendMail(ctx, cfg, cs, archive); err != nil {
+			logger.Error("archive copy failed", "err", err)
+		}
+	}
+	return nil
+}
+
+// emailSize approximates e's size from its bodies and attachments, before
+// transfer encoding.
+func emailSize(e *email.Email) int {
+	n := len(e.Text) + len(e.HTML)
+	for _, a := range e.Attachments {
+		n += len(a.Content)
+	}
+	return n
+}
+
+// archiveCopy returns the copy of e for the archive when e is too large to
+// Bcc, or nil. The copy keeps e's To and Cc headers but is only addressed
+// to the archive, and per <SITE>_BCC_OVERSIZE lists the removed files in a
+// note at the end of the body.
+func archiveCopy(cs *SiteCfg, e *email.Email) *email.Email {
+	if len(cs.BCC) == 0 || cs.BCCMaxKB <= 0 || len(e.Attachments) == 0 || emailSize(e) <= cs.BCCMaxKB*1024 {
+		return nil
+	}
+	c := *e
+	c.To, c.Cc, c.Bcc = nil, nil, cs.BCC
+	c.Attachments = nil
+	c.Headers = textproto.MIMEHeader{}
+	for k, v := range e.Headers {
+		c.Headers[k] = v
+	}
+	c.Headers.Set("To", strings.Join(e.To, ", "))
+	if len(e.Cc) > 0 {
+		c.Headers.Set("Cc", strings.Join(e.Cc, ", "))
+	}
+	if cs.BCCOversize == bccOversizeStrip {
+		return &c
+	}
+
+	var names []string
+	for _, a := range e.Attachments {
+		names = append(names, fmt.Sprintf("%s (%d KB)", a.Filename, (len(a.Content)+1023)/1024))
+	}
+	note := fmt.Sprintf("Attachments removed from this archive copy (over %d KB): %s", cs.BCCMaxKB, strings.Join(names, ", "))
+	c.Text = append(append([]byte{}, e.Text...), "\n\n["+note+"]\n"...)
+	if len(e.HTML) > 0 {
+		c.HTML = append(append([]byte{}, e.HTML...), "<p><em>"+html.EscapeString(note)+"</em></p>"...)
+	}
+	return &c
+}
@@ -0,0 +1,217 @@
+package form_mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/jordan-wright/email"
+)
+
+var (
+	// errAttachmentNotAllowed is returned for files outside the site's
+	// extension allowlist or whose content does not match their extension.
+	errAttachmentNotAllowed = errors.New("attachment type not allowed")
+	// errAttachmentsTooLarge is returned when the upload exceeds the site's
+	// attachment count or total size limit.
+	errAttachmentsTooLarge = errors.New("attachments too large")
+)
+
+type attachment struct {
+	Filename    string
+	ContentType string
+	Size        int64
+	Data        []byte // in memory, for files up to ATTACHMENT_SPOOL_KB
+	Path        string // temp file holding a larger upload; see removeSpooled
+}
+
+func (a attachment) open() (io.ReadCloser, error) {
+	if a.Path == "" {
+		return io.NopCloser(bytes.NewReader(a.Data)), nil
+	}
+	return os.Open(a.Path)
+}
+
+func (a attachment) bytes() ([]byte, error) {
+	if a.Path == "" {
+		return a.Data, nil
+	}
+	return os.ReadFile(a.Path)
+}
+
+// removeSpooled deletes the temp files behind spooled attachments.
+func removeSpooled(atts []attachment) {
+	for _, a := range atts {
+		if a.Path != "" {
+			_ = os.Remove(a.Path)
+		}
+	}
+}
+
+// readMultipart streams a multipart/form-data body part by part instead of
+// parsing it whole. Plain fields are kept in memory, every value of them;
+// files are checked against the site's limits as their bytes arrive, and
+// those over spoolBytes go to temp files, which the caller removes with
+// removeSpooled once the submission is handled. ContentType is sniffed from
+// the data rather than taken from the client. The overall body size is
+// capped by the reader the caller passes in.
+func readMultipart(body io.Reader, boundary string, cs *SiteCfg, spoolBytes int64) (values url.Values, atts []attachment, err error) {
+	defer func() {
+		if err != nil {
+			removeSpooled(atts)
+			atts = nil
+		}
+	}()
+	var (
+		mr    = multipart.NewReader(body, boundary)
+		total int64
+		limit = int64(cs.MaxAttachmentTotalKB) * 1024
+	)
+	values = url.Values{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return values, atts, nil
+		}
+		if err != nil {
+			return nil, atts, err
+		}
+		if part.FileName() == "" {
+			data, err := io.ReadAll(part)
+			if err != nil {
+				return nil, atts, err
+			}
+			if name := part.FormName(); name != "" {
+				values.Add(name, string(data))
+			}
+			continue
+		}
+
+		if cs.MaxAttachmentCount > 0 && len(atts) >= cs.MaxAttachmentCount {
+			return nil, atts, fmt.Errorf("%w: more than %d files", errAttachmentsTooLarge, cs.MaxAttachmentCount)
+		}
+		src := io.Reader(part)
+		if limit > 0 {
+			// One byte over the remaining budget is enough to tell
+			src = io.LimitReader(part, limit-total+1)
+		}
+		a, err := spoolAttachment(part.FileName(), src, spoolBytes)
+		if a.Path != "" {
+			atts = append(atts, a) // so it is cleaned up on every path
+		}
+		if err != nil {
+			return nil, atts, err
+		}
+		total += a.Size
+		if limit > 0 && total > limit {
+			return nil, atts, fmt.Errorf("%w: over %d KB in total", errAttachmentsTooLarge, cs.MaxAttachmentTotalKB)
+		}
+		if err := checkAttachmentType(a, cs.AllowedAttachmentExts); err != nil {
+			return nil, atts, err
+		}
+		if a.Path == "" {
+			atts = append(atts, a)
+		}
+	}
+}
+
+// spoolAttachment reads one file part, keeping it in memory up to
+// spoolBytes and moving it to a temp file beyond that. At least the bytes
+// needed for sniffing are always read first.
+func spoolAttachment(filename string, src io.Reader, spoolBytes int64) (attachment, error) {
+	a := attachment{Filename: filename}
+	spoolBytes = max(spoolBytes, 512)
+	head, err := io.ReadAll(io.LimitReader(src, spoolBytes+1))
+	if err != nil {
+		return a, err
+	}
+	a.ContentType = http.DetectContentType(head)
+	a.Size = int64(len(head))
+	if a.Size <= spoolBytes {
+		a.Data = head
+		return a, nil
+	}
+
+	f, err := os.CreateTemp("", "form-courier-upload-*")
+	if err != nil {
+		return a, err
+	}
+	defer f.Close()
+	a.Path = f.Name()
+	if _, err := f.Write(head); err != nil {
+		return a, err
+	}
+	n, err := io.Copy(f, src)
+	a.Size += n
+	return a, err
+}
+
+// checkAttachmentType enforces the extension allowlist, if any, and that the
+// sniffed content agrees with what the extension claims, so a renamed
+// executable cannot pass as a PDF.
+func checkAttachmentType(a attachment, allowed []string) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(a.Filename), "."))
+	if !slices.Contains(allowed, ext) {
+		return fmt.Errorf("%w: extension %q", errAttachmentNotAllowed, ext)
+	}
+	claimed, _, _ := mime.ParseMediaType(mime.TypeByExtension("." + ext))
+	sniffed, _, _ := mime.ParseMediaType(a.ContentType)
+	switch {
+	case claimed == "" || claimed == sniffed:
+	case sniffed == "text/plain" && strings.HasPrefix(claimed, "text/"):
+		// csv, markdown and friends all sniff as plain text
+	case sniffed == "application/zip" && (strings.Contains(claimed, "openxmlformats") || strings.Contains(claimed, "opendocument")):
+		// office documents are zip containers
+	default:
+		return fmt.Errorf("%w: %q content is %s", errAttachmentNotAllowed, a.Filename, sniffed)
+	}
+	return nil
+}
+
+// scanAttachments runs each attachment through clamd. It stops at the first
+// flagged file or scanner error.
+func scanAttachments(ctx context.Context, cfg *Config, atts []attachment) error {
+	if cfg.ClamAVAddr == "" {
+		return nil
+	}
+	for _, a := range atts {
+		f, err := a.open()
+		if err != nil {
+			return err
+		}
+		err = scanClamAV(ctx, cfg.ClamAVAddr, cfg.ClamAVTimeout, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func attachAll(e *email.Email, atts []attachment) error {
+	for _, a := range atts {
+		f, err := a.open()
+		if err != nil {
+			return err
+		}
+		_, err = e.Attach(f, a.Filename, a.ContentType)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package form_mailer
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/jordan-wright/email"
+)
+
+const autoReplyGlobalKey = "*"
+
+// autoReplies reports whether the site confirms submissions, with
+// <SITE>_AUTO_REPLY_TEXT or an external template.
+func (cs *SiteCfg) autoReplies() bool {
+	return cs.AutoReplyText != "" || cs.ExternalTextTemplate != nil || cs.ExternalHTMLTemplate != nil
+}
+
+// autoReplyWG tracks auto-replies still being sent, for a graceful
+// shutdown to wait on.
+var autoReplyWG sync.WaitGroup
+
+// WaitAutoReplies waits for auto-replies in flight to finish, or until ctx
+// is done.
+func WaitAutoReplies(ctx context.Context) error {
+	return waitGroupCtx(ctx, &autoReplyWG)
+}
+
+// sendAutoReply confirms receipt to the submitter. Submitter addresses are
+// unverified, so replies are throttled per address and globally to keep
+// forged submissions from turning the service into a backscatter source;
+// a reply that doesn't go out gives its budget back. The body comes from
+// the site's external templates, which see the submission but not the IP.
+// The reply is sent in the background, so the submitter's response doesn't
+// wait on it and a client going away doesn't cancel it.
+func sendAutoReply(ctx context.Context, logger *slog.Logger, cfg *Config, cs *SiteCfg, submissionID string, p ContactRequest) {
+	if !cs.autoReplies() {
+		return
+	}
+	text, html, err := renderBodies(cs.ExternalTextTemplate, cs.ExternalHTMLTemplate, newTemplateData(cs, submissionID, "", p, cs.AutoReplyText))
+	if err != nil {
+		logger.Warn("auto-reply failed", "err", err)
+		return
+	}
+	e := email.NewEmail()
+	e.From = cs.FromAddr
+	e.To = []string{p.Email}
+	e.Subject = cs.AutoReplySubject
+	if len(text) > 0 {
+		e.Text = text // none with only an external HTML template
+	}
+	e.HTML = html
+	e.Headers.Set("Auto-Submitted", "auto-replied")
+
+	addrKey := "autoreply:" + cs.Key + "|" + strings.ToLower(p.Email)
+	globalKey := "autoreply|" + autoReplyGlobalKey
+	if !takeBudget(addrKey, 1, cs.AutoReplyBurst, cfg.AutoReplyRefill) {
+		logger.Warn("auto-reply throttled", "scope", "address", "to", logEmail(cfg, p.Email))
+		return
+	}
+	if !takeBudget(globalKey, 1, cfg.AutoReplyGlobalBurst, cfg.AutoReplyRefill) {
+		refundBudget(addrKey, 1)
+		logger.Warn("auto-reply throttled", "scope", "global", "to", logEmail(cfg, p.Email))
+		return
+	}
+	refund := func() {
+		refundBudget(addrKey, 1)
+		refundBudget(globalKey, 1)
+	}
+	if ok, _ := allowGlobalSend(cfg); !ok {
+		refund()
+		logger.Warn("auto-reply throttled", "scope", "global_send_rate", "to", logEmail(cfg, p.Email))
+		return
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	autoReplyWG.Add(1)
+	go func() {
+		defer autoReplyWG.Done()
+		if err := sendMail(ctx, cfg, cs, e); err != nil {
+			refund()
+			logger.Warn("auto-reply failed", "err", err)
+			return
+		}
+		logger.Info("auto-reply sent", "to", logEmail(cfg, p.Email))
+	}()
+}
@@ -0,0 +1,316 @@
+package form_mailer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// batchResult is the per-item outcome of a batch submission, in request order.
+type batchResult struct {
+	OK           bool         `json:"ok"`
+	SubmissionID string       `json:"submission_id,omitempty"`
+	Error        RejectReason `json:"error,omitempty"`
+	// outcome is what /v1/stats counts the item as: how it went through,
+	// or why it was refused, faked successes included
+	outcome string
+}
+
+// statsOutcome returns the reason /v1/stats counts the item under.
+func (res batchResult) statsOutcome() string {
+	if res.outcome != "" {
+		return res.outcome
+	}
+	return string(res.Error)
+}
+
+// HandleBatch accepts a JSON array of contact submissions and sends one email
+// per valid item. The batch is rate limited as a whole, one token per item.
+// POST /v1/contact/{siteKey}/batch, and its CORS preflight
+func HandleBatch(w http.ResponseWriter, r *http.Request) {
+	logger := LoggerFromContext(r.Context())
+	info := RequestInfoFromContext(r.Context())
+	cfg := GetConfig()
+	start := time.Now()
+	defer countContact(info)
+
+	siteKey := r.PathValue("siteKey")
+	if !validSiteKey(siteKey) {
+		rejectProbe(w, r, info, cfg, start, RejectBadSiteKey, "bad site key", http.StatusBadRequest)
+		return
+	}
+	cs, err := cfg.Site(siteKey)
+	if errors.Is(err, errUnknownSite) && cfg.DefaultSiteKey != "" {
+		// Catch-all, as for a single submission
+		cs, err = cfg.Site(cfg.DefaultSiteKey)
+	}
+	if errors.Is(err, errUnknownSite) {
+		logger.Warn("unknown site", "reason_code", RejectUnknownSite, "site", siteKey)
+		rejectProbe(w, r, info, cfg, start, RejectUnknownSite, "unknown site", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Error("site config invalid", "reason_code", RejectSiteMisconfigured, "site", siteKey, "err", err)
+		reject(w, info, RejectSiteMisconfigured, "site misconfigured", http.StatusInternalServerError)
+		return
+	}
+	logger = withSiteLevel(logger, cs).With("site", cs.Key)
+	if siteKey != cs.Key {
+		logger = logger.With("requested_site", siteKey)
+	}
+	info.Site = cs.Key
+
+	if handleCORS(w, r, logger, cfg, info, cs, start) {
+		return
+	}
+
+	rej := checkCaller(logger, cfg, info, cs, r)
+	if rej != nil && !rej.fake {
+		rej.probe = true
+		rejectWith(w, r, info, cfg, start, rej)
+		return
+	}
+
+	w, finish, done := handleIdempotencyKey(w, r, logger, cfg, info, cs, start)
+	if done {
+		return
+	}
+	if finish != nil {
+		defer finish()
+	}
+
+	maxBytes := cfg.MaxBodyKB * 1024
+	if reason, msg, status := checkContentLength(cfg, r, maxBytes); reason != "" {
+		logger.Warn(msg, "reason_code", reason, "content_length", r.ContentLength, "transfer_encoding", r.TransferEncoding)
+		rejectProbe(w, r, info, cfg, start, reason, msg, status)
+		return
+	}
+	// JSON only, and only where single submissions may be JSON
+	if ct := r.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") || !cfg.AllowJSON {
+		logger.Warn("unsupported content type", "reason_code", RejectUnsupportedType, "content_type", ct)
+		rejectProbe(w, r, info, cfg, start, RejectUnsupportedType, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, int64(maxBytes)+1))
+	r.Body.Close()
+	if err != nil {
+		logger.Warn("body read error", "reason_code", RejectBodyReadError, "err", err)
+		rejectProbe(w, r, info, cfg, start, RejectBodyReadError, "read error", http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxBytes {
+		logger.Warn("payload too large", "reason_code", RejectPayloadTooLarge, "size_bytes", len(body))
+		rejectProbe(w, r, info, cfg, start, RejectPayloadTooLarge, "payload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if signatureRequired(cs, r) {
+		if _, err := checkSignature(cfg, cs, r.Header, body, nowFunc()); err != nil {
+			logSignatureFailure(logger, cs, err)
+			rejectProbe(w, r, info, cfg, start, RejectInvalidSignature, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	// Per-item limits, allowing for the enclosing array
+	maxDepth := cfg.JSONMaxDepth
+	if maxDepth > 0 {
+		maxDepth++
+	}
+	if err := checkJSONLimits(body, maxDepth, cfg.JSONMaxTokens*cfg.BatchMaxItems); errors.Is(err, errJSONTooComplex) {
+		logger.Warn("json payload too complex", "reason_code", RejectJSONTooComplex, "err", err)
+		rejectProbe(w, r, info, cfg, start, RejectJSONTooComplex, "json too complex", http.StatusBadRequest)
+		return
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		logger.Warn("bad json payload", "reason_code", RejectBadJSON, "err", err)
+		rejectProbe(w, r, info, cfg, start, RejectBadJSON, "bad json", http.StatusBadRequest)
+		return
+	}
+	if len(raw) == 0 {
+		rejectProbe(w, r, info, cfg, start, RejectBadJSON, "empty batch", http.StatusBadRequest)
+		return
+	}
+	// A batch bigger than the burst could never get its tokens, so it is
+	// refused as too large rather than rate limited on every retry
+	maxItems := min(cfg.BatchMaxItems, cfg.rateBurstFor(cs))
+	if len(raw) > maxItems {
+		logger.Warn("batch too large", "reason_code", RejectBatchTooLarge, "items", len(raw), "max_items", maxItems)
+		rejectProbe(w, r, info, cfg, start, RejectBatchTooLarge, "batch too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	// Each item decodes like a single submission's body
+	items := make([]map[string]any, len(raw))
+	dups := make([][]string, len(raw))
+	for i, item := range raw {
+		items[i], dups[i], err = decodeJSONObject(bytes.NewReader(item), cfg.JSONMaxDepth, cfg.JSONMaxTokens)
+		if errors.Is(err, errJSONTooComplex) {
+			logger.Warn("json payload too complex", "reason_code", RejectJSONTooComplex, "item", i, "err", err)
+			rejectProbe(w, r, info, cfg, start, RejectJSONTooComplex, "json too complex", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			logger.Warn("bad json payload", "reason_code", RejectBadJSON, "item", i, "err", err)
+			rejectProbe(w, r, info, cfg, start, RejectBadJSON, "bad json", http.StatusBadRequest)
+			return
+		}
+	}
+	if rej != nil {
+		// HONEYPOT_FAKE_SUCCESS: every item seems to go through
+		results := make([]batchResult, len(items))
+		for i := range results {
+			results[i] = batchResult{OK: true, SubmissionID: newSubmissionID()}
+		}
+		info.SetRejected(rej.reason)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "results": results})
+		return
+	}
+
+	ip := ClientIP(r)
+	logger = logger.With("ip", ip)
+	client, err := rateLimitClient(cs, r, ip)
+	if err != nil {
+		logger.Warn("invalid api key", "reason_code", RejectInvalidAPIKey)
+		rejectProbe(w, r, info, cfg, start, RejectInvalidAPIKey, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if client != ip {
+		logger = logger.With("api_key", client)
+	}
+	if !AllowN(cs.Key, client, len(items), cfg.rateBurstFor(cs), cfg.RateRefillMinutes) {
+		logger.Warn("rate limited", "reason_code", RejectRateLimited, "items", len(items))
+		rejectProbe(w, r, info, cfg, start, RejectRateLimited, "rate limited", http.StatusTooManyRequests)
+		return
+	}
+
+	results := make([]batchResult, len(items))
+	sent := 0
+	for i, values := range items {
+		results[i] = sendBatchItem(r, logger, cfg, cs, ip, values, dups[i])
+		countOutcome(cs.Key, results[i].statsOutcome())
+		if results[i].OK {
+			sent++
+		}
+	}
+	logger.Info("batch processed", "items", len(items), "sent", sent)
+	info.SetOutcome(OutcomeBatch)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "results": results})
+}
+
+// sendBatchItem validates and sends one batch entry, through the same
+// checks and follow-ups (cooldown, auto-reply) as a single submission.
+func sendBatchItem(r *http.Request, logger *slog.Logger, cfg *Config, cs *SiteCfg, ip string, values map[string]any, dups []string) batchResult {
+	// Item rejections are logged, but mustn't mark the batch's access log
+	// line as sampled out
+	info := &RequestInfo{}
+	if len(dups) > 0 && cfg.DuplicateFields == duplicateReject {
+		logger.Warn("duplicate json fields", "reason_code", RejectDuplicateField, "fields", dups)
+		return batchResult{Error: RejectDuplicateField}
+	}
+	if cfg.JSONDisallowUnknown {
+		if extra := unknownFields(cs, values); len(extra) > 0 {
+			logger.Warn("unknown json fields", "reason_code", RejectBadJSON, "fields", extra)
+			return batchResult{Error: RejectBadJSON}
+		}
+	}
+	applyFieldMap(values, cs.FieldMap)
+	p, err := parseSubmission(cfg, cs, values)
+	if err != nil {
+		return batchResult{Error: RejectBadJSON}
+	}
+	if key := r.PathValue("siteKey"); key != cs.Key {
+		p.RequestedSite = key
+	}
+	formToken, rej := checkFormToken(logger, cfg, info, cs, r, values)
+	if rej != nil {
+		return batchResult{Error: rej.reason}
+	}
+	hpToken, rej := checkHoneypot(logger, cfg, info, cs, values, p)
+	if rej != nil {
+		return honeypotResult(rej)
+	}
+	submissionID := newSubmissionID()
+	logger = logger.With("submission_id", submissionID)
+	cooldown, rej := checkSubmission(r.Context(), logger, cfg, info, cs, values, &p, 0)
+	if rej != nil {
+		return batchResult{Error: rej.reason}
+	}
+	defer cooldown.release()
+
+	e, err := composeEmail(cs, submissionID, ip, p)
+	if err != nil {
+		logger.Error("compose failed", "reason_code", RejectSendFailed, "err", err)
+		return batchResult{SubmissionID: submissionID, Error: RejectSendFailed}
+	}
+	applyThreadTag(e, cs, p)
+	e.Subject = sanitizeSubject(cs, e.Subject)
+	requestID := RequestInfoFromContext(r.Context()).RequestID
+	if requestID != "" {
+		e.Headers.Set("X-Request-ID", requestID)
+	}
+	sub := newSubmission(cs, submissionID, ip, p)
+	sub.Meta.RequestID = requestID
+	if reason, _, _ := checkValidation(r.Context(), logger, cs, sub); reason != "" {
+		return batchResult{SubmissionID: submissionID, Error: reason}
+	}
+	if rej := claimFormToken(logger, cfg, info, formToken); rej != nil {
+		return batchResult{SubmissionID: submissionID, Error: rej.reason}
+	}
+	defer formToken.release()
+	if rej := claimHoneypot(logger, cfg, info, hpToken, p); rej != nil {
+		return honeypotResult(rej)
+	}
+	defer hpToken.release()
+	dumpSubmissionEML(logger, cfg, cs, submissionID, e)
+	if cs.DigestInterval > 0 {
+		if err := bufferDigest(cfg, cs, submissionID, e); err != nil {
+			logger.Error("buffering for digest failed", "reason_code", RejectSendFailed, "err", err)
+			return batchResult{SubmissionID: submissionID, Error: RejectSendFailed}
+		}
+		logger.Info("submission buffered for digest", "from", logEmail(cfg, p.Email))
+		cooldown.start(nowFunc())
+		formToken.keep()
+		hpToken.keep()
+		sendAutoReply(r.Context(), logger, cfg, cs, submissionID, p)
+		return batchResult{OK: true, SubmissionID: submissionID, outcome: string(OutcomeDigestBuffered)}
+	}
+	taken, rej := checkSendBudget(logger, cfg, info, cs)
+	if rej != nil {
+		return batchResult{SubmissionID: submissionID, Error: rej.reason}
+	}
+	backend, err := deliverWithFallback(r.Context(), logger, cfg, cs, sub, nil, e)
+	if err != nil {
+		code := RejectSendFailed
+		if cfg.SendRetry503 && isTransientSendError(err) {
+			code = RejectSendUnavailable
+		}
+		logger.Error("delivery failed", "reason_code", code, "backend", backend, "err", err)
+		refundSendBudget(logger, cfg, cs, taken)
+		notifyFailure(logger, cfg.FailureWebhookURL, sub.failed(err).exported(cfg))
+		return batchResult{SubmissionID: submissionID, Error: code}
+	}
+	logger.Info("contact email sent", "backend", backend, "from", logEmail(cfg, p.Email))
+	cooldown.start(nowFunc())
+	formToken.keep()
+	hpToken.keep()
+	deliverShadow(r.Context(), logger, cfg, cs, sub, e)
+	sendAutoReply(r.Context(), logger, cfg, cs, submissionID, p)
+	return batchResult{OK: true, SubmissionID: submissionID, outcome: string(OutcomeSent)}
+}
+
+// honeypotResult reports a tripped honeypot, as a fake success with
+// HONEYPOT_FAKE_SUCCESS.
+func honeypotResult(rej *rejection) batchResult {
+	if rej.fake {
+		return batchResult{OK: true, SubmissionID: newSubmissionID(), outcome: string(rej.reason)}
+	}
+	return batchResult{Error: rej.reason}
+}
@@ -0,0 +1,398 @@
+package form_mailer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jordan-wright/email"
+)
+
+func postBatch(body string) *httptest.ResponseRecorder {
+	return serveBatch(newBatchRequest(body))
+}
+
+func newBatchRequest(body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme/batch", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+func serveBatch(req *http.Request) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/contact/{siteKey}/batch", HandleBatch)
+	mux.HandleFunc("OPTIONS /v1/contact/{siteKey}/batch", HandleBatch)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+// batchResults decodes the per-item results of a 200 batch response.
+func batchResults(t *testing.T, rec *httptest.ResponseRecorder) []batchResult {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		Results []batchResult `json:"results"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Results
+}
+
+func TestHandleBatch(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 3
+	conf.BatchMaxItems = 3
+
+	var sent []*email.Email
+	sendEmailFunc = func(_ context.Context, _ *SiteCfg, e *email.Email) error {
+		sent = append(sent, e)
+		return nil
+	}
+
+	rec := postBatch(`[
+		{"name":"Alice","email":"alice@example.com","message":"one"},
+		{"name":"Bob","email":"not-an-email","message":"two"}
+	]`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		Results []batchResult `json:"results"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) != 2 || !resp.Results[0].OK || resp.Results[0].SubmissionID == "" {
+		t.Fatalf("unexpected results: %+v", resp.Results)
+	}
+	if resp.Results[1].OK || resp.Results[1].Error != "invalid_submission" {
+		t.Fatalf("expected the second item to fail validation: %+v", resp.Results[1])
+	}
+	if len(sent) != 1 {
+		t.Fatalf("expected 1 email, got %d", len(sent))
+	}
+
+	// Two tokens used, one left: a two-item batch is refused as a whole.
+	rec = postBatch(`[{"name":"A","email":"a@example.com","message":"x"},{"name":"B","email":"b@example.com","message":"y"}]`)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d", rec.Code)
+	}
+
+	rec = postBatch(`[{},{},{},{}]`)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status 413 over BATCH_MAX_ITEMS, got %d", rec.Code)
+	}
+}
+
+func TestHandleBatchStats(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 3
+	conf.BatchMaxItems = 3
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return nil }
+	contactStats.Clear()
+	t.Cleanup(func() { contactStats.Clear() })
+
+	batchResults(t, postBatch(`[
+		{"name":"Alice","email":"alice@example.com","message":"one"},
+		{"name":"Bob","email":"not-an-email","message":"two"}
+	]`))
+	// refused as a whole, so counted once
+	if rec := postBatch(`[{},{}]`); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d", rec.Code)
+	}
+
+	v, ok := contactStats.Load("acme")
+	if !ok {
+		t.Fatal("expected stats for acme")
+	}
+	acme := v.(*siteStats).view()
+	if acme.Total != 3 || acme.Sent != 1 || acme.Rejected["invalid_submission"] != 1 || acme.Rejected["rate_limited"] != 1 || len(acme.Rejected) != 2 {
+		t.Fatalf("unexpected stats: %+v", acme)
+	}
+}
+
+func TestHandleBatchDefaultLimits(t *testing.T) {
+	setupTestConfig(t)
+	t.Setenv("SITES", "acme")
+	t.Setenv("ACME_TO", "ops@example.com")
+	t.Setenv("SMTP_HOST", "relay.internal")
+	t.Setenv("SMTP_PORT", "587")
+	t.Setenv("SMTP_USER", "user")
+	t.Setenv("SMTP_PASS", "pass")
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf = cfg
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return nil }
+
+	item := `{"name":"Alice","email":"alice@example.com","message":"hi"}`
+	batch := func(n int) string {
+		return "[" + strings.Repeat(item+",", n-1) + item + "]"
+	}
+
+	// More items than the burst could ever be granted: too large, not
+	// rate limited
+	rec := postBatch(batch(cfg.RateBurst + 1))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status 413 over the burst of %d, got %d: %s", cfg.RateBurst, rec.Code, rec.Body)
+	}
+	results := batchResults(t, postBatch(batch(cfg.RateBurst)))
+	if len(results) != cfg.RateBurst {
+		t.Fatalf("expected %d results, got %+v", cfg.RateBurst, results)
+	}
+}
+
+func TestHandleBatchDefaultSite(t *testing.T) {
+	setupTestConfig(t)
+	conf.BatchMaxItems = 1
+	conf.DefaultSiteKey = "acme"
+	var subjects []string
+	sendEmailFunc = func(_ context.Context, site *SiteCfg, e *email.Email) error {
+		if site.Key != "acme" {
+			t.Fatalf("expected the default site, got %s", site.Key)
+		}
+		subjects = append(subjects, e.Subject)
+		return nil
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/contact/unknown/batch", strings.NewReader(`[{"name":"Alice","email":"alice@example.com","message":"Hello"}]`))
+	req.Header.Set("Content-Type", "application/json")
+	results := batchResults(t, serveBatch(req))
+	if !results[0].OK {
+		t.Fatalf("expected the item to go through the default site, got %+v", results[0])
+	}
+	if want := `[Contact] New contact (site key "unknown")`; len(subjects) != 1 || subjects[0] != want {
+		t.Fatalf("subjects = %q, want %q", subjects, want)
+	}
+}
+
+func TestHandleBatchContentType(t *testing.T) {
+	setupTestConfig(t)
+	conf.BatchMaxItems = 1
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return nil }
+	body := `[{"name":"Alice","email":"alice@example.com","message":"Hello"}]`
+
+	req := newBatchRequest(body)
+	req.Header.Set("Content-Type", "text/plain")
+	if rec := serveBatch(req); rec.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected status 415 for text/plain, got %d", rec.Code)
+	}
+
+	conf.AllowJSON = false
+	if rec := postBatch(body); rec.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected status 415 with ALLOW_JSON off, got %d", rec.Code)
+	}
+}
+
+func TestHandleBatchCallerGates(t *testing.T) {
+	const item = `[{"name":"Alice","email":"alice@example.com","message":"Hello"}]`
+	setup := func(t *testing.T) *int {
+		setupTestConfig(t)
+		conf.RateBurst = 10
+		conf.BatchMaxItems = 5
+		sent := new(int)
+		sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error {
+			*sent++
+			return nil
+		}
+		return sent
+	}
+
+	t.Run("business hours", func(t *testing.T) {
+		sent := setup(t)
+		conf.Sites["acme"].BusinessHours, _ = parseBusinessHours("Mon-Fri 09:00-17:00 UTC")
+		conf.Sites["acme"].OutsideHoursMsg = "closed"
+		useFakeClock(t, time.Date(2024, 5, 4, 12, 0, 0, 0, time.UTC)) // Saturday
+		rec := postBatch(item)
+		if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" || *sent != 0 {
+			t.Fatalf("expected 503 with Retry-After outside business hours, got %d, %d sent", rec.Code, *sent)
+		}
+	})
+
+	t.Run("blocked user agent", func(t *testing.T) {
+		sent := setup(t)
+		conf.BlockedUserAgents, _ = parseUserAgentRules("python-requests")
+		req := newBatchRequest(item)
+		req.Header.Set("User-Agent", "python-requests/2.31")
+		if rec := serveBatch(req); rec.Code != http.StatusForbidden || *sent != 0 {
+			t.Fatalf("expected 403 for a blocked user agent, got %d, %d sent", rec.Code, *sent)
+		}
+
+		conf.HoneypotFakeSuccess = true
+		req = newBatchRequest(item)
+		req.Header.Set("User-Agent", "python-requests/2.31")
+		results := batchResults(t, serveBatch(req))
+		if len(results) != 1 || !results[0].OK || *sent != 0 {
+			t.Fatalf("expected a fake success and no email, got %+v, %d sent", results, *sent)
+		}
+	})
+
+	t.Run("referer", func(t *testing.T) {
+		sent := setup(t)
+		conf.Sites["acme"].AllowedOrigins = []string{"https://shop.example"}
+		conf.Sites["acme"].RequireReferer = true
+		req := newBatchRequest(item)
+		req.Header.Set("Referer", "https://elsewhere.example/form")
+		if rec := serveBatch(req); rec.Code != http.StatusForbidden || *sent != 0 {
+			t.Fatalf("expected 403 for a foreign referer, got %d, %d sent", rec.Code, *sent)
+		}
+		req = newBatchRequest(item)
+		req.Header.Set("Referer", "https://shop.example/contact")
+		if results := batchResults(t, serveBatch(req)); !results[0].OK {
+			t.Fatalf("expected an allowed referer through, got %+v", results)
+		}
+	})
+
+	t.Run("site log level", func(t *testing.T) {
+		setup(t)
+		var buf bytes.Buffer
+		base := slog.New(NewLevelHandler(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}), slog.LevelInfo))
+		conf.Sites["acme"].LogLevel = slog.LevelWarn
+		req := newBatchRequest(item)
+		serveBatch(req.WithContext(ContextWithLogger(req.Context(), base)))
+		if strings.Contains(buf.String(), "level=INFO") {
+			t.Fatalf("expected the site's log level to apply to the batch:\n%s", buf.String())
+		}
+	})
+}
+
+func TestHandleBatchCORS(t *testing.T) {
+	const item = `[{"name":"Alice","email":"alice@example.com","message":"Hello"}]`
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.BatchMaxItems = 5
+	conf.DumpEMLDir = t.TempDir()
+	conf.Sites["acme"].AllowedOrigins = []string{"https://shop.example"}
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return nil }
+
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, "/v1/contact/acme/batch", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		return serveBatch(req)
+	}
+	post := func(origin string) *httptest.ResponseRecorder {
+		req := newBatchRequest(item)
+		req.Header.Set("Origin", origin)
+		return serveBatch(req)
+	}
+
+	rec := preflight("https://shop.example")
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Origin") != "https://shop.example" {
+		t.Fatalf("expected an approved preflight, got %d %v", rec.Code, rec.Header())
+	}
+	if rec := preflight("https://evil.example"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected a disallowed preflight to get 403, got %d", rec.Code)
+	}
+
+	// CORS_EXPOSE_REJECTIONS lets the page read why it was refused
+	conf.CORSExposeRejections = true
+	if rec := preflight("https://evil.example"); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected the preflight through with CORS_EXPOSE_REJECTIONS, got %d", rec.Code)
+	}
+	rec = post("https://evil.example")
+	if rec.Code != http.StatusForbidden || rec.Header().Get("Access-Control-Allow-Origin") != "https://evil.example" {
+		t.Fatalf("expected a readable 403, got %d %v", rec.Code, rec.Header())
+	}
+
+	// Items are dumped like single submissions
+	results := batchResults(t, post("https://shop.example"))
+	if _, err := os.Stat(filepath.Join(conf.DumpEMLDir, "acme-"+results[0].SubmissionID+".eml")); err != nil {
+		t.Fatalf("expected the item dumped: %v", err)
+	}
+}
+
+func TestHandleBatchSubmissionGates(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.BatchMaxItems = 5
+	useFakeClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return nil }
+	fakeDNS(t, map[string][]*net.MX{"example.com": {{Host: "mx.example.com.", Pref: 10}}}, nil)
+	conf.MXTimeout, conf.MXCacheTTL = time.Second, time.Hour
+	conf.Sites["acme"].VerifyMX = true
+	conf.Sites["acme"].EmailCooldown = 10 * time.Minute
+	t.Cleanup(func() {
+		lastSubmissionMu.Lock()
+		lastSubmission = map[string]time.Time{}
+		lastSubmissionMu.Unlock()
+	})
+
+	results := batchResults(t, postBatch(`[
+		{"name":"Alice","email":"alice@example.com","message":"one"},
+		{"name":"Bob","email":"bob@nomail.example","message":"two"},
+		{"name":"Alice","email":"alice@example.com","message":"three"}
+	]`))
+	want := []RejectReason{"", RejectInvalidEmailDomain, RejectEmailCooldown}
+	for i, r := range results {
+		if r.Error != want[i] || r.OK != (want[i] == "") {
+			t.Fatalf("item %d: expected %q, got %+v", i, want[i], r)
+		}
+	}
+}
+
+func TestHandleBatchItemJSON(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.BatchMaxItems = 5
+	conf.JSONDisallowUnknown = true
+	conf.DuplicateFields = duplicateReject
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return nil }
+
+	// Items are held to the same JSON rules as a single submission
+	results := batchResults(t, postBatch(`[
+		{"name":"Alice","email":"alice@example.com","message":"one"},
+		{"name":"Bob","email":"bob@example.com","message":"two","extra":"x"},
+		{"name":"Carol","email":"carol@example.com","message":"three","message":"four"}
+	]`))
+	want := []RejectReason{"", RejectBadJSON, RejectDuplicateField}
+	for i, r := range results {
+		if r.Error != want[i] || r.OK != (want[i] == "") {
+			t.Fatalf("item %d: expected %q, got %+v", i, want[i], r)
+		}
+	}
+
+	rec := postBatch(`[{"name":"Alice","email":"alice@example.com","message":"one"},"not an object"]`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for a non-object item, got %d", rec.Code)
+	}
+}
+
+func TestHandleBatchDigestStartsCooldown(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 3
+	conf.BatchMaxItems = 3
+	conf.DigestStateFile = filepath.Join(t.TempDir(), "digest.json")
+	conf.Sites["acme"].DigestInterval = time.Hour
+	conf.Sites["acme"].EmailCooldown = 10 * time.Minute
+	t.Cleanup(func() {
+		digestMu.Lock()
+		digests = map[string]*digestBuffer{}
+		digestMu.Unlock()
+		lastSubmissionMu.Lock()
+		lastSubmission = map[string]time.Time{}
+		lastSubmissionMu.Unlock()
+	})
+
+	results := batchResults(t, postBatch(`[
+		{"name":"Alice","email":"alice@example.com","message":"one"},
+		{"name":"Alice","email":"alice@example.com","message":"two"}
+	]`))
+	if !results[0].OK || results[1].Error != RejectEmailCooldown {
+		t.Fatalf("expected the buffered item to start the cooldown, got %+v", results)
+	}
+}
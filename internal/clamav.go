@@ -0,0 +1,92 @@
+package form_mailer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const clamavChunkSize = 32 * 1024
+
+// errVirusFound wraps the clamd signature name for flagged attachments.
+var errVirusFound = errors.New("virus found")
+
+// clamavNetwork splits CLAMAV_ADDR into a dial network and address. Accepts
+// "tcp://host:port", "unix:///path/clamd.sock", a bare socket path or host:port.
+func clamavNetwork(addr string) (string, string) {
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		return "unix", strings.TrimPrefix(addr, "unix://")
+	case strings.HasPrefix(addr, "tcp://"):
+		return "tcp", strings.TrimPrefix(addr, "tcp://")
+	case strings.HasPrefix(addr, "/"):
+		return "unix", addr
+	default:
+		return "tcp", addr
+	}
+}
+
+// scanClamAV streams data to clamd's INSTREAM command. It returns an error
+// wrapping errVirusFound when clamd flags the data, or any other error when
+// the scan itself could not be completed.
+func scanClamAV(ctx context.Context, addr string, timeout time.Duration, data io.Reader) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	network, address := clamavNetwork(addr)
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return fmt.Errorf("clamd dial: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return fmt.Errorf("clamd write: %w", err)
+	}
+	buf := make([]byte, clamavChunkSize)
+	var size [4]byte
+	for {
+		n, err := data.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			if _, werr := conn.Write(append(size[:], buf[:n]...)); werr != nil {
+				return fmt.Errorf("clamd write: %w", werr)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read attachment: %w", err)
+		}
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	if _, err := conn.Write(size[:]); err != nil {
+		return fmt.Errorf("clamd write: %w", err)
+	}
+
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		return fmt.Errorf("clamd read: %w", err)
+	}
+	result := strings.TrimSpace(string(bytes.TrimRight(reply, "\x00")))
+	result = strings.TrimPrefix(result, "stream: ")
+	switch {
+	case result == "OK":
+		return nil
+	case strings.HasSuffix(result, " FOUND"):
+		return fmt.Errorf("%w: %s", errVirusFound, strings.TrimSuffix(result, " FOUND"))
+	default:
+		return fmt.Errorf("clamd: %s", result)
+	}
+}
@@ -0,0 +1,92 @@
+package form_mailer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd answers INSTREAM requests, flagging any stream containing EICAR.
+func fakeClamd(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				cmd := make([]byte, len("zINSTREAM\x00"))
+				if _, err := io.ReadFull(conn, cmd); err != nil {
+					return
+				}
+				var data bytes.Buffer
+				for {
+					var size [4]byte
+					if _, err := io.ReadFull(conn, size[:]); err != nil {
+						return
+					}
+					n := binary.BigEndian.Uint32(size[:])
+					if n == 0 {
+						break
+					}
+					if _, err := io.CopyN(&data, conn, int64(n)); err != nil {
+						return
+					}
+				}
+				if strings.Contains(data.String(), "EICAR-STANDARD-ANTIVIRUS-TEST-FILE") {
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+					return
+				}
+				conn.Write([]byte("stream: OK\x00"))
+			}(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestScanClamAV(t *testing.T) {
+	addr := fakeClamd(t)
+
+	if err := scanClamAV(context.Background(), addr, time.Second, strings.NewReader("hello")); err != nil {
+		t.Fatalf("expected clean scan, got %v", err)
+	}
+
+	err := scanClamAV(context.Background(), addr, time.Second, strings.NewReader(eicar))
+	if !errors.Is(err, errVirusFound) {
+		t.Fatalf("expected errVirusFound, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "Eicar-Test-Signature") {
+		t.Fatalf("expected signature name in error, got %v", err)
+	}
+}
+
+func TestClamAVNetwork(t *testing.T) {
+	cases := map[string][2]string{
+		"clamd:3310":                   {"tcp", "clamd:3310"},
+		"tcp://clamd:3310":             {"tcp", "clamd:3310"},
+		"unix:///run/clamd/clamd.sock": {"unix", "/run/clamd/clamd.sock"},
+		"/var/run/clamav/clamd.ctl":    {"unix", "/var/run/clamav/clamd.ctl"},
+	}
+	for in, want := range cases {
+		network, addr := clamavNetwork(in)
+		if network != want[0] || addr != want[1] {
+			t.Fatalf("clamavNetwork(%q) = %s %s, want %s %s", in, network, addr, want[0], want[1])
+		}
+	}
+}
@@ -0,0 +1,10 @@
+package form_mailer
+
+import "time"
+
+// nowFunc is the package's clock: everything that decides something based
+// on the time (rate limits, warmup days, token and signature expiry, log
+// sampling, timestamps in emails and envelopes) reads it here, so tests can
+// run the handler against a fake clock. Measuring real elapsed time, as for
+// OBSCURE_MIN_RESPONSE padding and network deadlines, stays on time.Now.
+var nowFunc = time.Now
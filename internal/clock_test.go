@@ -0,0 +1,101 @@
+package form_mailer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jordan-wright/email"
+)
+
+// fakeClock stands in for nowFunc until the test ends. It only moves when
+// told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func useFakeClock(t *testing.T, start time.Time) *fakeClock {
+	t.Helper()
+	c := &fakeClock{now: start}
+	prev := nowFunc
+	nowFunc = c.Now
+	t.Cleanup(func() { nowFunc = prev })
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func postContact(t *testing.T) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(`{"name":"Alice","email":"alice@example.com","message":"Hello"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	HandleContact(rec, req)
+	return rec
+}
+
+func TestHandleContactRateLimitFakeClock(t *testing.T) {
+	setupTestConfig(t)
+	clock := useFakeClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return nil }
+
+	// Burst 1: the first request opens the bucket, the second spends it.
+	for i := 0; i < 2; i++ {
+		if rec := postContact(t); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: expected status 200, got %d", i+1, rec.Code)
+		}
+	}
+	clock.Advance(59 * time.Second)
+	if rec := postContact(t); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429 before a minute passed, got %d", rec.Code)
+	}
+	clock.Advance(time.Second)
+	if rec := postContact(t); rec.Code != http.StatusOK {
+		t.Fatalf("expected a refill after a minute, got %d", rec.Code)
+	}
+}
+
+func TestHandleContactWarmupFakeClock(t *testing.T) {
+	setupTestConfig(t)
+	resetWarmup(t)
+	clock := useFakeClock(t, time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC))
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return nil }
+	conf.RateBurst = 10
+	conf.WarmupStateFile = filepath.Join(t.TempDir(), "warmup.json")
+	conf.Sites["acme"].WarmupDays = 2
+	conf.Sites["acme"].WarmupMaxDaily = 2
+
+	if rec := postContact(t); rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	rec := postContact(t)
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "3601" {
+		t.Fatalf("expected 503 until midnight, got %d with Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	clock.Advance(time.Hour)
+	for i := 0; i < 2; i++ {
+		if rec := postContact(t); rec.Code != http.StatusOK {
+			t.Fatalf("day 2, send %d: expected status 200, got %d", i+1, rec.Code)
+		}
+	}
+	if rec := postContact(t); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected day 2's cap of 2, got %d", rec.Code)
+	}
+}
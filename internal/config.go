@@ -1,28 +1,120 @@
 package form_mailer
 
 import (
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	htmltemplate "html/template"
 	"log/slog"
+	"maps"
+	"net/http"
+	"net/textproto"
+	"net/url"
 	"os"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+	"unicode/utf8"
 
 	"github.com/nazarhussain/form-courier/env"
 )
 
 /*
 ENV-ONLY CONFIG (documented in README):
-  Required global SMTP fallback:
+  Global SMTP fallback, required unless every site sets <SITE>_SMTP_HOST or sends no email:
     SMTP_HOST, SMTP_PORT, SMTP_USER, SMTP_PASS, SMTP_SSL (true/false)
+    SMTP_AUTH (default "plain")  // plain | login | cram-md5
   Optional global:
     LISTEN_ADDR (default ":3000")
-    FROM_ADDR
+    SITE_KEY_SOURCE (default "path")  // path | subdomain | header
+    SITE_KEY_HEADER (default "X-Site-Key")  // header read when SITE_KEY_SOURCE=header
+    HTTP_READ_TIMEOUT (default "15s")
+    HTTP_WRITE_TIMEOUT (default "30s")  // bounds the whole handler, SMTP send included
+    HTTP_IDLE_TIMEOUT (default "60s")
+    ENABLE_H2C (default "false")  // also serve HTTP/2 cleartext on LISTEN_ADDR
+    TLS_CERT_FILE, TLS_KEY_FILE  // serve HTTPS with this PEM pair (re-read on SIGHUP); unset = plain HTTP
+    TLS_MIN_VERSION (default "1.2")  // 1.2 | 1.3
+    ENABLE_PROXY_PROTOCOL (default "false")  // require a PROXY v1/v2 header on every connection
+    TRUSTED_PROXY_COUNT (default 0)  // proxies in front that append to X-Forwarded-For; 0 = trust its first entry
+    GLOBAL_SEND_RATE_PER_MINUTE (default 0)  // emails per minute across all sites; 0 = unlimited
+    SMTP_MAX_CONCURRENT_PER_HOST (default 4)  // simultaneous sends per SMTP host:port, across sites; 0 = unlimited
+    SMTP_SLOT_TIMEOUT (default 10s)  // how long a send waits for one of those slots; 0 = until one frees up
+    FROM_ADDR                    // see <SITE>_FROM_ADDR for the full precedence
     SUBJECT_PREFIX (default "[Contact]")
     RATE_LIMIT_BURST (default 3)
     RATE_LIMIT_REFILL_MINUTES (default 1)
+    RATE_LIMIT_MAX_BUCKETS (default 0)  // cap on buckets in memory, least recently used evicted first; 0 = no cap
+    RATE_LIMIT_STATE_FILE        // rate-limit state saved on shutdown and restored on startup; unset = in memory only
+    WARMUP_STATE_FILE            // <SITE>_WARMUP_* daily counters, written on every send; required by warmup sites
+    DIGEST_STATE_FILE            // <SITE>_DIGEST_INTERVAL buffers, written on every submission; required by digest sites
     ALLOW_JSON (default "true")
     ALLOW_FORM (default "true")
     MAX_BODY_KB (default 1024)  // 1MB
+    REQUIRE_CONTENT_LENGTH (default "false")  // 411 for bodies without Content-Length, chunked included
+    MAX_HEADER_COUNT (default 100)  // header fields per request, more gets 431; 0 = no limit
+    MAX_HEADER_KB (default 32)  // total header size; 0 = Go's 1MB default
+    JSON_MAX_DEPTH (default 8)  // deepest object/array nesting accepted
+    JSON_MAX_TOKENS (default 1000)  // JSON keys + values + delimiters accepted
+    JSON_DISALLOW_UNKNOWN_FIELDS (default "false")  // reject top-level fields the site doesn't read
+    DUPLICATE_FIELDS (default "first")  // repeated fields: first | reject | join | array (the last two for custom form fields only)
+    DUPLICATE_FIELD_SEPARATOR (default ", ")  // with DUPLICATE_FIELDS=join
+    MULTI_VALUE_SEPARATOR (default ", ")  // joins JSON array and DUPLICATE_FIELDS=array values in the email; per site as <SITE>_MULTI_VALUE_SEPARATOR
+    BATCH_MAX_ITEMS (default 20)  // submissions per POST /v1/contact/{site}/batch, capped by the rate-limit burst
+    CORS_EXPOSE_REJECTIONS (default "false")  // let disallowed origins read the 403 body
+    CORS_MAX_AGE_SECONDS (default 7200)  // Access-Control-Max-Age on allowed preflights; 0 = not sent
+    CORS_PREFLIGHT_UNKNOWN_SITES (default "true")  // bare 204 to preflights with a bad or unknown site key
+    SECURITY_HEADERS_HSTS        // Strict-Transport-Security value; unset = not sent
+    SECURITY_HEADERS_DISABLE     // comma-separated header names to omit, or "all"
+    FAILURE_WEBHOOK_URL          // receives a JSON POST when a submission fails to send
+    SANITIZE_CSV (default "false")  // prefix formula-like values with ' in NATS and failure webhook payloads
+    FORM_TOKEN_SECRET            // signs form tokens; unset = random per process (tokens die on restart)
+    FORM_TOKEN_TTL (default "30m")
+    LOG_SAMPLE_THRESHOLD (default 0)  // per reason and minute, flood rejections logged before sampling; 0 = off
+    LOG_SAMPLE_RATE (default 100)  // past the threshold, log 1 in N
+    SIGNATURE_MAX_AGE_SECONDS (default 0)  // >0: sign "<X-Signature-Timestamp>.<body>" and reject older timestamps
+    SIGNATURE_CLOCK_SKEW_SECONDS (default 30)  // how far ahead a client's timestamp may be
+    NATS_URL                     // nats://[user:pass@]host:4222 or tls://...; needed by <SITE>_DELIVERY=nats
+    NATS_SUBJECT (default "form.submissions.{site}")
+    NATS_JETSTREAM (default "false")  // wait for a JetStream PubAck instead of a server round trip
+    NATS_TIMEOUT (default "5s")
+    ECHO_KEEP (default 20)       // emails kept per <SITE>_DELIVERY=echo site
+    ATTACHMENT_SPOOL_KB (default 256)  // uploads larger than this are spooled to temp files instead of memory
+    OBSCURE_SITE_KEYS (default "false")  // answer unknown keys and early rejections alike with a padded 403
+    OBSCURE_MIN_RESPONSE (default "250ms")
+    REJECT_STATUS_CODES          // reason=status overrides for rejections, e.g. "rate_limited=503"
+    JSON_ERRORS (default "false") // rejections answer {"ok":false,"error","code","request_id"} instead of plain text
+    METRICS_ENABLED (default "false")  // serve Prometheus metrics on GET /metrics
+    ADMIN_TOKEN                  // bearer token for admin endpoints; unset = disabled
+    MAINTENANCE_MODE (default "false")  // reject all submissions with 503
+    MAINTENANCE_MESSAGE
+    CLAMAV_ADDR                  // clamd address (host:port, tcp://, unix://); unset = no scanning
+    CLAMAV_TIMEOUT (default "10s")
+    CLAMAV_FAIL_OPEN (default "false")  // accept attachments when clamd is unreachable
+    IDEMPOTENCY_TTL (default "24h")  // how long responses are replayed for an Idempotency-Key; 0 = ignore the header
+    IDEMPOTENCY_MAX_KEYS (default 10000)  // most responses kept for replay, oldest dropped first
+    SEND_RETRY_503 (default "false")  // answer transient send failures with 503 and Retry-After instead of 500
+    SEND_RETRY_AFTER (default "30s")  // first Retry-After, doubling per consecutive transient failure
+    SEND_RETRY_AFTER_MAX (default "10m")
+    MX_TIMEOUT (default "2s")    // DNS time limit for <SITE>_VERIFY_MX
+    MX_CACHE_TTL (default "1h")
+    DUMP_EML_DIR                 // debug: write each composed message to <dir>/<site>-<id>.eml
+    HONEYPOT_FAKE_SUCCESS (default "false")  // answer honeypot hits and blocked user agents with a normal success response
+    BLOCKED_USER_AGENTS          // comma-separated User-Agent substrings or /regexps/ (case-insensitive) to refuse with 403
+    AUTO_REPLY_GLOBAL_BURST (default 50)  // auto-replies across all sites before throttling
+    AUTO_REPLY_REFILL_MINUTES (default 60)  // minutes for the auto-reply budgets to regain one reply
+    DETECT_LANGUAGE (default "false")  // tag submissions with a guessed message language
+    NORMALIZE_UNICODE (default "false")  // fold homoglyphs to ASCII, strip invisible characters
+    TRIM_FIELDS (default "true")  // trim surrounding whitespace from submitted text fields
+    COLLAPSE_WHITESPACE (default "false")  // with TRIM_FIELDS, also squeeze whitespace runs in the name and subject to one space
+    REDACT_PII (default "false")  // mask submitter addresses in logs, e.g. a***@example.com
+    DEFAULT_SITE_KEY             // site from SITES that handles unknown site keys (contact and batch); unset = 404
+    LAZY_SITES (default "false")  // load each site's config on its first request
+    ENV_FILE                     // KEY=VALUE file applied on startup and on SIGHUP reload
 
   Multi-site:
     SITES="picadortech,instant-umzug"
@@ -31,130 +123,1143 @@ ENV-ONLY CONFIG (documented in README):
       <SITE>_TO (required)
       <SITE>_ALLOWED_ORIGINS="https://a.com,https://b.com"
       <SITE>_SUBJECT_PREFIX
-      <SITE>_SECRET                // optional HMAC secret; if set, require X-Signature
+      <SITE>_FROM_ADDR             // From precedence: <SITE>_FROM_ADDR > FROM_ADDR > <SITE>_SMTP_USER > SMTP_USER
+      <SITE>_FROM_STRICT           // From is always <SITE>_FROM_ADDR; submitter goes in subject and body (default "false")
+      <SITE>_CC_SUBMITTER          // Cc the submitter on the team email (default "false")
+      <SITE>_BCC                   // archive addresses Bcc'd on every team email, comma-separated
+      <SITE>_BCC_MAX_KB            // larger emails reach the archive as a separate copy without attachments; unset = always Bcc
+      <SITE>_BCC_OVERSIZE          // note | strip: list the removed attachments in the archive copy or not (default "note")
+      <SITE>_RATE_LIMIT_BURST      // requests per IP, overriding RATE_LIMIT_BURST
+      <SITE>_API_KEYS              // X-Api-Key values, comma-separated; each gets its own rate-limit bucket instead of the IP's
+      <SITE>_REJECT_INVALID_API_KEY // 401 for an X-Api-Key not in _API_KEYS instead of limiting by IP (default "false")
+      <SITE>_SEND_BURST            // emails the site may send before throttling, across all IPs; unset = unlimited
+      <SITE>_SEND_REFILL_MINUTES   // minutes for _SEND_BURST to regain one email (default RATE_LIMIT_REFILL_MINUTES)
+      <SITE>_EMAIL_COOLDOWN_MINUTES // minutes before the same submitter email may submit again; unset = none
+      <SITE>_WARMUP_DAYS           // ramp a new sending domain's daily cap up over this many days; unset = no warmup
+      <SITE>_WARMUP_MAX_DAILY      // daily cap on the last day of the ramp (with _WARMUP_DAYS)
+      <SITE>_DIGEST_INTERVAL       // buffer submissions and email them together once the oldest is this old, e.g. "24h"; unset = one email each
+      <SITE>_BUSINESS_HOURS        // accept submissions only then, e.g. "Mon-Fri 09:00-17:00 Europe/Berlin"; unset = always
+      <SITE>_OUTSIDE_HOURS_MESSAGE // 503 body outside business hours
+      <SITE>_ENCRYPTED_HONEYPOT    // require the "honeypot" token from the token endpoint in the hidden hp_token field (default "false")
+      <SITE>_INCLUDE_IP            // show the submitter IP in the team email (default "true")
+      <SITE>_MASK_IP               // zero the last IPv4 octet / all but the first 48 IPv6 bits in it (default "false")
+      <SITE>_BLOCKED_USER_AGENTS   // replaces BLOCKED_USER_AGENTS for the site; "none" = no denylist
+      <SITE>_SUBMISSION_RECEIPT    // add received_at and a receipt hash (HMAC with the first secret, else SHA-256) to success responses, also as ETag (default "false")
+      <SITE>_REQUIRE_TOKEN         // require a token from GET /v1/contact/{site}/token (default "false")
+      <SITE>_REQUIRE_REFERER       // reject posts whose Origin/Referer isn't in _ALLOWED_ORIGINS (default "false")
+      <SITE>_REFERER_ALLOW_MISSING // with _REQUIRE_REFERER, accept posts carrying neither header (default "false")
+      <SITE>_DELIVERY              // smtp | nats | echo (default "smtp")
+      <SITE>_NATS_SUBJECT          // overrides NATS_SUBJECT
+      <SITE>_SHADOW_DELIVERY       // smtp | nats | echo: also deliver a sample through this backend, for comparison
+      <SITE>_SHADOW_SAMPLE_PERCENT // share of delivered submissions shadowed (default 100)
+      <SITE>_SHADOW_TO             // shadow recipient (default <SITE>_TO)
+      <SITE>_SHADOW_SMTP_HOST      // with _SHADOW_DELIVERY=smtp; also _SHADOW_SMTP_PORT, _USER, _PASS, _SSL
+      <SITE>_DELIVERY_FALLBACK     // smtp,nats,echo in order: tried in turn when _DELIVERY fails
+      <SITE>_FALLBACK_SMTP_HOST    // smtp fallback server; also _FALLBACK_SMTP_PORT, _USER, _PASS, _SSL (default the site's own, unless _DELIVERY=smtp)
+      <SITE>_NOTIFY_ONLY           // publish the submission to NATS and email only site, time and ID (default "false")
+      <SITE>_SECRET                // optional HMAC secret(s), comma-separated for rotation; if set, require X-Signature
+      <SITE>_SIGNATURE_REQUIRED    // always | no_origin: unsigned posts from an _ALLOWED_ORIGINS browser Origin pass (default "always")
+      <SITE>_LOG_LEVEL             // debug | info | warn | error for this site's requests; unset = LOG_LEVEL
       <SITE>_SMTP_HOST (optional per-site override)
       <SITE>_SMTP_PORT
       <SITE>_SMTP_USER
       <SITE>_SMTP_PASS
       <SITE>_SMTP_SSL ("true"/"false")
+      <SITE>_SMTP_AUTH             // plain | login | cram-md5 (default SMTP_AUTH)
+      <SITE>_SMTP_CLIENT_CERT      // PEM client certificate for SMTP mTLS (with _SMTP_CLIENT_KEY)
+      <SITE>_SMTP_CLIENT_KEY
+      <SITE>_FIELD_MAP             // field=dotted.path pairs read from nested JSON, e.g. "name=contact.name"
+      <SITE>_ALLOWED_FIELDS        // custom fields accepted, e.g. "phone,company"; unset = any
+      <SITE>_STRICT_FIELDS         // with _ALLOWED_FIELDS, reject other fields with 400 instead of dropping them (default "true")
+      <SITE>_FIELD_TYPES           // field=kind pairs, kind string|int|float|bool, e.g. "subscribe=bool,budget=int"
+      <SITE>_THREAD_TAG_FIELDS     // fields hashed into a subject tag for threading, e.g. "email,topic"; unset = no tag
+      <SITE>_THREAD_TAG_FORMAT     // must contain {hash} (default "[#{hash}]")
+      <SITE>_INTERNAL_TEXT_TEMPLATE  // text/template file for the team email body; unset = built-in body (also as <SITE>_TEXT_TEMPLATE)
+      <SITE>_INTERNAL_HTML_TEMPLATE  // html/template file; adds an HTML part (multipart/alternative) (also as <SITE>_HTML_TEMPLATE)
+      <SITE>_EXTERNAL_TEXT_TEMPLATE  // text/template file for the auto-reply body, over the same data without the IP
+      <SITE>_EXTERNAL_HTML_TEMPLATE  // html/template file; adds an HTML part to the auto-reply
+      <SITE>_SANITIZE_SUBJECT      // off | strip | transliterate non-ASCII in the team email subject (default "off": RFC 2047 encoded)
+      <SITE>_EMAIL_HEADERS         // Name=value headers added to the team email, e.g. "X-Environment=prod"
+      <SITE>_ALLOW_SUBMITTER_SUBJECT  // use the payload's "subject" field in the subject after the prefix (default "false")
+      <SITE>_VALIDATION_WEBHOOK_URL   // POST each submission here first; it answers {"accept":true} or the submission is rejected
+      <SITE>_VALIDATION_REJECT_STATUS // status for rejected submissions, 400-599 (default "422")
+      <SITE>_VALIDATION_TIMEOUT       // (default "3s")
+      <SITE>_VALIDATION_FAIL_OPEN     // accept submissions when the webhook is down or errors (default "false")
+      <SITE>_PRIORITY_FIELD        // payload field holding the priority (default "priority")
+      <SITE>_PRIORITY_MAP          // value=level pairs, level high|normal|low (default "high=high,low=low")
+      <SITE>_CONTACT_PREFERENCES   // allowed values of the contact_preference field, e.g. "email,phone"; unset = field not read
+      <SITE>_REQUIRE_CONTACT_PREFERENCE  // 400 when contact_preference is missing (default "false")
+      <SITE>_VERIFY_MX             // reject submitter domains without MX (or A/AAAA) records (default "false")
+      <SITE>_NAME_MIN_LENGTH       // optional, in characters
+      <SITE>_NAME_MAX_LENGTH       // optional, in characters
+      <SITE>_NAME_REJECT_URLS      // reject names containing links (default "false")
+      <SITE>_FIELD_LENGTHS         // field:min-max pairs in characters, e.g. "name:2-80,message:10-5000,phone:0-20"
+      <SITE>_ALLOW_ATTACHMENTS     // accept multipart/form-data file uploads (default "false")
+      <SITE>_ALLOWED_ATTACHMENT_EXTENSIONS  // e.g. "pdf,png,jpg"; unset = any
+      <SITE>_MAX_ATTACHMENT_COUNT  // optional, files per submission
+      <SITE>_MAX_ATTACHMENT_TOTAL_KB  // optional, combined size of all files
+      <SITE>_MESSAGE_OPTIONAL_WITH_ATTACHMENT  // accept an empty message when a file is attached (default "false")
+      <SITE>_AUTO_REPLY_TEXT       // confirmation sent to the submitter; unset = no auto-reply unless an external template is set
+      <SITE>_AUTO_REPLY_SUBJECT    // default "<SUBJECT_PREFIX> We received your message"
+      <SITE>_AUTO_REPLY_BURST      // auto-replies per submitter address before throttling (default 1)
 */
 
 type SiteCfg struct {
-	Key            string
-	To             string
-	AllowedOrigins []string
-	SubjectPrefix  string
-	Secret         string
-	SMTP           *SmtpCfg
-	FromAddr       string
+	Key              string
+	To               string
+	AllowedOrigins   []string
+	SubjectPrefix    string
+	RateBurst        int           // 0 = RATE_LIMIT_BURST
+	SendBurst        int           // 0 = unlimited
+	SendRefill       time.Duration // per send token; 0 = RATE_LIMIT_REFILL_MINUTES
+	WarmupDays       int           // 0 = no warmup
+	WarmupMaxDaily   int
+	EmailCooldown    time.Duration  // 0 = none
+	DigestInterval   time.Duration  // 0 = one email per submission
+	BusinessHours    *businessHours // nil = always open
+	OutsideHoursMsg  string
+	RequireToken     bool
+	HoneypotToken    bool     // encrypted honeypot in the hp_token field
+	Receipts         bool     // receipt hash and ETag in success responses
+	BlockedUAs       *uaRules // nil = BLOCKED_USER_AGENTS
+	HideIP           bool     // leave the submitter IP out of the team email
+	MaskIP           bool     // show only its network
+	Delivery         string
+	NATSSubject      string
+	NotifyOnly       bool     // email carries no submitter data; needs NATS_URL
+	Shadow           *SiteCfg // also delivers a sample here; nil = none
+	ShadowPercent    float64
+	shadow           bool // this is another site's Shadow
+	RequireReferer   bool
+	AllowNoReferer   bool     // with RequireReferer, pass posts lacking Origin and Referer
+	Secrets          []string // any one may sign; several while rotating
+	SignaturePolicy  string   // signRequire*: who must sign when Secrets is set
+	APIKeys          []string // X-Api-Key values rate-limited on their own
+	RejectBadAPIKey  bool     // 401 for an unknown X-Api-Key; else limit by IP
+	SMTP             *SmtpCfg
+	LogLevel         slog.Leveler // nil = LOG_LEVEL
+	FromAddr         string
+	FromStrict       bool
+	CCSubmitter      bool
+	BCC              []string // archive addresses
+	BCCMaxKB         int      // 0 = no limit
+	BCCOversize      string
+	FieldMap         map[string]string
+	FieldTypes       map[string]string
+	AllowedFields    []string // custom fields; nil = any
+	StrictFields     bool
+	EmailHeaders     map[string]string // canonical name -> value
+	TextTemplate     *texttemplate.Template
+	HTMLTemplate     *htmltemplate.Template
+	ThreadTagFields  []string
+	ThreadTagFormat  string
+	SubmitterSubject bool   // from the "subject" field
+	SanitizeSubject  string // non-ASCII handling in the subject
+	// Asked to accept each submission before it is sent; "" = no check
+	ValidationURL      string
+	ValidationStatus   int
+	ValidationTimeout  time.Duration
+	ValidationFailOpen bool
+	PriorityField      string
+	PriorityMap        map[string]string
+	ContactPrefs       []string // allowed contact_preference values, lowercased; nil = not read
+	RequireContactPref bool
+	NameMinLength      int
+	NameMaxLength      int
+	NameRejectURLs     bool
+	FieldLengths       map[string]lengthRange
+	MultiValueSep      string // joins multi-value fields in the email
+	VerifyMX           bool
+	AllowAttachments   bool
+	// Lowercased, without the leading dot
+	AllowedAttachmentExts []string
+	MaxAttachmentCount    int
+	MaxAttachmentTotalKB  int
+	MessageOptional       bool // when files are attached
+	AutoReplyText         string
+	AutoReplySubject      string
+	ExternalTextTemplate  *texttemplate.Template
+	ExternalHTMLTemplate  *htmltemplate.Template
+	AutoReplyBurst        int
+	Fallbacks             []*SiteCfg // tried in order when Delivery fails
 }
 
 type SmtpCfg struct {
-	Host string
-	Port int
-	User string
-	Pass string
-	SSL  bool
+	Host       string
+	Port       int
+	User       string
+	Pass       string
+	SSL        bool
+	Auth       string // smtpAuth* mechanism; "" = plain
+	ClientCert *tls.Certificate
 }
 
 type Config struct {
-	RateBurst         int
-	RateRefillMinutes int
-	AllowJSON         bool
-	AllowForm         bool
-	MaxBodyKB         int
-	ListenAddr        string
-	Sites             map[string]*SiteCfg
+	RateBurst            int
+	RateRefillMinutes    int
+	RateStateFile        string
+	RateMaxBuckets       int
+	WarmupStateFile      string
+	DigestStateFile      string
+	AllowJSON            bool
+	AllowForm            bool
+	MaxBodyKB            int
+	RequireContentLength bool
+	MaxHeaderCount       int
+	MaxHeaderKB          int
+	JSONMaxDepth         int
+	JSONMaxTokens        int
+	JSONDisallowUnknown  bool
+	DuplicateFields      string
+	DuplicateFieldSep    string
+	BatchMaxItems        int
+	SMTPMaxPerHost       int // shared by every site using the same host:port
+	SMTPSlotTimeout      time.Duration
+	GlobalSendRate       int // emails per minute across all sites
+	ListenAddr           string
+	SiteKeySource        string
+	SiteKeyHeader        string
+	ReadTimeout          time.Duration
+	WriteTimeout         time.Duration
+	IdleTimeout          time.Duration
+	EnableH2C            bool
+	TLSCertFile          string
+	TLSKeyFile           string
+	TLSMinVersion        uint16
+	EnableProxyProtocol  bool
+	TrustedProxyCount    int
+	SecurityHeaders      map[string]string
+	CORSExposeRejections bool
+	CORSMaxAge           time.Duration
+	CORSPreflightUnknown bool
+	FailureWebhookURL    string
+	SanitizeCSV          bool
+	AdminToken           string
+	NATSURL              string
+	NATSJetStream        bool
+	NATSTimeout          time.Duration
+	EchoKeep             int
+	AttachmentSpoolKB    int
+	RejectStatus         map[string]int // rejection reason -> status
+	JSONErrors           bool           // rejections answer JSON with a "code"
+	ObscureSiteKeys      bool
+	ObscureMinResponse   time.Duration
+	FormTokenSecret      []byte
+	SignatureMaxAge      time.Duration
+	SignatureClockSkew   time.Duration
+	FormTokenTTL         time.Duration
+	MetricsEnabled       bool
+	LogSampleThreshold   int
+	LogSampleRate        int
+	MaintenanceMode      bool
+	MaintenanceMessage   string
+	HoneypotFakeSuccess  bool
+	BlockedUserAgents    *uaRules
+	AutoReplyGlobalBurst int
+	AutoReplyRefill      time.Duration // per auto-reply token, per address and global
+	RedactPII            bool
+	NormalizeUnicode     bool
+	TrimFields           bool
+	CollapseWhitespace   bool
+	DetectLanguage       bool
+	DumpEMLDir           string
+	ClamAVAddr           string
+	ClamAVTimeout        time.Duration
+	ClamAVFailOpen       bool
+	IdempotencyTTL       time.Duration
+	IdempotencyMaxKeys   int
+	SendRetry503         bool
+	SendRetryAfter       time.Duration
+	SendRetryAfterMax    time.Duration
+	MXTimeout            time.Duration
+	MXCacheTTL           time.Duration
+	SiteKeys             []string
+	DefaultSiteKey       string
+	LazySites            bool
+	Sites                map[string]*SiteCfg
+
+	// kept for lazy site loading
+	vars                map[string]string // the environment snapshot validated at load
+	globalSMTP          SmtpCfg
+	globalSubjectPrefix string
+	sitesMu             sync.Mutex
+
+	// FormTokenSecret was generated, not read from FORM_TOKEN_SECRET
+	randomTokenSecret bool
 }
 
 var (
 	emailRegex = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+	urlRegex   = regexp.MustCompile(`(?i)(https?://|www\.)`)
 
-	conf *Config
+	conf   *Config
+	confMu sync.Mutex
+
+	errUnknownSite = errors.New("unknown site")
 )
 
 func GetConfig() *Config {
+	confMu.Lock()
+	defer confMu.Unlock()
 	if conf == nil {
-		globalSMTP := loadGlobalSMTP()
-		globalSubjectPrefix := env.Env("SUBJECT_PREFIX", "[Contact]")
-		conf = &Config{
-			RateBurst:         env.EnvInt("RATE_LIMIT_BURST", 3),
-			RateRefillMinutes: env.EnvInt("RATE_LIMIT_REFILL_MINUTES", 1),
-			AllowJSON:         env.EnvBool("ALLOW_JSON", true),
-			AllowForm:         env.EnvBool("ALLOW_FORM", true),
-			MaxBodyKB:         env.EnvInt("MAX_BODY_KB", 1024),
-			ListenAddr:        env.Env("LISTEN_ADDR", ":3000"),
-			Sites:             loadSitesFromEnv(globalSMTP, globalSubjectPrefix),
+		c, err := loadConfig()
+		if err != nil {
+			fatalf("%v", err)
 		}
+		conf = c
 	}
 	return conf
 }
 
-func loadGlobalSMTP() SmtpCfg {
+// ReloadConfig re-reads ENV_FILE (when set) and the environment, and swaps the
+// result in for subsequent requests. Listener settings need a restart. When
+// the new configuration is invalid the running one stays in place and the
+// error lists every problem found. A random form token secret is carried
+// over while FORM_TOKEN_SECRET stays unset.
+func ReloadConfig() (*Config, error) {
+	c, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	confMu.Lock()
+	if c.randomTokenSecret && conf != nil && conf.randomTokenSecret {
+		// Outstanding form and honeypot tokens survive the reload
+		c.FormTokenSecret = conf.FormTokenSecret
+	}
+	conf = c
+	confMu.Unlock()
+	return c, nil
+}
+
+func loadConfig() (*Config, error) {
+	var (
+		p    env.Parser
+		file map[string]string
+	)
+	if path := os.Getenv("ENV_FILE"); path != "" {
+		var err error
+		if file, err = env.LoadFile(path); err != nil {
+			p.Failf("failed to load ENV_FILE: %v", err)
+		}
+	}
+	// Read from a snapshot, never the live environment, so a line removed
+	// from ENV_FILE is gone on reload and lazy sites see what was validated
+	p.Vars = env.Snapshot(file)
+	globalSMTP := loadGlobalSMTP(&p)
+	globalSubjectPrefix := p.Env("SUBJECT_PREFIX", "[Contact]")
+	keys := loadSiteKeys(&p)
+	tokenSecret, randomTokenSecret := loadFormTokenSecret(&p)
+	c := &Config{
+		RateBurst:            p.Int("RATE_LIMIT_BURST", 3),
+		RateRefillMinutes:    p.Int("RATE_LIMIT_REFILL_MINUTES", 1),
+		RateStateFile:        p.Get("RATE_LIMIT_STATE_FILE"),
+		RateMaxBuckets:       p.Int("RATE_LIMIT_MAX_BUCKETS", 0),
+		WarmupStateFile:      p.Get("WARMUP_STATE_FILE"),
+		DigestStateFile:      p.Get("DIGEST_STATE_FILE"),
+		AllowJSON:            p.Bool("ALLOW_JSON", true),
+		AllowForm:            p.Bool("ALLOW_FORM", true),
+		MaxBodyKB:            p.Int("MAX_BODY_KB", 1024),
+		RequireContentLength: p.Bool("REQUIRE_CONTENT_LENGTH", false),
+		MaxHeaderCount:       p.Int("MAX_HEADER_COUNT", 100),
+		MaxHeaderKB:          p.Int("MAX_HEADER_KB", 32),
+		JSONMaxDepth:         p.Int("JSON_MAX_DEPTH", 8),
+		JSONMaxTokens:        p.Int("JSON_MAX_TOKENS", 1000),
+		JSONDisallowUnknown:  p.Bool("JSON_DISALLOW_UNKNOWN_FIELDS", false),
+		DuplicateFields:      loadDuplicateFields(&p),
+		DuplicateFieldSep:    p.Env("DUPLICATE_FIELD_SEPARATOR", ", "),
+		BatchMaxItems:        p.Int("BATCH_MAX_ITEMS", 20),
+		GlobalSendRate:       p.Int("GLOBAL_SEND_RATE_PER_MINUTE", 0),
+		SMTPMaxPerHost:       p.Int("SMTP_MAX_CONCURRENT_PER_HOST", 4),
+		SMTPSlotTimeout:      p.Duration("SMTP_SLOT_TIMEOUT", 10*time.Second),
+		ListenAddr:           p.Env("LISTEN_ADDR", ":3000"),
+		SiteKeySource:        loadSiteKeySource(&p),
+		SiteKeyHeader:        p.Env("SITE_KEY_HEADER", "X-Site-Key"),
+		ReadTimeout:          p.Duration("HTTP_READ_TIMEOUT", 15*time.Second),
+		WriteTimeout:         p.Duration("HTTP_WRITE_TIMEOUT", 30*time.Second),
+		IdleTimeout:          p.Duration("HTTP_IDLE_TIMEOUT", 60*time.Second),
+		EnableH2C:            p.Bool("ENABLE_H2C", false),
+		TLSCertFile:          p.Get("TLS_CERT_FILE"),
+		TLSKeyFile:           p.Get("TLS_KEY_FILE"),
+		TLSMinVersion:        loadTLSMinVersion(&p),
+		EnableProxyProtocol:  p.Bool("ENABLE_PROXY_PROTOCOL", false),
+		TrustedProxyCount:    p.Int("TRUSTED_PROXY_COUNT", 0),
+		SecurityHeaders:      loadSecurityHeaders(&p),
+		CORSExposeRejections: p.Bool("CORS_EXPOSE_REJECTIONS", false),
+		CORSMaxAge:           time.Duration(p.Int("CORS_MAX_AGE_SECONDS", 7200)) * time.Second,
+		CORSPreflightUnknown: p.Bool("CORS_PREFLIGHT_UNKNOWN_SITES", true),
+		FailureWebhookURL:    p.Get("FAILURE_WEBHOOK_URL"),
+		SanitizeCSV:          p.Bool("SANITIZE_CSV", false),
+		AdminToken:           p.Get("ADMIN_TOKEN"),
+		NATSURL:              p.Get("NATS_URL"),
+		NATSJetStream:        p.Bool("NATS_JETSTREAM", false),
+		NATSTimeout:          p.Duration("NATS_TIMEOUT", 5*time.Second),
+		EchoKeep:             p.Int("ECHO_KEEP", 20),
+		AttachmentSpoolKB:    p.Int("ATTACHMENT_SPOOL_KB", 256),
+		RejectStatus:         loadRejectStatus(&p),
+		JSONErrors:           p.Bool("JSON_ERRORS", false),
+		ObscureSiteKeys:      p.Bool("OBSCURE_SITE_KEYS", false),
+		ObscureMinResponse:   p.Duration("OBSCURE_MIN_RESPONSE", 250*time.Millisecond),
+		FormTokenSecret:      tokenSecret,
+		SignatureMaxAge:      time.Duration(p.Int("SIGNATURE_MAX_AGE_SECONDS", 0)) * time.Second,
+		SignatureClockSkew:   time.Duration(p.Int("SIGNATURE_CLOCK_SKEW_SECONDS", 30)) * time.Second,
+		FormTokenTTL:         p.Duration("FORM_TOKEN_TTL", 30*time.Minute),
+		MetricsEnabled:       p.Bool("METRICS_ENABLED", false),
+		LogSampleThreshold:   p.Int("LOG_SAMPLE_THRESHOLD", 0),
+		LogSampleRate:        p.Int("LOG_SAMPLE_RATE", 100),
+		MaintenanceMode:      p.Bool("MAINTENANCE_MODE", false),
+		MaintenanceMessage:   p.Env("MAINTENANCE_MESSAGE", "temporarily unavailable for maintenance"),
+		HoneypotFakeSuccess:  p.Bool("HONEYPOT_FAKE_SUCCESS", false),
+		BlockedUserAgents:    loadBlockedUserAgents(&p),
+		AutoReplyGlobalBurst: p.Int("AUTO_REPLY_GLOBAL_BURST", 50),
+		AutoReplyRefill:      time.Duration(p.Int("AUTO_REPLY_REFILL_MINUTES", 60)) * time.Minute,
+		RedactPII:            p.Bool("REDACT_PII", false),
+		NormalizeUnicode:     p.Bool("NORMALIZE_UNICODE", false),
+		TrimFields:           p.Bool("TRIM_FIELDS", true),
+		CollapseWhitespace:   p.Bool("COLLAPSE_WHITESPACE", false),
+		DetectLanguage:       p.Bool("DETECT_LANGUAGE", false),
+		DumpEMLDir:           p.Get("DUMP_EML_DIR"),
+		ClamAVAddr:           p.Get("CLAMAV_ADDR"),
+		ClamAVTimeout:        p.Duration("CLAMAV_TIMEOUT", 10*time.Second),
+		ClamAVFailOpen:       p.Bool("CLAMAV_FAIL_OPEN", false),
+		IdempotencyTTL:       p.Duration("IDEMPOTENCY_TTL", 24*time.Hour),
+		IdempotencyMaxKeys:   p.Int("IDEMPOTENCY_MAX_KEYS", 10000),
+		SendRetry503:         p.Bool("SEND_RETRY_503", false),
+		SendRetryAfter:       p.Duration("SEND_RETRY_AFTER", 30*time.Second),
+		SendRetryAfterMax:    p.Duration("SEND_RETRY_AFTER_MAX", 10*time.Minute),
+		MXTimeout:            p.Duration("MX_TIMEOUT", 2*time.Second),
+		MXCacheTTL:           p.Duration("MX_CACHE_TTL", time.Hour),
+		SiteKeys:             keys,
+		DefaultSiteKey:       p.Get("DEFAULT_SITE_KEY"),
+		LazySites:            p.Bool("LAZY_SITES", false),
+
+		globalSMTP:          globalSMTP,
+		globalSubjectPrefix: globalSubjectPrefix,
+		randomTokenSecret:   randomTokenSecret,
+		vars:                p.Vars,
+	}
+	if c.SendRetryAfter < time.Second || c.SendRetryAfterMax < c.SendRetryAfter {
+		p.Failf("SEND_RETRY_AFTER must be at least 1s and at most SEND_RETRY_AFTER_MAX")
+	}
+	if c.AutoReplyRefill <= 0 {
+		p.Failf("AUTO_REPLY_REFILL_MINUTES must be at least 1")
+	}
+	if c.IdempotencyMaxKeys <= 0 {
+		p.Failf("IDEMPOTENCY_MAX_KEYS must be at least 1")
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		p.Failf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if c.DefaultSiteKey != "" && !slices.Contains(keys, c.DefaultSiteKey) {
+		p.Failf("DEFAULT_SITE_KEY %q is not listed in SITES", c.DefaultSiteKey)
+	}
+	if !c.LazySites {
+		c.Sites = loadSitesFromEnv(&p, keys, globalSMTP, globalSubjectPrefix)
+	}
+	return c, p.Err()
+}
+
+func loadSiteKeySource(p *env.Parser) string {
+	source := strings.ToLower(p.Env("SITE_KEY_SOURCE", "path"))
+	switch source {
+	case "path", "subdomain", "header":
+		return source
+	default:
+		p.Failf("SITE_KEY_SOURCE must be one of path, subdomain, header (got %q)", source)
+		return "path"
+	}
+}
+
+func loadDuplicateFields(p *env.Parser) string {
+	mode := strings.ToLower(p.Env("DUPLICATE_FIELDS", duplicateFirst))
+	switch mode {
+	case duplicateFirst, duplicateReject, duplicateJoin, duplicateArray:
+		return mode
+	default:
+		p.Failf("DUPLICATE_FIELDS must be one of first, reject, join, array (got %q)", mode)
+		return duplicateFirst
+	}
+}
+
+// loadRejectStatus parses REJECT_STATUS_CODES. Only 4xx and 5xx codes that
+// net/http knows are accepted, so a typo can't turn a rejection into a 2xx
+// or a redirect.
+func loadRejectStatus(p *env.Parser) map[string]int {
+	pairs, err := splitPairs(p.Get("REJECT_STATUS_CODES"))
+	if err != nil {
+		p.Failf("invalid REJECT_STATUS_CODES: %v", err)
+		return nil
+	}
+	out := make(map[string]int, len(pairs))
+	for reason, v := range pairs {
+		status, err := strconv.Atoi(v)
+		if err != nil || status < 400 || status > 599 || http.StatusText(status) == "" {
+			p.Failf("invalid REJECT_STATUS_CODES: %q is not a 4xx or 5xx status for %q", v, reason)
+			continue
+		}
+		out[reason] = status
+	}
+	return out
+}
+
+func loadTLSMinVersion(p *env.Parser) uint16 {
+	switch v := p.Env("TLS_MIN_VERSION", "1.2"); v {
+	case "1.2":
+		return tls.VersionTLS12
+	case "1.3":
+		return tls.VersionTLS13
+	default:
+		p.Failf("TLS_MIN_VERSION must be 1.2 or 1.3 (got %q)", v)
+		return tls.VersionTLS12
+	}
+}
+
+// loadSecurityHeaders returns the response headers secHeaders should set,
+// starting from the built-in defaults and applying the env overrides.
+func loadSecurityHeaders(p *env.Parser) map[string]string {
+	headers := map[string]string{
+		"Referrer-Policy":        "no-referrer-when-downgrade",
+		"X-Content-Type-Options": "nosniff",
+		"X-Frame-Options":        "DENY",
+		"X-XSS-Protection":       "0",
+	}
+	if v := p.Get("SECURITY_HEADERS_HSTS"); strings.TrimSpace(v) != "" {
+		headers["Strict-Transport-Security"] = v
+	}
+	for _, name := range splitString(p.Get("SECURITY_HEADERS_DISABLE")) {
+		if strings.EqualFold(name, "all") {
+			return map[string]string{}
+		}
+		for h := range headers {
+			if strings.EqualFold(h, name) {
+				delete(headers, h)
+			}
+		}
+	}
+	return headers
+}
+
+// loadFormTokenSecret reads FORM_TOKEN_SECRET or, when it is unset,
+// generates a random secret and reports that it did.
+func loadFormTokenSecret(p *env.Parser) ([]byte, bool) {
+	if v := p.Get("FORM_TOKEN_SECRET"); v != "" {
+		return []byte(v), false
+	}
+	secret := make([]byte, 32)
+	_, _ = rand.Read(secret)
+	return secret, true
+}
+
+// loadGlobalSMTP reads the fallback SMTP server. Without SMTP_HOST there is
+// none, and loadSiteFromEnv makes sure no site depends on it.
+func loadGlobalSMTP(p *env.Parser) SmtpCfg {
+	if p.Get("SMTP_HOST") == "" {
+		return SmtpCfg{}
+	}
 	return SmtpCfg{
-		Host: env.MustEnv("SMTP_HOST"),
-		Port: env.MustEnvInt("SMTP_PORT"),
-		User: env.MustEnv("SMTP_USER"),
-		Pass: env.MustEnv("SMTP_PASS"),
-		SSL:  env.EnvBool("SMTP_SSL", false),
+		Host: p.Require("SMTP_HOST"),
+		Port: p.RequireInt("SMTP_PORT"),
+		User: p.Require("SMTP_USER"),
+		Pass: p.Require("SMTP_PASS"),
+		SSL:  p.Bool("SMTP_SSL", false),
+		Auth: loadSMTPAuth(p),
 	}
 }
 
-func loadSitesFromEnv(globalSMTP SmtpCfg, globalSubjectPrefix string) map[string]*SiteCfg {
-	siteByKey := map[string]*SiteCfg{}
+// loadSMTPAuth reads SMTP_AUTH, the global SMTP server's mechanism.
+func loadSMTPAuth(p *env.Parser) string {
+	auth := strings.ToLower(p.Env("SMTP_AUTH", smtpAuthPlain))
+	if !smtpAuthMechanisms[auth] {
+		p.Failf("invalid SMTP_AUTH %q (want plain, login or cram-md5)", auth)
+		return smtpAuthPlain
+	}
+	return auth
+}
 
-	raw := os.Getenv("SITES")
+func loadSiteKeys(p *env.Parser) []string {
+	raw := p.Get("SITES")
 	if strings.TrimSpace(raw) == "" {
-		fatalf("SITES is required (comma-separated list of site keys, e.g. SITES=my-site,product-alpha)")
+		p.Failf("SITES is required (comma-separated list of site keys, e.g. SITES=my-site,product-alpha)")
 	}
-	keys := splitString(raw)
+	return splitString(raw)
+}
+
+func loadSitesFromEnv(p *env.Parser, keys []string, globalSMTP SmtpCfg, globalSubjectPrefix string) map[string]*SiteCfg {
+	siteByKey := map[string]*SiteCfg{}
 	for _, key := range keys {
-		if key == "" {
+		cs, err := loadSiteFromEnv(p.Vars, key, globalSMTP, globalSubjectPrefix)
+		if err != nil {
+			p.Failf("%v", err)
 			continue
 		}
-		uc := env.ToEnvKey(key) // e.g., picadortech -> PICADORTECH
-		to := os.Getenv(uc + "_TO")
-		if strings.TrimSpace(to) == "" {
-			fatalf("missing %s_TO for site %q", uc, key)
-		}
-		allowed := splitString(os.Getenv(uc + "_ALLOWED_ORIGINS"))
-		prefix := env.Env(uc+"_SUBJECT_PREFIX", globalSubjectPrefix)
-		secret := os.Getenv(uc + "_SECRET")
-
-		siteSMTP := &SmtpCfg{
-			Host: globalSMTP.Host,
-			Port: globalSMTP.Port,
-			User: globalSMTP.User,
-			Pass: globalSMTP.Pass,
-			SSL:  globalSMTP.SSL,
-		}
-		if v := os.Getenv(uc + "_SMTP_HOST"); v != "" {
-			siteSMTP = &SmtpCfg{
-				Host: v,
-				Port: env.EnvInt(uc+"_SMTP_PORT", globalSMTP.Port),
-				User: env.Env(uc+"_SMTP_USER", globalSMTP.User),
-				Pass: env.Env(uc+"_SMTP_PASS", globalSMTP.Pass),
-				SSL:  env.EnvBool(uc+"_SMTP_SSL", globalSMTP.SSL),
+		siteByKey[key] = cs
+	}
+	return siteByKey
+}
+
+// loadSiteFromEnv reads site key from vars, or from the process environment
+// when vars is nil.
+func loadSiteFromEnv(vars map[string]string, key string, globalSMTP SmtpCfg, globalSubjectPrefix string) (*SiteCfg, error) {
+	uc := env.ToEnvKey(key) // e.g., picadortech -> PICADORTECH
+	p := env.Parser{Vars: vars}
+	to := p.Get(uc + "_TO")
+	if strings.TrimSpace(to) == "" {
+		return nil, fmt.Errorf("missing %s_TO for site %q", uc, key)
+	}
+	allowed := splitString(p.Get(uc + "_ALLOWED_ORIGINS"))
+	prefix := p.Env(uc+"_SUBJECT_PREFIX", globalSubjectPrefix)
+	secrets := splitString(p.Get(uc + "_SECRET"))
+
+	siteSMTP, err := loadSMTP(&p, uc, globalSMTP)
+	if err != nil {
+		return nil, err
+	}
+
+	fromAddr := resolveFromAddr(
+		p.Get(uc+"_FROM_ADDR"),
+		p.Get("FROM_ADDR"),
+		siteSMTP.User,
+		globalSMTP.User,
+	)
+
+	delivery := strings.ToLower(p.Env(uc+"_DELIVERY", deliverySMTP))
+	switch delivery {
+	case deliverySMTP, deliveryEcho:
+	case deliveryNATS:
+		if p.Get("NATS_URL") == "" {
+			return nil, fmt.Errorf("%s_DELIVERY=nats needs NATS_URL", uc)
+		}
+	default:
+		return nil, fmt.Errorf("invalid %s_DELIVERY %q (want smtp, nats or echo)", uc, delivery)
+	}
+
+	notifyOnly := p.Bool(uc+"_NOTIFY_ONLY", false)
+	if notifyOnly && p.Get("NATS_URL") == "" {
+		return nil, fmt.Errorf("%s_NOTIFY_ONLY needs NATS_URL to publish the submission to", uc)
+	}
+
+	// Catch a site that can't send at startup rather than with a 500 on its
+	// first submission. NATS-only sites need no SMTP server unless they
+	// send auto-replies, and echo sites never need one.
+	if siteSMTP.Host == "" {
+		siteSMTP = nil
+	}
+	autoReply := p.Get(uc+"_AUTO_REPLY_TEXT") != "" ||
+		p.Get(uc+"_EXTERNAL_TEXT_TEMPLATE") != "" || p.Get(uc+"_EXTERNAL_HTML_TEMPLATE") != ""
+	if delivery != deliveryEcho && (delivery == deliverySMTP || notifyOnly || autoReply) {
+		switch {
+		case siteSMTP == nil:
+			return nil, fmt.Errorf("site %q has no way to send email: set SMTP_HOST or %s_SMTP_HOST (or %s_DELIVERY=nats)", key, uc, uc)
+		case siteSMTP.Port <= 0:
+			return nil, fmt.Errorf("site %q has no SMTP port: set %s_SMTP_PORT or SMTP_PORT", key, uc)
+		}
+	}
+
+	warmupDays := p.Int(uc+"_WARMUP_DAYS", 0)
+	warmupMaxDaily := p.Int(uc+"_WARMUP_MAX_DAILY", 0)
+	switch {
+	case warmupDays <= 0 && warmupMaxDaily <= 0:
+	case warmupDays <= 0 || warmupMaxDaily <= 0:
+		return nil, fmt.Errorf("%s_WARMUP_DAYS and %s_WARMUP_MAX_DAILY must be set together", uc, uc)
+	case p.Get("WARMUP_STATE_FILE") == "":
+		return nil, fmt.Errorf("%s_WARMUP_DAYS needs WARMUP_STATE_FILE to keep the daily count across restarts", uc)
+	}
+
+	var digestInterval time.Duration
+	if v := p.Get(uc + "_DIGEST_INTERVAL"); v != "" {
+		var err error
+		digestInterval, err = time.ParseDuration(v)
+		switch {
+		case err != nil || digestInterval < time.Minute:
+			return nil, fmt.Errorf("invalid %s_DIGEST_INTERVAL %q: must be a duration of at least 1m (e.g. 24h)", uc, v)
+		case p.Get("DIGEST_STATE_FILE") == "":
+			return nil, fmt.Errorf("%s_DIGEST_INTERVAL needs DIGEST_STATE_FILE to keep buffered submissions across restarts", uc)
+		case delivery == deliveryNATS || notifyOnly:
+			return nil, fmt.Errorf("%s_DIGEST_INTERVAL only works with email delivery", uc)
+		case p.Bool(uc+"_ALLOW_ATTACHMENTS", false):
+			return nil, fmt.Errorf("%s_DIGEST_INTERVAL can't be combined with %s_ALLOW_ATTACHMENTS", uc, uc)
+		}
+	}
+
+	signaturePolicy := p.Env(uc+"_SIGNATURE_REQUIRED", signRequireAlways)
+	switch signaturePolicy {
+	case signRequireAlways:
+	case signRequireNoOrigin:
+		if len(secrets) == 0 {
+			return nil, fmt.Errorf("%s_SIGNATURE_REQUIRED=%s needs %s_SECRET", uc, signaturePolicy, uc)
+		}
+		if len(allowed) == 0 || slices.Contains(allowed, "*") {
+			return nil, fmt.Errorf("%s_SIGNATURE_REQUIRED=%s needs %s_ALLOWED_ORIGINS without \"*\"", uc, signaturePolicy, uc)
+		}
+	default:
+		return nil, fmt.Errorf("invalid %s_SIGNATURE_REQUIRED %q: must be %s or %s", uc, signaturePolicy, signRequireAlways, signRequireNoOrigin)
+	}
+
+	requireReferer := p.Bool(uc+"_REQUIRE_REFERER", false)
+	if requireReferer && len(allowed) == 0 {
+		return nil, fmt.Errorf("%s_REQUIRE_REFERER needs %s_ALLOWED_ORIGINS", uc, uc)
+	}
+
+	fromStrict := p.Bool(uc+"_FROM_STRICT", false)
+	if fromStrict && !emailRegex.MatchString(p.Get(uc+"_FROM_ADDR")) {
+		return nil, fmt.Errorf("%s_FROM_STRICT requires a valid %s_FROM_ADDR", uc, uc)
+	}
+
+	var logLevel slog.Leveler
+	if v := p.Get(uc + "_LOG_LEVEL"); v != "" {
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(v)); err != nil {
+			return nil, fmt.Errorf("invalid %s_LOG_LEVEL %q: must be debug, info, warn or error", uc, v)
+		}
+		logLevel = l
+	}
+
+	sanitize := p.Env(uc+"_SANITIZE_SUBJECT", sanitizeSubjectOff)
+	switch sanitize {
+	case sanitizeSubjectOff, sanitizeSubjectStrip, sanitizeSubjectTranslit:
+	default:
+		return nil, fmt.Errorf("invalid %s_SANITIZE_SUBJECT %q: must be %s, %s or %s", uc, sanitize, sanitizeSubjectOff, sanitizeSubjectStrip, sanitizeSubjectTranslit)
+	}
+
+	var hours *businessHours
+	if v := p.Get(uc + "_BUSINESS_HOURS"); v != "" {
+		var err error
+		if hours, err = parseBusinessHours(v); err != nil {
+			return nil, fmt.Errorf("invalid %s_BUSINESS_HOURS %q: %v", uc, v, err)
+		}
+	}
+
+	bcc := splitString(p.Get(uc + "_BCC"))
+	for _, addr := range bcc {
+		if !emailRegex.MatchString(addr) {
+			return nil, fmt.Errorf("invalid %s_BCC: %q is not an email address", uc, addr)
+		}
+	}
+	bccOversize := p.Env(uc+"_BCC_OVERSIZE", bccOversizeNote)
+	if bccOversize != bccOversizeNote && bccOversize != bccOversizeStrip {
+		return nil, fmt.Errorf("invalid %s_BCC_OVERSIZE %q: must be %s or %s", uc, bccOversize, bccOversizeNote, bccOversizeStrip)
+	}
+
+	fieldMap, err := splitPairs(p.Get(uc + "_FIELD_MAP"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s_FIELD_MAP: %v", uc, err)
+	}
+	for field, path := range fieldMap {
+		if path == "" || slices.Contains(strings.Split(path, "."), "") {
+			return nil, fmt.Errorf("invalid %s_FIELD_MAP: bad path %q for %q", uc, path, field)
+		}
+	}
+
+	fieldTypes, err := splitPairs(p.Get(uc + "_FIELD_TYPES"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s_FIELD_TYPES: %v", uc, err)
+	}
+	for field, kind := range fieldTypes {
+		if !fieldKinds[kind] {
+			return nil, fmt.Errorf("invalid %s_FIELD_TYPES: unknown type %q for %q", uc, kind, field)
+		}
+	}
+
+	allowedFields := splitString(p.Get(uc + "_ALLOWED_FIELDS"))
+	if len(allowedFields) > 0 {
+		for field := range fieldTypes {
+			if !slices.Contains(allowedFields, field) {
+				return nil, fmt.Errorf("%s_FIELD_TYPES types %q, which %s_ALLOWED_FIELDS doesn't allow", uc, field, uc)
+			}
+		}
+	}
+
+	emailHeaders, err := parseEmailHeaders(p.Get(uc + "_EMAIL_HEADERS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s_EMAIL_HEADERS: %v", uc, err)
+	}
+
+	textPath, name, err := internalTemplatePath(&p, uc, "TEXT_TEMPLATE")
+	if err != nil {
+		return nil, err
+	}
+	textTemplate, err := loadTextTemplate(textPath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	htmlPath, name, err := internalTemplatePath(&p, uc, "HTML_TEMPLATE")
+	if err != nil {
+		return nil, err
+	}
+	htmlTemplate, err := loadHTMLTemplate(htmlPath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	externalText, err := loadTextTemplate(p.Get(uc + "_EXTERNAL_TEXT_TEMPLATE"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s_EXTERNAL_TEXT_TEMPLATE: %v", uc, err)
+	}
+	externalHTML, err := loadHTMLTemplate(p.Get(uc + "_EXTERNAL_HTML_TEMPLATE"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s_EXTERNAL_HTML_TEMPLATE: %v", uc, err)
+	}
+
+	threadTagFormat := p.Env(uc+"_THREAD_TAG_FORMAT", "[#{hash}]")
+	if !strings.Contains(threadTagFormat, "{hash}") || utf8.RuneCountInString(threadTagFormat) > 40 {
+		return nil, fmt.Errorf("invalid %s_THREAD_TAG_FORMAT %q: must contain {hash} and be at most 40 characters", uc, threadTagFormat)
+	}
+
+	fieldLengths, err := parseFieldLengths(p.Get(uc + "_FIELD_LENGTHS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s_FIELD_LENGTHS: %v", uc, err)
+	}
+
+	var contactPrefs []string
+	for _, v := range splitString(p.Get(uc + "_CONTACT_PREFERENCES")) {
+		contactPrefs = append(contactPrefs, strings.ToLower(v))
+	}
+	requireContactPref := p.Bool(uc+"_REQUIRE_CONTACT_PREFERENCE", false)
+	if requireContactPref && len(contactPrefs) == 0 {
+		return nil, fmt.Errorf("%s_REQUIRE_CONTACT_PREFERENCE needs %s_CONTACT_PREFERENCES", uc, uc)
+	}
+
+	blockedUAs, err := parseUserAgentRules(p.Get(uc + "_BLOCKED_USER_AGENTS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s_BLOCKED_USER_AGENTS: %v", uc, err)
+	}
+
+	validationURL := p.Get(uc + "_VALIDATION_WEBHOOK_URL")
+	if validationURL != "" {
+		u, err := url.Parse(validationURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid %s_VALIDATION_WEBHOOK_URL %q: must be an http(s) URL", uc, validationURL)
+		}
+	}
+	validationStatus := p.Int(uc+"_VALIDATION_REJECT_STATUS", http.StatusUnprocessableEntity)
+	if validationStatus < 400 || validationStatus > 599 {
+		return nil, fmt.Errorf("invalid %s_VALIDATION_REJECT_STATUS %d: must be 400-599", uc, validationStatus)
+	}
+	validationTimeout := 3 * time.Second
+	if v := p.Get(uc + "_VALIDATION_TIMEOUT"); v != "" {
+		if validationTimeout, err = time.ParseDuration(v); err != nil || validationTimeout <= 0 {
+			return nil, fmt.Errorf("invalid %s_VALIDATION_TIMEOUT %q: must be a positive duration (e.g. 2s)", uc, v)
+		}
+	}
+
+	var attachmentExts []string
+	for _, ext := range splitString(p.Get(uc + "_ALLOWED_ATTACHMENT_EXTENSIONS")) {
+		attachmentExts = append(attachmentExts, strings.ToLower(strings.TrimPrefix(ext, ".")))
+	}
+
+	priorityMap := map[string]string{}
+	pairs, err := splitPairs(p.Env(uc+"_PRIORITY_MAP", "high=high,low=low"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s_PRIORITY_MAP: %v", uc, err)
+	}
+	for value, level := range pairs {
+		level = strings.ToLower(level)
+		switch level {
+		case "high", "low":
+		case "normal":
+			level = ""
+		default:
+			return nil, fmt.Errorf("invalid %s_PRIORITY_MAP: unknown level %q", uc, level)
+		}
+		priorityMap[strings.ToLower(value)] = level
+	}
+
+	cs := &SiteCfg{
+		Key:                   key,
+		To:                    to,
+		AllowedOrigins:        allowed,
+		SubjectPrefix:         prefix,
+		FromAddr:              fromAddr,
+		FromStrict:            fromStrict,
+		CCSubmitter:           p.Bool(uc+"_CC_SUBMITTER", false),
+		BCC:                   bcc,
+		BCCMaxKB:              p.Int(uc+"_BCC_MAX_KB", 0),
+		BCCOversize:           bccOversize,
+		Secrets:               secrets,
+		SignaturePolicy:       signaturePolicy,
+		APIKeys:               splitString(p.Get(uc + "_API_KEYS")),
+		RejectBadAPIKey:       p.Bool(uc+"_REJECT_INVALID_API_KEY", false),
+		RateBurst:             p.Int(uc+"_RATE_LIMIT_BURST", 0),
+		SendBurst:             p.Int(uc+"_SEND_BURST", 0),
+		SendRefill:            time.Duration(p.Int(uc+"_SEND_REFILL_MINUTES", 0)) * time.Minute,
+		EmailCooldown:         time.Duration(p.Int(uc+"_EMAIL_COOLDOWN_MINUTES", 0)) * time.Minute,
+		WarmupDays:            warmupDays,
+		WarmupMaxDaily:        warmupMaxDaily,
+		DigestInterval:        digestInterval,
+		BusinessHours:         hours,
+		OutsideHoursMsg:       p.Env(uc+"_OUTSIDE_HOURS_MESSAGE", "We're currently closed. Please try again during business hours."),
+		RequireToken:          p.Bool(uc+"_REQUIRE_TOKEN", false),
+		HoneypotToken:         p.Bool(uc+"_ENCRYPTED_HONEYPOT", false),
+		Receipts:              p.Bool(uc+"_SUBMISSION_RECEIPT", false),
+		BlockedUAs:            blockedUAs,
+		HideIP:                !p.Bool(uc+"_INCLUDE_IP", true),
+		MaskIP:                p.Bool(uc+"_MASK_IP", false),
+		Delivery:              delivery,
+		NotifyOnly:            notifyOnly,
+		NATSSubject:           p.Env(uc+"_NATS_SUBJECT", p.Env("NATS_SUBJECT", "form.submissions.{site}")),
+		RequireReferer:        requireReferer,
+		AllowNoReferer:        p.Bool(uc+"_REFERER_ALLOW_MISSING", false),
+		SMTP:                  siteSMTP,
+		LogLevel:              logLevel,
+		FieldMap:              fieldMap,
+		FieldTypes:            fieldTypes,
+		AllowedFields:         allowedFields,
+		StrictFields:          p.Bool(uc+"_STRICT_FIELDS", true),
+		EmailHeaders:          emailHeaders,
+		TextTemplate:          textTemplate,
+		HTMLTemplate:          htmlTemplate,
+		ThreadTagFields:       splitString(p.Get(uc + "_THREAD_TAG_FIELDS")),
+		ThreadTagFormat:       threadTagFormat,
+		SubmitterSubject:      p.Bool(uc+"_ALLOW_SUBMITTER_SUBJECT", false),
+		SanitizeSubject:       sanitize,
+		ValidationURL:         validationURL,
+		ValidationStatus:      validationStatus,
+		ValidationTimeout:     validationTimeout,
+		ValidationFailOpen:    p.Bool(uc+"_VALIDATION_FAIL_OPEN", false),
+		PriorityField:         p.Env(uc+"_PRIORITY_FIELD", "priority"),
+		PriorityMap:           priorityMap,
+		ContactPrefs:          contactPrefs,
+		RequireContactPref:    requireContactPref,
+		NameMinLength:         p.Int(uc+"_NAME_MIN_LENGTH", 0),
+		NameMaxLength:         p.Int(uc+"_NAME_MAX_LENGTH", 0),
+		FieldLengths:          fieldLengths,
+		MultiValueSep:         p.Env(uc+"_MULTI_VALUE_SEPARATOR", p.Env("MULTI_VALUE_SEPARATOR", defaultMultiValueSep)),
+		NameRejectURLs:        p.Bool(uc+"_NAME_REJECT_URLS", false),
+		VerifyMX:              p.Bool(uc+"_VERIFY_MX", false),
+		AllowAttachments:      p.Bool(uc+"_ALLOW_ATTACHMENTS", false),
+		AllowedAttachmentExts: attachmentExts,
+		MaxAttachmentCount:    p.Int(uc+"_MAX_ATTACHMENT_COUNT", 0),
+		MaxAttachmentTotalKB:  p.Int(uc+"_MAX_ATTACHMENT_TOTAL_KB", 0),
+		MessageOptional:       p.Bool(uc+"_MESSAGE_OPTIONAL_WITH_ATTACHMENT", false),
+		AutoReplyText:         p.Get(uc + "_AUTO_REPLY_TEXT"),
+		AutoReplySubject:      p.Env(uc+"_AUTO_REPLY_SUBJECT", strings.TrimSpace(prefix+" We received your message")),
+		AutoReplyBurst:        p.Int(uc+"_AUTO_REPLY_BURST", 1),
+		ExternalTextTemplate:  externalText,
+		ExternalHTMLTemplate:  externalHTML,
+	}
+	if cs.SendRefill < 0 {
+		return nil, fmt.Errorf("invalid %s_SEND_REFILL_MINUTES: must not be negative", uc)
+	}
+	if err := loadShadow(&p, cs, uc, globalSMTP); err != nil {
+		return nil, err
+	}
+	if err := loadFallbacks(&p, cs, uc, globalSMTP); err != nil {
+		return nil, err
+	}
+	if err := p.Err(); err != nil {
+		return nil, fmt.Errorf("site %q: %w", key, err)
+	}
+	return cs, nil
+}
+
+// loadFallbacks sets up the site's <SITE>_DELIVERY_FALLBACK chain, copies
+// of cs that each deliver through another backend. An smtp fallback sends
+// over <SITE>_FALLBACK_SMTP_*, which default to the site's own server
+// settings, or over that server itself when the primary backend isn't smtp.
+// echo is no fallback: it would drop the submission and report success.
+func loadFallbacks(p *env.Parser, cs *SiteCfg, uc string, globalSMTP SmtpCfg) error {
+	names := splitString(strings.ToLower(p.Get(uc + "_DELIVERY_FALLBACK")))
+	if len(names) == 0 {
+		return nil
+	}
+	if cs.NotifyOnly {
+		// A fallback would put the submission in an email after all
+		return fmt.Errorf("%s_DELIVERY_FALLBACK can't be combined with %s_NOTIFY_ONLY", uc, uc)
+	}
+	if cs.DigestInterval > 0 {
+		return fmt.Errorf("%s_DELIVERY_FALLBACK can't be combined with %s_DIGEST_INTERVAL", uc, uc)
+	}
+	seen := map[string]bool{fallbackKey(cs): true}
+	for _, delivery := range names {
+		fb := *cs
+		fb.Delivery, fb.Shadow, fb.Fallbacks = delivery, nil, nil
+		switch delivery {
+		case deliveryNATS:
+			if p.Get("NATS_URL") == "" {
+				return fmt.Errorf("%s_DELIVERY_FALLBACK=nats needs NATS_URL", uc)
+			}
+		case deliverySMTP:
+			if p.Get(uc+"_FALLBACK_SMTP_HOST") != "" {
+				base := globalSMTP
+				if cs.SMTP != nil {
+					base = *cs.SMTP
+				}
+				smtpCfg, err := loadSMTP(p, uc+"_FALLBACK", base)
+				if err != nil {
+					return err
+				}
+				fb.SMTP = smtpCfg
 			}
+			if fb.SMTP == nil || fb.SMTP.Port <= 0 {
+				return fmt.Errorf("%s_DELIVERY_FALLBACK=smtp needs %s_FALLBACK_SMTP_HOST and a port", uc, uc)
+			}
+		default:
+			return fmt.Errorf("invalid %s_DELIVERY_FALLBACK %q (want smtp or nats)", uc, delivery)
+		}
+		if seen[fallbackKey(&fb)] {
+			return fmt.Errorf("invalid %s_DELIVERY_FALLBACK: %s is already tried", uc, delivery)
+		}
+		seen[fallbackKey(&fb)] = true
+		cs.Fallbacks = append(cs.Fallbacks, &fb)
+	}
+	return nil
+}
+
+// fallbackKey tells backends apart for loadFallbacks: smtp ones by server.
+func fallbackKey(cs *SiteCfg) string {
+	if cs.Delivery == deliverySMTP && cs.SMTP != nil {
+		return fmt.Sprintf("smtp %s:%d", cs.SMTP.Host, cs.SMTP.Port)
+	}
+	return cs.Delivery
+}
+
+// loadShadow sets up the site's <SITE>_SHADOW_DELIVERY backend, a copy of
+// cs that delivers elsewhere: to <SITE>_SHADOW_TO only, and over its own
+// <SITE>_SHADOW_SMTP_* server for smtp, read like the site's own server.
+func loadShadow(p *env.Parser, cs *SiteCfg, uc string, globalSMTP SmtpCfg) error {
+	delivery := strings.ToLower(p.Get(uc + "_SHADOW_DELIVERY"))
+	if delivery == "" {
+		return nil
+	}
+	shadow := *cs
+	shadow.Delivery, shadow.NotifyOnly, shadow.BCC, shadow.shadow = delivery, false, nil, true
+	shadow.To = p.Env(uc+"_SHADOW_TO", cs.To)
+	switch delivery {
+	case deliveryEcho:
+	case deliveryNATS:
+		if p.Get("NATS_URL") == "" {
+			return fmt.Errorf("%s_SHADOW_DELIVERY=nats needs NATS_URL", uc)
+		}
+	case deliverySMTP:
+		if p.Get(uc+"_SHADOW_SMTP_HOST") == "" {
+			return fmt.Errorf("%s_SHADOW_DELIVERY=smtp needs %s_SHADOW_SMTP_HOST and a port", uc, uc)
+		}
+		smtpCfg, err := loadSMTP(p, uc+"_SHADOW", globalSMTP)
+		if err != nil {
+			return err
 		}
+		shadow.SMTP = smtpCfg
+		if shadow.SMTP.Port <= 0 {
+			return fmt.Errorf("%s_SHADOW_DELIVERY=smtp needs %s_SHADOW_SMTP_HOST and a port", uc, uc)
+		}
+	default:
+		return fmt.Errorf("invalid %s_SHADOW_DELIVERY %q (want smtp, nats or echo)", uc, delivery)
+	}
 
-		fromAddr := env.Env("FROM_ADDR", globalSMTP.User)
-		if v := os.Getenv(uc + "_FROM_ADDR"); strings.TrimSpace(v) != "" {
-			fromAddr = v
+	percent := 100.0
+	if v := p.Get(uc + "_SHADOW_SAMPLE_PERCENT"); v != "" {
+		var err error
+		if percent, err = strconv.ParseFloat(v, 64); err != nil || percent <= 0 || percent > 100 {
+			return fmt.Errorf("invalid %s_SHADOW_SAMPLE_PERCENT %q: must be above 0 and at most 100", uc, v)
 		}
+	}
+	cs.Shadow, cs.ShadowPercent = &shadow, percent
+	return nil
+}
 
-		siteByKey[key] = &SiteCfg{
-			Key:            key,
-			To:             to,
-			AllowedOrigins: allowed,
-			SubjectPrefix:  prefix,
-			FromAddr:       fromAddr,
-			Secret:         secret,
-			SMTP:           siteSMTP,
+// loadSMTP reads the <prefix>_SMTP_* server settings. Without
+// <prefix>_SMTP_HOST the result is a copy of base, credentials, mechanism
+// and client certificate included; with it, each unset setting still
+// defaults to base's.
+func loadSMTP(p *env.Parser, prefix string, base SmtpCfg) (*SmtpCfg, error) {
+	cfg := base
+	if v := p.Get(prefix + "_SMTP_HOST"); v != "" {
+		cfg.Host = v
+		cfg.Port = p.Int(prefix+"_SMTP_PORT", base.Port)
+		cfg.User = p.Env(prefix+"_SMTP_USER", base.User)
+		cfg.Pass = p.Env(prefix+"_SMTP_PASS", base.Pass)
+		cfg.SSL = p.Bool(prefix+"_SMTP_SSL", base.SSL)
+	}
+	if v := p.Get(prefix + "_SMTP_AUTH"); v != "" {
+		cfg.Auth = strings.ToLower(v)
+		if !smtpAuthMechanisms[cfg.Auth] {
+			return nil, fmt.Errorf("invalid %s_SMTP_AUTH %q (want plain, login or cram-md5)", prefix, v)
 		}
 	}
 
-	return siteByKey
+	certFile, keyFile := p.Get(prefix+"_SMTP_CLIENT_CERT"), p.Get(prefix+"_SMTP_CLIENT_KEY")
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("%s_SMTP_CLIENT_CERT and %s_SMTP_CLIENT_KEY must be set together", prefix, prefix)
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s_SMTP_CLIENT_CERT: %v", prefix, err)
+		}
+		cfg.ClientCert = &cert
+	}
+	return &cfg, nil
+}
+
+// resolveFromAddr picks the first non-blank candidate, in precedence order:
+// <SITE>_FROM_ADDR, FROM_ADDR, the site's SMTP user, the global SMTP user.
+func resolveFromAddr(candidates ...string) string {
+	for _, c := range candidates {
+		if c = strings.TrimSpace(c); c != "" {
+			return c
+		}
+	}
+	return ""
+}
+
+// Site returns the configuration for key. In lazy mode sites listed in SITES
+// are loaded from the environment on first use and cached.
+func (c *Config) Site(key string) (*SiteCfg, error) {
+	c.sitesMu.Lock()
+	defer c.sitesMu.Unlock()
+	if cs, ok := c.Sites[key]; ok {
+		return cs, nil
+	}
+	if !c.LazySites || !slices.Contains(c.SiteKeys, key) {
+		return nil, errUnknownSite
+	}
+	cs, err := loadSiteFromEnv(c.vars, key, c.globalSMTP, c.globalSubjectPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if c.Sites == nil {
+		c.Sites = map[string]*SiteCfg{}
+	}
+	c.Sites[key] = cs
+	return cs, nil
+}
+
+// rateBurstFor returns the per-IP request burst for cs, which may override
+// RATE_LIMIT_BURST.
+func (c *Config) rateBurstFor(cs *SiteCfg) int {
+	if cs.RateBurst > 0 {
+		return cs.RateBurst
+	}
+	return c.RateBurst
+}
+
+// sendRefillFor returns how long cs's send budget takes to regain a token:
+// <SITE>_SEND_REFILL_MINUTES, or RATE_LIMIT_REFILL_MINUTES.
+func (c *Config) sendRefillFor(cs *SiteCfg) time.Duration {
+	if cs.SendRefill > 0 {
+		return cs.SendRefill
+	}
+	return time.Duration(max(c.RateRefillMinutes, 1)) * time.Minute
+}
+
+// SiteLoaded reports whether key's configuration is already in memory.
+func (c *Config) SiteLoaded(key string) bool {
+	c.sitesMu.Lock()
+	defer c.sitesMu.Unlock()
+	_, ok := c.Sites[key]
+	return ok
+}
+
+// loadedSites returns the sites already in memory, by key. In lazy mode
+// requests add to cfg.Sites, so it may only be read under sitesMu.
+func (c *Config) loadedSites() []*SiteCfg {
+	c.sitesMu.Lock()
+	defer c.sitesMu.Unlock()
+	var sites []*SiteCfg
+	for _, key := range slices.Sorted(maps.Keys(c.Sites)) {
+		if cs := c.Sites[key]; cs != nil {
+			sites = append(sites, cs)
+		}
+	}
+	return sites
 }
 
 func fatalf(format string, args ...any) {
@@ -178,6 +1283,102 @@ func splitString(s string) []string {
 	return out
 }
 
+// splitPairs parses "k1=v1,k2=v2" into a map.
+func splitPairs(s string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, part := range splitString(s) {
+		k, v, ok := strings.Cut(part, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", part)
+		}
+		out[k] = v
+	}
+	return out, nil
+}
+
+// reservedEmailHeaders are set by the mailer itself and can't be configured
+// through <SITE>_EMAIL_HEADERS.
+var reservedEmailHeaders = map[string]bool{
+	"From": true, "To": true, "Cc": true, "Bcc": true, "Reply-To": true, "Sender": true,
+	"Subject": true, "Date": true, "Message-Id": true, "Mime-Version": true,
+	"Content-Type": true, "Content-Transfer-Encoding": true, "X-Submission-Id": true,
+	"X-Request-Id": true,
+}
+
+// parseEmailHeaders parses Name=value pairs, rejecting names that aren't
+// valid header field names and values with control characters, which could
+// otherwise inject headers into every email.
+func parseEmailHeaders(s string) (map[string]string, error) {
+	pairs, err := splitPairs(s)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]string, len(pairs))
+	for name, value := range pairs {
+		for _, r := range name {
+			if r <= ' ' || r >= 0x7f || r == ':' {
+				return nil, fmt.Errorf("invalid header name %q", name)
+			}
+		}
+		for _, r := range value {
+			if (r < ' ' && r != '\t') || r == 0x7f {
+				return nil, fmt.Errorf("control character in value of %q", name)
+			}
+		}
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if reservedEmailHeaders[name] {
+			return nil, fmt.Errorf("%s can't be overridden", name)
+		}
+		out[name] = value
+	}
+	return out, nil
+}
+
+// siteFeatures summarizes which optional capabilities are on for cs, as
+// key/value pairs of booleans, so a rollout can be confirmed from the
+// startup log. Secrets only show up as whether one is set.
+func siteFeatures(cfg *Config, cs *SiteCfg) []any {
+	return []any{
+		"cors", len(cs.AllowedOrigins) > 0,
+		"referer_check", cs.RequireReferer,
+		"has_secret", len(cs.Secrets) > 0,
+		"unsigned_browser_origins", len(cs.Secrets) > 0 && cs.SignaturePolicy == signRequireNoOrigin,
+		"api_keys", len(cs.APIKeys) > 0,
+		"form_token", cs.RequireToken,
+		"encrypted_honeypot", cs.HoneypotToken,
+		"receipts", cs.Receipts,
+		"email_ip", !cs.HideIP,
+		"mask_ip", !cs.HideIP && cs.MaskIP,
+		"user_agent_denylist", cfg.blockedUserAgentsFor(cs).len() > 0,
+		"attachments", cs.AllowAttachments,
+		"bcc_archive", len(cs.BCC) > 0,
+		"virus_scan", cs.AllowAttachments && cfg.ClamAVAddr != "",
+		"field_allowlist", len(cs.AllowedFields) > 0,
+		"verify_mx", cs.VerifyMX,
+		"submitter_subject", cs.SubmitterSubject,
+		"sanitize_subject", cs.SanitizeSubject != "" && cs.SanitizeSubject != sanitizeSubjectOff,
+		"validation_webhook", cs.ValidationURL != "",
+		"text_template", cs.TextTemplate != nil,
+		"html_template", cs.HTMLTemplate != nil,
+		"thread_tag", len(cs.ThreadTagFields) > 0,
+		"contact_preference", len(cs.ContactPrefs) > 0,
+		"business_hours", cs.BusinessHours != nil,
+		"send_cap", cs.SendBurst > 0,
+		"warmup", cs.WarmupDays > 0,
+		"digest", cs.DigestInterval > 0,
+		"auto_reply", cs.autoReplies(),
+		"external_template", cs.ExternalTextTemplate != nil || cs.ExternalHTMLTemplate != nil,
+		"nats", cs.Delivery == deliveryNATS || cs.NotifyOnly,
+		"notify_only", cs.NotifyOnly,
+		"shadow_delivery", cs.Shadow != nil,
+		"delivery_fallback", len(cs.Fallbacks) > 0,
+		"echo", cs.Delivery == deliveryEcho,
+		"failure_webhook", cfg.FailureWebhookURL != "",
+		"detect_language", cfg.DetectLanguage,
+	}
+}
+
 func LogConfig(logger *slog.Logger, cfg *Config) {
 	if cfg == nil {
 		return
@@ -187,28 +1388,142 @@ func LogConfig(logger *slog.Logger, cfg *Config) {
 	}
 	logger.Info("configuration loaded",
 		"listen_addr", cfg.ListenAddr,
+		"site_key_source", cfg.SiteKeySource,
+		"read_timeout", cfg.ReadTimeout,
+		"write_timeout", cfg.WriteTimeout,
+		"idle_timeout", cfg.IdleTimeout,
+		"h2c", cfg.EnableH2C,
+		"tls", cfg.TLSCertFile != "",
+		"tls_min_version", tls.VersionName(cfg.TLSMinVersion),
+		"proxy_protocol", cfg.EnableProxyProtocol,
+		"trusted_proxy_count", cfg.TrustedProxyCount,
 		"allow_json", cfg.AllowJSON,
 		"allow_form", cfg.AllowForm,
 		"rate_burst", cfg.RateBurst,
 		"rate_refill_minutes", cfg.RateRefillMinutes,
+		"rate_state_file", cfg.RateStateFile,
+		"rate_max_buckets", cfg.RateMaxBuckets,
+		"auto_reply_global_burst", cfg.AutoReplyGlobalBurst,
+		"auto_reply_refill", cfg.AutoReplyRefill,
+		"warmup_state_file", cfg.WarmupStateFile,
+		"digest_state_file", cfg.DigestStateFile,
 		"max_body_kb", cfg.MaxBodyKB,
-		"sites", len(cfg.Sites),
+		"require_content_length", cfg.RequireContentLength,
+		"max_header_count", cfg.MaxHeaderCount,
+		"max_header_kb", cfg.MaxHeaderKB,
+		"json_max_depth", cfg.JSONMaxDepth,
+		"json_max_tokens", cfg.JSONMaxTokens,
+		"json_disallow_unknown_fields", cfg.JSONDisallowUnknown,
+		"duplicate_fields", cfg.DuplicateFields,
+		"batch_max_items", cfg.BatchMaxItems,
+		"global_send_rate_per_minute", cfg.GlobalSendRate,
+		"smtp_max_concurrent_per_host", cfg.SMTPMaxPerHost,
+		"smtp_slot_timeout", cfg.SMTPSlotTimeout,
+		"security_headers", len(cfg.SecurityHeaders),
+		"cors_expose_rejections", cfg.CORSExposeRejections,
+		"cors_max_age_seconds", int(cfg.CORSMaxAge.Seconds()),
+		"cors_preflight_unknown_sites", cfg.CORSPreflightUnknown,
+		"failure_webhook", cfg.FailureWebhookURL != "",
+		"sanitize_csv", cfg.SanitizeCSV,
+		"admin_enabled", cfg.AdminToken != "",
+		"form_token_ttl", cfg.FormTokenTTL,
+		"reject_status_codes", cfg.RejectStatus,
+		"obscure_site_keys", cfg.ObscureSiteKeys,
+		"attachment_spool_kb", cfg.AttachmentSpoolKB,
+		"nats", cfg.NATSURL != "",
+		"nats_jetstream", cfg.NATSJetStream,
+		"signature_max_age", cfg.SignatureMaxAge,
+		"signature_clock_skew", cfg.SignatureClockSkew,
+		"metrics_enabled", cfg.MetricsEnabled,
+		"log_sample_threshold", cfg.LogSampleThreshold,
+		"log_sample_rate", cfg.LogSampleRate,
+		"maintenance_mode", cfg.MaintenanceMode,
+		"lazy_sites", cfg.LazySites,
+		"normalize_unicode", cfg.NormalizeUnicode,
+		"trim_fields", cfg.TrimFields,
+		"collapse_whitespace", cfg.CollapseWhitespace,
+		"detect_language", cfg.DetectLanguage,
+		"default_site", cfg.DefaultSiteKey,
+		"redact_pii", cfg.RedactPII,
+		"honeypot_fake_success", cfg.HoneypotFakeSuccess,
+		"blocked_user_agents", cfg.BlockedUserAgents.len(),
+		"dump_eml_dir", cfg.DumpEMLDir,
+		"clamav", cfg.ClamAVAddr != "",
+		"idempotency_ttl", cfg.IdempotencyTTL,
+		"idempotency_max_keys", cfg.IdempotencyMaxKeys,
+		"send_retry_503", cfg.SendRetry503,
+		"send_retry_after", cfg.SendRetryAfter,
+		"send_retry_after_max", cfg.SendRetryAfterMax,
+		"mx_timeout", cfg.MXTimeout,
+		"mx_cache_ttl", cfg.MXCacheTTL,
+		"sites", len(cfg.SiteKeys),
 	)
-	for _, site := range cfg.Sites {
-		if site == nil || site.SMTP == nil {
-			continue
+	for _, site := range cfg.loadedSites() {
+		var smtpCfg SmtpCfg // zero for sites that send no email
+		if site.SMTP != nil {
+			smtpCfg = *site.SMTP
 		}
 		logger.Info("site configuration",
 			"site", site.Key,
+			slog.Group("features", siteFeatures(cfg, site)...),
 			"to", site.To,
 			"allowed_origins", site.AllowedOrigins,
 			"subject_prefix", site.SubjectPrefix,
 			"from_addr", site.FromAddr,
-			"smtp_host", site.SMTP.Host,
-			"smtp_user", site.SMTP.User,
-			"smtp_port", site.SMTP.Port,
-			"smtp_ssl", site.SMTP.SSL,
-			"has_secret", site.Secret != "",
+			"from_strict", site.FromStrict,
+			"cc_submitter", site.CCSubmitter,
+			"bcc", site.BCC,
+			"bcc_max_kb", site.BCCMaxKB,
+			"bcc_oversize", site.BCCOversize,
+			"allow_submitter_subject", site.SubmitterSubject,
+			"sanitize_subject", site.SanitizeSubject,
+			"field_map", len(site.FieldMap),
+			"email_headers", len(site.EmailHeaders),
+			"text_template", site.TextTemplate != nil,
+			"html_template", site.HTMLTemplate != nil,
+			"thread_tag_fields", site.ThreadTagFields,
+			"field_types", len(site.FieldTypes),
+			"field_lengths", len(site.FieldLengths),
+			"allowed_fields", site.AllowedFields,
+			"strict_fields", site.StrictFields,
+			"validation_webhook", site.ValidationURL != "",
+			"validation_reject_status", site.ValidationStatus,
+			"validation_timeout", site.ValidationTimeout,
+			"validation_fail_open", site.ValidationFailOpen,
+			"smtp_host", smtpCfg.Host,
+			"smtp_user", smtpCfg.User,
+			"smtp_port", smtpCfg.Port,
+			"smtp_ssl", smtpCfg.SSL,
+			"smtp_auth", smtpCfg.Auth,
+			"smtp_client_cert", smtpCfg.ClientCert != nil,
+			"secrets", len(site.Secrets),
+			"signature_required", site.SignaturePolicy,
+			"api_keys", len(site.APIKeys),
+			"rate_limit_burst", site.RateBurst,
+			"send_burst", site.SendBurst,
+			"send_refill", cfg.sendRefillFor(site),
+			"email_cooldown", site.EmailCooldown,
+			"digest_interval", site.DigestInterval,
+			"warmup_days", site.WarmupDays,
+			"warmup_max_daily", site.WarmupMaxDaily,
+			"business_hours", site.BusinessHours.String(),
+			"require_token", site.RequireToken,
+			"encrypted_honeypot", site.HoneypotToken,
+			"submission_receipt", site.Receipts,
+			"blocked_user_agents", cfg.blockedUserAgentsFor(site).len(),
+			"delivery", site.Delivery,
+			"log_level", site.LogLevel,
+			"notify_only", site.NotifyOnly,
+			"shadow_sample_percent", site.ShadowPercent,
+			"delivery_fallback", len(site.Fallbacks),
+			"require_referer", site.RequireReferer,
+			"verify_mx", site.VerifyMX,
+			"allow_attachments", site.AllowAttachments,
+			"attachment_extensions", site.AllowedAttachmentExts,
+			"max_attachment_count", site.MaxAttachmentCount,
+			"max_attachment_total_kb", site.MaxAttachmentTotalKB,
+			"message_optional_with_attachment", site.MessageOptional,
+			"auto_reply", site.autoReplies(),
 		)
 	}
 }
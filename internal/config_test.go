@@ -0,0 +1,559 @@
+package form_mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jordan-wright/email"
+	"github.com/nazarhussain/form-courier/env"
+)
+
+func TestLoadSecurityHeaders(t *testing.T) {
+	t.Setenv("SECURITY_HEADERS_HSTS", "max-age=63072000")
+	t.Setenv("SECURITY_HEADERS_DISABLE", "x-xss-protection")
+
+	headers := loadSecurityHeaders(&env.Parser{})
+
+	if got := headers["Strict-Transport-Security"]; got != "max-age=63072000" {
+		t.Fatalf("unexpected HSTS header: %q", got)
+	}
+	if _, ok := headers["X-XSS-Protection"]; ok {
+		t.Fatal("expected X-XSS-Protection to be disabled")
+	}
+	if got := headers["X-Frame-Options"]; got != "DENY" {
+		t.Fatalf("expected default X-Frame-Options, got %q", got)
+	}
+
+	t.Setenv("SECURITY_HEADERS_DISABLE", "all")
+	if headers := loadSecurityHeaders(&env.Parser{}); len(headers) != 0 {
+		t.Fatalf("expected no headers, got %v", headers)
+	}
+}
+
+func TestConfigSiteLazyLoading(t *testing.T) {
+	t.Setenv("LAZY_ONE_TO", "one@example.com")
+
+	cfg := &Config{
+		SiteKeys:   []string{"lazy-one", "lazy-two"},
+		LazySites:  true,
+		globalSMTP: SmtpCfg{Host: "smtp.example.com", Port: 587, User: "user"},
+	}
+
+	if cfg.SiteLoaded("lazy-one") {
+		t.Fatal("expected site not to be loaded before first use")
+	}
+	cs, err := cfg.Site("lazy-one")
+	if err != nil {
+		t.Fatalf("load lazy site: %v", err)
+	}
+	if cs.To != "one@example.com" || cs.SMTP.Host != "smtp.example.com" {
+		t.Fatalf("unexpected site config: %+v", cs)
+	}
+	if !cfg.SiteLoaded("lazy-one") {
+		t.Fatal("expected site to be cached after first use")
+	}
+
+	if _, err := cfg.Site("lazy-two"); err == nil || err == errUnknownSite {
+		t.Fatalf("expected a config error for a site without _TO, got %v", err)
+	}
+	if _, err := cfg.Site("unlisted"); err != errUnknownSite {
+		t.Fatalf("expected errUnknownSite, got %v", err)
+	}
+}
+
+func TestLazySiteParseErrorIsMisconfigured(t *testing.T) {
+	setupTestConfig(t)
+	conf.Sites = nil
+	conf.LazySites = true
+	conf.SiteKeys = []string{"acme"}
+	conf.globalSMTP = SmtpCfg{Host: "smtp.example.com", Port: 587, User: "noreply@example.com"}
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return nil }
+	t.Setenv("ACME_TO", "ops@example.com")
+	t.Setenv("ACME_RATE_LIMIT_BURST", "lots")
+
+	rec := postContact(t)
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), "site misconfigured") {
+		t.Fatalf("expected site misconfigured, got %d %q", rec.Code, rec.Body.String())
+	}
+	if conf.SiteLoaded("acme") {
+		t.Fatal("expected the invalid site not to be cached")
+	}
+
+	t.Setenv("ACME_RATE_LIMIT_BURST", "3")
+	if rec := postContact(t); rec.Code != http.StatusOK {
+		t.Fatalf("expected the fixed site to load, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+// writeTestKeyPair writes a self-signed certificate and key to dir.
+func writeTestKeyPair(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "form-courier test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	_ = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	_ = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+func TestLoadSiteSMTPClientCert(t *testing.T) {
+	certFile, keyFile := writeTestKeyPair(t, t.TempDir())
+	t.Setenv("ACME_TO", "ops@example.com")
+	t.Setenv("ACME_SMTP_CLIENT_CERT", certFile)
+	t.Setenv("ACME_SMTP_CLIENT_KEY", keyFile)
+
+	cs, err := loadSiteFromEnv(nil, "acme", SmtpCfg{Host: "relay.internal", Port: 465}, "")
+	if err != nil {
+		t.Fatalf("load site: %v", err)
+	}
+	if cs.SMTP.ClientCert == nil {
+		t.Fatal("expected client certificate to be loaded")
+	}
+
+	t.Setenv("ACME_SMTP_CLIENT_KEY", "")
+	if _, err := loadSiteFromEnv(nil, "acme", SmtpCfg{}, ""); err == nil {
+		t.Fatal("expected an error when only the certificate is set")
+	}
+
+	t.Setenv("ACME_SMTP_CLIENT_KEY", certFile)
+	if _, err := loadSiteFromEnv(nil, "acme", SmtpCfg{}, ""); err == nil {
+		t.Fatal("expected an error for an invalid key pair")
+	}
+}
+
+func TestLoadSiteSMTPAuth(t *testing.T) {
+	t.Setenv("ACME_TO", "ops@example.com")
+	global := SmtpCfg{Host: "relay.internal", Port: 587, Auth: smtpAuthCRAMMD5}
+
+	cs, err := loadSiteFromEnv(nil, "acme", global, "")
+	if err != nil || cs.SMTP.Auth != smtpAuthCRAMMD5 {
+		t.Fatalf("expected the global mechanism, got %v, %v", cs, err)
+	}
+	t.Setenv("ACME_SMTP_AUTH", "LOGIN")
+	if cs, err = loadSiteFromEnv(nil, "acme", global, ""); err != nil || cs.SMTP.Auth != smtpAuthLogin {
+		t.Fatalf("expected the site's mechanism, got %v, %v", cs, err)
+	}
+	t.Setenv("ACME_SMTP_AUTH", "ntlm")
+	if _, err := loadSiteFromEnv(nil, "acme", global, ""); err == nil {
+		t.Fatal("expected an error for an unknown mechanism")
+	}
+}
+
+func TestLoadSiteShadowDelivery(t *testing.T) {
+	t.Setenv("ACME_TO", "ops@example.com")
+	t.Setenv("ACME_SHADOW_DELIVERY", "smtp")
+	global := SmtpCfg{Host: "relay.internal", Port: 587}
+
+	if _, err := loadSiteFromEnv(nil, "acme", global, ""); err == nil {
+		t.Fatal("expected an error for an smtp shadow without a host")
+	}
+
+	t.Setenv("ACME_SHADOW_SMTP_HOST", "email-smtp.eu-west-1.amazonaws.com")
+	t.Setenv("ACME_SHADOW_SMTP_USER", "AKIAEXAMPLE")
+	t.Setenv("ACME_SHADOW_SMTP_AUTH", "login")
+	t.Setenv("ACME_SHADOW_SAMPLE_PERCENT", "12.5")
+	t.Setenv("ACME_SHADOW_TO", "seed@example.com")
+	cs, err := loadSiteFromEnv(nil, "acme", global, "")
+	if err != nil {
+		t.Fatalf("load site: %v", err)
+	}
+	s := cs.Shadow
+	if s == nil || !s.shadow || s.SMTP.Host != "email-smtp.eu-west-1.amazonaws.com" || s.SMTP.Port != 587 || s.To != "seed@example.com" || cs.ShadowPercent != 12.5 {
+		t.Fatalf("unexpected shadow: %+v (%v%%)", s, cs.ShadowPercent)
+	}
+	if s.SMTP.User != "AKIAEXAMPLE" || s.SMTP.Auth != smtpAuthLogin {
+		t.Fatalf("expected the shadow's credentials and mechanism, got %+v", s.SMTP)
+	}
+	if cs.SMTP.Host != "relay.internal" || cs.shadow {
+		t.Fatal("the site itself must keep its own delivery")
+	}
+
+	certFile, keyFile := writeTestKeyPair(t, t.TempDir())
+	t.Setenv("ACME_SHADOW_SMTP_CLIENT_CERT", certFile)
+	t.Setenv("ACME_SHADOW_SMTP_CLIENT_KEY", keyFile)
+	if cs, err = loadSiteFromEnv(nil, "acme", global, ""); err != nil || cs.Shadow.SMTP.ClientCert == nil || cs.SMTP.ClientCert != nil {
+		t.Fatalf("expected a client certificate on the shadow only, err %v", err)
+	}
+	t.Setenv("ACME_SHADOW_SMTP_CLIENT_KEY", "")
+	if _, err := loadSiteFromEnv(nil, "acme", global, ""); err == nil {
+		t.Fatal("expected an error for a shadow certificate without a key")
+	}
+	t.Setenv("ACME_SHADOW_SMTP_CLIENT_CERT", "")
+
+	for _, bad := range []string{"0", "101", "half"} {
+		t.Setenv("ACME_SHADOW_SAMPLE_PERCENT", bad)
+		if _, err := loadSiteFromEnv(nil, "acme", global, ""); err == nil {
+			t.Errorf("expected sample percent %q to be rejected", bad)
+		}
+	}
+}
+
+func TestLoadSiteDeliveryFallback(t *testing.T) {
+	t.Setenv("ACME_TO", "ops@example.com")
+	t.Setenv("ACME_DELIVERY_FALLBACK", "smtp,nats")
+	t.Setenv("NATS_URL", "nats://127.0.0.1:4222")
+	t.Setenv("ACME_SMTP_HOST", "relay.internal")
+	t.Setenv("ACME_SMTP_USER", "site-user")
+	t.Setenv("ACME_SMTP_AUTH", "login")
+	global := SmtpCfg{Host: "relay.internal", Port: 587, User: "global-user", Pass: "global-pass"}
+
+	if _, err := loadSiteFromEnv(nil, "acme", global, ""); err == nil {
+		t.Fatal("expected an error for an smtp fallback on the same server")
+	}
+
+	t.Setenv("ACME_FALLBACK_SMTP_HOST", "backup.example.com")
+	cs, err := loadSiteFromEnv(nil, "acme", global, "")
+	if err != nil {
+		t.Fatalf("load site: %v", err)
+	}
+	if len(cs.Fallbacks) != 2 || cs.Fallbacks[0].SMTP.Host != "backup.example.com" || cs.Fallbacks[0].SMTP.Port != 587 ||
+		cs.Fallbacks[1].Delivery != deliveryNATS || cs.SMTP.Host != "relay.internal" {
+		t.Fatalf("unexpected fallbacks: %+v", cs.Fallbacks)
+	}
+	if fb := cs.Fallbacks[0].SMTP; fb.User != "site-user" || fb.Pass != "global-pass" || fb.Auth != smtpAuthLogin {
+		t.Fatalf("expected the fallback server to inherit the site's credentials, got %+v", fb)
+	}
+
+	t.Setenv("ACME_FALLBACK_SMTP_USER", "backup-user")
+	t.Setenv("ACME_FALLBACK_SMTP_AUTH", "cram-md5")
+	if cs, err = loadSiteFromEnv(nil, "acme", global, ""); err != nil {
+		t.Fatalf("load site: %v", err)
+	}
+	if fb := cs.Fallbacks[0].SMTP; fb.User != "backup-user" || fb.Auth != smtpAuthCRAMMD5 {
+		t.Fatalf("expected the fallback's own settings, got %+v", fb)
+	}
+
+	for _, bad := range []string{"echo", "smtp,echo", "nats,nats", "smtp,smtp", "carrier-pigeon"} {
+		t.Setenv("ACME_DELIVERY_FALLBACK", bad)
+		if _, err := loadSiteFromEnv(nil, "acme", global, ""); err == nil {
+			t.Errorf("expected fallback %q to be rejected", bad)
+		}
+	}
+}
+
+func TestLoadSiteSignatureRequired(t *testing.T) {
+	t.Setenv("ACME_TO", "ops@example.com")
+	t.Setenv("ACME_SECRET", "s3cret")
+	t.Setenv("ACME_ALLOWED_ORIGINS", "https://widget.example.com")
+
+	cs, err := loadSiteFromEnv(nil, "acme", SmtpCfg{Host: "relay.internal", Port: 587}, "")
+	if err != nil || cs.SignaturePolicy != signRequireAlways {
+		t.Fatalf("expected the default policy %q, got %+v, %v", signRequireAlways, cs, err)
+	}
+	t.Setenv("ACME_SIGNATURE_REQUIRED", "no_origin")
+	if cs, err = loadSiteFromEnv(nil, "acme", SmtpCfg{Host: "relay.internal", Port: 587}, ""); err != nil || cs.SignaturePolicy != signRequireNoOrigin {
+		t.Fatalf("expected %q, got %+v, %v", signRequireNoOrigin, cs, err)
+	}
+
+	t.Setenv("ACME_ALLOWED_ORIGINS", "*")
+	if _, err := loadSiteFromEnv(nil, "acme", SmtpCfg{Host: "relay.internal", Port: 587}, ""); err == nil {
+		t.Fatal("expected an error for no_origin with a wildcard origin")
+	}
+	t.Setenv("ACME_ALLOWED_ORIGINS", "https://widget.example.com")
+	t.Setenv("ACME_SECRET", "")
+	if _, err := loadSiteFromEnv(nil, "acme", SmtpCfg{Host: "relay.internal", Port: 587}, ""); err == nil {
+		t.Fatal("expected an error for no_origin without a secret")
+	}
+	t.Setenv("ACME_SIGNATURE_REQUIRED", "sometimes")
+	if _, err := loadSiteFromEnv(nil, "acme", SmtpCfg{Host: "relay.internal", Port: 587}, ""); err == nil {
+		t.Fatal("expected an error for an unknown policy")
+	}
+}
+
+func TestLoadSiteFromAddrPrecedence(t *testing.T) {
+	global := SmtpCfg{Host: "smtp.example.com", Port: 587, User: "global@example.com"}
+
+	cases := []struct {
+		name     string
+		siteFrom string
+		from     string
+		siteHost string
+		siteUser string
+		want     string
+	}{
+		{"global smtp user", "", "", "", "", "global@example.com"},
+		{"site smtp user", "", "", "relay.example.com", "site-user@example.com", "site-user@example.com"},
+		{"site smtp host without user", "", "", "relay.example.com", "", "global@example.com"},
+		{"global from", "", "from@example.com", "relay.example.com", "site-user@example.com", "from@example.com"},
+		{"site from", "site-from@example.com", "from@example.com", "relay.example.com", "site-user@example.com", "site-from@example.com"},
+		{"site from without global from", "site-from@example.com", "", "", "", "site-from@example.com"},
+		{"blank values are ignored", "  ", " ", "", "", "global@example.com"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("ACME_TO", "ops@example.com")
+			t.Setenv("ACME_FROM_ADDR", tc.siteFrom)
+			t.Setenv("FROM_ADDR", tc.from)
+			t.Setenv("ACME_SMTP_HOST", tc.siteHost)
+			t.Setenv("ACME_SMTP_USER", tc.siteUser)
+
+			cs, err := loadSiteFromEnv(nil, "acme", global, "")
+			if err != nil {
+				t.Fatalf("load site: %v", err)
+			}
+			if cs.FromAddr != tc.want {
+				t.Fatalf("FromAddr = %q, want %q", cs.FromAddr, tc.want)
+			}
+		})
+	}
+}
+
+var relaySMTP = SmtpCfg{Host: "smtp.example.com", Port: 587, User: "relay@example.com"}
+
+func TestLoadSiteRequiresSMTPServer(t *testing.T) {
+	t.Setenv("NOSMTP_TO", "ops@example.com")
+	if _, err := loadSiteFromEnv(nil, "nosmtp", SmtpCfg{}, ""); err == nil || !strings.Contains(err.Error(), "NOSMTP_SMTP_HOST") {
+		t.Fatalf("expected a startup error naming the site, got %v", err)
+	}
+
+	t.Setenv("NOSMTP_SMTP_HOST", "smtp.example.com")
+	if _, err := loadSiteFromEnv(nil, "nosmtp", SmtpCfg{}, ""); err == nil || !strings.Contains(err.Error(), "NOSMTP_SMTP_PORT") {
+		t.Fatalf("expected a missing port error, got %v", err)
+	}
+	t.Setenv("NOSMTP_SMTP_PORT", "587")
+	if _, err := loadSiteFromEnv(nil, "nosmtp", SmtpCfg{}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// A NATS-only site doesn't need a server at all.
+	t.Setenv("NOSMTP_SMTP_HOST", "")
+	t.Setenv("NATS_URL", "nats://127.0.0.1:4222")
+	t.Setenv("NOSMTP_DELIVERY", "nats")
+	cs, err := loadSiteFromEnv(nil, "nosmtp", SmtpCfg{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.SMTP != nil {
+		t.Fatalf("expected no SMTP config, got %+v", cs.SMTP)
+	}
+}
+
+func TestLoadSiteFromStrictRequiresFromAddr(t *testing.T) {
+	t.Setenv("STRICT_TO", "ops@example.com")
+	t.Setenv("STRICT_FROM_STRICT", "true")
+	if _, err := loadSiteFromEnv(nil, "strict", relaySMTP, ""); err == nil {
+		t.Fatal("expected an error without STRICT_FROM_ADDR")
+	}
+
+	t.Setenv("STRICT_FROM_ADDR", "forms@example.com")
+	cs, err := loadSiteFromEnv(nil, "strict", relaySMTP, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cs.FromStrict || cs.FromAddr != "forms@example.com" {
+		t.Fatalf("FromStrict=%v FromAddr=%q", cs.FromStrict, cs.FromAddr)
+	}
+}
+
+func TestLoadSiteEmailHeaders(t *testing.T) {
+	t.Setenv("HDR_TO", "ops@example.com")
+	t.Setenv("HDR_EMAIL_HEADERS", "x-environment=prod, X-Site-Key=acme-web")
+	cs, err := loadSiteFromEnv(nil, "hdr", relaySMTP, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, _ := composeEmail(cs, "id-1", "198.51.100.7", ContactRequest{Name: "Jane", Email: "jane@example.org", Message: "hi"})
+	if got := e.Headers.Get("X-Environment"); got != "prod" {
+		t.Fatalf("X-Environment = %q", got)
+	}
+	if got := e.Headers.Get("X-Site-Key"); got != "acme-web" {
+		t.Fatalf("X-Site-Key = %q", got)
+	}
+	if got := e.Headers.Get("X-Submission-ID"); got != "id-1" {
+		t.Fatalf("X-Submission-ID = %q", got)
+	}
+
+	for _, bad := range []string{"X-Env=prod\rBcc: x@example.com", "X Env=prod", "Bcc=x@example.com", "X-Submission-ID=1"} {
+		t.Setenv("HDR_EMAIL_HEADERS", bad)
+		if _, err := loadSiteFromEnv(nil, "hdr", relaySMTP, ""); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestLoadSiteAllowedFields(t *testing.T) {
+	t.Setenv("AF_TO", "ops@example.com")
+	t.Setenv("AF_ALLOWED_FIELDS", "name,email,message,phone")
+	cs, err := loadSiteFromEnv(nil, "af", relaySMTP, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cs.StrictFields || len(cs.AllowedFields) != 4 {
+		t.Fatalf("StrictFields=%v AllowedFields=%v", cs.StrictFields, cs.AllowedFields)
+	}
+
+	t.Setenv("AF_FIELD_TYPES", "budget=int")
+	if _, err := loadSiteFromEnv(nil, "af", relaySMTP, ""); err == nil {
+		t.Fatal("expected a typed field outside the allowlist to be rejected")
+	}
+}
+
+func TestLogConfigSiteFeatures(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	cfg := &Config{Sites: map[string]*SiteCfg{
+		"acme": {Key: "acme", Secrets: []string{"s3cret-value"}, AutoReplyText: "Thanks!", Delivery: deliverySMTP},
+	}}
+	LogConfig(logger, cfg)
+
+	out := buf.String()
+	for _, want := range []string{"features.has_secret=true", "features.auto_reply=true", "features.form_token=false", "features.nats=false"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %s in:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "s3cret-value") {
+		t.Fatalf("secret leaked into the log:\n%s", out)
+	}
+}
+
+func TestReloadConfigKeepsCurrentOnError(t *testing.T) {
+	setupTestConfig(t)
+	prev := conf
+	t.Setenv("SITES", "acme")
+	t.Setenv("ACME_TO", "ops@example.com")
+	t.Setenv("SMTP_HOST", "relay.internal")
+	t.Setenv("SMTP_PORT", "587")
+	t.Setenv("SMTP_USER", "user")
+	t.Setenv("SMTP_PASS", "pass")
+	t.Setenv("RATE_LIMIT_BURST", "lots")
+	t.Setenv("ACME_SEND_BURST", "many")
+
+	_, err := ReloadConfig()
+	if err == nil {
+		t.Fatal("expected an invalid configuration to fail the reload")
+	}
+	for _, want := range []string{"RATE_LIMIT_BURST", "ACME_SEND_BURST"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected the error to mention %s, got %v", want, err)
+		}
+	}
+	if GetConfig() != prev {
+		t.Fatal("expected the running configuration to stay in place")
+	}
+
+	t.Setenv("RATE_LIMIT_BURST", "5")
+	t.Setenv("ACME_SEND_BURST", "2")
+	cfg, err := ReloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if GetConfig() != cfg || cfg.RateBurst != 5 {
+		t.Fatalf("expected the reloaded configuration to be in use, got %+v", cfg)
+	}
+}
+
+func TestReloadConfigKeepsRandomTokenSecret(t *testing.T) {
+	setupTestConfig(t)
+	t.Setenv("SITES", "acme")
+	t.Setenv("ACME_TO", "ops@example.com")
+	t.Setenv("SMTP_HOST", "relay.internal")
+	t.Setenv("SMTP_PORT", "587")
+	t.Setenv("SMTP_USER", "user")
+	t.Setenv("SMTP_PASS", "pass")
+	t.Setenv("FORM_TOKEN_SECRET", "")
+
+	first, err := ReloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ReloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.FormTokenSecret, second.FormTokenSecret) {
+		t.Fatal("expected the random form token secret to survive the reload")
+	}
+
+	t.Setenv("FORM_TOKEN_SECRET", "k")
+	third, err := ReloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(third.FormTokenSecret) != "k" {
+		t.Fatalf("expected FORM_TOKEN_SECRET to win, got %q", third.FormTokenSecret)
+	}
+}
+
+func TestReloadConfigReadsEnvFileSnapshot(t *testing.T) {
+	setupTestConfig(t)
+	t.Setenv("SITES", "acme")
+	t.Setenv("ACME_TO", "ops@example.com")
+	t.Setenv("SMTP_HOST", "relay.internal")
+	t.Setenv("SMTP_PORT", "587")
+	t.Setenv("SMTP_USER", "user")
+	t.Setenv("SMTP_PASS", "pass")
+	t.Setenv("LAZY_SITES", "true")
+	path := filepath.Join(t.TempDir(), "courier.env")
+	t.Setenv("ENV_FILE", path)
+	write := func(src string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(src), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("MAINTENANCE_MODE=true\n")
+	cfg, err := ReloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.MaintenanceMode {
+		t.Fatal("expected maintenance mode from ENV_FILE")
+	}
+	if os.Getenv("MAINTENANCE_MODE") != "" {
+		t.Fatal("expected ENV_FILE to leave the process environment alone")
+	}
+
+	// A rejected reload changes nothing, lazy sites included
+	write("ACME_TO=new@example.com\nRATE_LIMIT_BURST=lots\n")
+	if _, err := ReloadConfig(); err == nil {
+		t.Fatal("expected an invalid ENV_FILE to fail the reload")
+	}
+	cs, err := GetConfig().Site("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !GetConfig().MaintenanceMode || cs.To != "ops@example.com" {
+		t.Fatalf("expected the validated snapshot to stay in use, got maintenance=%v to=%s", GetConfig().MaintenanceMode, cs.To)
+	}
+
+	// Removing the line turns maintenance mode off again
+	write("# back in service\n")
+	if cfg, err = ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaintenanceMode {
+		t.Fatal("expected maintenance mode off once removed from ENV_FILE")
+	}
+}
@@ -0,0 +1,100 @@
+package form_mailer
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// <SITE>_EMAIL_COOLDOWN_MINUTES: after a delivered submission, the same
+// submitter email can't submit to the site again until the cooldown has
+// passed, however many rate-limit tokens its IP has left. Only delivered
+// submissions start a cooldown, so a rejected or failed one can be fixed
+// and sent again straight away.
+//
+// A submission that passes the check holds the address until it is
+// delivered or refused, so two concurrent submissions from one address
+// can't both get through.
+
+var (
+	lastSubmissionMu sync.Mutex
+	lastSubmission   = map[string]time.Time{} // site + "\x00" + email -> cooldown end
+	cooldownSweepAt  = minCooldownSweep
+)
+
+// minCooldownSweep is the number of cooldowns from which holding a new one
+// starts dropping the expired ones.
+const minCooldownSweep = 1024
+
+func cooldownKey(cs *SiteCfg, addr string) string {
+	return cs.Key + "\x00" + strings.ToLower(strings.TrimSpace(addr))
+}
+
+// cooldownHold is an address held by a submission in flight. A nil hold
+// (no cooldown configured) does nothing.
+type cooldownHold struct {
+	key      string
+	until    time.Time
+	cooldown time.Duration
+	started  bool
+}
+
+// holdEmailCooldown returns how long addr must still wait before
+// submitting to cs again or, when it needn't, holds the address for this
+// submission. The caller starts the cooldown on delivery and releases the
+// hold otherwise.
+func holdEmailCooldown(cs *SiteCfg, addr string, now time.Time) (*cooldownHold, time.Duration) {
+	if cs.EmailCooldown <= 0 {
+		return nil, 0
+	}
+	key := cooldownKey(cs, addr)
+	lastSubmissionMu.Lock()
+	defer lastSubmissionMu.Unlock()
+	if until, ok := lastSubmission[key]; ok && now.Before(until) {
+		return nil, until.Sub(now)
+	}
+	if len(lastSubmission) >= cooldownSweepAt {
+		sweepCooldowns(now)
+	}
+	// Held for a full cooldown, so a submission that never finishes
+	// doesn't lock the address out for good
+	h := &cooldownHold{key: key, until: now.Add(cs.EmailCooldown), cooldown: cs.EmailCooldown}
+	lastSubmission[key] = h.until
+	return h, 0
+}
+
+// sweepCooldowns drops the expired cooldowns, amortized over the holds
+// that grow the map. Callers hold lastSubmissionMu.
+func sweepCooldowns(now time.Time) {
+	for k, until := range lastSubmission {
+		if !now.Before(until) {
+			delete(lastSubmission, k)
+		}
+	}
+	cooldownSweepAt = max(minCooldownSweep, 2*len(lastSubmission))
+}
+
+// start begins the cooldown for a delivered submission.
+func (h *cooldownHold) start(now time.Time) {
+	if h == nil {
+		return
+	}
+	lastSubmissionMu.Lock()
+	defer lastSubmissionMu.Unlock()
+	h.started = true
+	h.until = now.Add(h.cooldown)
+	lastSubmission[h.key] = h.until
+}
+
+// release gives back the hold of a submission that wasn't delivered. It
+// does nothing once the cooldown has started.
+func (h *cooldownHold) release() {
+	if h == nil || h.started {
+		return
+	}
+	lastSubmissionMu.Lock()
+	defer lastSubmissionMu.Unlock()
+	if lastSubmission[h.key].Equal(h.until) {
+		delete(lastSubmission, h.key)
+	}
+}
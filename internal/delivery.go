@@ -0,0 +1,70 @@
+package form_mailer
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+
+	"github.com/jordan-wright/email"
+)
+
+// Delivery backends, chosen per site with <SITE>_DELIVERY.
+const (
+	deliverySMTP = "smtp"
+	deliveryNATS = "nats"
+	deliveryEcho = "echo"
+)
+
+// deliverWithFallback delivers through the site's backend and, when that
+// fails, through each <SITE>_DELIVERY_FALLBACK backend in turn until one
+// succeeds. It returns the backend that delivered, or the last one tried
+// and its error when none did.
+func deliverWithFallback(ctx context.Context, logger *slog.Logger, cfg *Config, cs *SiteCfg, sub *Submission, atts []attachment, e *email.Email) (string, error) {
+	err := deliver(ctx, logger, cfg, cs, sub, atts, e)
+	backend := cs.Delivery
+	for _, fb := range cs.Fallbacks {
+		if err == nil {
+			break
+		}
+		logger.Warn("delivery failed, trying fallback", "backend", backend, "fallback", fb.Delivery, "err", err)
+		ec := *e
+		err = deliver(ctx, logger, cfg, fb, sub, atts, &ec)
+		backend = fb.Delivery
+		outcome := "ok"
+		if err != nil {
+			outcome = "error"
+		}
+		deliveryFallbacks.Inc(cs.Key, backend, outcome)
+	}
+	return backend, err
+}
+
+// deliver hands a validated submission to the site's backend: the composed
+// email over SMTP (or to the echo buffer), or the JSON envelope to NATS for
+// a downstream consumer.
+//
+// <SITE>_NOTIFY_ONLY sites get both: the submission is published and e, a
+// content-free notice, is emailed. Once the publish succeeded the submission
+// is safe, so a failed notice is only logged rather than failing a request
+// the client might then retry.
+func deliver(ctx context.Context, logger *slog.Logger, cfg *Config, cs *SiteCfg, sub *Submission, atts []attachment, e *email.Email) error {
+	if cs.Delivery != deliveryNATS && !cs.NotifyOnly {
+		return sendTeamMail(ctx, logger, cfg, cs, e)
+	}
+	if err := sub.attach(atts); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(sub.exported(cfg))
+	if err != nil {
+		return err
+	}
+	if err := publishNATSFunc(cfg.NATSURL, natsSubject(cs.NATSSubject, cs.Key), payload, cfg.NATSJetStream, cfg.NATSTimeout); err != nil {
+		return err
+	}
+	if cs.NotifyOnly {
+		if err := sendTeamMail(ctx, logger, cfg, cs, e); err != nil {
+			logger.Error("notice email failed", "err", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package form_mailer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/jordan-wright/email"
+)
+
+func TestHandleContactDeliveryFallback(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	cs := conf.Sites["acme"]
+	backup := *cs
+	backup.Delivery, backup.SMTP = deliverySMTP, &SmtpCfg{Host: "backup.example.com", Port: 587}
+	cs.Fallbacks = []*SiteCfg{&backup}
+
+	var tried []string
+	down := map[string]bool{"smtp.example.com": true}
+	sendEmailFunc = func(_ context.Context, site *SiteCfg, e *email.Email) error {
+		tried = append(tried, site.SMTP.Host)
+		if down[site.SMTP.Host] {
+			return errors.New("421 service not available")
+		}
+		return nil
+	}
+
+	if rec := postContact(t); rec.Code != http.StatusOK {
+		t.Fatalf("expected the fallback to deliver, got %d", rec.Code)
+	}
+	if len(tried) != 2 || tried[1] != "backup.example.com" {
+		t.Fatalf("unexpected attempts: %v", tried)
+	}
+
+	tried = nil
+	down["backup.example.com"] = true
+	if rec := postContact(t); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500 once every backend failed, got %d", rec.Code)
+	}
+	if len(tried) != 2 {
+		t.Fatalf("unexpected attempts: %v", tried)
+	}
+}
@@ -0,0 +1,291 @@
+package form_mailer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jordan-wright/email"
+)
+
+// Digest mode (<SITE>_DIGEST_INTERVAL): instead of one email per
+// submission, a site's submissions are buffered and mailed together once
+// the oldest has waited the interval. The buffer is written to
+// DIGEST_STATE_FILE before the submitter is told it succeeded, so a restart
+// or crash loses nothing, and a graceful shutdown flushes it. The digest is
+// plain text; digest sites take no attachments.
+
+// digestCheckEvery is how often RunDigests looks for due digests.
+const digestCheckEvery = time.Minute
+
+type digestEntry struct {
+	SubmissionID string    `json:"submission_id"`
+	ReceivedAt   time.Time `json:"received_at"`
+	Subject      string    `json:"subject"`
+	Text         string    `json:"text"`
+}
+
+type digestBuffer struct {
+	Since   time.Time // when the oldest entry arrived
+	Entries []digestEntry
+}
+
+var (
+	digestMu sync.Mutex
+	digests  = map[string]*digestBuffer{}
+
+	// digestFlushMu lets one FlushDigests run at a time, so the ticker and a
+	// shutdown can't both send the same digest.
+	digestFlushMu sync.Mutex
+)
+
+// digestRecord is a line of DIGEST_STATE_FILE: one buffered submission.
+// Buffering appends a line; a flush rewrites the file with what is left.
+type digestRecord struct {
+	Site string `json:"site"`
+	digestEntry
+}
+
+// bufferDigest adds the team email e for a submission to cs's digest,
+// appending it to the state file first. When that fails the error is
+// returned, so the submission isn't acknowledged without being kept.
+func bufferDigest(cfg *Config, cs *SiteCfg, submissionID string, e *email.Email) error {
+	now := nowFunc().UTC()
+	en := digestEntry{
+		SubmissionID: submissionID,
+		ReceivedAt:   now,
+		Subject:      e.Subject,
+		Text:         string(e.Text),
+	}
+	digestMu.Lock()
+	defer digestMu.Unlock()
+	if err := appendDigestLocked(cfg.DigestStateFile, cs.Key, en); err != nil {
+		return err
+	}
+	b, ok := digests[cs.Key]
+	if !ok {
+		b = &digestBuffer{Since: now}
+		digests[cs.Key] = b
+	}
+	b.Entries = append(b.Entries, en)
+	return nil
+}
+
+// composeDigest builds the combined email for entries.
+func composeDigest(cs *SiteCfg, since time.Time, entries []digestEntry) *email.Email {
+	e := email.NewEmail()
+	e.From = cs.FromAddr
+	e.To = []string{cs.To}
+	noun := "submissions"
+	if len(entries) == 1 {
+		noun = "submission"
+	}
+	e.Subject = strings.TrimSpace(fmt.Sprintf("%s Digest: %d %s", cs.SubjectPrefix, len(entries), noun))
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d %s to %s since %s.\n", len(entries), noun, cs.Key, since.UTC().Format(time.RFC3339))
+	for i, en := range entries {
+		fmt.Fprintf(&b, "\n--- %d/%d: %s (%s, %s) ---\n\n", i+1, len(entries), en.Subject,
+			en.SubmissionID, en.ReceivedAt.UTC().Format(time.RFC3339))
+		b.WriteString(strings.TrimRight(en.Text, "\n"))
+		b.WriteString("\n")
+	}
+	e.Text = []byte(b.String())
+	setEmailHeaders(e, cs, newSubmissionID())
+	e.Headers.Set("X-Digest-Count", fmt.Sprint(len(entries)))
+	return e
+}
+
+// FlushDigests mails every digest whose oldest entry has waited its site's
+// interval, or every digest when all is set, as on shutdown. A digest goes
+// through the same send limits and warmup as a single email; one held back
+// by them, or that fails to send, is kept whole for the next try, and
+// submissions buffered meanwhile join it.
+func FlushDigests(ctx context.Context, logger *slog.Logger, all bool) {
+	cfg := GetConfig()
+	now := nowFunc()
+	digestFlushMu.Lock()
+	defer digestFlushMu.Unlock()
+
+	digestMu.Lock()
+	due := map[string]digestBuffer{}
+	for key, b := range digests {
+		cs, err := cfg.Site(key)
+		if err != nil {
+			logger.Warn("digest kept for unavailable site", "site", key, "entries", len(b.Entries), "err", err)
+			continue
+		}
+		if all || cs.DigestInterval <= 0 || !now.Before(b.Since.Add(cs.DigestInterval)) {
+			due[key] = digestBuffer{Since: b.Since, Entries: slices.Clone(b.Entries)}
+		}
+	}
+	digestMu.Unlock()
+
+	sent := 0
+	for key, b := range due {
+		cs, _ := cfg.Site(key)
+		logger := logger.With("site", key)
+		taken, rej := checkSendBudget(logger, cfg, &RequestInfo{}, cs)
+		if rej != nil {
+			logger.Info("digest held back", "reason_code", rej.reason, "entries", len(b.Entries))
+			continue
+		}
+		e := composeDigest(cs, b.Since, b.Entries)
+		if err := sendTeamMail(ctx, logger, cfg, cs, e); err != nil {
+			refundSendBudget(logger, cfg, cs, taken)
+			logger.Error("digest send failed", "entries", len(b.Entries), "err", err)
+			continue
+		}
+		logger.Info("digest sent", "entries", len(b.Entries), "digest_id", e.Headers.Get("X-Submission-ID"))
+		digestMu.Lock()
+		dropDigestEntriesLocked(key, len(b.Entries))
+		digestMu.Unlock()
+		sent++
+	}
+
+	if sent > 0 {
+		digestMu.Lock()
+		err := saveDigestsLocked(cfg.DigestStateFile)
+		digestMu.Unlock()
+		if err != nil {
+			logger.Error("saving digest state failed", "err", err)
+		}
+	}
+}
+
+// dropDigestEntriesLocked removes the n oldest entries of key's digest once
+// they are sent. Callers hold digestMu.
+func dropDigestEntriesLocked(key string, n int) {
+	b, ok := digests[key]
+	if !ok {
+		return
+	}
+	b.Entries = slices.Delete(b.Entries, 0, min(n, len(b.Entries)))
+	if len(b.Entries) == 0 {
+		delete(digests, key)
+		return
+	}
+	b.Since = b.Entries[0].ReceivedAt
+}
+
+// RunDigests flushes due digests every minute until ctx is done.
+func RunDigests(ctx context.Context, logger *slog.Logger) {
+	t := time.NewTicker(digestCheckEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			FlushDigests(ctx, logger, false)
+		}
+	}
+}
+
+func appendDigestLocked(path, site string, en digestEntry) error {
+	if path == "" {
+		return nil
+	}
+	line, err := json.Marshal(digestRecord{Site: site, digestEntry: en})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if err == nil {
+		// On disk before the submitter hears it was accepted
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// saveDigestsLocked rewrites the state file with the buffered entries.
+func saveDigestsLocked(path string) error {
+	if path == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, site := range slices.Sorted(maps.Keys(digests)) {
+		for _, en := range digests[site].Entries {
+			if err := enc.Encode(digestRecord{Site: site, digestEntry: en}); err != nil {
+				return err
+			}
+		}
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadDigests restores the digest buffers saved at path and returns how
+// many submissions they hold. A last line cut short by a crash mid-append
+// is dropped, and the file rewritten without it so the next append doesn't
+// run on from it; that submission was never acknowledged. On any other
+// error, including a missing file, the current buffers are kept.
+func LoadDigests(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	state := map[string]*digestBuffer{}
+	n, torn := 0, false
+	for i, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var rec digestRecord
+		if err := json.Unmarshal(line, &rec); err != nil || rec.Site == "" {
+			if !bytes.HasSuffix(line, []byte("\n")) {
+				torn = true
+				break
+			}
+			return 0, fmt.Errorf("corrupt digest state %s, line %d", path, i+1)
+		}
+		b, ok := state[rec.Site]
+		if !ok {
+			b = &digestBuffer{Since: rec.ReceivedAt}
+			state[rec.Site] = b
+		}
+		b.Entries = append(b.Entries, rec.digestEntry)
+		n++
+	}
+	digestMu.Lock()
+	defer digestMu.Unlock()
+	if torn {
+		prev := digests
+		digests = state
+		if err := saveDigestsLocked(path); err != nil {
+			digests = prev
+			return 0, fmt.Errorf("dropping the torn end of %s: %w", path, err)
+		}
+	}
+	digests = state
+	return n, nil
+}
@@ -0,0 +1,180 @@
+package form_mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jordan-wright/email"
+)
+
+func TestDigestBufferAndFlush(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.DigestStateFile = filepath.Join(t.TempDir(), "digest.json")
+	conf.Sites["acme"].DigestInterval = time.Hour
+	clock := useFakeClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	t.Cleanup(func() {
+		digestMu.Lock()
+		digests = map[string]*digestBuffer{}
+		digestMu.Unlock()
+	})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var sent []*email.Email
+	var fail bool
+	sendEmailFunc = func(_ context.Context, _ *SiteCfg, e *email.Email) error {
+		if fail {
+			return errors.New("smtp down")
+		}
+		sent = append(sent, e)
+		return nil
+	}
+
+	for range 2 {
+		if rec := postContact(t); rec.Code != http.StatusOK {
+			t.Fatalf("expected buffering to answer 200, got %d: %s", rec.Code, rec.Body)
+		}
+		clock.Advance(10 * time.Minute)
+	}
+	if len(sent) != 0 {
+		t.Fatalf("expected nothing sent while buffering, got %d emails", len(sent))
+	}
+
+	// A restart keeps the buffer
+	digestMu.Lock()
+	digests = map[string]*digestBuffer{}
+	digestMu.Unlock()
+	if n, err := LoadDigests(conf.DigestStateFile); err != nil || n != 2 {
+		t.Fatalf("LoadDigests = %d, %v", n, err)
+	}
+
+	FlushDigests(t.Context(), logger, false)
+	if len(sent) != 0 {
+		t.Fatal("expected no digest before the interval")
+	}
+
+	clock.Advance(40 * time.Minute)
+	fail = true
+	FlushDigests(t.Context(), logger, false)
+	fail = false
+	if rec := postContact(t); rec.Code != http.StatusOK {
+		t.Fatalf("expected buffering to answer 200, got %d", rec.Code)
+	}
+	FlushDigests(t.Context(), logger, false)
+	if len(sent) != 1 {
+		t.Fatalf("expected one digest after the failed try, got %d", len(sent))
+	}
+	e := sent[0]
+	if e.Subject != "[Contact] Digest: 3 submissions" || e.Headers.Get("X-Digest-Count") != "3" {
+		t.Fatalf("unexpected digest: %q, count %q", e.Subject, e.Headers.Get("X-Digest-Count"))
+	}
+	if strings.Count(string(e.Text), "--- ") != 3 || !strings.Contains(string(e.Text), "alice@example.com") {
+		t.Fatalf("unexpected digest body:\n%s", e.Text)
+	}
+
+	// Shutdown flushes whatever is left
+	if rec := postContact(t); rec.Code != http.StatusOK {
+		t.Fatalf("expected buffering to answer 200, got %d", rec.Code)
+	}
+	FlushDigests(t.Context(), logger, true)
+	if len(sent) != 2 || sent[1].Subject != "[Contact] Digest: 1 submission" {
+		t.Fatalf("expected the shutdown flush to send the last submission, got %d emails", len(sent))
+	}
+	if n, err := LoadDigests(conf.DigestStateFile); err != nil || n != 0 {
+		t.Fatalf("expected the saved buffer empty, got %d, %v", n, err)
+	}
+}
+
+func TestFlushDigestsThroughSendLimits(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.DigestStateFile = filepath.Join(t.TempDir(), "digest.json")
+	conf.GlobalSendRate = 1
+	conf.Sites["acme"].DigestInterval = time.Hour
+	clock := useFakeClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	globalSend = &sendRate{}
+	t.Cleanup(func() {
+		digestMu.Lock()
+		digests = map[string]*digestBuffer{}
+		digestMu.Unlock()
+		globalSend = &sendRate{}
+	})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	sent := 0
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { sent++; return nil }
+
+	for range 2 {
+		if rec := postContact(t); rec.Code != http.StatusOK {
+			t.Fatalf("expected buffering to answer 200, got %d: %s", rec.Code, rec.Body)
+		}
+	}
+	// One line appended per submission
+	data, err := os.ReadFile(conf.DigestStateFile)
+	if err != nil || bytes.Count(data, []byte("\n")) != 2 {
+		t.Fatalf("expected two state lines, got %q, %v", data, err)
+	}
+
+	// The global send rate holds the digest back, entries kept
+	clock.Advance(time.Hour)
+	globalSend.take(1, nowFunc())
+	FlushDigests(t.Context(), logger, false)
+	if sent != 0 {
+		t.Fatalf("expected the digest held back, got %d sent", sent)
+	}
+	if n, err := LoadDigests(conf.DigestStateFile); err != nil || n != 2 {
+		t.Fatalf("expected both entries kept, got %d, %v", n, err)
+	}
+
+	clock.Advance(time.Minute)
+	FlushDigests(t.Context(), logger, false)
+	if sent != 1 {
+		t.Fatalf("expected the digest sent once the rate allows, got %d", sent)
+	}
+	if data, _ := os.ReadFile(conf.DigestStateFile); len(data) != 0 {
+		t.Fatalf("expected the state file emptied, got %q", data)
+	}
+}
+
+func TestLoadDigestsSkipsTruncatedLine(t *testing.T) {
+	t.Cleanup(func() {
+		digestMu.Lock()
+		digests = map[string]*digestBuffer{}
+		digestMu.Unlock()
+	})
+	path := filepath.Join(t.TempDir(), "digest.json")
+	data := `{"site":"acme","submission_id":"a","received_at":"2024-05-01T12:00:00Z","subject":"s","text":"t"}` + "\n" +
+		`{"site":"acme","submission_id":"b","rec`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := LoadDigests(path); err != nil || n != 1 {
+		t.Fatalf("LoadDigests = %d, %v", n, err)
+	}
+
+	// The torn end is gone from the file, so the next append starts clean
+	cfg := &Config{DigestStateFile: path}
+	e := email.NewEmail()
+	e.Text = []byte("later")
+	if err := bufferDigest(cfg, &SiteCfg{Key: "acme"}, "c", e); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := LoadDigests(path); err != nil || n != 2 {
+		t.Fatalf("LoadDigests after an append = %d, %v", n, err)
+	}
+
+	if err := os.WriteFile(path, []byte("garbage\n"+data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadDigests(path); err == nil {
+		t.Fatal("expected a corrupt line to be an error")
+	}
+}
@@ -0,0 +1,32 @@
+package form_mailer
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/jordan-wright/email"
+)
+
+// dumpSubmissionEML writes the team email for a submission to DUMP_EML_DIR,
+// when set. A failed dump is only logged.
+func dumpSubmissionEML(logger *slog.Logger, cfg *Config, cs *SiteCfg, submissionID string, e *email.Email) {
+	if cfg.DumpEMLDir == "" {
+		return
+	}
+	if path, err := dumpEML(cfg.DumpEMLDir, cs.Key, submissionID, e); err != nil {
+		logger.Warn("eml dump failed", "err", err)
+	} else {
+		logger.Debug("eml dumped", "path", path)
+	}
+}
+
+// dumpEML writes the raw RFC 5322 message to dir/<site>-<submissionID>.eml.
+func dumpEML(dir, site, submissionID string, e *email.Email) (string, error) {
+	raw, err := e.Bytes()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, site+"-"+submissionID+".eml")
+	return path, os.WriteFile(path, raw, 0o600)
+}
@@ -0,0 +1,115 @@
+package form_mailer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jordan-wright/email"
+)
+
+// Sites with <SITE>_DELIVERY=echo send nothing: their emails are kept in
+// memory, the last ECHO_KEEP per site, for integration tests to fetch from
+// GET /v1/contact/{siteKey}/echo.
+
+type echoedAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+}
+
+type echoedEmail struct {
+	At          time.Time           `json:"at"`
+	From        string              `json:"from"`
+	To          []string            `json:"to"`
+	Cc          []string            `json:"cc,omitempty"`
+	Bcc         []string            `json:"bcc,omitempty"`
+	ReplyTo     []string            `json:"reply_to,omitempty"`
+	Subject     string              `json:"subject"`
+	Headers     map[string][]string `json:"headers"`
+	Text        string              `json:"text"`
+	Attachments []echoedAttachment  `json:"attachments,omitempty"`
+}
+
+var (
+	echoMu sync.Mutex
+	echoes = map[string][]echoedEmail{}
+)
+
+// sendMail sends e for the site, or records it on echo sites. Everything
+// the service emails goes through here so echo sites never reach SMTP.
+func sendMail(ctx context.Context, cfg *Config, cs *SiteCfg, e *email.Email) error {
+	if cs.Delivery == deliveryEcho {
+		recordEcho(cs.Key, e, cfg.EchoKeep)
+		return nil
+	}
+	return sendEmailFunc(ctx, cs, e)
+}
+
+func recordEcho(site string, e *email.Email, keep int) {
+	m := echoedEmail{
+		At:      nowFunc().UTC(),
+		From:    e.From,
+		To:      e.To,
+		Cc:      e.Cc,
+		Bcc:     e.Bcc,
+		ReplyTo: e.ReplyTo,
+		Subject: e.Subject,
+		Headers: e.Headers,
+		Text:    string(e.Text),
+	}
+	for _, a := range e.Attachments {
+		m.Attachments = append(m.Attachments, echoedAttachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Size:        len(a.Content),
+		})
+	}
+
+	echoMu.Lock()
+	defer echoMu.Unlock()
+	list := append(echoes[site], m)
+	if keep > 0 && len(list) > keep {
+		list = list[len(list)-keep:]
+	}
+	echoes[site] = list
+}
+
+// HandleEcho returns the emails recorded for an echo site, oldest first.
+// GET /v1/contact/{siteKey}/echo
+func HandleEcho(w http.ResponseWriter, r *http.Request) {
+	logger := LoggerFromContext(r.Context())
+	info := RequestInfoFromContext(r.Context())
+	if !requireAdmin(w, r, info) {
+		return
+	}
+
+	siteKey := r.PathValue("siteKey")
+	cs, err := GetConfig().Site(siteKey)
+	if errors.Is(err, errUnknownSite) {
+		logger.Warn("unknown site", "reason_code", RejectUnknownSite, "site", siteKey)
+		reject(w, info, RejectUnknownSite, "unknown site", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Error("site config invalid", "reason_code", RejectSiteMisconfigured, "site", siteKey, "err", err)
+		reject(w, info, RejectSiteMisconfigured, "site misconfigured", http.StatusInternalServerError)
+		return
+	}
+	info.Site = cs.Key
+	if cs.Delivery != deliveryEcho {
+		reject(w, info, RejectNotEchoSite, "site does not use echo delivery", http.StatusNotFound)
+		return
+	}
+
+	echoMu.Lock()
+	emails := append([]echoedEmail{}, echoes[cs.Key]...)
+	echoMu.Unlock()
+
+	info.SetOutcome(OutcomeOK)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"emails": emails})
+}
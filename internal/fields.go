@@ -0,0 +1,342 @@
+package form_mailer
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Field kinds accepted in <SITE>_FIELD_TYPES.
+var fieldKinds = map[string]bool{"string": true, "int": true, "float": true, "bool": true}
+
+// serviceFields returns the single-value fields the service reads itself,
+// as opposed to custom fields.
+func serviceFields(cs *SiteCfg) map[string]bool {
+	fields := map[string]bool{"name": true, "email": true, "message": true, "website": true, formTokenField: true, honeypotTokenField: true}
+	if cs.PriorityField != "" {
+		fields[cs.PriorityField] = true
+	}
+	if cs.SubmitterSubject {
+		fields[submitterSubjectField] = true
+	}
+	if len(cs.ContactPrefs) > 0 {
+		fields[contactPreferenceField] = true
+	}
+	return fields
+}
+
+// DUPLICATE_FIELDS modes.
+const (
+	duplicateFirst  = "first"
+	duplicateReject = "reject"
+	duplicateJoin   = "join"
+	duplicateArray  = "array"
+)
+
+// defaultMultiValueSep joins multi-value fields in the email when the site
+// has no <SITE>_MULTI_VALUE_SEPARATOR.
+const defaultMultiValueSep = ", "
+
+var errDuplicateField = errors.New("duplicate field")
+
+// formFields flattens a posted form according to DUPLICATE_FIELDS: a
+// repeated field keeps its first value, fails the submission, or, for
+// custom fields only, has its values joined with DUPLICATE_FIELD_SEPARATOR
+// or kept as a multi-value field, like a JSON array.
+func formFields(cfg *Config, cs *SiteCfg, form url.Values) (map[string]any, error) {
+	service := serviceFields(cs)
+	values := make(map[string]any, len(form))
+	for k, vs := range form {
+		switch {
+		case len(vs) == 0:
+			continue
+		case len(vs) == 1:
+			values[k] = vs[0]
+		case cfg.DuplicateFields == duplicateReject,
+			(cfg.DuplicateFields == duplicateJoin || cfg.DuplicateFields == duplicateArray) && service[k]:
+			return nil, fmt.Errorf("%w: %q sent %d times", errDuplicateField, k, len(vs))
+		case cfg.DuplicateFields == duplicateJoin:
+			values[k] = strings.Join(vs, cfg.DuplicateFieldSep)
+		case cfg.DuplicateFields == duplicateArray:
+			multi := make([]any, len(vs))
+			for i, v := range vs {
+				multi[i] = v
+			}
+			values[k] = multi
+		default:
+			values[k] = vs[0]
+		}
+	}
+	return values, nil
+}
+
+// trimFields applies TRIM_FIELDS to a payload before it is read: top-level
+// string values lose surrounding whitespace, so a name of only spaces
+// counts as missing, and with COLLAPSE_WHITESPACE runs of whitespace in the
+// name and subject become one space. The message keeps its inner layout,
+// and the "website" honeypot is left alone so whitespace still trips it.
+func trimFields(cfg *Config, values map[string]any) {
+	if !cfg.TrimFields {
+		return
+	}
+	for k, v := range values {
+		if k == "website" {
+			continue
+		}
+		if multi, ok := v.([]any); ok {
+			for i, e := range multi {
+				if s, ok := e.(string); ok {
+					multi[i] = strings.TrimSpace(s)
+				}
+			}
+			continue
+		}
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		if cfg.CollapseWhitespace && (k == "name" || k == submitterSubjectField) {
+			values[k] = strings.Join(strings.Fields(s), " ")
+			continue
+		}
+		values[k] = strings.TrimSpace(s)
+	}
+}
+
+// lengthRange bounds a field's length in characters; max 0 = no maximum.
+type lengthRange struct{ min, max int }
+
+// parseFieldLengths parses <SITE>_FIELD_LENGTHS, "field:min-max" pairs
+// such as "name:2-80,phone:0-20". The maximum may be left out ("10-").
+func parseFieldLengths(s string) (map[string]lengthRange, error) {
+	out := map[string]lengthRange{}
+	for _, part := range splitString(s) {
+		field, bounds, ok := strings.Cut(part, ":")
+		field = strings.TrimSpace(field)
+		lo, hi, ok2 := strings.Cut(strings.TrimSpace(bounds), "-")
+		if !ok || !ok2 || field == "" {
+			return nil, fmt.Errorf("expected field:min-max, got %q", part)
+		}
+		var r lengthRange
+		var err error
+		if r.min, err = strconv.Atoi(lo); err != nil || r.min < 0 {
+			return nil, fmt.Errorf("invalid minimum for %q: %q", field, lo)
+		}
+		if hi != "" {
+			if r.max, err = strconv.Atoi(hi); err != nil || r.max < 1 || r.max < r.min {
+				return nil, fmt.Errorf("invalid maximum for %q: %q", field, hi)
+			}
+		}
+		out[field] = r
+	}
+	return out, nil
+}
+
+// checkFieldLengths applies <SITE>_FIELD_LENGTHS to the submission's
+// canonical and custom text fields, counting runes after trimming
+// surrounding space. A field that wasn't sent counts as empty; typed
+// non-text values are left to <SITE>_FIELD_TYPES. The error names the
+// first offending field, in name order.
+func checkFieldLengths(cs *SiteCfg, p ContactRequest) error {
+	for _, field := range slices.Sorted(maps.Keys(cs.FieldLengths)) {
+		var v string
+		switch field {
+		case "name":
+			v = p.Name
+		case "email":
+			v = p.Email
+		case "message":
+			v = p.Message
+		case submitterSubjectField:
+			v = p.Subject
+		default:
+			s, ok := p.Fields[field].(string)
+			if !ok && p.Fields[field] != nil {
+				continue
+			}
+			v = s
+		}
+		r := cs.FieldLengths[field]
+		n := utf8.RuneCountInString(strings.TrimSpace(v))
+		if n < r.min {
+			return fmt.Errorf("%s must be at least %d characters", field, r.min)
+		}
+		if r.max > 0 && n > r.max {
+			return fmt.Errorf("%s must be at most %d characters", field, r.max)
+		}
+	}
+	return nil
+}
+
+// contactPreferenceField is how the submitter would like to be answered,
+// on sites with <SITE>_CONTACT_PREFERENCES.
+const contactPreferenceField = "contact_preference"
+
+// contactPreference returns the submitted contact_preference, lowercased,
+// or "" when the site doesn't read it or it was left out and isn't
+// required. A value outside the site's list is an error.
+func contactPreference(cs *SiteCfg, values map[string]any) (string, error) {
+	if len(cs.ContactPrefs) == 0 {
+		return "", nil
+	}
+	v, ok := values[contactPreferenceField].(string)
+	if !ok && values[contactPreferenceField] != nil {
+		return "", fmt.Errorf("%s must be a string", contactPreferenceField)
+	}
+	v = strings.ToLower(strings.TrimSpace(v))
+	switch {
+	case v == "" && cs.RequireContactPref:
+		return "", fmt.Errorf("%s is required", contactPreferenceField)
+	case v != "" && !slices.Contains(cs.ContactPrefs, v):
+		return "", fmt.Errorf("%s must be one of %s", contactPreferenceField, strings.Join(cs.ContactPrefs, ", "))
+	}
+	return v, nil
+}
+
+// customFields collects the scalar top-level values that aren't one of the
+// fields the service itself reads, and arrays of scalars as multi-value
+// fields, coercing those listed in cs.FieldTypes element by element.
+// Form posts only carry strings, so "budget=5000" becomes 5000 for an int
+// field; a value that doesn't coerce is an error naming the field. With
+// <SITE>_ALLOWED_FIELDS, other fields are an error or, without
+// <SITE>_STRICT_FIELDS, dropped.
+func customFields(cs *SiteCfg, values map[string]any) (map[string]any, error) {
+	reserved := serviceFields(cs)
+	for _, path := range cs.FieldMap {
+		root, _, _ := strings.Cut(path, ".")
+		reserved[root] = true
+	}
+
+	out := map[string]any{}
+	var unexpected []string
+	for k, v := range values {
+		if reserved[k] {
+			continue
+		}
+		if len(cs.AllowedFields) > 0 && !slices.Contains(cs.AllowedFields, k) {
+			unexpected = append(unexpected, k)
+			continue
+		}
+		if multi, ok := v.([]any); ok {
+			if !scalars(multi) {
+				continue // arrays of objects, arrays or null
+			}
+			if kind, ok := cs.FieldTypes[k]; ok {
+				coerced := make([]any, len(multi))
+				for i, e := range multi {
+					c, err := coerceField(kind, e)
+					if err != nil {
+						return nil, fmt.Errorf("%s must be a list of %s", k, kind)
+					}
+					coerced[i] = c
+				}
+				multi = coerced
+			}
+			out[k] = multi
+			continue
+		}
+		if !scalars([]any{v}) {
+			continue // nested objects, null
+		}
+		if kind, ok := cs.FieldTypes[k]; ok {
+			c, err := coerceField(kind, v)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be %s", k, kind)
+			}
+			v = c
+		}
+		out[k] = v
+	}
+	if len(unexpected) > 0 && cs.StrictFields {
+		sort.Strings(unexpected)
+		return nil, fmt.Errorf("unexpected %s", strings.Join(unexpected, ", "))
+	}
+	return out, nil
+}
+
+// scalars reports whether every value is a string, number or bool.
+func scalars(vs []any) bool {
+	for _, v := range vs {
+		switch v.(type) {
+		case string, float64, bool:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func coerceField(kind string, v any) (any, error) {
+	s, isString := v.(string)
+	s = strings.TrimSpace(s)
+	switch kind {
+	case "int":
+		if f, ok := v.(float64); ok {
+			if f != math.Trunc(f) {
+				return nil, strconv.ErrSyntax
+			}
+			if f < math.MinInt64 || f >= math.MaxInt64 {
+				return nil, strconv.ErrRange
+			}
+			return int64(f), nil
+		}
+		if isString {
+			return strconv.ParseInt(s, 10, 64)
+		}
+	case "float":
+		if f, ok := v.(float64); ok {
+			return f, nil
+		}
+		if isString {
+			return strconv.ParseFloat(s, 64)
+		}
+	case "bool":
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+		if isString {
+			switch strings.ToLower(s) {
+			case "true", "1", "on", "yes":
+				return true, nil
+			case "false", "0", "off", "no", "":
+				return false, nil
+			}
+		}
+	default: // string
+		if isString {
+			return v, nil
+		}
+		return fmt.Sprint(v), nil
+	}
+	return nil, strconv.ErrSyntax
+}
+
+// formatFields renders custom fields as "key: value" lines, sorted by key,
+// with the values of a multi-value field joined by sep.
+func formatFields(fields map[string]any, sep string) string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		v := fields[k]
+		if multi, ok := v.([]any); ok {
+			parts := make([]string, len(multi))
+			for i, e := range multi {
+				parts[i] = fmt.Sprint(e)
+			}
+			v = strings.Join(parts, sep)
+		}
+		fmt.Fprintf(&b, "%s: %v\n", k, v)
+	}
+	return b.String()
+}
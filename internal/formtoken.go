@@ -0,0 +1,198 @@
+package form_mailer
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Form tokens are "<payload>.<sig>" where payload is base64url of
+// "site|expiry-unix|nonce" and sig is hex HMAC-SHA256 of the payload under
+// FORM_TOKEN_SECRET. Each nonce is accepted once.
+
+const formTokenField = "form_token"
+
+var (
+	errBadFormToken = errors.New("invalid form token")
+
+	usedTokensMu sync.Mutex
+	usedTokens   = map[string]time.Time{} // nonce -> expiry
+)
+
+func issueFormToken(secret []byte, site string, expires time.Time) string {
+	var nonce [12]byte
+	_, _ = rand.Read(nonce[:])
+	payload := base64.RawURLEncoding.EncodeToString(
+		fmt.Appendf(nil, "%s|%d|%x", site, expires.Unix(), nonce),
+	)
+	return payload + "." + signFormToken(secret, payload)
+}
+
+func signFormToken(secret []byte, payload string) string {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(payload))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// consumeFormToken checks the token's signature, site and expiry, and marks
+// it used so it can't be replayed.
+func consumeFormToken(secret []byte, site, token string, now time.Time) error {
+	held, err := verifyFormToken(secret, site, token, now)
+	if err != nil {
+		return err
+	}
+	if !held.claim(now) {
+		return fmt.Errorf("%w: already used", errBadFormToken)
+	}
+	return nil
+}
+
+// verifyFormToken is consumeFormToken without marking the token used; the
+// caller claims it once the submission is accepted.
+func verifyFormToken(secret []byte, site, token string, now time.Time) (*heldNonce, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(signFormToken(secret, payload))) {
+		return nil, errBadFormToken
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errBadFormToken
+	}
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 3 || parts[0] != site {
+		return nil, errBadFormToken
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, errBadFormToken
+	}
+	expires := time.Unix(exp, 0)
+	if now.After(expires) {
+		return nil, fmt.Errorf("%w: expired", errBadFormToken)
+	}
+
+	held := &heldNonce{nonce: parts[2], expires: expires}
+	if held.used() {
+		return nil, fmt.Errorf("%w: already used", errBadFormToken)
+	}
+	return held, nil
+}
+
+// heldNonce is a verified single-use nonce that hasn't been claimed yet.
+// A nil heldNonce stands for "no token required" and always claims.
+type heldNonce struct {
+	nonce   string
+	expires time.Time
+	claimed bool
+	kept    bool
+}
+
+// used reports whether the nonce was already claimed, so a replay is
+// refused before any work is done on it.
+func (n *heldNonce) used() bool {
+	usedTokensMu.Lock()
+	defer usedTokensMu.Unlock()
+	_, seen := usedTokens[n.nonce]
+	return seen
+}
+
+// claim marks the nonce used, and reports whether it was still free: two
+// requests may verify the same token, only one claims it.
+func (n *heldNonce) claim(now time.Time) bool {
+	if n == nil {
+		return true
+	}
+	n.claimed = claimNonce(n.nonce, n.expires, now)
+	return n.claimed
+}
+
+// keep leaves the nonce used for good, once its submission is delivered or
+// buffered.
+func (n *heldNonce) keep() {
+	if n != nil {
+		n.kept = true
+	}
+}
+
+// release frees a claimed nonce whose submission wasn't delivered, so the
+// client can retry a 429 or 503 with the same token. It does nothing once
+// the nonce is kept.
+func (n *heldNonce) release() {
+	if n == nil || !n.claimed || n.kept {
+		return
+	}
+	usedTokensMu.Lock()
+	defer usedTokensMu.Unlock()
+	delete(usedTokens, n.nonce)
+}
+
+// claimNonce records a single-use nonce until it expires, and reports
+// whether it was new. Expired nonces are dropped on the way.
+func claimNonce(nonce string, expires, now time.Time) bool {
+	usedTokensMu.Lock()
+	defer usedTokensMu.Unlock()
+	for n, e := range usedTokens {
+		if now.After(e) {
+			delete(usedTokens, n)
+		}
+	}
+	if _, seen := usedTokens[nonce]; seen {
+		return false
+	}
+	usedTokens[nonce] = expires
+	return true
+}
+
+// HandleFormToken issues a short-lived, single-use token for the site's form.
+// GET /v1/contact/{siteKey}/token
+func HandleFormToken(w http.ResponseWriter, r *http.Request) {
+	logger := LoggerFromContext(r.Context())
+	info := RequestInfoFromContext(r.Context())
+	cfg := GetConfig()
+	start := time.Now()
+
+	siteKey := r.PathValue("siteKey")
+	cs, err := cfg.Site(siteKey)
+	if errors.Is(err, errUnknownSite) {
+		logger.Warn("unknown site", "reason_code", RejectUnknownSite, "site", siteKey)
+		rejectProbe(w, r, info, cfg, start, RejectUnknownSite, "unknown site", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Error("site config invalid", "reason_code", RejectSiteMisconfigured, "site", siteKey, "err", err)
+		reject(w, info, RejectSiteMisconfigured, "site misconfigured", http.StatusInternalServerError)
+		return
+	}
+	info.Site = cs.Key
+
+	allowedOrigin, ok := matchOrigin(r.Header.Get("Origin"), cs.AllowedOrigins)
+	if !ok {
+		logger.Warn("origin not allowed", "reason_code", RejectOriginNotAllowed, "origin", r.Header.Get("Origin"))
+		rejectProbe(w, r, info, cfg, start, RejectOriginNotAllowed, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	applyCORSHeaders(w, allowedOrigin)
+
+	expires := nowFunc().Add(cfg.FormTokenTTL)
+	resp := map[string]any{
+		"token":      issueFormToken(cfg.FormTokenSecret, cs.Key, expires),
+		"expires_at": expires.UTC().Format(time.RFC3339),
+	}
+	if cs.HoneypotToken {
+		resp["honeypot"] = issueHoneypotToken(cfg.FormTokenSecret, cs.Key, expires)
+	}
+	info.SetOutcome(OutcomeTokenIssued)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(resp)
+}
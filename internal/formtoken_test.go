@@ -0,0 +1,304 @@
+package form_mailer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jordan-wright/email"
+)
+
+func TestConsumeFormToken(t *testing.T) {
+	secret := []byte("k")
+	now := time.Now()
+
+	tok := issueFormToken(secret, "acme", now.Add(time.Minute))
+	if err := consumeFormToken(secret, "acme", tok, now); err != nil {
+		t.Fatalf("fresh token rejected: %v", err)
+	}
+	if err := consumeFormToken(secret, "acme", tok, now); !errors.Is(err, errBadFormToken) {
+		t.Fatalf("expected a reused token to be rejected, got %v", err)
+	}
+
+	tests := map[string]string{
+		"expired":    issueFormToken(secret, "acme", now.Add(-time.Second)),
+		"other site": issueFormToken(secret, "other", now.Add(time.Minute)),
+		"other key":  issueFormToken([]byte("other"), "acme", now.Add(time.Minute)),
+		"garbage":    "not-a-token",
+		"empty":      "",
+	}
+	for name, tok := range tests {
+		if err := consumeFormToken(secret, "acme", tok, now); !errors.Is(err, errBadFormToken) {
+			t.Errorf("%s: expected errBadFormToken, got %v", name, err)
+		}
+	}
+}
+
+func TestHandleContactRequireToken(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.FormTokenSecret = []byte("k")
+	conf.FormTokenTTL = time.Minute
+	conf.Sites["acme"].RequireToken = true
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return nil }
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/contact/{siteKey}/token", HandleFormToken)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/contact/acme/token", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("token endpoint: expected status 200, got %d", rec.Code)
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || resp.Token == "" {
+		t.Fatalf("decode token response: %v", err)
+	}
+
+	postAs := func(name, token string) int {
+		body := `{"name":"` + name + `","email":"alice@example.com","message":"Hello","form_token":"` + token + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		return rec.Code
+	}
+	post := func(token string) int { return postAs("Alice", token) }
+	if code := post(""); code != http.StatusForbidden {
+		t.Fatalf("expected status 403 without a token, got %d", code)
+	}
+	// A submission refused after the token check leaves the token usable
+	if code := postAs("", resp.Token); code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for an invalid submission, got %d", code)
+	}
+	if code := post(resp.Token); code != http.StatusOK {
+		t.Fatalf("expected status 200 with a token, got %d", code)
+	}
+	if code := post(resp.Token); code != http.StatusForbidden {
+		t.Fatalf("expected status 403 for a replayed token, got %d", code)
+	}
+}
+
+func TestHandleBatchRequireToken(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.BatchMaxItems = 3
+	conf.FormTokenSecret = []byte("k")
+	conf.Sites["acme"].RequireToken = true
+	sent := 0
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { sent++; return nil }
+
+	tok := issueFormToken(conf.FormTokenSecret, "acme", time.Now().Add(time.Minute))
+	results := batchResults(t, postBatch(`[
+		{"name":"Alice","email":"alice@example.com","message":"no token"},
+		{"name":"","email":"bob@example.com","message":"invalid","form_token":"`+tok+`"},
+		{"name":"Carol","email":"carol@example.com","message":"one","form_token":"`+tok+`"}
+	]`))
+	if results[0].Error != RejectInvalidToken {
+		t.Fatalf("expected an item without a token to be refused, got %+v", results[0])
+	}
+	if results[1].Error != RejectInvalidSubmission {
+		t.Fatalf("expected the invalid item to be refused, got %+v", results[1])
+	}
+	if !results[2].OK || sent != 1 {
+		t.Fatalf("expected the token to survive the invalid item, got %+v (%d sent)", results[2], sent)
+	}
+
+	// The X-Form-Token header stands in for the field, once
+	req := newBatchRequest(`[
+		{"name":"Dave","email":"dave@example.com","message":"two"},
+		{"name":"Erin","email":"erin@example.com","message":"three"}
+	]`)
+	req.Header.Set("X-Form-Token", issueFormToken(conf.FormTokenSecret, "acme", time.Now().Add(time.Minute)))
+	results = batchResults(t, serveBatch(req))
+	if !results[0].OK || results[1].Error != RejectInvalidToken {
+		t.Fatalf("expected the header token to cover one item, got %+v", results)
+	}
+}
+
+func TestHandleContactTokenSurvivesSendBudget(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.FormTokenSecret = []byte("k")
+	conf.Sites["acme"].RequireToken = true
+	conf.Sites["acme"].SendBurst = 1
+	clock := useFakeClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	sent := 0
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { sent++; return nil }
+
+	post := func(token string) int {
+		body := `{"name":"Alice","email":"alice@example.com","message":"Hello","form_token":"` + token + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		return rec.Code
+	}
+	issue := func() string { return issueFormToken(conf.FormTokenSecret, "acme", clock.Now().Add(time.Hour)) }
+	if code := post(issue()); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+
+	// The send budget refuses; the retry may use the same token
+	tok := issue()
+	if code := post(tok); code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429 once the send budget is used, got %d", code)
+	}
+	clock.Advance(conf.sendRefillFor(conf.Sites["acme"]))
+	if code := post(tok); code != http.StatusOK {
+		t.Fatalf("expected the retry to succeed with the same token, got %d", code)
+	}
+	if code := post(tok); code != http.StatusForbidden {
+		t.Fatalf("expected status 403 once the token is delivered, got %d", code)
+	}
+	if sent != 2 {
+		t.Fatalf("expected 2 emails, got %d", sent)
+	}
+}
+
+func TestConsumeHoneypotToken(t *testing.T) {
+	secret := []byte("k")
+	now := time.Now()
+
+	tok := issueHoneypotToken(secret, "acme", now.Add(time.Minute))
+	if err := consumeHoneypotToken(secret, "acme", tok, now); err != nil {
+		t.Fatalf("fresh token rejected: %v", err)
+	}
+	if err := consumeHoneypotToken(secret, "acme", tok, now); !errors.Is(err, errBadHoneypot) {
+		t.Fatalf("expected a reused token to be rejected, got %v", err)
+	}
+
+	altered := []byte(issueHoneypotToken(secret, "acme", now.Add(time.Minute)))
+	altered[len(altered)/2] ^= 1
+	tests := map[string]string{
+		"expired":    issueHoneypotToken(secret, "acme", now.Add(-time.Second)),
+		"other site": issueHoneypotToken(secret, "other", now.Add(time.Minute)),
+		"other key":  issueHoneypotToken([]byte("other"), "acme", now.Add(time.Minute)),
+		"form token": issueFormToken(secret, "acme", now.Add(time.Minute)),
+		"altered":    string(altered),
+		"empty":      "",
+	}
+	for name, tok := range tests {
+		if err := consumeHoneypotToken(secret, "acme", tok, now); !errors.Is(err, errBadHoneypot) {
+			t.Errorf("%s: expected errBadHoneypot, got %v", name, err)
+		}
+	}
+}
+
+func TestHandleContactEncryptedHoneypot(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.FormTokenSecret = []byte("k")
+	conf.FormTokenTTL = time.Minute
+	conf.Sites["acme"].HoneypotToken = true
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return nil }
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/contact/{siteKey}/token", HandleFormToken)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/contact/acme/token", nil))
+	var resp struct {
+		Honeypot string `json:"honeypot"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || resp.Honeypot == "" {
+		t.Fatalf("expected a honeypot token, got %v", err)
+	}
+
+	postAs := func(name, token string) *httptest.ResponseRecorder {
+		body := `{"name":"` + name + `","email":"alice@example.com","message":"Hello","hp_token":"` + token + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		return rec
+	}
+	post := func(token string) *httptest.ResponseRecorder { return postAs("Alice", token) }
+	if rec := post(""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 without a token, got %d", rec.Code)
+	}
+	// A submission refused after the honeypot check leaves the token usable
+	if rec := postAs("", resp.Honeypot); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for an invalid submission, got %d", rec.Code)
+	}
+	if rec := post(resp.Honeypot); rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200 with the token, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := post(resp.Honeypot); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for a replayed token, got %d", rec.Code)
+	}
+}
+
+func TestHandleContactHoneypotTokenSurvivesSendBudget(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.FormTokenSecret = []byte("k")
+	conf.HoneypotFakeSuccess = true
+	conf.Sites["acme"].HoneypotToken = true
+	conf.Sites["acme"].SendBurst = 1
+	clock := useFakeClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	sent := 0
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { sent++; return nil }
+
+	post := func(token string) int {
+		body := `{"name":"Alice","email":"alice@example.com","message":"Hello","hp_token":"` + token + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		return rec.Code
+	}
+	issue := func() string { return issueHoneypotToken(conf.FormTokenSecret, "acme", clock.Now().Add(time.Hour)) }
+	if code := post(issue()); code != http.StatusOK || sent != 1 {
+		t.Fatalf("expected status 200 and a send, got %d (%d sent)", code, sent)
+	}
+
+	// A retry after the send budget refuses is delivered, not faked
+	tok := issue()
+	if code := post(tok); code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429 once the send budget is used, got %d", code)
+	}
+	clock.Advance(conf.sendRefillFor(conf.Sites["acme"]))
+	if code := post(tok); code != http.StatusOK || sent != 2 {
+		t.Fatalf("expected the retry to be sent, got %d (%d sent)", code, sent)
+	}
+}
+
+func TestHandleBatchEncryptedHoneypot(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.BatchMaxItems = 3
+	conf.FormTokenSecret = []byte("k")
+	conf.Sites["acme"].HoneypotToken = true
+	sent := 0
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { sent++; return nil }
+
+	tok := issueHoneypotToken(conf.FormTokenSecret, "acme", time.Now().Add(time.Minute))
+	results := batchResults(t, postBatch(`[
+		{"name":"Alice","email":"alice@example.com","message":"no token"},
+		{"name":"","email":"bob@example.com","message":"invalid","hp_token":"`+tok+`"},
+		{"name":"Carol","email":"carol@example.com","message":"one","hp_token":"`+tok+`"}
+	]`))
+	if results[0].Error != RejectHoneypotToken {
+		t.Fatalf("expected an item without a token to trip the honeypot, got %+v", results[0])
+	}
+	if results[1].Error != RejectInvalidSubmission {
+		t.Fatalf("expected the invalid item to be refused, got %+v", results[1])
+	}
+	if !results[2].OK || sent != 1 {
+		t.Fatalf("expected the token to survive the invalid item, got %+v (%d sent)", results[2], sent)
+	}
+
+	conf.HoneypotFakeSuccess = true
+	results = batchResults(t, postBatch(`[
+		{"name":"Dave","email":"dave@example.com","message":"replayed","hp_token":"`+tok+`"}
+	]`))
+	if !results[0].OK || sent != 1 {
+		t.Fatalf("expected a fake success for a reused token, got %+v (%d sent)", results[0], sent)
+	}
+}
@@ -0,0 +1,244 @@
+package form_mailer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The checks HandleContact and HandleBatch share, so a gate added to one
+// can't be missed by the other. Each logs its refusal and returns it; the
+// contact handler answers with it, the batch handler answers the whole
+// batch with a caller rejection and reports the others per item.
+
+// rejection is a refused request or submission.
+type rejection struct {
+	reason RejectReason
+	msg    string // for the client
+	status int
+	retry  time.Duration // advertised in Retry-After when set
+	probe  bool          // answered through rejectProbe
+	fake   bool          // answered with a fake success (HONEYPOT_FAKE_SUCCESS)
+}
+
+// rejectWith answers rej. Fake successes are left to the caller, which
+// knows what a success looks like.
+func rejectWith(w http.ResponseWriter, r *http.Request, info *RequestInfo, cfg *Config, start time.Time, rej *rejection) {
+	if rej.retry > 0 && !(rej.probe && cfg.ObscureSiteKeys) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(rej.retry.Seconds())+1))
+	}
+	if rej.probe {
+		rejectProbe(w, r, info, cfg, start, rej.reason, rej.msg, rej.status)
+		return
+	}
+	reject(w, info, rej.reason, rej.msg, rej.status)
+}
+
+// checkCaller applies the gates on who is posting and when: the site's
+// referer rule, the User-Agent denylist, maintenance mode and business
+// hours.
+func checkCaller(logger *slog.Logger, cfg *Config, info *RequestInfo, cs *SiteCfg, r *http.Request) *rejection {
+	if cs.RequireReferer && !refererAllowed(r, cs) {
+		warnRejection(logger, cfg, info, RejectRefererNotAllowed, "referer not allowed", "referer", r.Referer())
+		return &rejection{reason: RejectRefererNotAllowed, msg: "referer not allowed", status: http.StatusForbidden, probe: true}
+	}
+	if rule, ok := cfg.blockedUserAgentsFor(cs).match(r.UserAgent()); ok {
+		warnRejection(logger, cfg, info, RejectBlockedUserAgent, "user agent blocked",
+			"user_agent", r.UserAgent(), "rule", rule, "fake_success", cfg.HoneypotFakeSuccess)
+		return &rejection{reason: RejectBlockedUserAgent, msg: "forbidden", status: http.StatusForbidden, fake: cfg.HoneypotFakeSuccess}
+	}
+	if cfg.MaintenanceMode {
+		logger.Warn("maintenance mode", "reason_code", RejectMaintenance)
+		return &rejection{reason: RejectMaintenance, msg: cfg.MaintenanceMessage, status: http.StatusServiceUnavailable}
+	}
+	if bh := cs.BusinessHours; bh != nil {
+		if now := nowFunc(); !bh.isOpen(now) {
+			logger.Info("outside business hours", "reason_code", RejectOutsideHours)
+			return &rejection{reason: RejectOutsideHours, msg: cs.OutsideHoursMsg, status: http.StatusServiceUnavailable, retry: bh.nextOpen(now).Sub(now)}
+		}
+	}
+	return nil
+}
+
+// parseSubmission builds the submission from the decoded fields, with the
+// derived values (priority, submitter subject, language) filled in and
+// NORMALIZE_UNICODE applied.
+func parseSubmission(cfg *Config, cs *SiteCfg, values map[string]any) (ContactRequest, error) {
+	if cfg.NormalizeUnicode {
+		// First, so whitespace uncovered by dropped characters is trimmed
+		normalizeFields(values)
+	}
+	trimFields(cfg, values)
+	p, err := contactFromValues(values)
+	if err != nil {
+		return p, err
+	}
+	p.Priority = priorityFor(cs, values)
+	p.Subject = submitterSubject(cs, values)
+	if cfg.DetectLanguage {
+		p.Language = detectLanguage(p.Message)
+	}
+	return p, nil
+}
+
+// checkFormToken verifies the <SITE>_REQUIRE_TOKEN form token, from the
+// form_token field or the X-Form-Token header, without using it up: a
+// submission refused later keeps its token for the retry. Claim the
+// returned nonce with claimFormToken once the submission is accepted.
+func checkFormToken(logger *slog.Logger, cfg *Config, info *RequestInfo, cs *SiteCfg, r *http.Request, values map[string]any) (*heldNonce, *rejection) {
+	if !cs.RequireToken {
+		return nil, nil
+	}
+	token, _ := values[formTokenField].(string)
+	if token == "" {
+		token = r.Header.Get("X-Form-Token")
+	}
+	held, err := verifyFormToken(cfg.FormTokenSecret, cs.Key, token, nowFunc())
+	if err != nil {
+		warnRejection(logger, cfg, info, RejectInvalidToken, "form token rejected", "err", err)
+		return nil, &rejection{reason: RejectInvalidToken, msg: "invalid form token", status: http.StatusForbidden}
+	}
+	return held, nil
+}
+
+// claimFormToken marks a verified form token used. It fails when a
+// concurrent submission claimed the same token first. The caller keeps the
+// token on delivery and releases it otherwise.
+func claimFormToken(logger *slog.Logger, cfg *Config, info *RequestInfo, held *heldNonce) *rejection {
+	if !held.claim(nowFunc()) {
+		warnRejection(logger, cfg, info, RejectInvalidToken, "form token rejected", "err", fmt.Errorf("%w: already used", errBadFormToken))
+		return &rejection{reason: RejectInvalidToken, msg: "invalid form token", status: http.StatusForbidden}
+	}
+	return nil
+}
+
+// checkHoneypot applies the honeypots: "website" must stay empty and, on
+// <SITE>_ENCRYPTED_HONEYPOT sites, the issued hp_token must come back
+// unaltered and unused. Like the form token, the hp_token is only verified
+// here; claim it with claimHoneypot once the submission is accepted.
+func checkHoneypot(logger *slog.Logger, cfg *Config, info *RequestInfo, cs *SiteCfg, values map[string]any, p ContactRequest) (*heldNonce, *rejection) {
+	var (
+		held *heldNonce
+		err  error
+	)
+	reason := RejectHoneypot
+	if p.Website == "" {
+		if !cs.HoneypotToken {
+			return nil, nil
+		}
+		token, _ := values[honeypotTokenField].(string)
+		if held, err = verifyHoneypotToken(cfg.FormTokenSecret, cs.Key, token, nowFunc()); err == nil {
+			return held, nil
+		}
+		reason = RejectHoneypotToken
+	}
+	return nil, honeypotTriggered(logger, cfg, info, reason, p, err)
+}
+
+// claimHoneypot marks a verified hp_token used. A token claimed first by a
+// concurrent submission trips the honeypot like any other reuse. Like the
+// form token, it is kept on delivery and released otherwise.
+func claimHoneypot(logger *slog.Logger, cfg *Config, info *RequestInfo, held *heldNonce, p ContactRequest) *rejection {
+	if held.claim(nowFunc()) {
+		return nil
+	}
+	return honeypotTriggered(logger, cfg, info, RejectHoneypotToken, p, fmt.Errorf("%w: already used", errBadHoneypot))
+}
+
+func honeypotTriggered(logger *slog.Logger, cfg *Config, info *RequestInfo, reason RejectReason, p ContactRequest, err error) *rejection {
+	logArgs := []any{"from", logEmail(cfg, p.Email), "fake_success", cfg.HoneypotFakeSuccess}
+	if err != nil {
+		logArgs = append(logArgs, "err", err)
+	}
+	warnRejection(logger, cfg, info, reason, "honeypot triggered", logArgs...)
+	return &rejection{reason: reason, msg: "invalid submission", status: http.StatusBadRequest, fake: cfg.HoneypotFakeSuccess}
+}
+
+// checkSubmission validates a parsed submission: the required fields, the
+// name rules, <SITE>_VERIFY_MX and the custom fields, which it stores in p.
+// Last it checks the per-address cooldown and holds the address; the
+// caller starts the returned hold on delivery and releases it otherwise.
+func checkSubmission(ctx context.Context, logger *slog.Logger, cfg *Config, info *RequestInfo, cs *SiteCfg, values map[string]any, p *ContactRequest, attachments int) (*cooldownHold, *rejection) {
+	hasMessage := strings.TrimSpace(p.Message) != "" || (cs.MessageOptional && attachments > 0)
+	if p.Name == "" || !emailRegex.MatchString(p.Email) || !hasMessage {
+		warnRejection(logger, cfg, info, RejectInvalidSubmission, "invalid submission", "from", logEmail(cfg, p.Email))
+		return nil, &rejection{reason: RejectInvalidSubmission, msg: "invalid submission", status: http.StatusBadRequest}
+	}
+
+	if err := validateName(cs, p.Name); err != nil {
+		logger.Warn("invalid name", "reason_code", RejectInvalidName, "err", err)
+		return nil, &rejection{reason: RejectInvalidName, msg: "invalid name: " + err.Error(), status: http.StatusBadRequest}
+	}
+
+	if cs.VerifyMX {
+		ok, err := domainAcceptsMail(ctx, cfg, p.Email)
+		if err != nil {
+			logger.Warn("mx lookup failed, accepting", "from", logEmail(cfg, p.Email), "err", err)
+		} else if !ok {
+			logger.Warn("submitter domain takes no mail", "reason_code", RejectInvalidEmailDomain, "from", logEmail(cfg, p.Email))
+			return nil, &rejection{reason: RejectInvalidEmailDomain, msg: "invalid email: domain does not receive mail", status: http.StatusBadRequest}
+		}
+	}
+
+	var err error
+	if p.Fields, err = customFields(cs, values); err != nil {
+		logger.Warn("invalid field", "reason_code", RejectInvalidField, "err", err)
+		return nil, &rejection{reason: RejectInvalidField, msg: "invalid field: " + err.Error(), status: http.StatusBadRequest}
+	}
+	if p.ContactPreference, err = contactPreference(cs, values); err != nil {
+		logger.Warn("invalid contact preference", "reason_code", RejectInvalidField, "err", err)
+		return nil, &rejection{reason: RejectInvalidField, msg: "invalid field: " + err.Error(), status: http.StatusBadRequest}
+	}
+	if err := checkFieldLengths(cs, *p); err != nil {
+		logger.Warn("invalid field length", "reason_code", RejectInvalidField, "err", err)
+		return nil, &rejection{reason: RejectInvalidField, msg: "invalid field: " + err.Error(), status: http.StatusBadRequest}
+	}
+
+	cooldown, wait := holdEmailCooldown(cs, p.Email, nowFunc())
+	if wait > 0 {
+		logger.Warn("email cooldown", "reason_code", RejectEmailCooldown, "from", logEmail(cfg, p.Email), "retry_after", wait)
+		return nil, &rejection{reason: RejectEmailCooldown, msg: "rate limited", status: http.StatusTooManyRequests, retry: wait}
+	}
+	return cooldown, nil
+}
+
+// checkSendBudget takes what sending one email costs: a <SITE>_WARMUP_DAYS
+// slot, a token from the site's <SITE>_SEND_BURST budget and one from
+// GLOBAL_SEND_RATE_PER_MINUTE. Whatever was taken is handed back when a
+// later check refuses. It returns when the warmup slot was taken, for
+// refundSendBudget if the email then isn't sent.
+func checkSendBudget(logger *slog.Logger, cfg *Config, info *RequestInfo, cs *SiteCfg) (time.Time, *rejection) {
+	taken := nowFunc()
+	ok, wait, err := takeWarmup(cfg, cs, taken)
+	if err != nil {
+		logger.Warn("saving warmup state failed", "err", err)
+	}
+	if !ok {
+		logger.Warn("warmup daily cap reached", "reason_code", RejectWarmupLimited, "retry_after", wait)
+		return taken, &rejection{reason: RejectWarmupLimited, msg: "temporarily unavailable", status: http.StatusServiceUnavailable, retry: wait}
+	}
+	if !allowSend(cfg, cs) {
+		refundSendBudget(logger, cfg, cs, taken)
+		warnRejection(logger, cfg, info, RejectSendRateLimited, "send rate limited")
+		return taken, &rejection{reason: RejectSendRateLimited, msg: "rate limited", status: http.StatusTooManyRequests}
+	}
+	if ok, wait := allowGlobalSend(cfg); !ok {
+		refundSend(cs)
+		refundSendBudget(logger, cfg, cs, taken)
+		logger.Warn("global send rate exceeded", "reason_code", RejectGlobalSendLimited, "retry_after", wait)
+		return taken, &rejection{reason: RejectGlobalSendLimited, msg: "temporarily unavailable", status: http.StatusServiceUnavailable, retry: wait}
+	}
+	return taken, nil
+}
+
+// refundSendBudget gives back the warmup slot checkSendBudget took at
+// taken, for an email that wasn't sent.
+func refundSendBudget(logger *slog.Logger, cfg *Config, cs *SiteCfg, taken time.Time) {
+	if err := refundWarmup(cfg, cs, taken); err != nil {
+		logger.Warn("saving warmup state failed", "err", err)
+	}
+}
@@ -1,30 +1,60 @@
 package form_mailer
 
 import (
+	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"mime"
 	"net"
 	"net/http"
-	"net/smtp"
+	"net/mail"
+	"net/url"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/jordan-wright/email"
 )
 
 var sendEmailFunc = sendEmailSMTP
 
+// preflightAllowHeaders lists the request headers a form may send.
+const preflightAllowHeaders = "Content-Type, X-Signature, X-Signature-Timestamp, X-Form-Token, Idempotency-Key, X-Api-Key"
+
 // Parse payload (JSON or form)
 type ContactRequest struct {
 	Name    string `json:"name"`
 	Email   string `json:"email"`
 	Message string `json:"message"`
 	Website string `json:"website,omitempty"` // honeypot
+
+	// Priority is the normalized "high"/"low" level, or "" for normal.
+	Priority string `json:"-"`
+	// Fields holds any other scalar values, typed per <SITE>_FIELD_TYPES.
+	Fields map[string]any `json:"fields,omitempty"`
+	// Language is the DETECT_LANGUAGE guess for Message, or "" when off.
+	Language string `json:"-"`
+	// Subject is the sanitized "subject" field with
+	// <SITE>_ALLOW_SUBMITTER_SUBJECT, or "". It reaches the envelope as
+	// fields.subject.
+	Subject string `json:"-"`
+	// ContactPreference is the lowercased contact_preference field with
+	// <SITE>_CONTACT_PREFERENCES, or "".
+	ContactPreference string `json:"-"`
+	// RequestedSite is the unknown site key DEFAULT_SITE_KEY stood in
+	// for, or "".
+	RequestedSite string `json:"-"`
 }
 
 func HandleHealth(w http.ResponseWriter, r *http.Request) {
@@ -32,186 +62,931 @@ func HandleHealth(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte("ok"))
 }
 
+// HandleReady is the readiness probe; it fails while in maintenance mode so
+// load balancers drain traffic while /health keeps the process alive.
+func HandleReady(w http.ResponseWriter, r *http.Request) {
+	cfg := GetConfig()
+	if cfg.MaintenanceMode {
+		http.Error(w, cfg.MaintenanceMessage, http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok"))
+}
+
 func HandleContact(w http.ResponseWriter, r *http.Request) {
 	logger := LoggerFromContext(r.Context())
+	info := RequestInfoFromContext(r.Context())
 	cfg := GetConfig()
+	start := time.Now()
+	defer countContact(info)
 
-	siteKey := strings.TrimPrefix(r.URL.Path, "/v1/contact/")
-	if siteKey == "" || strings.ContainsRune(siteKey, '/') {
-		logger.Warn("bad site key")
-		http.Error(w, "bad site key", http.StatusBadRequest)
+	siteKey := siteKeyFromRequest(cfg, r)
+	if !validSiteKey(siteKey) {
+		logger.Warn("bad site key", "reason_code", RejectBadSiteKey, "source", cfg.SiteKeySource)
+		if preflightUnknownSite(w, r, info, cfg) {
+			return
+		}
+		rejectProbe(w, r, info, cfg, start, RejectBadSiteKey, "bad site key", http.StatusBadRequest)
 		return
 	}
 
-	cs, ok := cfg.Sites[siteKey]
-	if !ok {
-		logger.Warn("unknown site", "site", siteKey)
-		http.Error(w, "unknown site", http.StatusNotFound)
-		return
+	cs, err := cfg.Site(siteKey)
+	if errors.Is(err, errUnknownSite) && cfg.DefaultSiteKey != "" {
+		// Catch-all: handle it as the default site, noting the key used
+		cs, err = cfg.Site(cfg.DefaultSiteKey)
 	}
-	logger = logger.With("site", cs.Key)
-
-	origin := r.Header.Get("Origin")
-	allowedOrigin, originOK := matchOrigin(origin, cs.AllowedOrigins)
-
-	if r.Method == http.MethodOptions {
-		if len(cs.AllowedOrigins) > 0 && origin != "" && !originOK {
-			logger.Warn("origin not allowed", "origin", origin)
-			http.Error(w, "origin not allowed", http.StatusForbidden)
+	if errors.Is(err, errUnknownSite) {
+		logger.Warn("unknown site", "reason_code", RejectUnknownSite, "site", siteKey)
+		if preflightUnknownSite(w, r, info, cfg) {
 			return
 		}
-		applyCORSHeaders(w, allowedOrigin)
-		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Signature")
-		w.Header().Set("Access-Control-Max-Age", "300")
-		w.WriteHeader(http.StatusNoContent)
+		rejectProbe(w, r, info, cfg, start, RejectUnknownSite, "unknown site", http.StatusNotFound)
 		return
 	}
-	if r.Method != http.MethodPost {
-		logger.Warn("method not allowed")
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	if err != nil {
+		logger.Error("site config invalid", "reason_code", RejectSiteMisconfigured, "site", siteKey, "err", err)
+		reject(w, info, RejectSiteMisconfigured, "site misconfigured", http.StatusInternalServerError)
 		return
 	}
+	submissionID := newSubmissionID()
+	logger = withSiteLevel(logger, cs).With("site", cs.Key, "submission_id", submissionID)
+	if siteKey != cs.Key {
+		logger = logger.With("requested_site", siteKey)
+	}
+	info.Site = cs.Key
+	info.SubmissionID = submissionID
 
-	// CORS for that site (exact match)
-	if len(cs.AllowedOrigins) > 0 {
-		if origin != "" && !originOK {
-			logger.Warn("origin not allowed", "origin", origin)
-			http.Error(w, "origin not allowed", http.StatusForbidden)
+	if handleCORS(w, r, logger, cfg, info, cs, start) {
+		return
+	}
+	if rej := checkCaller(logger, cfg, info, cs, r); rej != nil {
+		if rej.fake {
+			info.SetRejected(rej.reason)
+			writeSuccess(w, r, submissionID, newReceipt(cs, newSubmission(cs, submissionID, ClientIP(r), ContactRequest{})))
 			return
 		}
-		applyCORSHeaders(w, allowedOrigin)
+		rej.probe = true
+		rejectWith(w, r, info, cfg, start, rej)
+		return
 	}
 
-	ip := clientIP(r)
-	logger = logger.With("ip", ip)
-	if !Allow(siteKey, ip, cfg.RateBurst, cfg.RateRefillMinutes) {
-		logger.Warn("rate limited")
-		http.Error(w, "rate limited", http.StatusTooManyRequests)
+	// A retry with the same Idempotency-Key gets the first answer again
+	// instead of a second email; checked before the rate limit so replays
+	// don't spend it.
+	w, finish, done := handleIdempotencyKey(w, r, logger, cfg, info, cs, start)
+	if done {
 		return
 	}
+	if finish != nil {
+		defer finish()
+	}
 
-	// Read body once for HMAC (and to enforce max size), then re-wrap for decode
-	maxBytes := cfg.MaxBodyKB * 1024
-	body, err := io.ReadAll(io.LimitReader(r.Body, int64(maxBytes)+1))
-	r.Body.Close()
+	ip := ClientIP(r)
+	logger = logger.With("ip", ip)
+	client, err := rateLimitClient(cs, r, ip)
 	if err != nil {
-		logger.Warn("body read error", "err", err)
-		http.Error(w, "read error", http.StatusBadRequest)
+		logger.Warn("invalid api key", "reason_code", RejectInvalidAPIKey)
+		rejectProbe(w, r, info, cfg, start, RejectInvalidAPIKey, "unauthorized", http.StatusUnauthorized)
 		return
 	}
-	if len(body) > maxBytes {
-		logger.Warn("payload too large", "size_bytes", len(body))
-		http.Error(w, "payload too large", http.StatusRequestEntityTooLarge)
+	if client != ip {
+		logger = logger.With("api_key", client)
+	}
+	if !Allow(cs.Key, client, cfg.rateBurstFor(cs), cfg.RateRefillMinutes) {
+		warnRejection(logger, cfg, info, RejectRateLimited, "rate limited")
+		rejectProbe(w, r, info, cfg, start, RejectRateLimited, "rate limited", http.StatusTooManyRequests)
 		return
 	}
 
-	// Optional shared-secret HMAC
-	if cs.Secret != "" {
-		sig := r.Header.Get("X-Signature") // hex(HMAC-SHA256(body, secret))
-		if !verifyHMAC(body, cs.Secret, sig) {
-			logger.Warn("invalid signature")
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
+	maxBytes := cfg.MaxBodyKB * 1024
+	if reason, msg, status := checkContentLength(cfg, r, maxBytes); reason != "" {
+		logger.Warn(msg, "reason_code", reason, "content_length", r.ContentLength, "transfer_encoding", r.TransferEncoding)
+		rejectProbe(w, r, info, cfg, start, reason, msg, status)
+		return
+	}
+	ct := r.Header.Get("Content-Type")
+	upload := strings.HasPrefix(ct, "multipart/form-data") && cfg.AllowForm && cs.AllowAttachments
+	var signer *bodySigner
+	if signatureRequired(cs, r) && !upload {
+		// Read body once for HMAC (and to enforce max size), then re-wrap for decode
+		body, err := io.ReadAll(io.LimitReader(r.Body, int64(maxBytes)+1))
+		r.Body.Close()
+		if err != nil {
+			logger.Warn("body read error", "reason_code", RejectBodyReadError, "err", err)
+			rejectProbe(w, r, info, cfg, start, RejectBodyReadError, "read error", http.StatusBadRequest)
+			return
+		}
+		if len(body) > maxBytes {
+			logger.Warn("payload too large", "reason_code", RejectPayloadTooLarge, "size_bytes", len(body))
+			rejectProbe(w, r, info, cfg, start, RejectPayloadTooLarge, "payload too large", http.StatusRequestEntityTooLarge)
 			return
 		}
-	}
 
-	// Recreate Body for decoding
-	r.Body = io.NopCloser(strings.NewReader(string(body)))
+		// X-Signature: hex(HMAC-SHA256(body, secret))
+		idx, err := checkSignature(cfg, cs, r.Header, body, nowFunc())
+		if err != nil {
+			logSignatureFailure(logger, cs, err)
+			rejectProbe(w, r, info, cfg, start, RejectInvalidSignature, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		logger.Debug("signature verified", "secret_index", idx)
 
-	ct := r.Header.Get("Content-Type")
-	var p = ContactRequest{}
+		// Recreate Body for decoding
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	} else if signatureRequired(cs, r) {
+		// Uploads are too large to buffer: hash them as they stream in and
+		// verify once they have been read
+		signer, err = newBodySigner(cfg, cs, r.Header, nowFunc())
+		if err != nil {
+			logSignatureFailure(logger, cs, err)
+			rejectProbe(w, r, info, cfg, start, RejectInvalidSignature, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		body := http.MaxBytesReader(w, r.Body, int64(maxBytes))
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(body, signer), body}
+	} else {
+		// No signature to verify: decode straight from the capped body
+		if len(cs.Secrets) > 0 {
+			logger.Debug("signature not required for browser origin", "origin", r.Header.Get("Origin"))
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+	}
+
+	values := map[string]any{}
+	var attachments []attachment
 
 	switch {
 	case strings.HasPrefix(ct, "application/json") && cfg.AllowJSON:
-		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
-			logger.Warn("bad json payload", "err", err)
-			http.Error(w, "bad json", http.StatusBadRequest)
+		var dups []string
+		values, dups, err = decodeJSONObject(r.Body, cfg.JSONMaxDepth, cfg.JSONMaxTokens)
+		if err != nil {
+			if isTooLarge(err) {
+				logger.Warn("payload too large", "reason_code", RejectPayloadTooLarge, "max_bytes", maxBytes)
+				rejectProbe(w, r, info, cfg, start, RejectPayloadTooLarge, "payload too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if errors.Is(err, errJSONTooComplex) {
+				logger.Warn("json payload too complex", "reason_code", RejectJSONTooComplex, "err", err)
+				rejectProbe(w, r, info, cfg, start, RejectJSONTooComplex, "json too complex", http.StatusBadRequest)
+				return
+			}
+			logger.Warn("bad json payload", "reason_code", RejectBadJSON, "err", err)
+			rejectProbe(w, r, info, cfg, start, RejectBadJSON, "bad json", http.StatusBadRequest)
+			return
+		}
+		if len(dups) > 0 && cfg.DuplicateFields == duplicateReject {
+			logger.Warn("duplicate json fields", "reason_code", RejectDuplicateField, "fields", dups)
+			rejectProbe(w, r, info, cfg, start, RejectDuplicateField, "duplicate field", http.StatusBadRequest)
+			return
+		}
+		if cfg.JSONDisallowUnknown {
+			if extra := unknownFields(cs, values); len(extra) > 0 {
+				logger.Warn("unknown json fields", "reason_code", RejectBadJSON, "fields", extra)
+				rejectProbe(w, r, info, cfg, start, RejectBadJSON, "unknown fields", http.StatusBadRequest)
+				return
+			}
+		}
+		applyFieldMap(values, cs.FieldMap)
+	case upload:
+		_, params, _ := mime.ParseMediaType(ct)
+		var form url.Values
+		form, attachments, err = readMultipart(r.Body, params["boundary"], cs, int64(cfg.AttachmentSpoolKB)*1024)
+		defer removeSpooled(attachments)
+		if err == nil && signer != nil {
+			// The signature covers the whole body, epilogue included
+			if _, err = io.Copy(io.Discard, r.Body); err == nil {
+				idx, err := signer.verify(r.Header)
+				if err != nil {
+					logSignatureFailure(logger, cs, err)
+					rejectProbe(w, r, info, cfg, start, RejectInvalidSignature, "unauthorized", http.StatusUnauthorized)
+					return
+				}
+				logger.Debug("signature verified", "secret_index", idx)
+			}
+		}
+		if err == nil {
+			values, err = formFields(cfg, cs, form)
+		}
+		if err != nil {
+			if isTooLarge(err) {
+				logger.Warn("payload too large", "reason_code", RejectPayloadTooLarge, "max_bytes", maxBytes)
+				rejectProbe(w, r, info, cfg, start, RejectPayloadTooLarge, "payload too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if errors.Is(err, errAttachmentNotAllowed) {
+				logger.Warn("attachment rejected", "reason_code", RejectAttachmentNotAllowed, "err", err)
+				rejectProbe(w, r, info, cfg, start, RejectAttachmentNotAllowed, "attachment type not allowed", http.StatusUnprocessableEntity)
+				return
+			}
+			if errors.Is(err, errAttachmentsTooLarge) {
+				logger.Warn("attachments too large", "reason_code", RejectAttachmentsTooLarge, "err", err)
+				rejectProbe(w, r, info, cfg, start, RejectAttachmentsTooLarge, "attachments too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if errors.Is(err, errDuplicateField) {
+				logger.Warn("duplicate form field", "reason_code", RejectDuplicateField, "err", err)
+				rejectProbe(w, r, info, cfg, start, RejectDuplicateField, "duplicate field", http.StatusBadRequest)
+				return
+			}
+			logger.Warn("bad multipart payload", "reason_code", RejectBadForm, "err", err)
+			rejectProbe(w, r, info, cfg, start, RejectBadForm, "bad form", http.StatusBadRequest)
 			return
 		}
 	case cfg.AllowForm:
 		if err := r.ParseForm(); err != nil {
-			logger.Warn("bad form payload", "err", err)
-			http.Error(w, "bad form", http.StatusBadRequest)
+			if isTooLarge(err) {
+				logger.Warn("payload too large", "reason_code", RejectPayloadTooLarge, "max_bytes", maxBytes)
+				rejectProbe(w, r, info, cfg, start, RejectPayloadTooLarge, "payload too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			logger.Warn("bad form payload", "reason_code", RejectBadForm, "err", err)
+			rejectProbe(w, r, info, cfg, start, RejectBadForm, "bad form", http.StatusBadRequest)
+			return
+		}
+		if values, err = formFields(cfg, cs, r.Form); err != nil {
+			logger.Warn("duplicate form field", "reason_code", RejectDuplicateField, "err", err)
+			rejectProbe(w, r, info, cfg, start, RejectDuplicateField, "duplicate field", http.StatusBadRequest)
 			return
 		}
-		p.Name = r.Form.Get("name")
-		p.Email = r.Form.Get("email")
-		p.Message = r.Form.Get("message")
-		p.Website = r.Form.Get("website")
 	default:
-		logger.Warn("unsupported content type", "content_type", ct)
-		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		logger.Warn("unsupported content type", "reason_code", RejectUnsupportedType, "content_type", ct)
+		rejectProbe(w, r, info, cfg, start, RejectUnsupportedType, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	p, err := parseSubmission(cfg, cs, values)
+	if err != nil {
+		if strings.HasPrefix(ct, "application/json") {
+			logger.Warn("bad json payload", "reason_code", RejectBadJSON, "err", err)
+			rejectProbe(w, r, info, cfg, start, RejectBadJSON, "bad json", http.StatusBadRequest)
+			return
+		}
+		logger.Warn("bad form payload", "reason_code", RejectBadForm, "err", err)
+		rejectProbe(w, r, info, cfg, start, RejectBadForm, "bad form", http.StatusBadRequest)
+		return
+	}
+	if siteKey != cs.Key {
+		p.RequestedSite = siteKey
+	}
+	logger.Debug("submission parsed", "content_type", ct, "fields", len(values), "attachments", len(attachments))
+
+	formToken, rej := checkFormToken(logger, cfg, info, cs, r, values)
+	if rej != nil {
+		rejectWith(w, r, info, cfg, start, rej)
+		return
+	}
+
+	// Same shape as a real success, receipt included
+	fakeSuccess := func(rej *rejection) {
+		info.SetRejected(rej.reason)
+		writeSuccess(w, r, submissionID, newReceipt(cs, newSubmission(cs, submissionID, ip, p)))
+	}
+	hpToken, rej := checkHoneypot(logger, cfg, info, cs, values, p)
+	if rej != nil {
+		if rej.fake {
+			fakeSuccess(rej)
+			return
+		}
+		rejectWith(w, r, info, cfg, start, rej)
+		return
+	}
+
+	cooldown, rej := checkSubmission(r.Context(), logger, cfg, info, cs, values, &p, len(attachments))
+	if rej != nil {
+		rejectWith(w, r, info, cfg, start, rej)
+		return
+	}
+	defer cooldown.release()
+
+	sub := newSubmission(cs, submissionID, ip, p)
+	sub.Meta.RequestID = info.RequestID
+	if reason, msg, status := checkValidation(r.Context(), logger, cs, sub); reason != "" {
+		reject(w, info, reason, msg, status)
+		return
+	}
+	if rej := claimFormToken(logger, cfg, info, formToken); rej != nil {
+		rejectWith(w, r, info, cfg, start, rej)
+		return
+	}
+	defer formToken.release()
+	if rej := claimHoneypot(logger, cfg, info, hpToken, p); rej != nil {
+		if rej.fake {
+			fakeSuccess(rej)
+			return
+		}
+		rejectWith(w, r, info, cfg, start, rej)
 		return
 	}
+	defer hpToken.release()
+
+	if err := scanAttachments(r.Context(), cfg, attachments); err != nil {
+		if errors.Is(err, errVirusFound) {
+			logger.Warn("attachment flagged by virus scan", "reason_code", RejectVirusFound, "err", err)
+			reject(w, info, RejectVirusFound, "attachment rejected", http.StatusUnprocessableEntity)
+			return
+		}
+		if !cfg.ClamAVFailOpen {
+			logger.Error("virus scan failed", "reason_code", RejectScanFailed, "err", err)
+			reject(w, info, RejectScanFailed, "attachment scan unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		logger.Warn("virus scan failed, accepting attachments unscanned", "err", err)
+	}
 
-	// Honeypot & validation
-	if p.Website != "" || p.Name == "" || !emailRegex.MatchString(p.Email) || strings.TrimSpace(p.Message) == "" {
-		logger.Warn("invalid submission", "from", p.Email)
-		http.Error(w, "invalid submission", http.StatusBadRequest)
+	e, err := composeEmail(cs, submissionID, ip, p)
+	if err != nil {
+		logger.Error("compose failed", "reason_code", RejectSendFailed, "err", err)
+		reject(w, info, RejectSendFailed, "failed to send", http.StatusInternalServerError)
 		return
 	}
+	applyThreadTag(e, cs, p)
+	e.Subject = sanitizeSubject(cs, e.Subject)
+	if info.RequestID != "" {
+		e.Headers.Set("X-Request-ID", info.RequestID)
+	}
+	// A notify-only notice carries no content; attachments travel in the
+	// published submission.
+	if !cs.NotifyOnly {
+		if err := attachAll(e, attachments); err != nil {
+			logger.Error("attach failed", "reason_code", RejectSendFailed, "err", err)
+			reject(w, info, RejectSendFailed, "failed to send", http.StatusInternalServerError)
+			return
+		}
+	}
 
-	// Compose email
+	dumpSubmissionEML(logger, cfg, cs, submissionID, e)
+
+	if cs.DigestInterval > 0 {
+		if err := bufferDigest(cfg, cs, submissionID, e); err != nil {
+			logger.Error("buffering for digest failed", "reason_code", RejectSendFailed, "err", err)
+			reject(w, info, RejectSendFailed, "failed to send", http.StatusInternalServerError)
+			return
+		}
+		logger.Info("submission buffered for digest", "from", logEmail(cfg, p.Email))
+		info.SetOutcome(OutcomeDigestBuffered)
+		cooldown.start(nowFunc())
+		formToken.keep()
+		hpToken.keep()
+		writeSuccess(w, r, submissionID, newReceipt(cs, sub))
+		sendAutoReply(r.Context(), logger, cfg, cs, submissionID, p)
+		return
+	}
+
+	taken, rej := checkSendBudget(logger, cfg, info, cs)
+	if rej != nil {
+		rejectWith(w, r, info, cfg, start, rej)
+		return
+	}
+
+	backend, err := deliverWithFallback(r.Context(), logger, cfg, cs, sub, attachments, e)
+	if err != nil {
+		code := RejectSendFailed
+		if cfg.SendRetry503 && isTransientSendError(err) {
+			code = RejectSendUnavailable
+		}
+		logger.Error("delivery failed", "reason_code", code, "backend", backend, "err", err)
+		refundSendBudget(logger, cfg, cs, taken)
+		notifyFailure(logger, cfg.FailureWebhookURL, sub.failed(err).exported(cfg))
+		if code == RejectSendUnavailable {
+			delay, hint := sendBackoff(cfg)
+			w.Header().Set("Retry-After", strconv.Itoa(int(delay.Seconds())))
+			w.Header().Set("X-Courier-Backoff", hint)
+			reject(w, info, code, "temporarily unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		reject(w, info, RejectSendFailed, "failed to send", http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("contact email sent", "backend", backend, "from", logEmail(cfg, p.Email))
+	info.SetOutcome(OutcomeSent)
+	cooldown.start(nowFunc())
+	formToken.keep()
+	hpToken.keep()
+	deliverShadow(r.Context(), logger, cfg, cs, sub, e)
+
+	writeSuccess(w, r, submissionID, newReceipt(cs, sub))
+	sendAutoReply(r.Context(), logger, cfg, cs, submissionID, p)
+}
+
+// composeEmail builds the notification for a validated submission. From is
+// always the site's configured address; the submitter appears in Reply-To
+// and the body, in Cc with <SITE>_CC_SUBMITTER, and in the subject with
+// <SITE>_FROM_STRICT. It only fails when a body template does.
+func composeEmail(cs *SiteCfg, submissionID, ip string, p ContactRequest) (*email.Email, error) {
+	if cs.NotifyOnly {
+		return composeNotice(cs, submissionID, p.RequestedSite, nowFunc()), nil
+	}
 	subject := strings.TrimSpace(cs.SubjectPrefix + " New contact")
+	if p.Subject != "" {
+		subject = strings.TrimSpace(cs.SubjectPrefix + " " + p.Subject)
+	}
+	message := p.Message
+	if strings.TrimSpace(message) == "" {
+		// Only reachable with <SITE>_MESSAGE_OPTIONAL_WITH_ATTACHMENT.
+		message = "(no message, see attachments)"
+	}
+	ip = emailIP(cs, ip)
 	msg := fmt.Sprintf(
-		"Site: %s\nFrom: %s <%s>\nIP: %s\n\n%s\n",
-		cs.Key, p.Name, p.Email, ip, p.Message,
+		"Site: %s\nSubmission: %s\nFrom: %s <%s>\n",
+		cs.Key, submissionID, p.Name, p.Email,
 	)
+	if ip != "" {
+		msg += "IP: " + ip + "\n"
+	}
+	if p.ContactPreference != "" {
+		// The submitter asked to be answered this way; keep it in sight
+		subject += " (prefers " + p.ContactPreference + ")"
+		msg += "Preferred contact: " + p.ContactPreference + "\n"
+	}
+	if p.Language != "" {
+		msg += "Language: " + p.Language + "\n"
+	}
+	msg += "\n" + message + "\n"
+	if len(p.Fields) > 0 {
+		sep := cs.MultiValueSep
+		if sep == "" {
+			sep = defaultMultiValueSep
+		}
+		msg += "\n--\n" + formatFields(p.Fields, sep)
+	}
+	if cs.FromStrict {
+		// Relays in strict mode may strip Reply-To, so make the submitter
+		// visible in the subject and at the very top of the body.
+		subject = fmt.Sprintf("%s from %s <%s>", subject, p.Name, p.Email)
+		msg = fmt.Sprintf("Reply to: %s <%s>\n\n", p.Name, p.Email) + msg
+	}
+	if p.RequestedSite != "" {
+		subject += fmt.Sprintf(" (site key %q)", p.RequestedSite)
+		msg = "Requested site key: " + p.RequestedSite + "\n" + msg
+	}
+	text, html, err := renderBodies(cs.TextTemplate, cs.HTMLTemplate, newTemplateData(cs, submissionID, ip, p, msg))
+	if err != nil {
+		return nil, err
+	}
 
 	e := email.NewEmail()
 	e.From = cs.FromAddr
 	e.To = []string{cs.To}
-	e.ReplyTo = []string{fmt.Sprintf("%s <%s>", p.Name, p.Email)}
+	e.ReplyTo = []string{submitterAddress(p)}
 	e.Subject = subject
+	e.Text = text
+	e.HTML = html // both set: multipart/alternative
+	setEmailHeaders(e, cs, submissionID)
+	if p.Language != "" {
+		e.Headers.Set("X-Detected-Language", p.Language)
+	}
+	if p.ContactPreference != "" {
+		e.Headers.Set("X-Contact-Preference", p.ContactPreference)
+	}
+	applyPriorityHeaders(e, p.Priority)
+	if cs.CCSubmitter {
+		addCC(e, submitterAddress(p), p.Email)
+	}
+	return e, nil
+}
+
+// composeNotice builds the email for <SITE>_NOTIFY_ONLY sites: it says that
+// a submission arrived and nothing about who sent it or what it says, since
+// the submission itself is published to NATS.
+func composeNotice(cs *SiteCfg, submissionID, requestedSite string, received time.Time) *email.Email {
+	e := email.NewEmail()
+	e.From = cs.FromAddr
+	e.To = []string{cs.To}
+	e.Subject = strings.TrimSpace(cs.SubjectPrefix + " New submission")
+	msg := fmt.Sprintf(
+		"Site: %s\nSubmission: %s\nReceived: %s\n\nThe submission content is not included in this email.\n",
+		cs.Key, submissionID, received.UTC().Format(time.RFC3339),
+	)
+	if requestedSite != "" {
+		e.Subject += fmt.Sprintf(" (site key %q)", requestedSite)
+		msg = "Requested site key: " + requestedSite + "\n" + msg
+	}
 	e.Text = []byte(msg)
+	setEmailHeaders(e, cs, submissionID)
+	return e
+}
 
-	if err := sendEmailFunc(cs, e); err != nil {
-		logger.Error("smtp send failed", "err", err)
-		http.Error(w, "failed to send", http.StatusInternalServerError)
-		return
+// setEmailHeaders tags the team email with the site and submission ID,
+// followed by the site's <SITE>_EMAIL_HEADERS, which may override
+// X-Site-Key but not the submission ID.
+func setEmailHeaders(e *email.Email, cs *SiteCfg, submissionID string) {
+	e.Headers.Set("X-Site-Key", cs.Key)
+	for name, value := range cs.EmailHeaders {
+		e.Headers.Set(name, value)
+	}
+	e.Headers.Set("X-Submission-ID", submissionID)
+}
+
+// submitterAddress formats the submitter for an address header, quoting
+// and encoding the name as needed, so names like "Smith, John" or non-ASCII
+// ones survive the parsing the email package does before sending.
+func submitterAddress(p ContactRequest) string {
+	return (&mail.Address{Name: p.Name, Address: p.Email}).String()
+}
+
+// addCC copies addr onto the email unless that address already receives it
+// through To or Cc.
+func addCC(e *email.Email, entry, addr string) {
+	for _, existing := range slices.Concat(e.To, e.Cc) {
+		if a, err := mail.ParseAddress(existing); err == nil && strings.EqualFold(a.Address, addr) {
+			return
+		}
+	}
+	e.Cc = append(e.Cc, entry)
+}
+
+// siteKeyFromRequest extracts the site key according to SITE_KEY_SOURCE.
+func siteKeyFromRequest(cfg *Config, r *http.Request) string {
+	switch cfg.SiteKeySource {
+	case "subdomain":
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		label, rest, ok := strings.Cut(strings.ToLower(host), ".")
+		if !ok || rest == "" {
+			return ""
+		}
+		return label
+	case "header":
+		return strings.TrimSpace(r.Header.Get(cfg.SiteKeyHeader))
+	default:
+		return strings.TrimPrefix(r.URL.Path, "/v1/contact/")
+	}
+}
+
+func validSiteKey(key string) bool {
+	if key == "" || len(key) > 128 {
+		return false
+	}
+	for _, r := range key {
+		if r == '/' || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// contactFromValues fills the canonical fields from a decoded payload. Only
+// form values are guaranteed to be strings, so JSON callers get an error for
+// anything else.
+func contactFromValues(values map[string]any) (ContactRequest, error) {
+	var p ContactRequest
+	fields := map[string]*string{
+		"name":    &p.Name,
+		"email":   &p.Email,
+		"message": &p.Message,
+		"website": &p.Website,
+	}
+	for name, dst := range fields {
+		v, ok := values[name]
+		if !ok || v == nil {
+			continue
+		}
+		s, ok := v.(string)
+		if !ok {
+			return p, fmt.Errorf("field %q must be a string", name)
+		}
+		*dst = s
+	}
+	return p, nil
+}
+
+// applyFieldMap copies values found at dotted paths (e.g. "contact.name") in
+// nested JSON onto their flat field names. Missing paths are left alone so
+// flat payloads keep working with a map configured.
+func applyFieldMap(values map[string]any, fieldMap map[string]string) {
+	for field, path := range fieldMap {
+		if v, ok := lookupPath(values, path); ok {
+			values[field] = v
+		}
+	}
+}
+
+func lookupPath(values map[string]any, path string) (any, bool) {
+	var cur any = values
+	for _, seg := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[seg]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// priorityFor maps the site's priority field onto a level. Unknown or
+// non-string values fall back to normal priority.
+func priorityFor(cs *SiteCfg, values map[string]any) string {
+	if cs.PriorityField == "" {
+		return ""
+	}
+	v, _ := values[cs.PriorityField].(string)
+	return cs.PriorityMap[strings.ToLower(strings.TrimSpace(v))]
+}
+
+const (
+	submitterSubjectField = "subject"
+	// maxSubmitterSubject caps the submitter's part of the subject, in
+	// characters.
+	maxSubmitterSubject = 100
+)
+
+// submitterSubject returns the payload's "subject" field for sites with
+// <SITE>_ALLOW_SUBMITTER_SUBJECT, on one line and capped. Control
+// characters become spaces, so CR/LF can't inject headers.
+func submitterSubject(cs *SiteCfg, values map[string]any) string {
+	if !cs.SubmitterSubject {
+		return ""
+	}
+	v, _ := values[submitterSubjectField].(string)
+	v = strings.Join(strings.Fields(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, v)), " ")
+	if r := []rune(v); len(r) > maxSubmitterSubject {
+		v = strings.TrimSpace(string(r[:maxSubmitterSubject]))
+	}
+	return v
+}
+
+func applyPriorityHeaders(e *email.Email, level string) {
+	switch level {
+	case "high":
+		e.Headers.Set("X-Priority", "1")
+		e.Headers.Set("Importance", "high")
+	case "low":
+		e.Headers.Set("X-Priority", "5")
+		e.Headers.Set("Importance", "low")
+	}
+}
+
+// validateName applies the site's optional name rules. Lengths count runes.
+func validateName(cs *SiteCfg, name string) error {
+	n := utf8.RuneCountInString(name)
+	if cs.NameMinLength > 0 && n < cs.NameMinLength {
+		return fmt.Errorf("must be at least %d characters", cs.NameMinLength)
+	}
+	if cs.NameMaxLength > 0 && n > cs.NameMaxLength {
+		return fmt.Errorf("must be at most %d characters", cs.NameMaxLength)
+	}
+	if cs.NameRejectURLs && urlRegex.MatchString(name) {
+		return errors.New("must not contain links")
 	}
+	return nil
+}
 
-	logger.Info("contact email sent", "from", p.Email)
+// reject records the rejection reason for the access log and writes the
+// error: msg as plain text, or with JSON_ERRORS as
+// {"ok": false, "error": msg, "code": reason, "request_id": ...}.
+func reject(w http.ResponseWriter, info *RequestInfo, reason RejectReason, msg string, status int) {
+	rejectCfg(w, info, GetConfig(), reason, msg, status)
+}
 
+func rejectCfg(w http.ResponseWriter, info *RequestInfo, cfg *Config, reason RejectReason, msg string, status int) {
+	info.SetRejected(reason)
+	if s, ok := cfg.RejectStatus[string(reason)]; ok {
+		status = s
+	}
+	if !cfg.JSONErrors {
+		http.Error(w, msg, status)
+		return
+	}
+	w.Header().Del("Content-Length")
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(map[string]any{"ok": true})
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"ok":         false,
+		"error":      msg,
+		"code":       reason,
+		"request_id": info.RequestID,
+	})
+}
+
+// Reject answers r with a rejection like the handlers do, for the
+// middleware in front of them.
+func Reject(w http.ResponseWriter, r *http.Request, cfg *Config, reason RejectReason, msg string, status int) {
+	rejectCfg(w, RequestInfoFromContext(r.Context()), cfg, reason, msg, status)
+}
+
+// handleCORS applies the site's CORS rules (exact origin match), answers
+// preflights, and refuses anything but a POST from an allowed origin. It
+// reports whether it answered r. An allowed origin gets CORS headers on
+// every response from here on, rejections included, so the page can read
+// why it failed. A disallowed origin only can with CORS_EXPOSE_REJECTIONS.
+func handleCORS(w http.ResponseWriter, r *http.Request, logger *slog.Logger, cfg *Config, info *RequestInfo, cs *SiteCfg, start time.Time) bool {
+	origin := r.Header.Get("Origin")
+	allowedOrigin, originOK := matchOrigin(origin, cs.AllowedOrigins)
+	if !originOK && cfg.CORSExposeRejections {
+		allowedOrigin = origin
+	}
+	applyCORSHeaders(w, allowedOrigin)
+
+	if r.Method == http.MethodOptions {
+		if !originOK && !cfg.CORSExposeRejections {
+			warnRejection(logger, cfg, info, RejectOriginNotAllowed, "origin not allowed", "origin", origin)
+			rejectProbe(w, r, info, cfg, start, RejectOriginNotAllowed, "origin not allowed", http.StatusForbidden)
+			return true
+		}
+		// With CORS_EXPOSE_REJECTIONS a disallowed origin passes preflight so
+		// the browser sends the real request and can read its 403.
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", preflightAllowHeaders)
+		// Only a real approval is worth caching; a disallowed origin let
+		// through for CORS_EXPOSE_REJECTIONS should ask again next time.
+		if originOK && allowedOrigin != "" && cfg.CORSMaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.CORSMaxAge.Seconds())))
+		}
+		info.SetOutcome(OutcomePreflight)
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+	if r.Method != http.MethodPost {
+		logger.Warn("method not allowed", "reason_code", RejectMethodNotAllowed)
+		rejectProbe(w, r, info, cfg, start, RejectMethodNotAllowed, "method not allowed", http.StatusMethodNotAllowed)
+		return true
+	}
+
+	if !originOK {
+		warnRejection(logger, cfg, info, RejectOriginNotAllowed, "origin not allowed", "origin", origin)
+		rejectProbe(w, r, info, cfg, start, RejectOriginNotAllowed, "origin not allowed", http.StatusForbidden)
+		return true
+	}
+	return false
+}
+
+// rejectProbe answers the rejections that tell a valid site key from an
+// unknown one: those for the key itself and every refusal a known site
+// makes before the submission is read. With OBSCURE_SITE_KEYS they all
+// become the same plain 403, sent no sooner than OBSCURE_MIN_RESPONSE after
+// start, so neither the status, the body nor the timing gives the key away;
+// the access log keeps the real reason. A client that hangs up meanwhile
+// gets no answer.
+func rejectProbe(w http.ResponseWriter, r *http.Request, info *RequestInfo, cfg *Config, start time.Time, reason RejectReason, msg string, status int) {
+	if !cfg.ObscureSiteKeys {
+		reject(w, info, reason, msg, status)
+		return
+	}
+	info.SetRejected(reason)
+	if d := cfg.ObscureMinResponse - time.Since(start); d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	http.Error(w, "forbidden", http.StatusForbidden)
 }
 
-func clientIP(r *http.Request) string {
-	if xf := r.Header.Get("X-Forwarded-For"); xf != "" {
-		parts := strings.Split(xf, ",")
-		return strings.TrimSpace(parts[0])
+// preflightUnknownSite answers a preflight for a missing, malformed or
+// unknown site key when CORS_PREFLIGHT_UNKNOWN_SITES allows it, and reports
+// whether it did. The approval is bare and never cached: the POST that
+// follows still gets its 400 or 404, which the browser's network panel
+// shows plainly instead of a failed preflight. OBSCURE_SITE_KEYS wins, as a
+// 204 here would tell unknown keys from known ones.
+func preflightUnknownSite(w http.ResponseWriter, r *http.Request, info *RequestInfo, cfg *Config) bool {
+	if r.Method != http.MethodOptions || !cfg.CORSPreflightUnknown || cfg.ObscureSiteKeys {
+		return false
+	}
+	applyCORSHeaders(w, r.Header.Get("Origin"))
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", preflightAllowHeaders)
+	info.SetOutcome(OutcomePreflightUnknownSite)
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// checkContentLength applies REQUIRE_CONTENT_LENGTH before the body is
+// read: requests without a Content-Length, chunked ones included, get a
+// 411, and a declared length over maxBytes gets its 413 straight away. The
+// size-limit readers still cap what is actually read.
+func checkContentLength(cfg *Config, r *http.Request, maxBytes int) (reason RejectReason, msg string, status int) {
+	if !cfg.RequireContentLength {
+		return "", "", 0
+	}
+	if r.ContentLength < 0 || slices.Contains(r.TransferEncoding, "chunked") {
+		return RejectLengthRequired, "length required", http.StatusLengthRequired
+	}
+	if r.ContentLength > int64(maxBytes) {
+		return RejectPayloadTooLarge, "payload too large", http.StatusRequestEntityTooLarge
+	}
+	return "", "", 0
+}
+
+// isTooLarge reports whether err came from hitting the MaxBytesReader cap.
+func isTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// ClientIP returns the submitter's address, preferring X-Forwarded-For,
+// read across all its header lines: its first entry, or with
+// TRUSTED_PROXY_COUNT the entry the outermost trusted proxy added, so
+// entries the client made up are ignored. A chain shorter than
+// TRUSTED_PROXY_COUNT didn't come through all the proxies, so it is not
+// trusted and the peer address is used.
+func ClientIP(r *http.Request) string {
+	if xf := r.Header.Values("X-Forwarded-For"); len(xf) > 0 {
+		if n := GetConfig().TrustedProxyCount; n > 0 {
+			if hop, ok := forwardedHop(xf, n); ok {
+				return hop
+			}
+		} else {
+			for _, line := range xf {
+				if first, _, _ := strings.Cut(line, ","); strings.TrimSpace(first) != "" {
+					return strings.TrimSpace(first)
+				}
+			}
+		}
 	}
 	host, _, _ := net.SplitHostPort(r.RemoteAddr)
 	return host
 }
 
-func verifyHMAC(body []byte, secret, hexSig string) bool {
-	if secret == "" || hexSig == "" {
-		return false
+// forwardedHop returns the n-th X-Forwarded-For entry from the right,
+// across all header lines, skipping blank ones. It reports false when the
+// chain is shorter. It reads no further left than that, so a chain padded
+// with thousands of entries costs no more than a short one.
+func forwardedHop(lines []string, n int) (string, bool) {
+	for i := len(lines) - 1; i >= 0; i-- {
+		rest := lines[i]
+		if strings.TrimSpace(rest) == "" {
+			continue
+		}
+		for {
+			j := strings.LastIndexByte(rest, ',')
+			if n--; n == 0 {
+				return strings.TrimSpace(rest[j+1:]), true
+			}
+			if j < 0 {
+				break
+			}
+			rest = rest[:j]
+		}
 	}
-	m := hmac.New(sha256.New, []byte(secret))
-	m.Write(body)
-	sum := m.Sum(nil)
-	want := strings.ToLower(hex.EncodeToString(sum))
-	have := strings.ToLower(hexSig)
-	// constant-time compare
-	return hmac.Equal([]byte(want), []byte(have))
+	return "", false
 }
 
-func sendEmailSMTP(cs *SiteCfg, e *email.Email) error {
+// verifyHMAC returns the index of the secret that signed body, or -1. Every
+// secret is checked so the timing doesn't reveal which one matched.
+func verifyHMAC(body []byte, secrets []string, hexSig string) int {
+	if hexSig == "" {
+		return -1
+	}
+	have := []byte(strings.ToLower(hexSig))
+	matched := -1
+	for i, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		m := hmac.New(sha256.New, []byte(secret))
+		m.Write(body)
+		want := []byte(hex.EncodeToString(m.Sum(nil)))
+		// constant-time compare
+		if hmac.Equal(want, have) && matched < 0 {
+			matched = i
+		}
+	}
+	return matched
+}
+
+func sendEmailSMTP(ctx context.Context, cs *SiteCfg, e *email.Email) error {
 	if cs.SMTP == nil {
 		return fmt.Errorf("smtp config missing for site %s", cs.Key)
 	}
 
 	addr := net.JoinHostPort(cs.SMTP.Host, strconv.Itoa(cs.SMTP.Port))
-	auth := smtp.PlainAuth("", cs.SMTP.User, cs.SMTP.Pass, cs.SMTP.Host)
+	cfg := GetConfig()
+	release, err := acquireSMTPSlot(ctx, addr, cfg.SMTPMaxPerHost, cfg.SMTPSlotTimeout)
+	if err != nil {
+		return fmt.Errorf("smtp %s: %w", addr, err)
+	}
+	defer release()
+	auth := smtpAuth(cs.SMTP)
 
+	tlsCfg := &tls.Config{ServerName: cs.SMTP.Host}
+	if cs.SMTP.ClientCert != nil {
+		tlsCfg.Certificates = []tls.Certificate{*cs.SMTP.ClientCert}
+	}
 	if cs.SMTP.SSL {
-		tlsCfg := &tls.Config{ServerName: cs.SMTP.Host}
 		return e.SendWithTLS(addr, auth, tlsCfg)
 	}
+	if cs.SMTP.ClientCert != nil {
+		// Send negotiates STARTTLS with a default config, so it can't present a certificate
+		return e.SendWithStartTLS(addr, auth, tlsCfg)
+	}
 	return e.Send(addr, auth)
 }
 
@@ -230,6 +1005,29 @@ func matchOrigin(origin string, allowed []string) (string, bool) {
 	return "", false
 }
 
+// refererAllowed checks the page a form was posted from against the site's
+// allowed origins, using Origin when the browser sent one and Referer
+// otherwise. Plain cross-site form posts skip CORS, so this is their CSRF
+// check. Requests with neither header pass only with
+// <SITE>_REFERER_ALLOW_MISSING, since privacy tools often strip Referer.
+// "Origin: null" is an origin, an opaque one such as a sandboxed iframe's,
+// and is never allowed: any page can send it with no Referer.
+func refererAllowed(r *http.Request, cs *SiteCfg) bool {
+	source := r.Header.Get("Origin")
+	if source == "null" {
+		return false
+	}
+	if source == "" {
+		ref, err := url.Parse(r.Referer())
+		if err != nil || ref.Scheme == "" || ref.Host == "" {
+			return r.Referer() == "" && cs.AllowNoReferer
+		}
+		source = ref.Scheme + "://" + ref.Host
+	}
+	_, ok := matchOrigin(source, cs.AllowedOrigins)
+	return ok
+}
+
 func applyCORSHeaders(w http.ResponseWriter, allowedOrigin string) {
 	if allowedOrigin == "" {
 		return
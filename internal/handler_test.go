@@ -2,12 +2,29 @@ package form_mailer
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/jordan-wright/email"
 )
@@ -25,6 +42,7 @@ func setupTestConfig(t *testing.T) {
 		AllowForm:         true,
 		MaxBodyKB:         1024,
 		ListenAddr:        ":0",
+		TrimFields:        true,
 		Sites: map[string]*SiteCfg{
 			"acme": {
 				Key:           "acme",
@@ -44,6 +62,8 @@ func setupTestConfig(t *testing.T) {
 
 	bucketsMu.Lock()
 	buckets = map[string]*Bucket{}
+	budgets = map[string]*budget{}
+	bucketLRU.Init()
 	bucketsMu.Unlock()
 
 	t.Cleanup(func() {
@@ -51,6 +71,8 @@ func setupTestConfig(t *testing.T) {
 		sendEmailFunc = prevSend
 		bucketsMu.Lock()
 		buckets = map[string]*Bucket{}
+		budgets = map[string]*budget{}
+		bucketLRU.Init()
 		bucketsMu.Unlock()
 	})
 }
@@ -63,7 +85,7 @@ func TestHandleContactJSONSuccess(t *testing.T) {
 		mu            sync.Mutex
 	)
 
-	sendEmailFunc = func(site *SiteCfg, e *email.Email) error {
+	sendEmailFunc = func(_ context.Context, site *SiteCfg, e *email.Email) error {
 		mu.Lock()
 		defer mu.Unlock()
 		capturedEmail = e
@@ -105,13 +127,23 @@ func TestHandleContactJSONSuccess(t *testing.T) {
 	if ok, _ := resp["ok"].(bool); !ok {
 		t.Fatalf("expected ok=true in response, got %v", resp)
 	}
+	id, _ := resp["submission_id"].(string)
+	if len(id) != 36 {
+		t.Fatalf("expected a UUID submission_id in response, got %v", resp)
+	}
+	if got := capturedEmail.Headers.Get("X-Submission-ID"); got != id {
+		t.Fatalf("expected X-Submission-ID %q, got %q", id, got)
+	}
+	if got := string(capturedEmail.Text); !strings.Contains(got, id) {
+		t.Fatalf("email body missing submission id: %q", got)
+	}
 }
 
 func TestHandleContactRateLimited(t *testing.T) {
 	setupTestConfig(t)
 
 	var calls int
-	sendEmailFunc = func(site *SiteCfg, e *email.Email) error {
+	sendEmailFunc = func(_ context.Context, site *SiteCfg, e *email.Email) error {
 		calls++
 		return nil
 	}
@@ -144,7 +176,7 @@ func TestHandleContactCORSAllowed(t *testing.T) {
 	setupTestConfig(t)
 	conf.Sites["acme"].AllowedOrigins = []string{"https://example.com"}
 
-	sendEmailFunc = func(site *SiteCfg, e *email.Email) error {
+	sendEmailFunc = func(_ context.Context, site *SiteCfg, e *email.Email) error {
 		return nil
 	}
 
@@ -164,12 +196,41 @@ func TestHandleContactCORSAllowed(t *testing.T) {
 	}
 }
 
+func TestHandleContactPreflightMaxAge(t *testing.T) {
+	setupTestConfig(t)
+	conf.Sites["acme"].AllowedOrigins = []string{"https://allowed.example.com"}
+	conf.CORSMaxAge = 2 * time.Hour
+	conf.CORSExposeRejections = true
+
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, "/v1/contact/acme", nil)
+		req.Header.Set("Origin", origin)
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("%s: expected status 204, got %d", origin, rec.Code)
+		}
+		return rec
+	}
+	if got := preflight("https://allowed.example.com").Header().Get("Access-Control-Max-Age"); got != "7200" {
+		t.Fatalf("expected Access-Control-Max-Age 7200 for an allowed origin, got %q", got)
+	}
+	if got := preflight("https://blocked.example.com").Header().Get("Access-Control-Max-Age"); got != "" {
+		t.Fatalf("a disallowed origin's preflight must not be cached, got %q", got)
+	}
+
+	conf.CORSMaxAge = 0
+	if got := preflight("https://allowed.example.com").Header().Get("Access-Control-Max-Age"); got != "" {
+		t.Fatalf("expected no Access-Control-Max-Age with CORS_MAX_AGE_SECONDS=0, got %q", got)
+	}
+}
+
 func TestHandleContactCORSForbidden(t *testing.T) {
 	setupTestConfig(t)
 	conf.Sites["acme"].AllowedOrigins = []string{"https://allowed.example.com"}
 
 	var calls int
-	sendEmailFunc = func(site *SiteCfg, e *email.Email) error {
+	sendEmailFunc = func(_ context.Context, site *SiteCfg, e *email.Email) error {
 		calls++
 		return nil
 	}
@@ -188,13 +249,56 @@ func TestHandleContactCORSForbidden(t *testing.T) {
 	if calls != 0 {
 		t.Fatalf("expected sendEmailFunc not to be called, got %d", calls)
 	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Fatalf("expected no Access-Control-Allow-Origin, got %q", got)
+	}
+
+	conf.CORSExposeRejections = true
+	req = httptest.NewRequest(http.MethodOptions, "/v1/contact/acme", nil)
+	req.Header.Set("Origin", "https://blocked.example.com")
+	rec = httptest.NewRecorder()
+	HandleContact(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected preflight to pass with CORS_EXPOSE_REJECTIONS, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Origin", "https://blocked.example.com")
+	rec = httptest.NewRecorder()
+	HandleContact(rec, req)
+	if rec.Code != http.StatusForbidden || calls != 0 {
+		t.Fatalf("expected status 403 and no email, got %d (%d sends)", rec.Code, calls)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://blocked.example.com" {
+		t.Fatalf("expected the 403 to be readable by the page, got %q", got)
+	}
+}
+
+func TestHandleContactCORSHeadersOnRejection(t *testing.T) {
+	setupTestConfig(t)
+	conf.Sites["acme"].AllowedOrigins = []string{"https://example.com"}
+
+	// Invalid submission from an allowed origin: still readable cross-origin.
+	req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(`{"name":"Alice"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Origin", "https://example.com")
+	rec := httptest.NewRecorder()
+	HandleContact(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://example.com" {
+		t.Fatalf("expected Access-Control-Allow-Origin on the rejection, got %q", got)
+	}
 }
 
 func TestHandleContactCORSWildcard(t *testing.T) {
 	setupTestConfig(t)
 	conf.Sites["acme"].AllowedOrigins = []string{"*"}
 
-	sendEmailFunc = func(site *SiteCfg, e *email.Email) error {
+	sendEmailFunc = func(_ context.Context, site *SiteCfg, e *email.Email) error {
 		return nil
 	}
 
@@ -227,3 +331,1893 @@ func TestHandleHealth(t *testing.T) {
 		t.Fatalf("unexpected body: %q", got)
 	}
 }
+
+func TestHandleContactRecordsRequestInfo(t *testing.T) {
+	setupTestConfig(t)
+
+	sendEmailFunc = func(_ context.Context, site *SiteCfg, e *email.Email) error {
+		return nil
+	}
+
+	send := func(body string) *RequestInfo {
+		info := &RequestInfo{}
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req = req.WithContext(ContextWithRequestInfo(req.Context(), info))
+		HandleContact(httptest.NewRecorder(), req)
+		return info
+	}
+
+	info := send(`{"name":"Alice","email":"alice@example.com","message":"Hello there"}`)
+	if info.Site != "acme" || info.Reason() != string(OutcomeSent) {
+		t.Fatalf("unexpected request info on success: %+v", info)
+	}
+
+	info = send(`{"name":"Alice","email":"not-an-email","message":"Hello there"}`)
+	if info.Site != "acme" || info.Reason() != string(RejectInvalidSubmission) {
+		t.Fatalf("unexpected request info on rejection: %+v", info)
+	}
+}
+
+func TestHandleContactSiteLogLevel(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return nil }
+
+	var buf bytes.Buffer
+	base := slog.New(NewLevelHandler(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}), slog.LevelInfo))
+	post := func() {
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(`{"name":"Alice","email":"alice@example.com","message":"Hello"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req = req.WithContext(ContextWithLogger(req.Context(), base.With("request_id", "r1")))
+		HandleContact(httptest.NewRecorder(), req)
+	}
+
+	post()
+	if strings.Contains(buf.String(), "level=DEBUG") {
+		t.Fatalf("expected no debug logs at the global level:\n%s", buf.String())
+	}
+
+	conf.Sites["acme"].LogLevel = slog.LevelDebug
+	post()
+	if !strings.Contains(buf.String(), "level=DEBUG") || !strings.Contains(buf.String(), "request_id=r1") {
+		t.Fatalf("expected debug logs with the request's attributes for the site:\n%s", buf.String())
+	}
+	if !base.Enabled(context.Background(), slog.LevelInfo) || base.Enabled(context.Background(), slog.LevelDebug) {
+		t.Fatal("the base logger's level must not change")
+	}
+}
+
+func TestHandleContactFailureWebhook(t *testing.T) {
+	setupTestConfig(t)
+
+	events := make(chan Submission, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev Submission
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Errorf("decode webhook body: %v", err)
+		}
+		if v := r.Header.Get("X-Schema-Version"); v != SchemaVersion {
+			t.Errorf("unexpected X-Schema-Version %q", v)
+		}
+		events <- ev
+	}))
+	defer hook.Close()
+	conf.FailureWebhookURL = hook.URL
+
+	var requestIDHeader string
+	sendEmailFunc = func(_ context.Context, site *SiteCfg, e *email.Email) error {
+		requestIDHeader = e.Headers.Get("X-Request-ID")
+		return errors.New("connection refused")
+	}
+
+	body := `{"name":"Alice","email":"alice@example.com","message":"Hello there"}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req = req.WithContext(ContextWithRequestInfo(req.Context(), &RequestInfo{RequestID: "req-42"}))
+	rec := httptest.NewRecorder()
+
+	HandleContact(rec, req)
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500, got %d", rec.Code)
+	}
+
+	select {
+	case ev := <-events:
+		if ev.Event != eventDeliveryFailed || ev.Site != "acme" || ev.Fields["email"] != "alice@example.com" || ev.Meta.Error != "connection refused" {
+			t.Fatalf("unexpected webhook event: %+v", ev)
+		}
+		if ev.Meta.RequestID != "req-42" || requestIDHeader != "req-42" {
+			t.Fatalf("request ID not propagated: webhook %q, email header %q", ev.Meta.RequestID, requestIDHeader)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("failure webhook was not called")
+	}
+}
+
+func TestHandleContactValidationWebhook(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	sent := 0
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error {
+		sent++
+		return nil
+	}
+
+	var (
+		status = http.StatusOK
+		answer string
+		event  Submission
+	)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("decode webhook body: %v", err)
+		}
+		w.WriteHeader(status)
+		io.WriteString(w, answer)
+	}))
+	defer hook.Close()
+	cs := conf.Sites["acme"]
+	cs.ValidationURL = hook.URL
+	cs.ValidationStatus = http.StatusForbidden
+	cs.ValidationTimeout = time.Second
+
+	post := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(`{"name":"Alice","email":"alice@example.com","message":"Hello there"}`))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		return rec
+	}
+
+	answer = `{"accept":true}`
+	if rec := post(); rec.Code != http.StatusOK || sent != 1 {
+		t.Fatalf("expected accepted submission to be sent, got %d (sent %d)", rec.Code, sent)
+	}
+	if event.Event != eventValidate || event.Site != "acme" || event.Fields["email"] != "alice@example.com" {
+		t.Fatalf("unexpected validation event: %+v", event)
+	}
+
+	answer = `{"accept":false,"message":"Please use the customer portal."}`
+	if rec := post(); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "customer portal") {
+		t.Fatalf("expected 403 with the webhook's message, got %d: %s", rec.Code, rec.Body)
+	}
+
+	status, answer = http.StatusBadRequest, ""
+	if rec := post(); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "submission rejected") {
+		t.Fatalf("expected 4xx answer to reject, got %d: %s", rec.Code, rec.Body)
+	}
+
+	status = http.StatusInternalServerError
+	if rec := post(); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 when the webhook fails closed, got %d", rec.Code)
+	}
+	cs.ValidationFailOpen = true
+	if rec := post(); rec.Code != http.StatusOK || sent != 2 {
+		t.Fatalf("expected fail-open to send, got %d (sent %d)", rec.Code, sent)
+	}
+}
+
+func TestClientIPTrustedProxies(t *testing.T) {
+	setupTestConfig(t)
+	ip := func(lines ...string) string {
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", nil)
+		req.RemoteAddr = "10.0.0.9:4711"
+		for _, l := range lines {
+			req.Header.Add("X-Forwarded-For", l)
+		}
+		return ClientIP(req)
+	}
+
+	if got := ip("6.6.6.6, 203.0.113.7, 10.0.0.2"); got != "6.6.6.6" {
+		t.Fatalf("without trusted proxies, expected the first entry, got %q", got)
+	}
+	if got := ip(); got != "10.0.0.9" {
+		t.Fatalf("without the header, expected the peer address, got %q", got)
+	}
+	if got := ip("", "6.6.6.6, 10.0.0.2"); got != "6.6.6.6" {
+		t.Fatalf("expected a blank first line skipped, got %q", got)
+	}
+
+	conf.TrustedProxyCount = 2
+	for _, tc := range []struct {
+		lines []string
+		want  string
+	}{
+		{[]string{"6.6.6.6, 203.0.113.7, 10.0.0.2"}, "203.0.113.7"},
+		{[]string{"6.6.6.6,203.0.113.7", "10.0.0.2"}, "203.0.113.7"},
+		{[]string{"6.6.6.6", "203.0.113.7", "10.0.0.2"}, "203.0.113.7"},
+		{[]string{"", "203.0.113.7, 10.0.0.2"}, "203.0.113.7"},
+		{[]string{"203.0.113.7", ""}, "10.0.0.9"},
+		{[]string{"203.0.113.7"}, "10.0.0.9"},
+		{nil, "10.0.0.9"},
+		{[]string{strings.Repeat("6.6.6.6, ", 5000) + "203.0.113.7, 10.0.0.2"}, "203.0.113.7"},
+	} {
+		if got := ip(tc.lines...); got != tc.want {
+			t.Errorf("%.40q: got %q, want %q", tc.lines, got, tc.want)
+		}
+	}
+}
+
+func TestHandleContactRequireContentLength(t *testing.T) {
+	setupTestConfig(t)
+	conf.MaxBodyKB = 1
+	conf.RateBurst = 10
+	conf.RequireContentLength = true
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return nil }
+
+	post := func(body string, length int64, chunked bool) int {
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.ContentLength = length
+		if chunked {
+			req.TransferEncoding = []string{"chunked"}
+		}
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		return rec.Code
+	}
+
+	body := `{"name":"Alice","email":"alice@example.com","message":"Hello"}`
+	if code := post(body, int64(len(body)), false); code != http.StatusOK {
+		t.Fatalf("expected status 200 with a Content-Length, got %d", code)
+	}
+	if code := post(body, -1, true); code != http.StatusLengthRequired {
+		t.Fatalf("expected status 411 for a chunked body, got %d", code)
+	}
+	if code := post(body, -1, false); code != http.StatusLengthRequired {
+		t.Fatalf("expected status 411 without a Content-Length, got %d", code)
+	}
+	if code := post(body, 4096, false); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status 413 for a declared length over MAX_BODY_KB, got %d", code)
+	}
+	// A body longer than it claims still meets the size limit
+	long := `{"name":"Alice","email":"alice@example.com","message":"` + strings.Repeat("a", 2048) + `"}`
+	if code := post(long, 100, false); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected the size limit to still apply, got %d", code)
+	}
+
+	conf.RequireContentLength = false
+	if code := post(body, -1, true); code != http.StatusOK {
+		t.Fatalf("expected chunked bodies accepted with the option off, got %d", code)
+	}
+}
+
+func TestHandleContactPayloadTooLarge(t *testing.T) {
+	setupTestConfig(t)
+	conf.MaxBodyKB = 1
+	conf.RateBurst = 10
+
+	var calls int
+	sendEmailFunc = func(_ context.Context, site *SiteCfg, e *email.Email) error {
+		calls++
+		return nil
+	}
+
+	message := strings.Repeat("a", 2048)
+	cases := map[string]string{
+		"application/json":                  `{"name":"Alice","email":"alice@example.com","message":"` + message + `"}`,
+		"application/x-www-form-urlencoded": "name=Alice&email=alice%40example.com&message=" + message,
+	}
+	for ct, body := range cases {
+		for _, secret := range []string{"", "s3cret"} {
+			conf.Sites["acme"].Secrets = splitString(secret)
+			req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+			req.Header.Set("Content-Type", ct)
+			rec := httptest.NewRecorder()
+
+			HandleContact(rec, req)
+
+			if rec.Code != http.StatusRequestEntityTooLarge {
+				t.Fatalf("%s (secret=%q): expected status 413, got %d", ct, secret, rec.Code)
+			}
+		}
+	}
+	if calls != 0 {
+		t.Fatalf("expected sendEmailFunc not to be called, got %d", calls)
+	}
+}
+
+func TestHandleContactPriorityHeaders(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.Sites["acme"].PriorityField = "urgency"
+	conf.Sites["acme"].PriorityMap = map[string]string{"urgent": "high", "whenever": "low"}
+
+	var captured *email.Email
+	sendEmailFunc = func(_ context.Context, site *SiteCfg, e *email.Email) error {
+		captured = e
+		return nil
+	}
+
+	cases := []struct {
+		urgency    string
+		xPriority  string
+		importance string
+	}{
+		{"URGENT", "1", "high"},
+		{"whenever", "5", "low"},
+		{"bogus", "", ""},
+	}
+	for _, tc := range cases {
+		body := `{"name":"Alice","email":"alice@example.com","message":"Hello","urgency":"` + tc.urgency + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+
+		HandleContact(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", tc.urgency, rec.Code)
+		}
+		if got := captured.Headers.Get("X-Priority"); got != tc.xPriority {
+			t.Fatalf("%s: unexpected X-Priority %q", tc.urgency, got)
+		}
+		if got := captured.Headers.Get("Importance"); got != tc.importance {
+			t.Fatalf("%s: unexpected Importance %q", tc.urgency, got)
+		}
+	}
+}
+
+func TestHandleContactSubmitterSubject(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+
+	var captured *email.Email
+	sendEmailFunc = func(_ context.Context, site *SiteCfg, e *email.Email) error {
+		captured = e
+		return nil
+	}
+	post := func(subject string) {
+		t.Helper()
+		body, _ := json.Marshal(map[string]string{"name": "Alice", "email": "alice@example.com", "message": "Hello", "subject": subject})
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+		}
+	}
+
+	post("Billing")
+	if captured.Subject != "[Contact] New contact" {
+		t.Fatalf("subject field must be ignored when the feature is off, got %q", captured.Subject)
+	}
+
+	conf.Sites["acme"].SubmitterSubject = true
+	post("Billing\r\nBcc: victim@example.com")
+	if captured.Subject != "[Contact] Billing Bcc: victim@example.com" || len(captured.Bcc) != 0 {
+		t.Fatalf("unexpected subject %q", captured.Subject)
+	}
+	if strings.Contains(string(captured.Text), "subject:") {
+		t.Fatalf("subject should not be repeated as a custom field:\n%s", captured.Text)
+	}
+
+	post(strings.Repeat("x", 300))
+	if want := "[Contact] " + strings.Repeat("x", maxSubmitterSubject); captured.Subject != want {
+		t.Fatalf("expected the subject to be capped, got %d characters", len(captured.Subject))
+	}
+
+	post("   ")
+	if captured.Subject != "[Contact] New contact" {
+		t.Fatalf("blank subject should fall back to the default, got %q", captured.Subject)
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	cs := &SiteCfg{NameMinLength: 2, NameMaxLength: 5, NameRejectURLs: true}
+
+	cases := map[string]bool{
+		"Al":                true,
+		"Zoë":               true,
+		"A":                 false,
+		"Alexander":         false,
+		"www.x":             false,
+		"http://spam.local": false,
+	}
+	for name, ok := range cases {
+		if err := validateName(cs, name); (err == nil) != ok {
+			t.Fatalf("validateName(%q) = %v, want ok=%v", name, err, ok)
+		}
+	}
+
+	if err := validateName(&SiteCfg{}, "http://anything.example.com"); err != nil {
+		t.Fatalf("expected no rules by default, got %v", err)
+	}
+}
+
+func TestFieldLengths(t *testing.T) {
+	lengths, err := parseFieldLengths("name:2-80, message:10-5000,phone:0-20,notes:3-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lengths["notes"] != (lengthRange{min: 3}) || lengths["phone"] != (lengthRange{max: 20}) {
+		t.Fatalf("unexpected ranges: %v", lengths)
+	}
+	for _, bad := range []string{"name", "name:2", "name:x-5", "name:5-2", ":1-2", "name:-1-5"} {
+		if _, err := parseFieldLengths(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+
+	cs := &SiteCfg{FieldLengths: lengths}
+	ok := ContactRequest{Name: "Zoë", Message: "Long enough message", Fields: map[string]any{"phone": "+49 30 1234", "notes": "abc"}}
+	if err := checkFieldLengths(cs, ok); err != nil {
+		t.Fatalf("expected the submission to pass, got %v", err)
+	}
+	for want, p := range map[string]ContactRequest{
+		"name must be at least 2 characters":     {Name: "Z", Message: ok.Message, Fields: ok.Fields},
+		"message must be at least 10 characters": {Name: "Zoë", Message: "  hi       ", Fields: ok.Fields},
+		"phone must be at most 20 characters":    {Name: "Zoë", Message: ok.Message, Fields: map[string]any{"phone": strings.Repeat("1", 21), "notes": "abc"}},
+		"notes must be at least 3 characters":    {Name: "Zoë", Message: ok.Message},
+	} {
+		if err := checkFieldLengths(cs, p); err == nil || err.Error() != want {
+			t.Errorf("got %v, want %q", err, want)
+		}
+	}
+	// Typed values aren't measured
+	typed := ok
+	typed.Fields = map[string]any{"phone": float64(123456789012345678901), "notes": "abc"}
+	if err := checkFieldLengths(cs, typed); err != nil {
+		t.Fatalf("expected a typed value skipped, got %v", err)
+	}
+}
+
+func TestTrimFields(t *testing.T) {
+	cfg := &Config{TrimFields: true}
+	values := map[string]any{
+		"name":    "  Alice \t Smith\n",
+		"email":   "\u00a0alice@example.com ",
+		"message": "\n  Line one\n\n    indented  line\t\n",
+		"subject": " Quote   request ",
+		"company": "\tAcme  Corp ",
+		"count":   float64(3),
+		"blank":   " \t\r\n ",
+		"website": " ",
+	}
+	trimFields(cfg, values)
+	want := map[string]any{
+		"name":    "Alice \t Smith",
+		"email":   "alice@example.com",
+		"message": "Line one\n\n    indented  line",
+		"subject": "Quote   request",
+		"company": "Acme  Corp",
+		"count":   float64(3),
+		"blank":   "",
+		"website": " ",
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Fatalf("trimmed = %q, want %q", values, want)
+	}
+
+	cfg.CollapseWhitespace = true
+	trimFields(cfg, values)
+	if values["name"] != "Alice Smith" || values["subject"] != "Quote request" ||
+		values["company"] != "Acme  Corp" || values["message"] != want["message"] {
+		t.Fatalf("collapsed = %q", values)
+	}
+
+	values = map[string]any{"name": " Alice "}
+	trimFields(&Config{CollapseWhitespace: true}, values)
+	if values["name"] != " Alice " {
+		t.Fatalf("expected no change with TRIM_FIELDS off, got %q", values["name"])
+	}
+}
+
+func TestHandleContactWhitespaceName(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	var captured *email.Email
+	sendEmailFunc = func(_ context.Context, _ *SiteCfg, e *email.Email) error { captured = e; return nil }
+
+	post := func(body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		return rec.Code
+	}
+	if code := post(`{"name":"  \t ","email":"alice@example.com","message":"Hello"}`); code != http.StatusBadRequest {
+		t.Fatalf("expected a blank name to be rejected, got %d", code)
+	}
+	if code := post(`{"name":" Alice ","email":" alice@example.com ","message":"Hello"}`); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if captured.ReplyTo[0] != `"Alice" <alice@example.com>` {
+		t.Fatalf("expected trimmed Reply-To, got %q", captured.ReplyTo)
+	}
+}
+
+func TestHandleContactFieldLengths(t *testing.T) {
+	setupTestConfig(t)
+	conf.Sites["acme"].FieldLengths = map[string]lengthRange{"phone": {max: 5}}
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return nil }
+
+	body := `{"name":"Alice","email":"alice@example.com","message":"Hello","phone":"0123456789"}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	HandleContact(rec, req)
+	if rec.Code != http.StatusBadRequest || rec.Body.String() != "invalid field: phone must be at most 5 characters\n" {
+		t.Fatalf("expected a field-level 400, got %d %q", rec.Code, rec.Body)
+	}
+}
+
+func TestHandleContactContactPreference(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	cs := conf.Sites["acme"]
+	cs.ContactPrefs = []string{"email", "phone"}
+	var captured *email.Email
+	sendEmailFunc = func(_ context.Context, _ *SiteCfg, e *email.Email) error { captured = e; return nil }
+
+	post := func(extra string) *httptest.ResponseRecorder {
+		body := `{"name":"Alice","email":"alice@example.com","message":"Hello"` + extra + `}`
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		return rec
+	}
+
+	if rec := post(`,"contact_preference":" Phone "`); rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if !strings.HasSuffix(captured.Subject, "(prefers phone)") || !strings.Contains(string(captured.Text), "Preferred contact: phone\n") ||
+		captured.Headers.Get("X-Contact-Preference") != "phone" || strings.Contains(string(captured.Text), "contact_preference") {
+		t.Fatalf("preference not surfaced: %q\n%s", captured.Subject, captured.Text)
+	}
+
+	rec := post(`,"contact_preference":"fax"`)
+	if rec.Code != http.StatusBadRequest || rec.Body.String() != "invalid field: contact_preference must be one of email, phone\n" {
+		t.Fatalf("expected a field-level 400, got %d %q", rec.Code, rec.Body)
+	}
+
+	// Optional unless required
+	captured = nil
+	if rec := post(""); rec.Code != http.StatusOK || captured.Headers.Get("X-Contact-Preference") != "" {
+		t.Fatalf("expected a send without a preference, got %d", rec.Code)
+	}
+	cs.RequireContactPref = true
+	if rec := post(""); rec.Code != http.StatusBadRequest || rec.Body.String() != "invalid field: contact_preference is required\n" {
+		t.Fatalf("expected a missing preference to fail, got %d %q", rec.Code, rec.Body)
+	}
+}
+
+func TestHandleContactMaintenanceMode(t *testing.T) {
+	setupTestConfig(t)
+	conf.MaintenanceMode = true
+	conf.MaintenanceMessage = "back soon"
+
+	var calls int
+	sendEmailFunc = func(_ context.Context, site *SiteCfg, e *email.Email) error {
+		calls++
+		return nil
+	}
+
+	body := `{"name":"Alice","email":"alice@example.com","message":"Hello there"}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+
+	HandleContact(rec, req)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503, got %d", rec.Code)
+	}
+	if got := rec.Body.String(); !strings.Contains(got, "back soon") {
+		t.Fatalf("expected maintenance message, got %q", got)
+	}
+	if calls != 0 {
+		t.Fatalf("expected sendEmailFunc not to be called, got %d", calls)
+	}
+
+	rec = httptest.NewRecorder()
+	HandleReady(rec, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected readiness 503, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	HandleHealth(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected liveness 200, got %d", rec.Code)
+	}
+}
+
+func multipartRequest(t *testing.T, fields map[string]string, filename, content string) *http.Request {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for k, v := range fields {
+		_ = mw.WriteField(k, v)
+	}
+	if filename != "" {
+		fw, err := mw.CreateFormFile("file", filename)
+		if err != nil {
+			t.Fatalf("create form file: %v", err)
+		}
+		_, _ = fw.Write([]byte(content))
+	}
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestHandleContactAttachmentsScanned(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.ClamAVAddr = fakeClamd(t)
+	conf.ClamAVTimeout = time.Second
+	conf.Sites["acme"].AllowAttachments = true
+
+	var captured *email.Email
+	sendEmailFunc = func(_ context.Context, site *SiteCfg, e *email.Email) error {
+		captured = e
+		return nil
+	}
+	fields := map[string]string{"name": "Alice", "email": "alice@example.com", "message": "See attached"}
+
+	rec := httptest.NewRecorder()
+	HandleContact(rec, multipartRequest(t, fields, "cv.txt", "hello"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if captured == nil || len(captured.Attachments) != 1 || captured.Attachments[0].Filename != "cv.txt" {
+		t.Fatalf("expected cv.txt to be attached, got %+v", captured)
+	}
+
+	captured = nil
+	rec = httptest.NewRecorder()
+	HandleContact(rec, multipartRequest(t, fields, "eicar.txt", eicar))
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected status 422, got %d", rec.Code)
+	}
+	if captured != nil {
+		t.Fatal("expected no email for a flagged attachment")
+	}
+
+	conf.ClamAVAddr = "127.0.0.1:1"
+	rec = httptest.NewRecorder()
+	HandleContact(rec, multipartRequest(t, fields, "cv.txt", "hello"))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503 when clamd is down, got %d", rec.Code)
+	}
+
+	conf.ClamAVFailOpen = true
+	rec = httptest.NewRecorder()
+	HandleContact(rec, multipartRequest(t, fields, "cv.txt", "hello"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200 with fail-open, got %d", rec.Code)
+	}
+}
+
+func TestHandleContactBCCArchive(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	cs := conf.Sites["acme"]
+	cs.AllowAttachments = true
+	cs.BCC = []string{"archive@example.com"}
+	cs.BCCMaxKB = 1
+	cs.BCCOversize = bccOversizeNote
+
+	var sent []*email.Email
+	sendEmailFunc = func(_ context.Context, site *SiteCfg, e *email.Email) error {
+		sent = append(sent, e)
+		return nil
+	}
+	fields := map[string]string{"name": "Alice", "email": "alice@example.com", "message": "See attached"}
+
+	rec := httptest.NewRecorder()
+	HandleContact(rec, multipartRequest(t, fields, "cv.txt", "hello"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if len(sent) != 1 || len(sent[0].Bcc) != 1 || len(sent[0].Attachments) != 1 {
+		t.Fatalf("expected a small email to be Bcc'd with its attachment, got %+v", sent)
+	}
+
+	sent = nil
+	rec = httptest.NewRecorder()
+	HandleContact(rec, multipartRequest(t, fields, "scan.txt", strings.Repeat("x", 4096)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if len(sent) != 2 {
+		t.Fatalf("expected the team email and an archive copy, got %d emails", len(sent))
+	}
+	team, archive := sent[0], sent[1]
+	if len(team.Bcc) != 0 || len(team.Attachments) != 1 || team.To[0] != "ops@example.com" {
+		t.Fatalf("unexpected team email: to %v, bcc %v, %d attachments", team.To, team.Bcc, len(team.Attachments))
+	}
+	if len(archive.To) != 0 || archive.Bcc[0] != "archive@example.com" || len(archive.Attachments) != 0 {
+		t.Fatalf("unexpected archive copy: to %v, bcc %v, %d attachments", archive.To, archive.Bcc, len(archive.Attachments))
+	}
+	if archive.Headers.Get("To") != "ops@example.com" || !strings.Contains(string(archive.Text), "scan.txt (4 KB)") {
+		t.Fatalf("archive copy lacks the original To or the note: %q / %q", archive.Headers.Get("To"), archive.Text)
+	}
+	if strings.Contains(string(team.Text), "removed") {
+		t.Fatal("the note leaked into the team email")
+	}
+
+	cs.BCCOversize = bccOversizeStrip
+	sent = nil
+	HandleContact(httptest.NewRecorder(), multipartRequest(t, fields, "scan.txt", strings.Repeat("x", 4096)))
+	if len(sent) != 2 || strings.Contains(string(sent[1].Text), "removed") {
+		t.Fatalf("expected a stripped copy without a note, got %+v", sent)
+	}
+}
+
+func TestHandleContactDumpsEML(t *testing.T) {
+	setupTestConfig(t)
+	conf.DumpEMLDir = t.TempDir()
+
+	sendEmailFunc = func(_ context.Context, site *SiteCfg, e *email.Email) error {
+		return nil
+	}
+
+	body := `{"name":"Alice","email":"alice@example.com","message":"Hello there"}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+
+	HandleContact(rec, req)
+
+	var resp map[string]any
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	raw, err := os.ReadFile(filepath.Join(conf.DumpEMLDir, "acme-"+resp["submission_id"].(string)+".eml"))
+	if err != nil {
+		t.Fatalf("read dumped eml: %v", err)
+	}
+	if !bytes.Contains(raw, []byte("Subject: [Contact] New contact")) {
+		t.Fatalf("dumped eml missing subject: %s", raw)
+	}
+}
+
+func TestHandleContactAutoReplyThrottled(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.AutoReplyGlobalBurst = 10
+	conf.Sites["acme"].AutoReplyText = "Thanks, we'll be in touch."
+	conf.Sites["acme"].AutoReplySubject = "We received your message"
+	conf.Sites["acme"].AutoReplyBurst = 1
+
+	replies := map[string]int{}
+	sendEmailFunc = func(_ context.Context, site *SiteCfg, e *email.Email) error {
+		if e.Headers.Get("Auto-Submitted") == "auto-replied" {
+			replies[e.To[0]]++
+		}
+		return nil
+	}
+
+	submit := func(from string) {
+		body := `{"name":"Alice","email":"` + from + `","message":"Hello there"}`
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", rec.Code)
+		}
+		if err := WaitAutoReplies(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		submit("victim@example.com")
+	}
+	submit("other@example.com")
+
+	if got := replies["victim@example.com"]; got == 0 || got >= 5 {
+		t.Fatalf("expected auto-replies to one address to be throttled, got %d", got)
+	}
+	if got := replies["other@example.com"]; got != 1 {
+		t.Fatalf("expected one auto-reply to a fresh address, got %d", got)
+	}
+
+	// AUTO_REPLY_REFILL_MINUTES, not the request limiter's refill, lets
+	// the address have another one
+	conf.AutoReplyRefill = time.Hour
+	clock := useFakeClock(t, nowFunc())
+	before := replies["victim@example.com"]
+	clock.Advance(59 * time.Minute)
+	submit("victim@example.com")
+	if replies["victim@example.com"] != before {
+		t.Fatal("expected no auto-reply before AUTO_REPLY_REFILL_MINUTES")
+	}
+	clock.Advance(time.Minute)
+	submit("victim@example.com")
+	if replies["victim@example.com"] != before+1 {
+		t.Fatal("expected an auto-reply after AUTO_REPLY_REFILL_MINUTES")
+	}
+}
+
+func TestHandleContactAutoReplyRefund(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.AutoReplyGlobalBurst = 1
+	conf.Sites["acme"].AutoReplyText = "Thanks, we'll be in touch."
+	conf.Sites["acme"].AutoReplyBurst = 1
+
+	var replies []string
+	replyErr := errors.New("smtp: 451")
+	sendEmailFunc = func(_ context.Context, site *SiteCfg, e *email.Email) error {
+		if e.Headers.Get("Auto-Submitted") == "auto-replied" {
+			replies = append(replies, e.To[0])
+			return replyErr
+		}
+		return nil
+	}
+
+	submit := func(from string) {
+		body := `{"name":"Alice","email":"` + from + `","message":"Hello there"}`
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", rec.Code)
+		}
+		if err := WaitAutoReplies(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a failed send gives back both the address and the global token
+	submit("alice@example.com")
+	replyErr = nil
+	submit("alice@example.com")
+	if len(replies) != 2 {
+		t.Fatalf("expected a retry after a failed auto-reply, got %v", replies)
+	}
+
+	// the global budget refusing doesn't use up the address's token
+	submit("bob@example.com")
+	if len(replies) != 2 {
+		t.Fatalf("expected the global budget to throttle, got %v", replies)
+	}
+	refundBudget("autoreply|"+autoReplyGlobalKey, 1)
+	submit("bob@example.com")
+	if len(replies) != 3 || replies[2] != "bob@example.com" {
+		t.Fatalf("expected an auto-reply once the global budget allows, got %v", replies)
+	}
+}
+
+func TestHandleContactHoneypot(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+
+	var calls int
+	sendEmailFunc = func(_ context.Context, site *SiteCfg, e *email.Email) error {
+		calls++
+		return nil
+	}
+
+	submit := func() *httptest.ResponseRecorder {
+		body := `{"name":"Bot","email":"bot@example.com","message":"Buy now","website":"http://spam.example.com"}`
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		return rec
+	}
+
+	if rec := submit(); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d", rec.Code)
+	}
+
+	conf.HoneypotFakeSuccess = true
+	rec := submit()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected fake status 200, got %d", rec.Code)
+	}
+	var resp map[string]any
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if ok, _ := resp["ok"].(bool); !ok {
+		t.Fatalf("expected a normal success body, got %v", resp)
+	}
+	if calls != 0 {
+		t.Fatalf("expected sendEmailFunc not to be called, got %d", calls)
+	}
+}
+
+func TestSiteKeyFromRequest(t *testing.T) {
+	cases := []struct {
+		source string
+		target string
+		host   string
+		header string
+		want   string
+	}{
+		{"path", "/v1/contact/acme", "forms.example.com", "", "acme"},
+		{"path", "/v1/contact/acme/extra", "forms.example.com", "", "acme/extra"},
+		{"subdomain", "/submit", "Acme.forms.example.com:8443", "", "acme"},
+		{"subdomain", "/submit", "localhost", "", ""},
+		{"header", "/submit", "forms.example.com", " acme ", "acme"},
+		{"header", "/submit", "forms.example.com", "", ""},
+	}
+	for _, tc := range cases {
+		cfg := &Config{SiteKeySource: tc.source, SiteKeyHeader: "X-Site-Key"}
+		req := httptest.NewRequest(http.MethodPost, tc.target, nil)
+		req.Host = tc.host
+		if tc.header != "" {
+			req.Header.Set("X-Site-Key", tc.header)
+		}
+		if got := siteKeyFromRequest(cfg, req); got != tc.want {
+			t.Fatalf("%s %s%s: got %q want %q", tc.source, tc.host, tc.target, got, tc.want)
+		}
+	}
+
+	for key, ok := range map[string]bool{"acme": true, "my-site": true, "": false, "a/b": false, "a b": false} {
+		if validSiteKey(key) != ok {
+			t.Fatalf("validSiteKey(%q) = %v, want %v", key, !ok, ok)
+		}
+	}
+}
+
+func TestComposeEmailFromStrict(t *testing.T) {
+	cs := &SiteCfg{Key: "acme", To: "ops@example.com", SubjectPrefix: "[Contact]", FromAddr: "noreply@acme.test"}
+	p := ContactRequest{Name: "Jane", Email: "jane@example.org", Message: "hi"}
+
+	e, _ := composeEmail(cs, "id-1", "198.51.100.7", p)
+	if e.From != "noreply@acme.test" || e.Subject != "[Contact] New contact" {
+		t.Fatalf("default mode: From=%q Subject=%q", e.From, e.Subject)
+	}
+	if len(e.ReplyTo) != 1 || e.ReplyTo[0] != `"Jane" <jane@example.org>` {
+		t.Fatalf("ReplyTo = %v", e.ReplyTo)
+	}
+
+	cs.FromStrict = true
+	e, _ = composeEmail(cs, "id-1", "198.51.100.7", p)
+	if e.From != "noreply@acme.test" {
+		t.Fatalf("strict From = %q", e.From)
+	}
+	if e.Subject != "[Contact] New contact from Jane <jane@example.org>" {
+		t.Fatalf("strict Subject = %q", e.Subject)
+	}
+	if !strings.HasPrefix(string(e.Text), "Reply to: Jane <jane@example.org>\n") {
+		t.Fatalf("strict body does not start with the submitter:\n%s", e.Text)
+	}
+}
+
+func TestHandleContactNestedFieldMap(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.Sites["acme"].FieldMap = map[string]string{
+		"name":    "contact.name",
+		"email":   "contact.email",
+		"message": "metadata.note",
+	}
+
+	var captured *email.Email
+	sendEmailFunc = func(_ context.Context, _ *SiteCfg, e *email.Email) error {
+		captured = e
+		return nil
+	}
+
+	for _, body := range []string{
+		`{"contact":{"name":"Alice","email":"alice@example.com"},"metadata":{"note":"Nested hello"}}`,
+		`{"name":"Alice","email":"alice@example.com","message":"Nested hello"}`,
+	} {
+		captured = nil
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+
+		HandleContact(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", body, rec.Code, rec.Body)
+		}
+		if got := string(captured.Text); !strings.Contains(got, "Alice <alice@example.com>") || !strings.Contains(got, "Nested hello") {
+			t.Fatalf("%s: email body missing mapped fields: %q", body, got)
+		}
+	}
+}
+
+func TestHandleContactAttachmentLimits(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 20
+	cs := conf.Sites["acme"]
+	cs.AllowAttachments = true
+	cs.AllowedAttachmentExts = []string{"pdf", "txt"}
+	cs.MaxAttachmentCount = 1
+	cs.MaxAttachmentTotalKB = 1
+
+	var captured *email.Email
+	sendEmailFunc = func(_ context.Context, site *SiteCfg, e *email.Email) error {
+		captured = e
+		return nil
+	}
+	fields := map[string]string{"name": "Alice", "email": "alice@example.com", "message": "See attached"}
+
+	rec := httptest.NewRecorder()
+	HandleContact(rec, multipartRequest(t, fields, "doc.pdf", "%PDF-1.4 minimal"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200 for a pdf, got %d", rec.Code)
+	}
+	if got := captured.Attachments[0].ContentType; got != "application/pdf" {
+		t.Fatalf("expected sniffed application/pdf, got %q", got)
+	}
+
+	tests := []struct {
+		name     string
+		filename string
+		content  string
+		status   int
+	}{
+		{"extension not allowed", "run.exe", "MZ\x90\x00", http.StatusUnprocessableEntity},
+		{"content does not match extension", "doc.pdf", "MZ\x90\x00\x03\x00\x00\x00", http.StatusUnprocessableEntity},
+		{"over total size", "big.txt", strings.Repeat("a", 2048), http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			HandleContact(rec, multipartRequest(t, fields, tc.filename, tc.content))
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d, got %d", tc.status, rec.Code)
+			}
+		})
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for k, v := range fields {
+		_ = mw.WriteField(k, v)
+	}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		fw, _ := mw.CreateFormFile("file", name)
+		_, _ = fw.Write([]byte("hello"))
+	}
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec = httptest.NewRecorder()
+	HandleContact(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status 413 for too many files, got %d", rec.Code)
+	}
+}
+
+func TestHandleContactSignedUpload(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 20
+	cs := conf.Sites["acme"]
+	cs.AllowAttachments = true
+	cs.MaxAttachmentTotalKB = 1
+	cs.Secrets = []string{"old", "s3cret"}
+
+	var sent int
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { sent++; return nil }
+	fields := map[string]string{"name": "Alice", "email": "alice@example.com", "message": "See attached"}
+
+	signed := func(secret, content string) *http.Request {
+		req := multipartRequest(t, fields, "notes.txt", content)
+		body, _ := io.ReadAll(req.Body)
+		m := hmac.New(sha256.New, []byte(secret))
+		m.Write(body)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.Header.Set("X-Signature", hex.EncodeToString(m.Sum(nil)))
+		return req
+	}
+
+	rec := httptest.NewRecorder()
+	HandleContact(rec, signed("s3cret", "hello"))
+	if rec.Code != http.StatusOK || sent != 1 {
+		t.Fatalf("expected a signed upload to be sent, got %d (sent %d)", rec.Code, sent)
+	}
+
+	rec = httptest.NewRecorder()
+	HandleContact(rec, signed("wrong", "hello"))
+	if rec.Code != http.StatusUnauthorized || sent != 1 {
+		t.Fatalf("expected 401 for a bad signature, got %d (sent %d)", rec.Code, sent)
+	}
+
+	// The attachment limit applies as the upload streams in, before the
+	// rest of the body is read for the signature
+	req := signed("s3cret", strings.Repeat("a", 2048))
+	req.Body = io.NopCloser(io.MultiReader(req.Body, iotest.ErrReader(errors.New("read past the limit"))))
+	rec = httptest.NewRecorder()
+	HandleContact(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 while streaming, got %d", rec.Code)
+	}
+}
+
+func TestHandleContactDefaultSite(t *testing.T) {
+	setupTestConfig(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/contact/unknown", strings.NewReader(`{"name":"Alice","email":"alice@example.com","message":"Hello"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	HandleContact(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404 without a default site, got %d", rec.Code)
+	}
+
+	conf.DefaultSiteKey = "acme"
+	var captured *email.Email
+	sendEmailFunc = func(_ context.Context, site *SiteCfg, e *email.Email) error {
+		if site.Key != "acme" {
+			t.Fatalf("expected the default site, got %s", site.Key)
+		}
+		captured = e
+		return nil
+	}
+	req = httptest.NewRequest(http.MethodPost, "/v1/contact/unknown", strings.NewReader(`{"name":"Alice","email":"alice@example.com","message":"Hello"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	HandleContact(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200 via the default site, got %d", rec.Code)
+	}
+	if want := `[Contact] New contact (site key "unknown")`; captured.Subject != want {
+		t.Fatalf("subject = %q, want %q", captured.Subject, want)
+	}
+	if !strings.HasPrefix(string(captured.Text), "Requested site key: unknown\n") {
+		t.Fatalf("body missing requested key: %q", captured.Text)
+	}
+}
+
+func TestHandleContactJSONLimits(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.JSONMaxDepth = 3
+	conf.JSONMaxTokens = 40
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return nil }
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"flat", `{"name":"Alice","email":"alice@example.com","message":"Hello"}`, http.StatusOK},
+		{"too deep", `{"name":"Alice","email":"alice@example.com","message":"Hello","x":[[[[1]]]]}`, http.StatusBadRequest},
+		{"too many tokens", `{"name":"Alice","email":"alice@example.com","message":"Hello","x":[` + strings.Repeat("1,", 40) + `1]}`, http.StatusBadRequest},
+		{"not an object", `["Alice"]`, http.StatusBadRequest},
+		{"trailing data", `{"name":"Alice","email":"alice@example.com","message":"Hello"} {}`, http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			HandleContact(rec, req)
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d, got %d", tc.status, rec.Code)
+			}
+		})
+	}
+
+	// The limits apply while the body streams in, not once it is read
+	body := io.MultiReader(strings.NewReader(`{"x":[[[[`), iotest.ErrReader(errors.New("read past the limit")))
+	if _, _, err := decodeJSONObject(body, conf.JSONMaxDepth, conf.JSONMaxTokens); !errors.Is(err, errJSONTooComplex) {
+		t.Fatalf("expected errJSONTooComplex before the rest of the body, got %v", err)
+	}
+
+	conf.JSONDisallowUnknown = true
+	req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(`{"name":"Alice","email":"alice@example.com","message":"Hello","extra":"x"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	HandleContact(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for an unknown field, got %d", rec.Code)
+	}
+}
+
+func TestComposeEmailCCSubmitter(t *testing.T) {
+	cs := &SiteCfg{Key: "acme", To: "ops@example.com", FromAddr: "noreply@acme.test", CCSubmitter: true}
+
+	e, _ := composeEmail(cs, "id-1", "198.51.100.7", ContactRequest{Name: "Jane", Email: "jane@example.org", Message: "hi"})
+	if len(e.Cc) != 1 || e.Cc[0] != `"Jane" <jane@example.org>` {
+		t.Fatalf("Cc = %v", e.Cc)
+	}
+
+	e, _ = composeEmail(cs, "id-2", "198.51.100.7", ContactRequest{Name: "Ops", Email: "OPS@example.com", Message: "hi"})
+	if len(e.Cc) != 0 {
+		t.Fatalf("expected no Cc when the submitter is already in To, got %v", e.Cc)
+	}
+
+	// Names with specials or outside ASCII must still parse as addresses
+	for _, name := range []string{"Smith, John", `Jo "JJ" <Smith>`, "José Núñez"} {
+		e, _ = composeEmail(cs, "id-3", "198.51.100.7", ContactRequest{Name: name, Email: "john@example.org", Message: "hi"})
+		for _, entry := range slices.Concat(e.Cc, e.ReplyTo) {
+			a, err := mail.ParseAddress(entry)
+			if err != nil || a.Name != name || a.Address != "john@example.org" {
+				t.Fatalf("%q: %q parsed as %v, %v", name, entry, a, err)
+			}
+		}
+	}
+}
+
+func TestVerifyHMACRotation(t *testing.T) {
+	body := []byte(`{"name":"Alice"}`)
+	sign := func(secret string) string {
+		m := hmac.New(sha256.New, []byte(secret))
+		m.Write(body)
+		return hex.EncodeToString(m.Sum(nil))
+	}
+	secrets := []string{"new-secret", "old-secret"}
+
+	if got := verifyHMAC(body, secrets, sign("new-secret")); got != 0 {
+		t.Fatalf("new secret matched index %d, want 0", got)
+	}
+	if got := verifyHMAC(body, secrets, strings.ToUpper(sign("old-secret"))); got != 1 {
+		t.Fatalf("old secret matched index %d, want 1", got)
+	}
+	if got := verifyHMAC(body, secrets, sign("other")); got != -1 {
+		t.Fatalf("unknown secret matched index %d", got)
+	}
+	if got := verifyHMAC(body, secrets, ""); got != -1 {
+		t.Fatalf("empty signature matched index %d", got)
+	}
+}
+
+func TestHandleContactSendBurst(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.Sites["acme"].SendBurst = 2
+
+	var sends int
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error {
+		sends++
+		return nil
+	}
+
+	post := func(body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		return rec.Code
+	}
+	valid := `{"name":"Alice","email":"alice@example.com","message":"Hello"}`
+
+	// Invalid submissions don't use the send budget.
+	for range 3 {
+		if code := post(`{"name":"Alice"}`); code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d", code)
+		}
+	}
+	for i := range 2 {
+		if code := post(valid); code != http.StatusOK {
+			t.Fatalf("send %d: expected status 200, got %d", i+1, code)
+		}
+	}
+	if code := post(valid); code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429 once the send budget is used, got %d", code)
+	}
+	if sends != 2 {
+		t.Fatalf("expected 2 emails, got %d", sends)
+	}
+}
+
+func TestHandleContactGlobalSendRate(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.GlobalSendRate = 1
+	prev := globalSend
+	globalSend = &sendRate{}
+	t.Cleanup(func() { globalSend = prev })
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return nil }
+
+	post := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(`{"name":"Alice","email":"alice@example.com","message":"Hello"}`))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		return rec
+	}
+	if rec := post(); rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	rec := post()
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503 past the global rate, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got == "" || got == "0" {
+		t.Fatalf("expected a Retry-After header, got %q", got)
+	}
+}
+
+func TestCustomFieldsCoercion(t *testing.T) {
+	cs := &SiteCfg{PriorityField: "priority", FieldTypes: map[string]string{"subscribe": "bool", "budget": "int", "score": "float"}}
+
+	fields, err := customFields(cs, map[string]any{
+		"name": "Alice", "priority": "high", "form_token": "t",
+		"subscribe": "on", "budget": "5000", "score": "4.5", "company": "Acme",
+		"nested": map[string]any{"x": 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{"subscribe": true, "budget": int64(5000), "score": 4.5, "company": "Acme"}
+	if len(fields) != len(want) {
+		t.Fatalf("fields = %v, want %v", fields, want)
+	}
+	for k, v := range want {
+		if fields[k] != v {
+			t.Errorf("%s = %#v, want %#v", k, fields[k], v)
+		}
+	}
+
+	if _, err := customFields(cs, map[string]any{"budget": "lots"}); err == nil || err.Error() != "budget must be int" {
+		t.Fatalf("expected a field-level error, got %v", err)
+	}
+
+	// JSON numbers beyond int64 are refused rather than wrapped
+	for _, f := range []float64{1e20, -1e20, math.MaxInt64} {
+		if _, err := customFields(cs, map[string]any{"budget": f}); err == nil || err.Error() != "budget must be int" {
+			t.Fatalf("expected %v to be out of range, got %v", f, err)
+		}
+	}
+	fields, err = customFields(cs, map[string]any{"budget": float64(math.MinInt64)})
+	if err != nil || fields["budget"] != int64(math.MinInt64) {
+		t.Fatalf("expected the smallest int64 to be kept, got %v (%v)", fields, err)
+	}
+}
+
+func TestCustomFieldsAllowlist(t *testing.T) {
+	cs := &SiteCfg{AllowedFields: []string{"name", "email", "message", "phone"}, StrictFields: true}
+	values := map[string]any{"name": "Alice", "website": "", "phone": "555", "company": "Acme", "utm": map[string]any{"x": 1}}
+
+	if _, err := customFields(cs, values); err == nil || err.Error() != "unexpected company, utm" {
+		t.Fatalf("expected unexpected fields to be rejected, got %v", err)
+	}
+
+	cs.StrictFields = false
+	fields, err := customFields(cs, values)
+	if err != nil || len(fields) != 1 || fields["phone"] != "555" {
+		t.Fatalf("expected only phone to survive, got %v (%v)", fields, err)
+	}
+}
+
+func TestHandleContactCustomFields(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.Sites["acme"].FieldTypes = map[string]string{"budget": "int"}
+
+	var captured *email.Email
+	sendEmailFunc = func(_ context.Context, _ *SiteCfg, e *email.Email) error {
+		captured = e
+		return nil
+	}
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		return rec
+	}
+
+	rec := post("name=Alice&email=alice%40example.com&message=Hi&budget=5000&company=Acme")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if got := string(captured.Text); !strings.HasSuffix(got, "\n--\nbudget: 5000\ncompany: Acme\n") {
+		t.Fatalf("email body missing custom fields: %q", got)
+	}
+
+	rec = post("name=Alice&email=alice%40example.com&message=Hi&budget=lots")
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "budget must be int") {
+		t.Fatalf("expected a 400 naming the field, got %d %q", rec.Code, rec.Body)
+	}
+}
+
+func TestHandleContactDuplicateFields(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 50
+
+	var captured *email.Email
+	sendEmailFunc = func(_ context.Context, _ *SiteCfg, e *email.Email) error {
+		captured = e
+		return nil
+	}
+	post := func(ct, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+		req.Header.Set("Content-Type", ct)
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		return rec
+	}
+	const (
+		form        = "application/x-www-form-urlencoded"
+		dupName     = "name=Alice&name=Mallory&email=alice%40example.com&message=Hi"
+		dupCustom   = "name=Alice&email=alice%40example.com&message=Hi&topic=sales&topic=billing"
+		dupJSONName = `{"name":"Alice","email":"alice@example.com","message":"Hi","name":"Mallory"}`
+	)
+
+	// Default: forms keep the first value, JSON the last.
+	if rec := post(form, dupName); rec.Code != http.StatusOK || !strings.Contains(string(captured.Text), "From: Alice <") {
+		t.Fatalf("form: expected the first name to win, got %d %q", rec.Code, captured.Text)
+	}
+	if rec := post("application/json", dupJSONName); rec.Code != http.StatusOK || !strings.Contains(string(captured.Text), "From: Mallory <") {
+		t.Fatalf("json: expected the last name to win, got %d %q", rec.Code, captured.Text)
+	}
+
+	conf.DuplicateFields = duplicateReject
+	for ct, body := range map[string]string{form: dupCustom, "application/json": dupJSONName} {
+		if rec := post(ct, body); rec.Code != http.StatusBadRequest {
+			t.Fatalf("reject, %s: expected status 400, got %d", ct, rec.Code)
+		}
+	}
+	if rec := post("application/json", `{"name":"Alice","email":"alice@example.com","message":"Hi","meta":{"a":1,"b":{"a":2}}}`); rec.Code != http.StatusOK {
+		t.Fatalf("reject: repeated keys in nested objects are not duplicates, got %d", rec.Code)
+	}
+
+	conf.DuplicateFields = duplicateJoin
+	conf.DuplicateFieldSep = " | "
+	if rec := post(form, dupCustom); rec.Code != http.StatusOK || !strings.Contains(string(captured.Text), "topic: sales | billing\n") {
+		t.Fatalf("join: expected joined custom values, got %d %q", rec.Code, captured.Text)
+	}
+	if rec := post(form, dupName); rec.Code != http.StatusBadRequest {
+		t.Fatalf("join: a repeated name can't be joined and should get 400, got %d", rec.Code)
+	}
+}
+
+func TestHandleContactMultiValueFields(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 50
+	conf.DuplicateFields = duplicateArray
+	cs := conf.Sites["acme"]
+	cs.MultiValueSep = " / "
+	cs.FieldTypes = map[string]string{"seats": "int"}
+
+	var captured *email.Email
+	sendEmailFunc = func(_ context.Context, _ *SiteCfg, e *email.Email) error {
+		captured = e
+		return nil
+	}
+	post := func(ct, body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+		req.Header.Set("Content-Type", ct)
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		return rec.Code
+	}
+
+	if code := post("application/json", `{"name":"Alice","email":"alice@example.com","message":"Hi","interests":[" sales ","support"],"seats":["2","3"],"nested":[{"a":1}]}`); code != http.StatusOK {
+		t.Fatalf("json: expected status 200, got %d", code)
+	}
+	text := string(captured.Text)
+	if !strings.Contains(text, "interests: sales / support\n") || !strings.Contains(text, "seats: 2 / 3\n") || strings.Contains(text, "nested") {
+		t.Fatalf("json: unexpected fields in %q", text)
+	}
+
+	if code := post("application/x-www-form-urlencoded", "name=Alice&email=alice%40example.com&message=Hi&interests=sales&interests=billing"); code != http.StatusOK {
+		t.Fatalf("form: expected status 200, got %d", code)
+	}
+	if !strings.Contains(string(captured.Text), "interests: sales / billing\n") {
+		t.Fatalf("form: unexpected fields in %q", captured.Text)
+	}
+	if code := post("application/x-www-form-urlencoded", "name=Alice&name=Mallory&email=alice%40example.com&message=Hi"); code != http.StatusBadRequest {
+		t.Fatalf("form: a repeated name can't be multi-valued and should get 400, got %d", code)
+	}
+	if code := post("application/json", `{"name":"Alice","email":"alice@example.com","message":"Hi","seats":["2","many"]}`); code != http.StatusBadRequest {
+		t.Fatalf("json: expected a bad element to fail coercion, got %d", code)
+	}
+}
+
+func TestMultiValueFieldsKeepArrays(t *testing.T) {
+	cs := &SiteCfg{Key: "acme"}
+	fields, err := customFields(cs, map[string]any{"interests": []any{"=cmd", "b"}, "n": []any{float64(1), true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := newSubmission(cs, "id-1", "192.0.2.1", ContactRequest{Fields: fields})
+	data, err := json.Marshal(sub.exported(&Config{SanitizeCSV: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"interests":["'=cmd","b"]`) || !strings.Contains(string(data), `"n":[1,true]`) {
+		t.Fatalf("expected arrays in the payload, got %s", data)
+	}
+}
+
+func TestRefererAllowed(t *testing.T) {
+	cs := &SiteCfg{AllowedOrigins: []string{"https://example.com"}, RequireReferer: true}
+
+	tests := []struct {
+		name, origin, referer string
+		allowMissing          bool
+		want                  bool
+	}{
+		{"matching referer", "", "https://example.com/contact?x=1", false, true},
+		{"matching origin wins", "https://example.com", "https://evil.test/", false, true},
+		{"foreign referer", "", "https://evil.test/form", false, false},
+		{"foreign origin", "https://evil.test", "https://example.com/", false, false},
+		{"null origin", "null", "https://example.com/", false, false},
+		{"null origin, lenient", "null", "", true, false},
+		{"missing, strict", "", "", false, false},
+		{"missing, lenient", "", "", true, true},
+		{"garbage referer, lenient", "", "not a url", true, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cs.AllowNoReferer = tc.allowMissing
+			req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", nil)
+			if tc.origin != "" {
+				req.Header.Set("Origin", tc.origin)
+			}
+			if tc.referer != "" {
+				req.Header.Set("Referer", tc.referer)
+			}
+			if got := refererAllowed(req, cs); got != tc.want {
+				t.Fatalf("refererAllowed = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHandleContactMessageOptionalWithAttachment(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.Sites["acme"].AllowAttachments = true
+
+	var captured *email.Email
+	sendEmailFunc = func(_ context.Context, site *SiteCfg, e *email.Email) error {
+		captured = e
+		return nil
+	}
+	fields := map[string]string{"name": "Alice", "email": "alice@example.com"}
+
+	rec := httptest.NewRecorder()
+	HandleContact(rec, multipartRequest(t, fields, "cv.pdf", "%PDF-1.4"))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 while the message is required, got %d", rec.Code)
+	}
+
+	conf.Sites["acme"].MessageOptional = true
+	rec = httptest.NewRecorder()
+	HandleContact(rec, multipartRequest(t, fields, "cv.pdf", "%PDF-1.4"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if captured == nil || len(captured.Attachments) != 1 || !strings.Contains(string(captured.Text), "(no message, see attachments)") {
+		t.Fatalf("unexpected email: %+v", captured)
+	}
+
+	rec = httptest.NewRecorder()
+	HandleContact(rec, multipartRequest(t, fields, "", ""))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 without a file, got %d", rec.Code)
+	}
+}
+
+func TestRejectStatusOverride(t *testing.T) {
+	setupTestConfig(t)
+	conf.RejectStatus = map[string]int{"rate_limited": http.StatusServiceUnavailable}
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return nil }
+
+	post := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(`{"name":"Alice","email":"alice@example.com","message":"hi"}`))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		return rec.Code
+	}
+	codes := []int{post(), post(), post()}
+	if codes[2] != http.StatusServiceUnavailable {
+		t.Fatalf("expected the rate limit to answer 503, got %v", codes)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(`{}`))
+	req.Header.Set("Content-Type", "application/json")
+	ResetBuckets("", "")
+	rec := httptest.NewRecorder()
+	HandleContact(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected other rejections to keep their status, got %d", rec.Code)
+	}
+}
+
+func TestHandleContactRejectionCodes(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 50
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return nil }
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+	post := func(body string) *httptest.ResponseRecorder {
+		logs.Reset()
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		ctx := ContextWithLogger(req.Context(), logger)
+		req = req.WithContext(ContextWithRequestInfo(ctx, &RequestInfo{RequestID: "r1"}))
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		return rec
+	}
+
+	rec := post(`{"name":`)
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") || rec.Body.String() != "bad json\n" {
+		t.Fatalf("expected a plain text error by default, got %q %q", ct, rec.Body.String())
+	}
+	var line map[string]any
+	if err := json.Unmarshal(logs.Bytes(), &line); err != nil || line["reason_code"] != string(RejectBadJSON) {
+		t.Fatalf("expected reason_code %q in the log, got %s", RejectBadJSON, logs.String())
+	}
+
+	conf.JSONErrors = true
+	for _, tc := range []struct {
+		body string
+		code RejectReason
+	}{
+		{`{"name":`, RejectBadJSON},
+		{`{"name":"Alice","email":"not-an-email","message":"Hello"}`, RejectInvalidSubmission},
+		{`{"name":"Alice","email":"alice@example.com","message":"Hello","website":"spam"}`, RejectHoneypot},
+	} {
+		rec := post(tc.body)
+		var resp map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: expected a JSON error, got %q", tc.code, rec.Body.String())
+		}
+		if rec.Code != http.StatusBadRequest || rec.Header().Get("Content-Type") != "application/json" ||
+			resp["ok"] != false || resp["code"] != string(tc.code) || resp["request_id"] != "r1" || resp["error"] == "" {
+			t.Fatalf("%s: got %d %v", tc.code, rec.Code, resp)
+		}
+		if err := json.Unmarshal(logs.Bytes(), &line); err != nil || line["reason_code"] != string(tc.code) {
+			t.Fatalf("%s: expected reason_code in the log, got %s", tc.code, logs.String())
+		}
+	}
+}
+
+func TestReadMultipartSpoolsLargeFiles(t *testing.T) {
+	cs := &SiteCfg{Key: "acme", AllowAttachments: true}
+	req := multipartRequest(t, map[string]string{"name": "Alice"}, "big.txt", strings.Repeat("a", 4096))
+	_, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+
+	values, atts, err := readMultipart(req.Body, params["boundary"], cs, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values.Get("name") != "Alice" || len(atts) != 1 {
+		t.Fatalf("values=%v atts=%d", values, len(atts))
+	}
+	a := atts[0]
+	if a.Path == "" || a.Data != nil || a.Size != 4096 {
+		t.Fatalf("expected the file spooled to disk, got %+v", a)
+	}
+	if data, err := a.bytes(); err != nil || len(data) != 4096 {
+		t.Fatalf("spooled file has %d bytes, err %v", len(data), err)
+	}
+	removeSpooled(atts)
+	if _, err := os.Stat(a.Path); !os.IsNotExist(err) {
+		t.Fatalf("expected the temp file removed, got %v", err)
+	}
+
+	// A file over the site's total is cut off while streaming, and its
+	// temp file doesn't outlive the error.
+	cs.MaxAttachmentTotalKB = 2
+	req = multipartRequest(t, nil, "big.txt", strings.Repeat("a", 4096))
+	_, params, _ = mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if _, atts, err = readMultipart(req.Body, params["boundary"], cs, 1024); !errors.Is(err, errAttachmentsTooLarge) || atts != nil {
+		t.Fatalf("expected errAttachmentsTooLarge, got %v (%d attachments)", err, len(atts))
+	}
+}
+
+func TestObscureSiteKeys(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.Sites["acme"].AllowedOrigins = []string{"https://acme.example"}
+	conf.ObscureSiteKeys = true
+	conf.ObscureMinResponse = 30 * time.Millisecond
+
+	post := func(path string) (*httptest.ResponseRecorder, time.Duration) {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"name":"A","email":"a@example.com","message":"hi"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Origin", "https://attacker.example")
+		rec := httptest.NewRecorder()
+		start := time.Now()
+		HandleContact(rec, req)
+		return rec, time.Since(start)
+	}
+
+	known, knownTook := post("/v1/contact/acme")
+	unknown, unknownTook := post("/v1/contact/nosuchsite")
+	for _, rec := range []*httptest.ResponseRecorder{known, unknown} {
+		if rec.Code != http.StatusForbidden || rec.Body.String() != "forbidden\n" {
+			t.Fatalf("expected a plain 403, got %d %q", rec.Code, rec.Body)
+		}
+	}
+	if len(known.Header()) != len(unknown.Header()) {
+		t.Fatalf("headers differ: %v vs %v", known.Header(), unknown.Header())
+	}
+	for name := range known.Header() {
+		if known.Header().Get(name) != unknown.Header().Get(name) {
+			t.Fatalf("header %s differs: %q vs %q", name, known.Header().Get(name), unknown.Header().Get(name))
+		}
+	}
+	if knownTook < conf.ObscureMinResponse || unknownTook < conf.ObscureMinResponse {
+		t.Fatalf("expected both padded to %s, took %s and %s", conf.ObscureMinResponse, knownTook, unknownTook)
+	}
+
+	// Nor do a known site's other early refusals: no Origin with a bad
+	// body, a GET, or a body over the limit
+	conf.ObscureMinResponse = 0
+	early := []*http.Request{
+		httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(`{`)),
+		httptest.NewRequest(http.MethodGet, "/v1/contact/acme", nil),
+		httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(strings.Repeat("a", 2<<20))),
+	}
+	early[0].Header.Set("Content-Type", "application/json")
+	early[2].Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, req := range early {
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		if rec.Code != http.StatusForbidden || rec.Body.String() != "forbidden\n" {
+			t.Fatalf("%s: expected a plain 403, got %d %q", req.Method, rec.Code, rec.Body)
+		}
+	}
+
+	// A client that hangs up isn't waited for
+	conf.ObscureMinResponse = time.Minute
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	req := httptest.NewRequestWithContext(ctx, http.MethodPost, "/v1/contact/nosuchsite", strings.NewReader(`{}`))
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	HandleContact(rec, req)
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("expected the padding to stop with the request, took %s", took)
+	}
+
+	conf.ObscureSiteKeys = false
+	if rec, _ := post("/v1/contact/nosuchsite"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without OBSCURE_SITE_KEYS, got %d", rec.Code)
+	}
+}
+
+func TestPreflightUnknownSite(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.Sites["acme"].AllowedOrigins = []string{"https://acme.example"}
+	conf.CORSPreflightUnknown = true
+	conf.CORSMaxAge = time.Hour
+
+	preflight := func(path, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, path, nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		return rec
+	}
+
+	for _, path := range []string{"/v1/contact/nosuchsite", "/v1/contact/bad%20key"} {
+		rec := preflight(path, "https://shop.example")
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("%s: expected 204, got %d", path, rec.Code)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://shop.example" {
+			t.Fatalf("%s: expected the origin echoed, got %q", path, got)
+		}
+		if rec.Header().Get("Access-Control-Allow-Methods") == "" || rec.Header().Get("Access-Control-Max-Age") != "" {
+			t.Fatalf("%s: expected a bare uncached approval, got %v", path, rec.Header())
+		}
+	}
+
+	// A known site still checks the origin
+	if rec := preflight("/v1/contact/acme", "https://shop.example"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a disallowed origin on a known site, got %d", rec.Code)
+	}
+
+	// The real request is still turned away
+	req := httptest.NewRequest(http.MethodPost, "/v1/contact/nosuchsite", strings.NewReader(`{}`))
+	rec := httptest.NewRecorder()
+	HandleContact(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for the POST, got %d", rec.Code)
+	}
+
+	conf.ObscureSiteKeys = true
+	conf.ObscureMinResponse = 0
+	if rec := preflight("/v1/contact/nosuchsite", "https://shop.example"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected OBSCURE_SITE_KEYS to keep the 403, got %d", rec.Code)
+	}
+}
+
+func TestHandleContactEmailCooldown(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.Sites["acme"].EmailCooldown = 10 * time.Minute
+	clock := useFakeClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	t.Cleanup(func() {
+		lastSubmissionMu.Lock()
+		lastSubmission = map[string]time.Time{}
+		lastSubmissionMu.Unlock()
+	})
+	fail := false
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error {
+		if fail {
+			return errors.New("smtp down")
+		}
+		return nil
+	}
+
+	post := func(from string) *httptest.ResponseRecorder {
+		body := `{"name":"Alice","email":"` + from + `","message":"Hello"}`
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		return rec
+	}
+
+	fail = true
+	if rec := post("alice@example.com"); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected the failed send to answer 500, got %d", rec.Code)
+	}
+	fail = false
+	if rec := post("alice@example.com"); rec.Code != http.StatusOK {
+		t.Fatalf("expected a failed send not to start the cooldown, got %d", rec.Code)
+	}
+	clock.Advance(4 * time.Minute)
+	rec := post("Alice@Example.com")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "361" {
+		t.Fatalf("expected 429 with Retry-After 361, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := post("bob@example.com"); rec.Code != http.StatusOK {
+		t.Fatalf("expected another submitter to pass, got %d", rec.Code)
+	}
+	clock.Advance(6 * time.Minute)
+	if rec := post("alice@example.com"); rec.Code != http.StatusOK {
+		t.Fatalf("expected the cooldown over, got %d", rec.Code)
+	}
+}
+
+func TestEmailCooldownHold(t *testing.T) {
+	cs := &SiteCfg{Key: "acme", EmailCooldown: 10 * time.Minute}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	t.Cleanup(func() {
+		lastSubmissionMu.Lock()
+		lastSubmission = map[string]time.Time{}
+		cooldownSweepAt = minCooldownSweep
+		lastSubmissionMu.Unlock()
+	})
+
+	// A submission in flight holds the address against a concurrent one
+	h, wait := holdEmailCooldown(cs, "alice@example.com", now)
+	if h == nil || wait != 0 {
+		t.Fatalf("expected a hold, got %v %v", h, wait)
+	}
+	if _, wait := holdEmailCooldown(cs, "Alice@example.com", now); wait != 10*time.Minute {
+		t.Fatalf("expected the held address to wait, got %v", wait)
+	}
+	h.release()
+	if h, wait = holdEmailCooldown(cs, "alice@example.com", now); h == nil || wait != 0 {
+		t.Fatalf("expected a released hold to free the address, got %v", wait)
+	}
+
+	// The cooldown runs from delivery, and a release after that is a no-op
+	h.start(now.Add(time.Minute))
+	h.release()
+	if _, wait := holdEmailCooldown(cs, "alice@example.com", now.Add(2*time.Minute)); wait != 9*time.Minute {
+		t.Fatalf("expected 9m left, got %v", wait)
+	}
+
+	// Expired cooldowns go once the map grows past the sweep mark
+	lastSubmissionMu.Lock()
+	cooldownSweepAt = 1
+	lastSubmissionMu.Unlock()
+	later := now.Add(time.Hour)
+	holdEmailCooldown(cs, "bob@example.com", later)
+	lastSubmissionMu.Lock()
+	n := len(lastSubmission)
+	lastSubmissionMu.Unlock()
+	if n != 1 {
+		t.Fatalf("expected the expired cooldown swept, got %d entries", n)
+	}
+
+	if h, _ := holdEmailCooldown(&SiteCfg{Key: "acme"}, "carol@example.com", now); h != nil {
+		t.Fatalf("expected no hold without a cooldown, got %v", h)
+	}
+}
@@ -0,0 +1,97 @@
+package form_mailer
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Encrypted honeypot tokens go in a hidden form field for
+// <SITE>_ENCRYPTED_HONEYPOT sites. Unlike the "website" honeypot, which
+// must stay empty, this one must come back exactly as issued: a bot that
+// skips the form page, fills every field or replays an old post fails.
+// The token is base64url of a GCM nonce and "site|expiry-unix|id" sealed
+// under a key derived from FORM_TOKEN_SECRET, so it is opaque and can't
+// be edited. Each id is accepted once.
+
+const honeypotTokenField = "hp_token"
+
+var errBadHoneypot = errors.New("invalid honeypot token")
+
+func honeypotAEAD(secret []byte) cipher.AEAD {
+	// Derived so the honeypot and form tokens don't share a key
+	key := sha256.Sum256(append([]byte("honeypot\x00"), secret...))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		panic(err) // a 32-byte key can't fail
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+func issueHoneypotToken(secret []byte, site string, expires time.Time) string {
+	aead := honeypotAEAD(secret)
+	var id [12]byte
+	_, _ = rand.Read(id[:])
+	nonce := make([]byte, aead.NonceSize())
+	_, _ = rand.Read(nonce)
+	sealed := aead.Seal(nonce, nonce, fmt.Appendf(nil, "%s|%d|%x", site, expires.Unix(), id), nil)
+	return base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+// consumeHoneypotToken opens the token, checks its site and expiry, and
+// marks it used.
+func consumeHoneypotToken(secret []byte, site, token string, now time.Time) error {
+	held, err := verifyHoneypotToken(secret, site, token, now)
+	if err != nil {
+		return err
+	}
+	if !held.claim(now) {
+		return fmt.Errorf("%w: already used", errBadHoneypot)
+	}
+	return nil
+}
+
+// verifyHoneypotToken is consumeHoneypotToken without marking the token
+// used; the caller claims it once the submission is accepted.
+func verifyHoneypotToken(secret []byte, site, token string, now time.Time) (*heldNonce, error) {
+	if token == "" {
+		return nil, fmt.Errorf("%w: missing", errBadHoneypot)
+	}
+	aead := honeypotAEAD(secret)
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(raw) < aead.NonceSize() {
+		return nil, errBadHoneypot
+	}
+	plain, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: altered", errBadHoneypot)
+	}
+	parts := strings.Split(string(plain), "|")
+	if len(parts) != 3 || parts[0] != site {
+		return nil, errBadHoneypot
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, errBadHoneypot
+	}
+	expires := time.Unix(exp, 0)
+	if now.After(expires) {
+		return nil, fmt.Errorf("%w: expired", errBadHoneypot)
+	}
+	held := &heldNonce{nonce: "hp|" + parts[2], expires: expires}
+	if held.used() {
+		return nil, fmt.Errorf("%w: already used", errBadHoneypot)
+	}
+	return held, nil
+}
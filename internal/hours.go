@@ -0,0 +1,114 @@
+package form_mailer
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// businessHours is a parsed <SITE>_BUSINESS_HOURS spec such as
+// "Mon-Fri 09:00-17:00 Europe/Berlin": the same opening times on each of
+// the listed days, in a named zone so DST shifts with the local clock.
+type businessHours struct {
+	days       [7]bool // by time.Weekday
+	open, shut int     // minutes after local midnight; shut is exclusive
+	loc        *time.Location
+	spec       string
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseBusinessHours parses "DAYS HH:MM-HH:MM [ZONE]". DAYS is a comma
+// list of days or day ranges, e.g. "Mon-Fri" or "Mon-Thu,Sat"; a range may
+// wrap around the week ("Fri-Mon"). The zone defaults to UTC. Opening times
+// can't span midnight, but "24:00" ends the day.
+func parseBusinessHours(spec string) (*businessHours, error) {
+	f := strings.Fields(spec)
+	if len(f) != 2 && len(f) != 3 {
+		return nil, fmt.Errorf(`want "DAYS HH:MM-HH:MM [ZONE]", e.g. "Mon-Fri 09:00-17:00 Europe/Berlin"`)
+	}
+	bh := &businessHours{loc: time.UTC, spec: spec}
+	for _, part := range strings.Split(f[0], ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, ok := weekdays[strings.ToLower(from)]
+		if !ok {
+			return nil, fmt.Errorf("unknown day %q", from)
+		}
+		last := first
+		if isRange {
+			if last, ok = weekdays[strings.ToLower(to)]; !ok {
+				return nil, fmt.Errorf("unknown day %q", to)
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			bh.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+
+	open, shut, ok := strings.Cut(f[1], "-")
+	if !ok {
+		return nil, fmt.Errorf("bad opening times %q", f[1])
+	}
+	var err error
+	if bh.open, err = parseClock(open); err != nil {
+		return nil, err
+	}
+	if bh.shut, err = parseClock(shut); err != nil {
+		return nil, err
+	}
+	if bh.shut <= bh.open {
+		return nil, fmt.Errorf("opening times %q end before they start", f[1])
+	}
+
+	if len(f) == 3 {
+		if bh.loc, err = time.LoadLocation(f[2]); err != nil {
+			return nil, fmt.Errorf("unknown time zone %q", f[2])
+		}
+	}
+	return bh, nil
+}
+
+// String returns the spec bh was parsed from, or "" for none.
+func (bh *businessHours) String() string {
+	if bh == nil {
+		return ""
+	}
+	return bh.spec
+}
+
+// parseClock parses "HH:MM" into minutes after midnight.
+func parseClock(s string) (int, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 || len(s) != 5 ||
+		h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("bad time %q, want HH:MM", s)
+	}
+	return h*60 + m, nil
+}
+
+// isOpen reports whether t falls within business hours, read off the local
+// wall clock.
+func (bh *businessHours) isOpen(t time.Time) bool {
+	lt := t.In(bh.loc)
+	m := lt.Hour()*60 + lt.Minute()
+	return bh.days[lt.Weekday()] && m >= bh.open && m < bh.shut
+}
+
+// nextOpen returns when business hours next start after t.
+func (bh *businessHours) nextOpen(t time.Time) time.Time {
+	lt := t.In(bh.loc)
+	for i := 0; i <= 7; i++ {
+		// time.Date normalizes across month ends and DST changes
+		at := time.Date(lt.Year(), lt.Month(), lt.Day()+i, bh.open/60, bh.open%60, 0, 0, bh.loc)
+		if bh.days[at.Weekday()] && at.After(t) {
+			return at
+		}
+	}
+	return t
+}
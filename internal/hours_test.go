@@ -0,0 +1,86 @@
+package form_mailer
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jordan-wright/email"
+)
+
+func TestParseBusinessHours(t *testing.T) {
+	for _, bad := range []string{
+		"", "Mon-Fri", "Mon-Fri 9:00-17:00", "Mon-Fri 09:00", "Mon-Fri 17:00-09:00",
+		"Mon-Fry 09:00-17:00", "Mon-Fri 09:00-24:30", "Mon-Fri 09:00-17:00 Europe/Nowhere",
+		"Mon-Fri 09:00-17:00 Europe/Berlin extra",
+	} {
+		if _, err := parseBusinessHours(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+
+	bh, err := parseBusinessHours("Fri-Mon,wed 00:00-24:00")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	want := [7]bool{true, true, false, true, false, true, true}
+	if bh.days != want || bh.loc != time.UTC {
+		t.Fatalf("unexpected days %v in %v", bh.days, bh.loc)
+	}
+}
+
+func TestBusinessHoursDST(t *testing.T) {
+	bh, err := parseBusinessHours("Mon-Fri 09:00-17:00 Europe/Berlin")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	for _, c := range []struct {
+		at   time.Time
+		open bool
+	}{
+		{time.Date(2024, 3, 25, 8, 30, 0, 0, time.UTC), true},  // 09:30 CET
+		{time.Date(2024, 4, 1, 6, 30, 0, 0, time.UTC), false},  // 08:30 CEST
+		{time.Date(2024, 4, 1, 7, 30, 0, 0, time.UTC), true},   // 09:30 CEST
+		{time.Date(2024, 4, 1, 15, 0, 0, 0, time.UTC), false},  // 17:00 CEST
+		{time.Date(2024, 3, 30, 10, 0, 0, 0, time.UTC), false}, // Saturday
+	} {
+		if got := bh.isOpen(c.at); got != c.open {
+			t.Errorf("isOpen(%v) = %v, want %v", c.at, got, c.open)
+		}
+	}
+
+	// Friday evening before the switch to summer time opens Monday at 09:00 CEST.
+	next := bh.nextOpen(time.Date(2024, 3, 29, 17, 0, 0, 0, time.UTC))
+	if want := time.Date(2024, 4, 1, 7, 0, 0, 0, time.UTC); !next.Equal(want) {
+		t.Fatalf("nextOpen = %v, want %v", next.UTC(), want)
+	}
+}
+
+func TestHandleContactOutsideBusinessHours(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return nil }
+	bh, err := parseBusinessHours("Mon-Fri 09:00-17:00 UTC")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	conf.Sites["acme"].BusinessHours = bh
+	conf.Sites["acme"].OutsideHoursMsg = "Closed now, please call us instead."
+
+	clock := useFakeClock(t, time.Date(2024, 5, 3, 16, 30, 0, 0, time.UTC)) // Friday
+	if rec := postContact(t); rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200 during business hours, got %d", rec.Code)
+	}
+
+	clock.Advance(time.Hour)
+	rec := postContact(t)
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "please call us") {
+		t.Fatalf("expected 503 with the outside-hours message, got %d: %s", rec.Code, rec.Body)
+	}
+	// Monday 09:00 is 2 days 15.5 hours away
+	if got := rec.Header().Get("Retry-After"); got != "228601" {
+		t.Fatalf("unexpected Retry-After %q", got)
+	}
+}
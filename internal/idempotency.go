@@ -0,0 +1,230 @@
+package form_mailer
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Idempotency-Key support: the first response to a key is kept for
+// IDEMPOTENCY_TTL and replayed to retries of the same key on the same
+// site, so a client that lost the answer can safely post again. Only final
+// answers are kept; a 429 or 5xx is forgotten so the retry runs for real.
+// A key is bound to the hash of its request body: reusing it for a
+// different body is refused with 422 rather than answered with the other
+// submission's response. At most IDEMPOTENCY_MAX_KEYS are kept, the oldest
+// going first.
+
+const maxIdempotencyKey = 255
+
+var (
+	errBadIdempotencyKey = errors.New("invalid idempotency key")
+	errIdempotencyBusy   = errors.New("request with this idempotency key in progress")
+	errIdempotencyReused = errors.New("idempotency key reused with a different body")
+)
+
+type idempotentResponse struct {
+	done     bool // false while the first request is running
+	status   int
+	header   http.Header
+	body     []byte
+	bodyHash [sha256.Size]byte // of the request
+	expires  time.Time
+	elem     *list.Element // in idempotencyOrder
+}
+
+var (
+	idempotencyMu sync.Mutex
+	idempotency   = map[string]*idempotentResponse{} // site + "\x00" + key
+	// idempotencyOrder holds the keys oldest first. Every key gets the same
+	// TTL, so the expired ones are always at the front.
+	idempotencyOrder = list.New()
+)
+
+// idempotencyRecorder passes the response through and keeps a copy of it
+// for the key, along with the hash of the request body read through it.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	id       string
+	ttl      time.Duration
+	entry    *idempotentResponse
+	reqBody  io.Reader
+	bodyHash hash.Hash
+	maxBody  int64
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+		rec.header = rec.Header().Clone()
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	rec.body.Write(p)
+	return rec.ResponseWriter.Write(p)
+}
+
+// beginIdempotent claims key for site. When an earlier response is stored
+// for the same request body it is returned for replay; otherwise the
+// returned recorder wraps w, hashes r's body as the handler reads it, and
+// its finish method stores what the handler wrote. Up to maxBody bytes of
+// the body are hashed.
+func beginIdempotent(w http.ResponseWriter, r *http.Request, site, key string, ttl time.Duration, maxKeys int, maxBody int64) (*idempotencyRecorder, *idempotentResponse, error) {
+	if len(key) > maxIdempotencyKey {
+		return nil, nil, errBadIdempotencyKey
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x21 || key[i] > 0x7e {
+			return nil, nil, errBadIdempotencyKey
+		}
+	}
+
+	id := site + "\x00" + key
+	now := nowFunc()
+	idempotencyMu.Lock()
+	dropExpiredIdempotencyLocked(now)
+	if e, ok := idempotency[id]; ok {
+		idempotencyMu.Unlock()
+		if !e.done {
+			return nil, nil, errIdempotencyBusy
+		}
+		// Hashing a body can be slow; the entry doesn't change once done
+		if hashBody(r.Body, maxBody) != e.bodyHash {
+			return nil, nil, errIdempotencyReused
+		}
+		return nil, e, nil
+	}
+	for maxKeys > 0 && len(idempotency) >= maxKeys {
+		removeIdempotencyLocked(idempotencyOrder.Front().Value.(string))
+	}
+	e := &idempotentResponse{}
+	e.elem = idempotencyOrder.PushBack(id)
+	idempotency[id] = e
+	idempotencyMu.Unlock()
+
+	rec := &idempotencyRecorder{ResponseWriter: w, id: id, ttl: ttl, entry: e, bodyHash: sha256.New(), maxBody: maxBody}
+	rec.reqBody = io.TeeReader(r.Body, rec.bodyHash)
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{rec.reqBody, r.Body}
+	return rec, nil, nil
+}
+
+// dropExpiredIdempotencyLocked removes the expired responses at the front
+// of idempotencyOrder. Callers hold idempotencyMu.
+func dropExpiredIdempotencyLocked(now time.Time) {
+	for el := idempotencyOrder.Front(); el != nil; el = idempotencyOrder.Front() {
+		id := el.Value.(string)
+		if e := idempotency[id]; !e.done || !now.After(e.expires) {
+			return
+		}
+		removeIdempotencyLocked(id)
+	}
+}
+
+func removeIdempotencyLocked(id string) {
+	if e, ok := idempotency[id]; ok {
+		idempotencyOrder.Remove(e.elem)
+		delete(idempotency, id)
+	}
+}
+
+// hashBody returns the SHA-256 of the first maxBody+1 bytes of body.
+func hashBody(body io.Reader, maxBody int64) [sha256.Size]byte {
+	h := sha256.New()
+	_, _ = io.Copy(h, io.LimitReader(body, maxBody+1))
+	return [sha256.Size]byte(h.Sum(nil))
+}
+
+// finish stores the response, or releases the key when it isn't final. A
+// key evicted meanwhile for IDEMPOTENCY_MAX_KEYS stays gone.
+func (rec *idempotencyRecorder) finish() {
+	// The handler may have answered before reading the whole body
+	_, _ = io.Copy(io.Discard, io.LimitReader(rec.reqBody, rec.maxBody+1))
+	idempotencyMu.Lock()
+	defer idempotencyMu.Unlock()
+	if idempotency[rec.id] != rec.entry {
+		return
+	}
+	if rec.status == 0 || rec.status == http.StatusTooManyRequests || rec.status >= 500 {
+		removeIdempotencyLocked(rec.id)
+		return
+	}
+	// CORS headers belong to the request they answer; a replay gets its own
+	header := rec.header.Clone()
+	for k := range header {
+		if strings.HasPrefix(k, "Access-Control-") {
+			delete(header, k)
+		}
+	}
+	// Moved to the back, as it now expires last
+	idempotencyOrder.MoveToBack(rec.entry.elem)
+	*rec.entry = idempotentResponse{
+		done:     true,
+		status:   rec.status,
+		header:   header,
+		body:     rec.body.Bytes(),
+		bodyHash: [sha256.Size]byte(rec.bodyHash.Sum(nil)),
+		expires:  nowFunc().Add(rec.ttl),
+		elem:     rec.entry.elem,
+	}
+}
+
+// replay writes a stored response again.
+func (e *idempotentResponse) replay(w http.ResponseWriter) {
+	maps.Copy(w.Header(), e.header)
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(e.status)
+	_, _ = w.Write(e.body)
+}
+
+// handleIdempotencyKey applies the request's Idempotency-Key, if any. It
+// returns the writer to answer on, with done set when it has answered
+// itself: a replay or a refusal, which OBSCURE_SITE_KEYS hides like the
+// other refusals before a submission is read. Call finish, when not nil, after the
+// handler has answered.
+func handleIdempotencyKey(w http.ResponseWriter, r *http.Request, logger *slog.Logger, cfg *Config, info *RequestInfo, cs *SiteCfg, start time.Time) (_ http.ResponseWriter, finish func(), done bool) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" || cfg.IdempotencyTTL <= 0 {
+		return w, nil, false
+	}
+	rec, prev, err := beginIdempotent(w, r, cs.Key, key, cfg.IdempotencyTTL, cfg.IdempotencyMaxKeys, int64(cfg.MaxBodyKB)*1024)
+	switch {
+	case errors.Is(err, errIdempotencyBusy):
+		logger.Warn("idempotency key in use", "reason_code", RejectIdempotencyBusy)
+		rejectProbe(w, r, info, cfg, start, RejectIdempotencyBusy, "request with this idempotency key in progress", http.StatusConflict)
+		return w, nil, true
+	case errors.Is(err, errIdempotencyReused):
+		logger.Warn("idempotency key reused", "reason_code", RejectIdempotencyReused)
+		rejectProbe(w, r, info, cfg, start, RejectIdempotencyReused, "idempotency key reused with a different body", http.StatusUnprocessableEntity)
+		return w, nil, true
+	case err != nil:
+		logger.Warn("bad idempotency key", "reason_code", RejectBadIdempotencyKey)
+		rejectProbe(w, r, info, cfg, start, RejectBadIdempotencyKey, "invalid idempotency key", http.StatusBadRequest)
+		return w, nil, true
+	case prev != nil:
+		logger.Info("replaying idempotent response", "status", prev.status)
+		info.SetOutcome(OutcomeIdempotentReplay)
+		prev.replay(w)
+		return w, nil, true
+	}
+	return rec, rec.finish, false
+}
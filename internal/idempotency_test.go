@@ -0,0 +1,185 @@
+package form_mailer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jordan-wright/email"
+)
+
+func resetIdempotency(t *testing.T) {
+	t.Helper()
+	t.Cleanup(func() {
+		idempotencyMu.Lock()
+		idempotency = map[string]*idempotentResponse{}
+		idempotencyOrder.Init()
+		idempotencyMu.Unlock()
+	})
+}
+
+func TestHandleContactIdempotencyKey(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.IdempotencyTTL = time.Minute
+	resetIdempotency(t)
+	clock := useFakeClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+
+	sent := 0
+	var fail error
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error {
+		sent++
+		return fail
+	}
+	post := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(`{"name":"Alice","email":"alice@example.com","message":"Hello"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", key)
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		return rec
+	}
+
+	first := post("k1")
+	if first.Code != http.StatusOK || sent != 1 {
+		t.Fatalf("expected the first request to send, got %d (sent %d)", first.Code, sent)
+	}
+	replay := post("k1")
+	if replay.Code != http.StatusOK || sent != 1 || replay.Body.String() != first.Body.String() || replay.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("expected the stored response without a send, got %d %q (sent %d)", replay.Code, replay.Body, sent)
+	}
+	if rec := post("k2"); rec.Code != http.StatusOK || sent != 2 {
+		t.Fatalf("expected a new key to send, got %d (sent %d)", rec.Code, sent)
+	}
+
+	// Failures aren't stored, so the retry sends again.
+	fail = errors.New("smtp down")
+	if rec := post("k3"); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500, got %d", rec.Code)
+	}
+	fail = nil
+	if rec := post("k3"); rec.Code != http.StatusOK || sent != 4 {
+		t.Fatalf("expected the retry after a failure to send, got %d (sent %d)", rec.Code, sent)
+	}
+
+	clock.Advance(2 * time.Minute)
+	if rec := post("k1"); rec.Header().Get("Idempotent-Replayed") != "" || sent != 5 {
+		t.Fatalf("expected an expired key to be handled afresh (sent %d)", sent)
+	}
+	if rec := post("bad key"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for a key with a space, got %d", rec.Code)
+	}
+}
+
+func TestIdempotencyKeyInProgress(t *testing.T) {
+	resetIdempotency(t)
+	begin := func(site string) (*idempotencyRecorder, *idempotentResponse, error) {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+		return beginIdempotent(httptest.NewRecorder(), req, site, "k", time.Minute, 0, 1024)
+	}
+	rec, _, err := begin("acme")
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	if _, _, err := begin("acme"); !errors.Is(err, errIdempotencyBusy) {
+		t.Fatalf("expected errIdempotencyBusy, got %v", err)
+	}
+	if _, prev, err := begin("other"); err != nil || prev != nil {
+		t.Fatalf("expected keys to be per site, got %v", err)
+	}
+	rec.WriteHeader(http.StatusTeapot)
+	rec.finish()
+	if _, prev, _ := begin("acme"); prev == nil || prev.status != http.StatusTeapot {
+		t.Fatalf("expected the finished response to be stored, got %+v", prev)
+	}
+}
+
+func TestIdempotencyKeyBoundToBodyAndOrigin(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.IdempotencyTTL = time.Minute
+	conf.Sites["acme"].AllowedOrigins = []string{"https://a.example", "https://b.example"}
+	resetIdempotency(t)
+	sent := 0
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { sent++; return nil }
+
+	post := func(message, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(`{"name":"Alice","email":"alice@example.com","message":"`+message+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Idempotency-Key", "k1")
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		return rec
+	}
+	if rec := post("Hello", "https://a.example"); rec.Code != http.StatusOK || sent != 1 {
+		t.Fatalf("expected the first request to send, got %d", rec.Code)
+	}
+	if rec := post("Something else", "https://a.example"); rec.Code != http.StatusUnprocessableEntity || sent != 1 {
+		t.Fatalf("expected 422 for the key with another body, got %d (sent %d)", rec.Code, sent)
+	}
+	rec := post("Hello", "https://b.example")
+	if rec.Header().Get("Idempotent-Replayed") != "true" || sent != 1 {
+		t.Fatalf("expected a replay, got %d (sent %d)", rec.Code, sent)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://b.example" {
+		t.Fatalf("expected the replay's own CORS origin, got %q", got)
+	}
+}
+
+func TestIdempotencyMaxKeys(t *testing.T) {
+	resetIdempotency(t)
+	begin := func(key string) *idempotentResponse {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+		rec, prev, err := beginIdempotent(httptest.NewRecorder(), req, "acme", key, time.Minute, 2, 1024)
+		if err != nil {
+			t.Fatalf("begin %s: %v", key, err)
+		}
+		if rec != nil {
+			rec.WriteHeader(http.StatusOK)
+			rec.finish()
+		}
+		return prev
+	}
+	begin("k1")
+	begin("k2")
+	begin("k3")
+	idempotencyMu.Lock()
+	n := len(idempotency)
+	idempotencyMu.Unlock()
+	if n != 2 {
+		t.Fatalf("expected the store capped at 2, got %d", n)
+	}
+	if begin("k3") == nil {
+		t.Fatal("expected the newest key kept")
+	}
+	if begin("k1") != nil {
+		t.Fatal("expected the oldest key evicted")
+	}
+}
+
+func TestHandleBatchIdempotencyKey(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.BatchMaxItems = 3
+	conf.IdempotencyTTL = time.Minute
+	resetIdempotency(t)
+	sent := 0
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { sent++; return nil }
+
+	body := `[{"name":"Alice","email":"alice@example.com","message":"one"}]`
+	for range 2 {
+		req := newBatchRequest(body)
+		req.Header.Set("Idempotency-Key", "b1")
+		if rec := serveBatch(req); rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+		}
+	}
+	if sent != 1 {
+		t.Fatalf("expected the retried batch replayed, got %d sent", sent)
+	}
+}
@@ -0,0 +1,196 @@
+package form_mailer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// errJSONTooComplex is returned for payloads nested deeper or holding more
+// tokens than JSON_MAX_DEPTH / JSON_MAX_TOKENS allow.
+var errJSONTooComplex = errors.New("json payload too complex")
+
+// checkJSONLimits walks data token by token, without building any values,
+// and fails as soon as a limit is crossed. Zero disables a limit.
+func checkJSONLimits(data []byte, maxDepth, maxTokens int) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	depth, tokens := 0, 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		tokens++
+		if maxTokens > 0 && tokens > maxTokens {
+			return fmt.Errorf("%w: more than %d tokens", errJSONTooComplex, maxTokens)
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+			if maxDepth > 0 && depth > maxDepth {
+				return fmt.Errorf("%w: nested deeper than %d", errJSONTooComplex, maxDepth)
+			}
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+}
+
+// errNotJSONObject is returned for a contact payload that isn't a JSON
+// object.
+var errNotJSONObject = errors.New("json payload is not an object")
+
+// decodeJSONObject decodes a JSON object from r token by token, under the
+// same limits as checkJSONLimits, so an oversized or overly complex body
+// is turned away while it streams in rather than after it is buffered. It
+// also lists the top-level keys that occur more than once, the last one
+// winning as with encoding/json.
+func decodeJSONObject(r io.Reader, maxDepth, maxTokens int) (map[string]any, []string, error) {
+	jw := &jsonWalker{dec: json.NewDecoder(r), maxDepth: maxDepth, maxTokens: maxTokens}
+	tok, err := jw.token()
+	if err != nil {
+		return nil, nil, err
+	}
+	if tok != json.Delim('{') {
+		return nil, nil, errNotJSONObject
+	}
+	if err := jw.enter(); err != nil {
+		return nil, nil, err
+	}
+	values := map[string]any{}
+	var dups []string
+	for jw.dec.More() {
+		k, v, err := jw.member()
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, ok := values[k]; ok && !slices.Contains(dups, k) {
+			dups = append(dups, k)
+		}
+		values[k] = v
+	}
+	if _, err := jw.token(); err != nil {
+		return nil, nil, err
+	}
+	if _, err := jw.dec.Token(); err != io.EOF {
+		if err == nil {
+			err = errors.New("invalid data after top-level value")
+		}
+		return nil, nil, err
+	}
+	return values, dups, nil
+}
+
+// jsonWalker builds JSON values from a decoder's tokens, counting tokens
+// and depth as it goes.
+type jsonWalker struct {
+	dec                 *json.Decoder
+	maxDepth, maxTokens int
+	depth, tokens       int
+}
+
+func (jw *jsonWalker) token() (json.Token, error) {
+	tok, err := jw.dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	jw.tokens++
+	if jw.maxTokens > 0 && jw.tokens > jw.maxTokens {
+		return nil, fmt.Errorf("%w: more than %d tokens", errJSONTooComplex, jw.maxTokens)
+	}
+	return tok, nil
+}
+
+func (jw *jsonWalker) enter() error {
+	jw.depth++
+	if jw.maxDepth > 0 && jw.depth > jw.maxDepth {
+		return fmt.Errorf("%w: nested deeper than %d", errJSONTooComplex, jw.maxDepth)
+	}
+	return nil
+}
+
+// member reads one key and value of the object being walked.
+func (jw *jsonWalker) member() (string, any, error) {
+	tok, err := jw.token()
+	if err != nil {
+		return "", nil, err
+	}
+	k, _ := tok.(string) // the decoder only allows string keys
+	v, err := jw.value()
+	return k, v, err
+}
+
+// value reads the next value, recursing into objects and arrays.
+func (jw *jsonWalker) value() (any, error) {
+	tok, err := jw.token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		if err := jw.enter(); err != nil {
+			return nil, err
+		}
+		m := map[string]any{}
+		for jw.dec.More() {
+			k, v, err := jw.member()
+			if err != nil {
+				return nil, err
+			}
+			m[k] = v
+		}
+		if _, err := jw.token(); err != nil {
+			return nil, err
+		}
+		jw.depth--
+		return m, nil
+	case json.Delim('['):
+		if err := jw.enter(); err != nil {
+			return nil, err
+		}
+		a := []any{}
+		for jw.dec.More() {
+			v, err := jw.value()
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+		if _, err := jw.token(); err != nil {
+			return nil, err
+		}
+		jw.depth--
+		return a, nil
+	}
+	return tok, nil
+}
+
+// unknownFields lists top-level keys the site doesn't read, for
+// JSON_DISALLOW_UNKNOWN_FIELDS.
+func unknownFields(cs *SiteCfg, values map[string]any) []string {
+	known := serviceFields(cs)
+	for k := range cs.FieldTypes {
+		known[k] = true
+	}
+	for _, k := range cs.AllowedFields {
+		known[k] = true
+	}
+	for _, path := range cs.FieldMap {
+		root, _, _ := strings.Cut(path, ".")
+		known[root] = true
+	}
+	var out []string
+	for k := range values {
+		if !known[k] {
+			out = append(out, k)
+		}
+	}
+	return out
+}
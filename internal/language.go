@@ -0,0 +1,118 @@
+package form_mailer
+
+import (
+	"strings"
+	"unicode"
+)
+
+// A small language guesser for DETECT_LANGUAGE: enough to route a message
+// to a regional team, not a general-purpose detector. Messages in a script
+// used by a single common language are tagged from the script; Latin-script
+// messages are scored by common function words. Anything short or close
+// is "unknown" rather than a guess.
+
+const languageUnknown = "unknown"
+
+// Minimum evidence before committing to an answer.
+const (
+	minScriptLetters = 10
+	minStopwordHits  = 3
+)
+
+var scriptLanguages = []struct {
+	table *unicode.RangeTable
+	lang  string
+}{
+	{unicode.Hiragana, "ja"},
+	{unicode.Katakana, "ja"},
+	{unicode.Hangul, "ko"},
+	{unicode.Han, "zh"}, // after kana: Japanese mixes both
+	{unicode.Cyrillic, "ru"},
+	{unicode.Greek, "el"},
+	{unicode.Arabic, "ar"},
+	{unicode.Hebrew, "he"},
+	{unicode.Thai, "th"},
+	{unicode.Devanagari, "hi"},
+}
+
+var stopwords = map[string][]string{
+	"en": {"the", "and", "is", "are", "you", "to", "of", "for", "with", "this", "that", "have", "not", "would", "your", "we", "my", "it", "be", "can"},
+	"de": {"der", "die", "das", "und", "ist", "nicht", "ich", "sie", "mit", "für", "wir", "ein", "eine", "zu", "auf", "haben", "bitte", "ihr", "den", "auch"},
+	"fr": {"le", "la", "les", "et", "est", "je", "vous", "nous", "pour", "avec", "une", "des", "pas", "que", "qui", "dans", "sur", "mon", "votre", "merci"},
+	"es": {"el", "la", "los", "las", "y", "es", "que", "por", "para", "con", "una", "del", "mi", "su", "pero", "como", "gracias", "hola", "estoy", "usted"},
+	"it": {"il", "lo", "gli", "e", "che", "per", "con", "una", "non", "sono", "mi", "grazie", "della", "questo", "vorrei", "buongiorno", "ho", "ciao", "anche", "come"},
+	"pt": {"o", "os", "as", "e", "que", "para", "com", "uma", "não", "por", "obrigado", "obrigada", "olá", "meu", "minha", "vocês", "gostaria", "isso", "está", "também"},
+	"nl": {"de", "het", "een", "en", "is", "ik", "niet", "van", "met", "voor", "wij", "zijn", "dat", "op", "ook", "graag", "bedankt", "mijn", "u", "jullie"},
+}
+
+var stopwordLangs = invertStopwords()
+
+func invertStopwords() map[string][]string {
+	out := map[string][]string{}
+	for lang, words := range stopwords {
+		for _, w := range words {
+			out[w] = append(out[w], lang)
+		}
+	}
+	return out
+}
+
+// detectLanguage returns an ISO 639-1 code for text, or "unknown".
+func detectLanguage(text string) string {
+	scripts := map[string]int{}
+	latin := 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		if unicode.Is(unicode.Latin, r) {
+			latin++
+			continue
+		}
+		for _, s := range scriptLanguages {
+			if unicode.Is(s.table, r) {
+				scripts[s.lang]++
+				break
+			}
+		}
+	}
+
+	best, bestN := "", 0
+	for lang, n := range scripts {
+		if n > bestN {
+			best, bestN = lang, n
+		}
+	}
+	if scripts["ja"] > 0 && best == "zh" {
+		best = "ja"
+	}
+	if bestN >= minScriptLetters && bestN > latin {
+		return best
+	}
+
+	hits := map[string]int{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '\''
+	}) {
+		for _, lang := range stopwordLangs[word] {
+			hits[lang]++
+		}
+	}
+	var (
+		first          string
+		firstN, second int
+	)
+	for lang, n := range hits {
+		switch {
+		case n > firstN:
+			second, first, firstN = firstN, lang, n
+		case n > second:
+			second = n
+		}
+	}
+	// Require a clear lead: related languages share many function words.
+	if firstN < minStopwordHits || firstN*2 < second*3 {
+		return languageUnknown
+	}
+	return first
+}
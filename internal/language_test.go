@@ -0,0 +1,24 @@
+package form_mailer
+
+import "testing"
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		text, want string
+	}{
+		{"Hello, I would like to know the price of your service for my team.", "en"},
+		{"Hallo, ich habe eine Frage zu Ihrem Angebot und wir möchten es bitte auch testen.", "de"},
+		{"Bonjour, je voudrais savoir si vous pouvez nous envoyer une offre pour le projet.", "fr"},
+		{"Hola, estoy interesado en el producto y me gustaría saber el precio para mi empresa.", "es"},
+		{"Здравствуйте, хотел бы узнать стоимость ваших услуг.", "ru"},
+		{"お問い合わせありがとうございます。料金について教えてください。", "ja"},
+		{"Hi there", "unknown"},
+		{"ok ok ok", "unknown"},
+		{"", "unknown"},
+	}
+	for _, tt := range tests {
+		if got := detectLanguage(tt.text); got != tt.want {
+			t.Errorf("detectLanguage(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
@@ -3,12 +3,58 @@ package form_mailer
 import (
 	"context"
 	"log/slog"
+	"net/http"
 )
 
 type loggerKey struct{}
 
+type requestInfoKey struct{}
+
 var fallbackLogger = slog.Default()
 
+// RequestInfo carries handler outcome details back up to the access log.
+type RequestInfo struct {
+	RequestID    string
+	Site         string
+	SubmissionID string
+	reason       string // a RejectReason or an Outcome
+	// LogSuppressed is set when log sampling dropped this request's
+	// rejection log, so the access log can drop it as well.
+	LogSuppressed bool
+}
+
+// Reason returns the access log reason: the RejectReason of a rejected
+// request, otherwise its Outcome.
+func (info *RequestInfo) Reason() string {
+	return info.reason
+}
+
+// SetRejected records why the request was turned away.
+func (info *RequestInfo) SetRejected(reason RejectReason) {
+	info.reason = string(reason)
+}
+
+// SetOutcome records how a request that wasn't turned away ended.
+func (info *RequestInfo) SetOutcome(o Outcome) {
+	info.reason = string(o)
+}
+
+// RequestID returns the caller's X-Request-ID when it looks like an ID a
+// proxy would set (up to 128 of [A-Za-z0-9._-]), so logs can be joined
+// across hops, or a new one otherwise.
+func RequestID(r *http.Request) string {
+	id := r.Header.Get("X-Request-ID")
+	if id == "" || len(id) > 128 {
+		return newSubmissionID()
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return newSubmissionID()
+		}
+	}
+	return id
+}
+
 // ContextWithLogger attaches a logger to the context; handlers can retrieve it later.
 func ContextWithLogger(ctx context.Context, logger *slog.Logger) context.Context {
 	if logger == nil {
@@ -27,3 +73,62 @@ func LoggerFromContext(ctx context.Context) *slog.Logger {
 	}
 	return fallbackLogger
 }
+
+// ContextWithRequestInfo attaches a mutable RequestInfo the handler fills in.
+func ContextWithRequestInfo(ctx context.Context, info *RequestInfo) context.Context {
+	if info == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// RequestInfoFromContext returns the request's RequestInfo, or a throwaway one
+// when none was attached so callers can always write to it.
+func RequestInfoFromContext(ctx context.Context) *RequestInfo {
+	if ctx != nil {
+		if info, ok := ctx.Value(requestInfoKey{}).(*RequestInfo); ok && info != nil {
+			return info
+		}
+	}
+	return &RequestInfo{}
+}
+
+// levelHandler applies a minimum level in front of a handler that lets
+// everything through, so loggers sharing one output can differ in
+// verbosity: <SITE>_LOG_LEVEL swaps the level for a site's requests.
+type levelHandler struct {
+	level slog.Leveler
+	inner slog.Handler
+}
+
+// NewLevelHandler returns a handler passing records at level or above to
+// inner, which should itself accept every level.
+func NewLevelHandler(inner slog.Handler, level slog.Leveler) slog.Handler {
+	return &levelHandler{level: level, inner: inner}
+}
+
+func (h *levelHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
+
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.inner.Handle(ctx, r)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{level: h.level, inner: h.inner.WithAttrs(attrs)}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{level: h.level, inner: h.inner.WithGroup(name)}
+}
+
+// withSiteLevel returns logger at the site's <SITE>_LOG_LEVEL, if it has
+// one and logger was built on NewLevelHandler.
+func withSiteLevel(logger *slog.Logger, cs *SiteCfg) *slog.Logger {
+	h, ok := logger.Handler().(*levelHandler)
+	if cs.LogLevel == nil || !ok {
+		return logger
+	}
+	return slog.New(&levelHandler{level: cs.LogLevel, inner: h.inner})
+}
@@ -0,0 +1,65 @@
+package form_mailer
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// sampledReasons are the rejections a flood produces in bulk. Successful
+// sends and server errors are never sampled.
+var sampledReasons = map[RejectReason]bool{
+	RejectHoneypot:          true,
+	RejectHoneypotToken:     true,
+	RejectRateLimited:       true,
+	RejectSendRateLimited:   true,
+	RejectOriginNotAllowed:  true,
+	RejectRefererNotAllowed: true,
+	RejectInvalidSubmission: true,
+	RejectInvalidToken:      true,
+}
+
+const logSampleWindow = time.Minute
+
+// logSampler lets the first threshold events per reason and window through,
+// then one in rate, and reports what it dropped when the window rolls over.
+type logSampler struct {
+	mu         sync.Mutex
+	start      time.Time
+	counts     map[string]int
+	suppressed map[string]int
+}
+
+var rejectionSampler = &logSampler{}
+
+func (s *logSampler) keep(reason string, threshold, rate int, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.start) >= logSampleWindow {
+		for r, n := range s.suppressed {
+			slog.Default().Warn("log sampling summary", "reason", r, "suppressed", n, "window", logSampleWindow)
+		}
+		s.start = now
+		s.counts = map[string]int{}
+		s.suppressed = map[string]int{}
+	}
+	s.counts[reason]++
+	n := s.counts[reason]
+	if n <= threshold || rate <= 1 || (n-threshold)%rate == 0 {
+		return true
+	}
+	s.suppressed[reason]++
+	return false
+}
+
+// warnRejection logs a rejection at warn level, subject to LOG_SAMPLE_* for
+// the reasons in sampledReasons. A sampled-out request is marked so the
+// access log skips it too.
+func warnRejection(logger *slog.Logger, cfg *Config, info *RequestInfo, reason RejectReason, msg string, args ...any) {
+	if cfg.LogSampleThreshold > 0 && sampledReasons[reason] &&
+		!rejectionSampler.keep(string(reason), cfg.LogSampleThreshold, cfg.LogSampleRate, nowFunc()) {
+		info.LogSuppressed = true
+		return
+	}
+	logger.Warn(msg, append([]any{"reason_code", reason}, args...)...)
+}
@@ -0,0 +1,43 @@
+package form_mailer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLogSamplerKeep(t *testing.T) {
+	s := &logSampler{}
+	now := time.Now()
+
+	kept := 0
+	for range 25 {
+		if s.keep("honeypot", 5, 10, now) {
+			kept++
+		}
+	}
+	// 5 under the threshold, then the 10th and 20th of the remaining 20.
+	if kept != 7 {
+		t.Fatalf("kept %d of 25, want 7", kept)
+	}
+	if got := s.suppressed["honeypot"]; got != 18 {
+		t.Fatalf("suppressed = %d, want 18", got)
+	}
+	if !s.keep("rate_limited", 5, 10, now) {
+		t.Fatal("reasons should be counted separately")
+	}
+
+	if !s.keep("honeypot", 5, 10, now.Add(logSampleWindow)) || s.suppressed["honeypot"] != 0 {
+		t.Fatal("expected counts to reset in a new window")
+	}
+}
+
+func TestWarnRejectionSkipsUnsampledReasons(t *testing.T) {
+	cfg := &Config{LogSampleThreshold: 1, LogSampleRate: 1000}
+	info := &RequestInfo{}
+	for range 3 {
+		warnRejection(fallbackLogger, cfg, info, "send_failed", "smtp send failed")
+	}
+	if info.LogSuppressed {
+		t.Fatal("reasons outside sampledReasons must never be suppressed")
+	}
+}
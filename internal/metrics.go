@@ -0,0 +1,143 @@
+package form_mailer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A tiny Prometheus text-format registry; enough for a handful of counters
+// and gauges without pulling in client_golang.
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	metricsMu sync.Mutex
+	registry  []metric
+
+	inFlight atomic.Int64
+
+	submissionsTotal = newCounterVec("form_courier_submissions_total",
+		"Contact requests by site and outcome reason.", "site", "reason")
+	globalSendThrottled = newCounterVec("form_courier_global_send_throttled_total",
+		"Emails held back by GLOBAL_SEND_RATE_PER_MINUTE.")
+	signatureFailures = newCounterVec("form_courier_signature_failures_total",
+		"X-Signature verification failures by site and reason.", "site", "reason")
+	rateLimitEvictions = newCounterVec("form_courier_rate_limit_evictions_total",
+		"Rate-limit buckets dropped to stay under RATE_LIMIT_MAX_BUCKETS.")
+	deliveryFallbacks = newCounterVec("form_courier_delivery_fallbacks_total",
+		"Deliveries tried on a <SITE>_DELIVERY_FALLBACK backend by site, backend and outcome (ok, error).", "site", "backend", "outcome")
+	shadowDeliveries = newCounterVec("form_courier_shadow_deliveries_total",
+		"Shadow deliveries by site, shadow backend and outcome (ok, error).", "site", "backend", "outcome")
+)
+
+func init() {
+	newGaugeFunc("form_courier_in_flight_requests", "HTTP requests currently being served.", func() float64 {
+		return float64(inFlight.Load())
+	})
+	newGaugeFunc("form_courier_rate_limit_buckets", "Rate-limit buckets currently held in memory.", func() float64 {
+		return float64(BucketCount())
+	})
+	newGaugeFunc("form_courier_global_send_tokens", "Emails that may be sent now under GLOBAL_SEND_RATE_PER_MINUTE.", func() float64 {
+		return globalSend.available()
+	})
+}
+
+func register(m metric) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	registry = append(registry, m)
+}
+
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+	register(c)
+	return c
+}
+
+// Inc adds one to the series identified by labelValues, in label order.
+func (c *counterVec) Inc(labelValues ...string) {
+	var b strings.Builder
+	for i, l := range c.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		v := ""
+		if i < len(labelValues) {
+			v = labelValues[i]
+		}
+		fmt.Fprintf(&b, "%s=%q", l, v)
+	}
+	c.mu.Lock()
+	c.values[b.String()]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k == "" {
+			fmt.Fprintf(w, "%s %g\n", c.name, c.values[k])
+			continue
+		}
+		fmt.Fprintf(w, "%s{%s} %g\n", c.name, k, c.values[k])
+	}
+}
+
+type gaugeFunc struct {
+	name, help string
+	fn         func() float64
+}
+
+func newGaugeFunc(name, help string, fn func() float64) {
+	register(&gaugeFunc{name: name, help: help, fn: fn})
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", g.name, g.help, g.name, g.name, g.fn())
+}
+
+// TrackInFlight counts a request as in flight until the returned func runs.
+func TrackInFlight() func() {
+	inFlight.Add(1)
+	return func() { inFlight.Add(-1) }
+}
+
+// RecordOutcome counts a finished request that was attributed to a site.
+func RecordOutcome(info *RequestInfo) {
+	if info == nil || info.Site == "" {
+		return
+	}
+	submissionsTotal.Inc(info.Site, info.Reason())
+}
+
+// HandleMetrics serves all registered metrics in the Prometheus text format.
+func HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	for _, m := range registry {
+		m.write(w)
+	}
+}
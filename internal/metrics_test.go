@@ -0,0 +1,30 @@
+package form_mailer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleMetrics(t *testing.T) {
+	done := TrackInFlight()
+	info := &RequestInfo{Site: "metrics-test"}
+	info.SetOutcome(OutcomeSent)
+	RecordOutcome(info)
+
+	rr := httptest.NewRecorder()
+	HandleMetrics(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	done()
+
+	body := rr.Body.String()
+	for _, want := range []string{
+		"# TYPE form_courier_in_flight_requests gauge\nform_courier_in_flight_requests 1\n",
+		"# TYPE form_courier_rate_limit_buckets gauge\n",
+		`form_courier_submissions_total{site="metrics-test",reason="sent"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output missing %q:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package form_mailer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// <SITE>_VERIFY_MX: reject submitter addresses whose domain can't receive
+// mail. A domain without MX records may still take mail on its A/AAAA
+// address (RFC 5321 implicit MX), while a "." MX (RFC 7505) says it
+// takes none. Only definite answers are cached and acted on; a timeout or
+// failing resolver lets the submission through rather than blaming it.
+
+// lookupMXFunc and lookupHostFunc resolve DNS; tests replace them.
+var (
+	lookupMXFunc   = net.DefaultResolver.LookupMX
+	lookupHostFunc = net.DefaultResolver.LookupHost
+)
+
+type mxEntry struct {
+	ok      bool
+	expires time.Time
+}
+
+var (
+	mxCacheMu sync.Mutex
+	mxCache   = map[string]mxEntry{} // lowercased domain -> answer
+)
+
+// domainAcceptsMail reports whether the domain of addr has an MX or, lacking
+// one, an address record. err is set when DNS gave no definite answer.
+func domainAcceptsMail(ctx context.Context, cfg *Config, addr string) (bool, error) {
+	_, domain, _ := strings.Cut(addr, "@")
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	now := nowFunc()
+
+	mxCacheMu.Lock()
+	e, hit := mxCache[domain]
+	mxCacheMu.Unlock()
+	if hit && now.Before(e.expires) {
+		return e.ok, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.MXTimeout)
+	defer cancel()
+	ok, err := resolveMailDomain(ctx, domain)
+	if err != nil {
+		return false, err
+	}
+
+	mxCacheMu.Lock()
+	defer mxCacheMu.Unlock()
+	for d, e := range mxCache {
+		if now.After(e.expires) {
+			delete(mxCache, d)
+		}
+	}
+	mxCache[domain] = mxEntry{ok: ok, expires: now.Add(cfg.MXCacheTTL)}
+	return ok, nil
+}
+
+func resolveMailDomain(ctx context.Context, domain string) (bool, error) {
+	mxs, err := lookupMXFunc(ctx, domain)
+	if err == nil && len(mxs) > 0 {
+		return !(len(mxs) == 1 && mxs[0].Host == "."), nil
+	}
+	if err != nil && !isNotFound(err) {
+		return false, err
+	}
+	addrs, err := lookupHostFunc(ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return len(addrs) > 0, nil
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
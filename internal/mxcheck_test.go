@@ -0,0 +1,105 @@
+package form_mailer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jordan-wright/email"
+)
+
+// fakeDNS answers MX and host lookups from the given tables; domains in
+// neither are NXDOMAIN, and "slow.example" times out. It counts MX lookups.
+func fakeDNS(t *testing.T, mx map[string][]*net.MX, hosts map[string][]string) *int {
+	t.Helper()
+	prevMX, prevHost := lookupMXFunc, lookupHostFunc
+	t.Cleanup(func() {
+		lookupMXFunc, lookupHostFunc = prevMX, prevHost
+		mxCacheMu.Lock()
+		mxCache = map[string]mxEntry{}
+		mxCacheMu.Unlock()
+	})
+	lookups := new(int)
+	notFound := func(name string) error { return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true} }
+	lookupMXFunc = func(ctx context.Context, name string) ([]*net.MX, error) {
+		*lookups++
+		if name == "slow.example" {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		if r, ok := mx[name]; ok {
+			return r, nil
+		}
+		return nil, notFound(name)
+	}
+	lookupHostFunc = func(_ context.Context, name string) ([]string, error) {
+		if r, ok := hosts[name]; ok {
+			return r, nil
+		}
+		return nil, notFound(name)
+	}
+	return lookups
+}
+
+func TestDomainAcceptsMail(t *testing.T) {
+	lookups := fakeDNS(t,
+		map[string][]*net.MX{"example.com": {{Host: "mx.example.com.", Pref: 10}}, "nomail.example": {{Host: "."}}},
+		map[string][]string{"a-only.example": {"192.0.2.1"}},
+	)
+	useFakeClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	cfg := &Config{MXTimeout: 50 * time.Millisecond, MXCacheTTL: time.Hour}
+
+	for addr, want := range map[string]bool{
+		"alice@example.com":      true,
+		"alice@EXAMPLE.com":      true,
+		"bob@a-only.example":     true,
+		"carol@nomail.example":   false,
+		"dave@gmial.con":         false,
+		"erin@typo.example.com.": false,
+	} {
+		ok, err := domainAcceptsMail(context.Background(), cfg, addr)
+		if err != nil || ok != want {
+			t.Errorf("%s: got %v, %v; want %v", addr, ok, err, want)
+		}
+	}
+	if *lookups != 5 {
+		t.Fatalf("expected the second example.com lookup to be cached, got %d lookups", *lookups)
+	}
+
+	if _, err := domainAcceptsMail(context.Background(), cfg, "frank@slow.example"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+}
+
+func TestHandleContactVerifyMX(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.MXTimeout = 50 * time.Millisecond
+	conf.MXCacheTTL = time.Hour
+	conf.Sites["acme"].VerifyMX = true
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return nil }
+	fakeDNS(t, map[string][]*net.MX{"example.com": {{Host: "mx.example.com."}}}, nil)
+
+	post := func(from string) int {
+		body := `{"name":"Alice","email":"` + from + `","message":"Hello"}`
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		return rec.Code
+	}
+	if code := post("alice@example.com"); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if code := post("alice@gmial.con"); code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for a domain without mail, got %d", code)
+	}
+	if code := post("alice@slow.example"); code != http.StatusOK {
+		t.Fatalf("expected a DNS timeout to let the submission through, got %d", code)
+	}
+}
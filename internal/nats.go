@@ -0,0 +1,172 @@
+package form_mailer
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A minimal NATS publisher: one connection per message, which is plenty at
+// form-submission rates and avoids a client library. Publishing waits for
+// confirmation: a PONG after the PUB for core NATS, or the stream's PubAck
+// with NATS_JETSTREAM.
+
+type natsInfo struct {
+	MaxPayload int64 `json:"max_payload"`
+	Headers    bool  `json:"headers"`
+}
+
+type natsPubAck struct {
+	Stream string `json:"stream"`
+	Seq    uint64 `json:"seq"`
+	Error  *struct {
+		Description string `json:"description"`
+	} `json:"error"`
+}
+
+// natsDefaultMaxPayload caps the messages read back from a server that
+// doesn't announce max_payload; it is the NATS server's own default.
+const natsDefaultMaxPayload = 1 << 20
+
+var publishNATSFunc = publishNATS
+
+// natsSubject expands {site} in the site's subject template.
+func natsSubject(tmpl, site string) string {
+	return strings.ReplaceAll(tmpl, "{site}", site)
+}
+
+func publishNATS(rawURL, subject string, payload []byte, jetstream bool, timeout time.Duration) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("nats url: %w", err)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	d := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	if u.Scheme == "tls" {
+		conn, err = tls.DialWithDialer(d, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = d.Dial("tcp", host)
+	}
+	if err != nil {
+		return fmt.Errorf("nats dial: %w", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	br := bufio.NewReader(conn)
+
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("nats read info: %w", err)
+	}
+	infoJSON, ok := strings.CutPrefix(strings.TrimSpace(line), "INFO ")
+	if !ok {
+		return fmt.Errorf("nats: unexpected greeting %q", strings.TrimSpace(line))
+	}
+	var info natsInfo
+	if err := json.Unmarshal([]byte(infoJSON), &info); err != nil {
+		return fmt.Errorf("nats info: %w", err)
+	}
+	if info.MaxPayload > 0 && int64(len(payload)) > info.MaxPayload {
+		return fmt.Errorf("nats: payload of %d bytes exceeds server max_payload %d", len(payload), info.MaxPayload)
+	}
+	maxPayload := info.MaxPayload
+	if maxPayload <= 0 {
+		maxPayload = natsDefaultMaxPayload
+	}
+
+	connect := map[string]any{
+		"verbose": false, "pedantic": false, "name": "form-courier", "lang": "go",
+		"headers": info.Headers, "no_responders": info.Headers,
+	}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			connect["user"], connect["pass"] = u.User.Username(), pass
+		} else {
+			connect["auth_token"] = u.User.Username()
+		}
+	}
+	connectJSON, _ := json.Marshal(connect)
+
+	var cmd strings.Builder
+	fmt.Fprintf(&cmd, "CONNECT %s\r\n", connectJSON)
+	inbox := "_INBOX." + strings.ReplaceAll(newSubmissionID(), "-", "")
+	if jetstream {
+		fmt.Fprintf(&cmd, "SUB %s 1\r\nPUB %s %s %d\r\n", inbox, subject, inbox, len(payload))
+	} else {
+		fmt.Fprintf(&cmd, "PUB %s %d\r\n", subject, len(payload))
+	}
+	if _, err := conn.Write(append(append([]byte(cmd.String()), payload...), "\r\nPING\r\n"...)); err != nil {
+		return fmt.Errorf("nats write: %w", err)
+	}
+
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("nats read: %w", err)
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		case line == "PING":
+			_, _ = conn.Write([]byte("PONG\r\n"))
+		case line == "PONG" && !jetstream:
+			// The server handles a connection's commands in order, so the
+			// PONG confirms the PUB before it was accepted.
+			return nil
+		case strings.HasPrefix(line, "MSG "), strings.HasPrefix(line, "HMSG "):
+			body, err := readNATSPayload(br, line, maxPayload)
+			if err != nil {
+				return err
+			}
+			if strings.HasPrefix(line, "HMSG ") {
+				// Only status messages come back with headers here, e.g.
+				// "NATS/1.0 503" when no stream listens on the subject.
+				return fmt.Errorf("nats: no stream acknowledged %s: %s", subject, firstLine(body))
+			}
+			var ack natsPubAck
+			if err := json.Unmarshal(body, &ack); err != nil {
+				return fmt.Errorf("nats pub ack: %w", err)
+			}
+			if ack.Error != nil {
+				return fmt.Errorf("nats pub ack: %s", ack.Error.Description)
+			}
+			return nil
+		}
+	}
+}
+
+// readNATSPayload reads the body announced by a MSG/HMSG line, whose last
+// field is the total byte count, refusing counts beyond limit so a broken or
+// hostile server can't make it allocate at will.
+func readNATSPayload(br *bufio.Reader, line string, limit int64) ([]byte, error) {
+	fields := strings.Fields(line)
+	n, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("nats: bad message header %q", line)
+	}
+	if int64(n) > limit {
+		return nil, fmt.Errorf("nats: message of %d bytes exceeds max_payload %d", n, limit)
+	}
+	buf := make([]byte, n+2) // payload + CRLF
+	if _, err := io.ReadFull(br, buf); err != nil {
+		return nil, fmt.Errorf("nats read payload: %w", err)
+	}
+	return buf[:n], nil
+}
+
+func firstLine(b []byte) string {
+	s, _, _ := strings.Cut(string(b), "\r\n")
+	return s
+}
@@ -0,0 +1,225 @@
+package form_mailer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jordan-wright/email"
+)
+
+// fakeNATS speaks enough of the NATS protocol for one publish per
+// connection. Published payloads are sent on the returned channel; reply
+// answers a PUB carrying a reply subject (JetStream) and reject, when set,
+// is sent as -ERR instead of processing the PUB.
+func fakeNATS(t *testing.T, reply, reject string) (string, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	got := make(chan string, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				fmt.Fprintf(conn, "INFO {\"server_id\":\"test\",\"max_payload\":1024,\"headers\":true}\r\n")
+				br := bufio.NewReader(conn)
+				var inbox string
+				for {
+					line, err := br.ReadString('\n')
+					if err != nil {
+						return
+					}
+					f := strings.Fields(line)
+					switch {
+					case len(f) == 0:
+					case f[0] == "SUB":
+						inbox = f[1]
+					case f[0] == "PUB":
+						if reject != "" {
+							fmt.Fprintf(conn, "-ERR '%s'\r\n", reject)
+							return
+						}
+						n, _ := strconv.Atoi(f[len(f)-1])
+						buf := make([]byte, n+2)
+						if _, err := io.ReadFull(br, buf); err != nil {
+							return
+						}
+						got <- f[1] + " " + string(buf[:n])
+						if len(f) == 4 && reply != "" {
+							fmt.Fprintf(conn, "MSG %s 1 %d\r\n%s\r\n", inbox, len(reply), reply)
+						}
+					case f[0] == "PING":
+						fmt.Fprintf(conn, "PONG\r\n")
+					}
+				}
+			}(conn)
+		}
+	}()
+	return "nats://" + ln.Addr().String(), got
+}
+
+func TestPublishNATS(t *testing.T) {
+	addr, got := fakeNATS(t, "", "")
+	if err := publishNATS(addr, "form.submissions.acme", []byte(`{"id":"1"}`), false, time.Second); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if msg := <-got; msg != `form.submissions.acme {"id":"1"}` {
+		t.Fatalf("unexpected publish: %q", msg)
+	}
+
+	if err := publishNATS(addr, "s", make([]byte, 2048), false, time.Second); err == nil || !strings.Contains(err.Error(), "max_payload") {
+		t.Fatalf("expected max_payload error, got %v", err)
+	}
+}
+
+func TestPublishNATSJetStream(t *testing.T) {
+	addr, got := fakeNATS(t, `{"stream":"FORMS","seq":7}`, "")
+	if err := publishNATS(addr, "form.submissions.acme", []byte("{}"), true, time.Second); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	<-got
+
+	addr, _ = fakeNATS(t, `{"error":{"code":503,"description":"insufficient resources"}}`, "")
+	if err := publishNATS(addr, "form.submissions.acme", []byte("{}"), true, time.Second); err == nil || !strings.Contains(err.Error(), "insufficient resources") {
+		t.Fatalf("expected PubAck error, got %v", err)
+	}
+}
+
+func TestPublishNATSServerError(t *testing.T) {
+	addr, _ := fakeNATS(t, "", "Permissions Violation for Publish")
+	err := publishNATS(addr, "form.submissions.acme", []byte("{}"), false, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "Permissions Violation") {
+		t.Fatalf("expected -ERR to fail the publish, got %v", err)
+	}
+}
+
+func TestReadNATSPayload(t *testing.T) {
+	br := bufio.NewReader(strings.NewReader("{}\r\n"))
+	if body, err := readNATSPayload(br, "MSG _INBOX.x 1 2", 1024); err != nil || string(body) != "{}" {
+		t.Fatalf("expected the payload, got %q (%v)", body, err)
+	}
+	for _, line := range []string{"MSG _INBOX.x 1 -5", "MSG _INBOX.x 1 x"} {
+		if _, err := readNATSPayload(br, line, 1024); err == nil || !strings.Contains(err.Error(), "bad message header") {
+			t.Fatalf("%q: expected a bad header error, got %v", line, err)
+		}
+	}
+	if _, err := readNATSPayload(br, "MSG _INBOX.x 1 4294967296", 1024); err == nil || !strings.Contains(err.Error(), "max_payload") {
+		t.Fatalf("expected a max_payload error, got %v", err)
+	}
+}
+
+func TestHandleContactNATSDelivery(t *testing.T) {
+	setupTestConfig(t)
+	prev := publishNATSFunc
+	t.Cleanup(func() { publishNATSFunc = prev })
+
+	conf.RateBurst = 10
+	conf.NATSURL = "nats://nats.internal:4222"
+	conf.Sites["acme"].Delivery = deliveryNATS
+	conf.Sites["acme"].NATSSubject = "form.submissions.{site}"
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error {
+		t.Fatal("no email expected with nats delivery")
+		return nil
+	}
+
+	var (
+		subject string
+		sub     Submission
+		fail    error
+	)
+	publishNATSFunc = func(url, subj string, payload []byte, _ bool, _ time.Duration) error {
+		subject = subj
+		if err := json.Unmarshal(payload, &sub); err != nil {
+			t.Fatalf("payload is not a submission: %v", err)
+		}
+		return fail
+	}
+
+	post := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(`{"name":"Alice","email":"alice@example.com","message":"Hello"}`))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		return rec
+	}
+
+	rec := post()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if subject != "form.submissions.acme" {
+		t.Fatalf("unexpected subject %q", subject)
+	}
+	if sub.SchemaVersion != SchemaVersion || sub.Site != "acme" || sub.Fields["email"] != "alice@example.com" || sub.Fields["message"] != "Hello" || sub.SubmissionID == "" {
+		t.Fatalf("unexpected submission: %+v", sub)
+	}
+
+	fail = errors.New("nats: no responders")
+	if rec := post(); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500 when publishing fails, got %d", rec.Code)
+	}
+}
+
+func TestHandleContactNotifyOnly(t *testing.T) {
+	setupTestConfig(t)
+	prev := publishNATSFunc
+	t.Cleanup(func() { publishNATSFunc = prev })
+
+	conf.RateBurst = 10
+	conf.NATSURL = "nats://nats.internal:4222"
+	conf.Sites["acme"].NotifyOnly = true
+	conf.Sites["acme"].NATSSubject = "form.submissions.{site}"
+
+	var published []byte
+	publishNATSFunc = func(_, _ string, payload []byte, _ bool, _ time.Duration) error {
+		published = payload
+		return nil
+	}
+	var notice *email.Email
+	sendEmailFunc = func(_ context.Context, _ *SiteCfg, e *email.Email) error {
+		notice = e
+		return errors.New("smtp down")
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(`{"name":"Alice","email":"alice@example.com","message":"secret details"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	HandleContact(rec, req)
+
+	// The submission was stored, so the failed notice doesn't fail the request.
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if !strings.Contains(string(published), "secret details") {
+		t.Fatalf("expected the full submission to be published, got %s", published)
+	}
+	if notice == nil {
+		t.Fatal("expected a notice email")
+	}
+	for _, s := range []string{notice.Subject, string(notice.Text), strings.Join(notice.ReplyTo, ",")} {
+		if strings.Contains(s, "alice") || strings.Contains(s, "Alice") || strings.Contains(s, "secret") {
+			t.Fatalf("notice leaks submitter data: %q", s)
+		}
+	}
+	if !strings.Contains(string(notice.Text), "Site: acme") || notice.Headers.Get("X-Submission-ID") == "" {
+		t.Fatalf("notice lacks metadata: %q", notice.Text)
+	}
+}
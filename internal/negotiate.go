@@ -0,0 +1,80 @@
+package form_mailer
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Success response formats HandleContact can answer in, by media type.
+const (
+	formatJSON = "application/json"
+	formatForm = "application/x-www-form-urlencoded"
+	formatText = "text/plain"
+)
+
+// negotiateFormat picks the success response format from an Accept header:
+// the supported type with the highest q, ties going to the one listed
+// first. JSON is the answer for a missing header, wildcards and anything
+// unsupported, so existing clients see no change.
+func negotiateFormat(accept string) string {
+	best, bestQ := formatJSON, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch mt {
+		case formatJSON, formatForm, formatText:
+		case "*/*", "application/*":
+			mt = formatJSON
+		default:
+			continue
+		}
+		if q > bestQ {
+			best, bestQ = mt, q
+		}
+	}
+	return best
+}
+
+// writeSuccess answers an accepted submission in the negotiated format. A
+// receipt, when given, adds received_at, receipt and receipt_alg to the
+// JSON and form answers and is sent as the ETag in every format.
+func writeSuccess(w http.ResponseWriter, r *http.Request, submissionID string, rc *submissionReceipt) {
+	w.Header().Add("Vary", "Accept")
+	if rc != nil {
+		w.Header().Set("ETag", `"`+rc.Hash+`"`)
+	}
+	switch format := negotiateFormat(r.Header.Get("Accept")); format {
+	case formatForm:
+		w.Header().Set("Content-Type", format)
+		v := url.Values{"status": {"ok"}, "submission_id": {submissionID}}
+		if rc != nil {
+			v.Set("received_at", rc.ReceivedAt)
+			v.Set("receipt", rc.Hash)
+			v.Set("receipt_alg", rc.Alg)
+		}
+		fmt.Fprint(w, v.Encode())
+	case formatText:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "ok %s\n", submissionID)
+	default:
+		w.Header().Set("Content-Type", formatJSON)
+		resp := map[string]any{"ok": true, "submission_id": submissionID}
+		if rc != nil {
+			resp["received_at"], resp["receipt"], resp["receipt_alg"] = rc.ReceivedAt, rc.Hash, rc.Alg
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,126 @@
+package form_mailer
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jordan-wright/email"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := map[string]string{
+		"":                                  formatJSON,
+		"*/*":                               formatJSON,
+		"application/json":                  formatJSON,
+		"text/html, */*;q=0.8":              formatJSON,
+		"text/plain":                        formatText,
+		"application/x-www-form-urlencoded": formatForm,
+		"text/plain;q=0.5, application/x-www-form-urlencoded": formatForm,
+		"application/json;q=0.2, text/plain;q=0.9":            formatText,
+		"text/plain;q=0, */*":                                 formatJSON,
+		"image/png":                                           formatJSON,
+		"text/plain;q=oops":                                   formatJSON,
+	}
+	for accept, want := range tests {
+		if got := negotiateFormat(accept); got != want {
+			t.Errorf("negotiateFormat(%q) = %q, want %q", accept, got, want)
+		}
+	}
+}
+
+func TestHandleContactResponseFormats(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return nil }
+
+	post := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(`{"name":"Alice","email":"alice@example.com","message":"Hello"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", accept, rec.Code)
+		}
+		if rec.Header().Get("Vary") != "Accept" {
+			t.Fatalf("%s: expected Vary: Accept", accept)
+		}
+		return rec
+	}
+
+	rec := post("application/x-www-form-urlencoded")
+	if ct := rec.Header().Get("Content-Type"); ct != formatForm || !strings.HasPrefix(rec.Body.String(), "status=ok&submission_id=") {
+		t.Fatalf("unexpected form response %q: %q", ct, rec.Body)
+	}
+	rec = post("text/plain")
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") || !strings.HasPrefix(rec.Body.String(), "ok ") {
+		t.Fatalf("unexpected text response %q: %q", ct, rec.Body)
+	}
+	rec = post("")
+	if ct := rec.Header().Get("Content-Type"); ct != formatJSON || !strings.Contains(rec.Body.String(), `"ok":true`) {
+		t.Fatalf("unexpected default response %q: %q", ct, rec.Body)
+	}
+}
+
+func TestHandleContactSubmissionReceipt(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return nil }
+	cs := conf.Sites["acme"]
+	cs.Receipts = true
+
+	sign := func(key, payload string) string {
+		m := hmac.New(sha256.New, []byte(key))
+		m.Write([]byte(payload))
+		return hex.EncodeToString(m.Sum(nil))
+	}
+	post := func() map[string]any {
+		body := `{"name":"Alice","email":"alice@example.com","message":"Hi <there> & bye"}`
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if len(cs.Secrets) > 0 {
+			req.Header.Set("X-Signature", sign(cs.Secrets[0], body))
+		}
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+		}
+		var resp map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if etag := rec.Header().Get("ETag"); etag != `"`+resp["receipt"].(string)+`"` {
+			t.Fatalf("ETag %q doesn't match receipt %v", etag, resp["receipt"])
+		}
+		return resp
+	}
+	// What a submitter can rebuild from what they sent and got back
+	recompute := func(resp map[string]any, key string) string {
+		payload := `{"fields":{"email":"alice@example.com","message":"Hi <there> & bye","name":"Alice"},` +
+			`"received_at":"` + resp["received_at"].(string) + `","site":"acme","submission_id":"` + resp["submission_id"].(string) + `"}`
+		if key == "" {
+			sum := sha256.Sum256([]byte(payload))
+			return hex.EncodeToString(sum[:])
+		}
+		return sign(key, payload)
+	}
+
+	resp := post()
+	if resp["receipt_alg"] != receiptSHA256 || resp["receipt"] != recompute(resp, "") {
+		t.Fatalf("unexpected unkeyed receipt: %v", resp)
+	}
+
+	cs.Secrets = []string{"s3cret", "old"}
+	resp = post()
+	if resp["receipt_alg"] != receiptHMAC || resp["receipt"] != recompute(resp, "s3cret") {
+		t.Fatalf("unexpected keyed receipt: %v", resp)
+	}
+}
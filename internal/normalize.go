@@ -0,0 +1,60 @@
+package form_mailer
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// normalizeText applies NFKC, which folds the compatibility characters
+// spammers use as homoglyphs (fullwidth forms, mathematical and enclosed
+// alphanumerics, ligatures...) back to their plain forms, then drops
+// control characters and the zero-width characters that only serve to
+// split words. ZWJ and ZWNJ stay: emoji sequences and several scripts
+// need them.
+func normalizeText(s string) string {
+	s = norm.NFKC.String(s)
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range s {
+		switch {
+		case r == '\n' || r == '\t':
+			b.WriteRune(r)
+		case unicode.Is(unicode.Cc, r), invisibleRunes[r]:
+			// dropped; \r\n becomes \n
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// normalizeFields applies NORMALIZE_UNICODE to every top-level string
+// value, list entries included, so the subject and custom fields reach the
+// email as clean as the name and message. The "website" honeypot is left
+// alone: a bot filling it with invisible characters still trips it.
+func normalizeFields(values map[string]any) {
+	for k, v := range values {
+		if k == "website" {
+			continue
+		}
+		switch v := v.(type) {
+		case string:
+			values[k] = normalizeText(v)
+		case []any:
+			for i, e := range v {
+				if s, ok := e.(string); ok {
+					v[i] = normalizeText(s)
+				}
+			}
+		}
+	}
+}
+
+// invisibleRunes are the zero-width characters normalizeText removes.
+var invisibleRunes = map[rune]bool{
+	'\u200b': true, // zero width space
+	'\u2060': true, // word joiner
+	'\ufeff': true, // zero width no-break space (BOM)
+}
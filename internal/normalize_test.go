@@ -0,0 +1,55 @@
+package form_mailer
+
+import "testing"
+
+func TestNormalizeText(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain text\nline two", "plain text\nline two"},
+		{"ｆｒｅｅ ｍｏｎｅｙ", "free money"},
+		{"𝐅𝐫𝐞𝐞 𝓂𝑜𝓃𝑒𝓎 𝟙𝟘𝟘", "Free money 100"},
+		{"ⓒⓐⓢⓗ", "cash"},
+		{"vi\u200bag\u2060ra\ufeff", "viagra"},
+		{"bell\x07 and\x00 nul", "bell and nul"},
+		{"👩\u200d💻 मे\u200dरा", "👩\u200d💻 मे\u200dरा"},
+		{"mi\u200ci", "mi\u200ci"},
+		{"™ \u00a0x²", "TM  x2"},
+		{"ﬁnance", "finance"},
+		{"line\r\nbreak", "line\nbreak"},
+		{"bob＠example.com", "bob@example.com"},
+		{"Zoë Ł", "Zoë Ł"},
+	}
+	for _, tc := range tests {
+		if got := normalizeText(tc.in); got != tc.want {
+			t.Errorf("normalizeText(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParseSubmissionNormalizesEveryField(t *testing.T) {
+	cfg := &Config{NormalizeUnicode: true, TrimFields: true}
+	cs := &SiteCfg{Key: "acme", SubmitterSubject: true}
+	values := map[string]any{
+		"name":    "\u200b Ａlice",
+		"email":   "alice＠example.com",
+		"message": "ｆｒｅｅ",
+		"subject": "vi\u200bagra",
+		"company": "𝐀𝐜𝐦𝐞",
+		"tags":    []any{"ⓒⓐⓢⓗ", float64(1)},
+		"website": "\u200b",
+	}
+	p, err := parseSubmission(cfg, cs, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "Alice" || p.Email != "alice@example.com" || p.Message != "free" || p.Subject != "viagra" {
+		t.Fatalf("unexpected submission %+v", p)
+	}
+	if values["company"] != "Acme" || values["tags"].([]any)[0] != "cash" {
+		t.Fatalf("custom fields not normalized: %q", values)
+	}
+	if p.Website != "\u200b" {
+		t.Fatalf("expected the honeypot left as sent, got %q", p.Website)
+	}
+}
@@ -0,0 +1,164 @@
+package form_mailer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol (v1 text and v2 binary) support, so the server sees the
+// client address an L4 load balancer forwards instead of the balancer's own.
+// See https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+
+var (
+	proxyV1Prefix = []byte("PROXY ")
+	proxyV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errNoProxyHeader = errors.New("proxy protocol: missing header")
+)
+
+// proxyHeaderTimeout bounds how long a connection may take to send its header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// ProxyProtoListener wraps ln so every accepted connection must start with a
+// PROXY protocol header, whose source address becomes the RemoteAddr.
+// Connections without a valid header are closed on first use.
+func ProxyProtoListener(ln net.Listener) net.Listener {
+	return &proxyListener{Listener: ln}
+}
+
+type proxyListener struct {
+	net.Listener
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	// The header is read lazily, on the connection's own goroutine, so a
+	// slow client can't stall Accept.
+	return &proxyConn{Conn: c}, nil
+}
+
+type proxyConn struct {
+	net.Conn
+
+	once sync.Once
+	br   *bufio.Reader
+	src  net.Addr
+	err  error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.br = bufio.NewReader(c.Conn)
+		c.src, c.err = readProxyHeader(c.br)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader consumes a v1 or v2 header and returns the source address
+// it carries, or nil for LOCAL/UNKNOWN connections (health checks).
+func readProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	if sig, err := br.Peek(len(proxyV2Sig)); err == nil && bytes.Equal(sig, proxyV2Sig) {
+		return readProxyV2(br)
+	}
+	if prefix, err := br.Peek(len(proxyV1Prefix)); err == nil && bytes.Equal(prefix, proxyV1Prefix) {
+		return readProxyV1(br)
+	}
+	return nil, errNoProxyHeader
+}
+
+func readProxyV1(br *bufio.Reader) (net.Addr, error) {
+	// A v1 header is at most 107 bytes including the CRLF.
+	var line []byte
+	for len(line) < 107 {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("proxy protocol v1: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, errors.New("proxy protocol v1: header too long")
+	}
+	fields := strings.Fields(s)
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("proxy protocol v1: malformed header %q", s)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("proxy protocol v1: bad source %s:%s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(br *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, fmt.Errorf("proxy protocol v2: %w", err)
+	}
+	verCmd, fam := hdr[12], hdr[13]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("proxy protocol v2: unsupported version %d", verCmd>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, fmt.Errorf("proxy protocol v2: %w", err)
+	}
+	if verCmd&0x0f == 0 { // LOCAL
+		return nil, nil
+	}
+	switch fam >> 4 {
+	case 1: // AF_INET
+		if len(payload) < 12 {
+			return nil, errors.New("proxy protocol v2: short IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, errors.New("proxy protocol v2: short IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		// AF_UNIX or unspecified: keep the connection's own address
+		return nil, nil
+	}
+}
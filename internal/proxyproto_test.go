@@ -0,0 +1,83 @@
+package form_mailer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func proxyV2Header(src net.IP, port uint16) []byte {
+	var b bytes.Buffer
+	b.Write(proxyV2Sig)
+	b.WriteByte(0x21) // v2, PROXY
+	b.WriteByte(0x11) // AF_INET, STREAM
+	_ = binary.Write(&b, binary.BigEndian, uint16(12))
+	b.Write(src.To4())
+	b.Write(net.IPv4(10, 0, 0, 1).To4())
+	_ = binary.Write(&b, binary.BigEndian, port)
+	_ = binary.Write(&b, binary.BigEndian, uint16(443))
+	return b.Bytes()
+}
+
+func TestProxyProtoListener(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  []byte
+		want    string // "" = the connection's own address
+		wantErr bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n"), "203.0.113.7:51234", false},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::7 2001:db8::1 51234 443\r\n"), "[2001:db8::7]:51234", false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v2 tcp4", proxyV2Header(net.IPv4(198, 51, 100, 9), 40000), "198.51.100.9:40000", false},
+		{"no header", []byte("GET / HTTP/1.1\r\n"), "", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			pl := ProxyProtoListener(ln)
+
+			go func() {
+				c, err := net.Dial("tcp", ln.Addr().String())
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				_, _ = c.Write(append(tc.header, "hello"...))
+			}()
+
+			c, err := pl.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			addr := c.RemoteAddr().String()
+			data, err := io.ReadAll(c)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, read %q", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "hello" {
+				t.Fatalf("payload = %q, want %q", data, "hello")
+			}
+			if tc.want != "" && addr != tc.want {
+				t.Fatalf("RemoteAddr = %s, want %s", addr, tc.want)
+			}
+			if tc.want == "" && addr == "" {
+				t.Fatal("expected the connection's own address")
+			}
+		})
+	}
+}
@@ -1,6 +1,13 @@
 package form_mailer
 
 import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 )
@@ -8,22 +15,148 @@ import (
 type Bucket struct {
 	tokens int
 	ts     time.Time
+	elem   *list.Element // in bucketLRU
 }
 
 var (
 	// simple per-site+ip rate limit
 	buckets   = map[string]*Bucket{}
 	bucketsMu sync.Mutex
+	// bucketLRU orders bucket keys from least to most recently used, for
+	// RATE_LIMIT_MAX_BUCKETS.
+	bucketLRU = list.New()
+
+	// budgets hold the send and auto-reply allowances. They live apart from
+	// the per-IP buckets so RATE_LIMIT_MAX_BUCKETS can't evict one and hand
+	// its site a fresh allowance; a budget that has refilled completely is
+	// dropped instead, since it would start out full anyway. Guarded by
+	// bucketsMu.
+	budgets       = map[string]*budget{}
+	budgetSweepAt = minBudgetSweep
 )
 
-func Allow(site, ip string, burst, refillMins int) bool {
-	key := site + "|" + ip
-	now := time.Now()
+// minBudgetSweep is the number of budgets from which takeBudget starts
+// dropping the refilled ones.
+const minBudgetSweep = 1024
+
+type budget struct {
+	tokens int
+	ts     time.Time
+	burst  int           // 0 until used after LoadBuckets
+	refill time.Duration // per token
+}
+
+// refilled brings b up to date and reports whether it is full.
+func (b *budget) refilled(now time.Time) bool {
+	if b.burst <= 0 || b.refill <= 0 {
+		return false
+	}
+	if n := int(now.Sub(b.ts) / b.refill); n > 0 {
+		b.tokens = min(b.tokens+n, b.burst)
+		b.ts = b.ts.Add(time.Duration(n) * b.refill)
+	}
+	return b.tokens >= b.burst
+}
+
+// isBudgetKey tells the budget keys in a saved state file from bucket keys.
+func isBudgetKey(key string) bool {
+	return strings.HasPrefix(key, "send:") || strings.HasPrefix(key, "autoreply")
+}
+
+// takeBudget takes n tokens from the budget key, which holds up to burst
+// and regains one token every refill. It takes nothing when fewer than n
+// remain.
+func takeBudget(key string, n, burst int, refill time.Duration) bool {
+	now := nowFunc()
 	bucketsMu.Lock()
 	defer bucketsMu.Unlock()
-	b, ok := buckets[key]
+	b, ok := budgets[key]
 	if !ok {
-		buckets[key] = &Bucket{tokens: burst, ts: now}
+		if len(budgets) >= budgetSweepAt {
+			sweepBudgets(now)
+		}
+		b = &budget{tokens: burst, ts: now}
+		budgets[key] = b
+	}
+	b.burst, b.refill = burst, refill
+	if b.refilled(now) {
+		b.ts = now // a full budget doesn't bank time
+	}
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// refundBudget gives n tokens taken by takeBudget back to the budget key,
+// up to its burst.
+func refundBudget(key string, n int) {
+	bucketsMu.Lock()
+	defer bucketsMu.Unlock()
+	if b, ok := budgets[key]; ok {
+		b.tokens = min(b.tokens+n, b.burst)
+	}
+}
+
+// sweepBudgets drops the budgets that have refilled completely, keeping
+// the sweeps amortized constant time per new budget. Callers hold
+// bucketsMu.
+func sweepBudgets(now time.Time) {
+	for key, b := range budgets {
+		if b.refilled(now) {
+			delete(budgets, key)
+		}
+	}
+	budgetSweepAt = max(minBudgetSweep, 2*len(budgets))
+}
+
+// bucketFor returns the bucket for key, creating a full one when there is
+// none, and marks it most recently used. With maxBuckets set, creating a
+// bucket first evicts the least recently used ones over the cap; an evicted
+// client simply starts again with a full bucket. Callers hold bucketsMu.
+func bucketFor(key string, burst, maxBuckets int, now time.Time) (*Bucket, bool) {
+	if b, ok := buckets[key]; ok {
+		if b.elem != nil {
+			bucketLRU.MoveToBack(b.elem)
+		} else {
+			b.elem = bucketLRU.PushBack(key)
+		}
+		return b, false
+	}
+	for maxBuckets > 0 && len(buckets) >= maxBuckets && evictOldestBucket() {
+	}
+	b := &Bucket{tokens: burst, ts: now}
+	b.elem = bucketLRU.PushBack(key)
+	buckets[key] = b
+	return b, true
+}
+
+// evictOldestBucket drops the least recently used bucket, reporting false
+// when there is none left to drop.
+func evictOldestBucket() bool {
+	e := bucketLRU.Front()
+	if e == nil {
+		return false
+	}
+	bucketLRU.Remove(e)
+	key := e.Value.(string)
+	if b, ok := buckets[key]; ok && b.elem == e {
+		delete(buckets, key)
+		rateLimitEvictions.Inc()
+	}
+	return true
+}
+
+// Allow takes a token from the bucket of client, usually an IP, on site.
+func Allow(site, client string, burst, refillMins int) bool {
+	key := site + "|" + client
+	now := nowFunc()
+	maxBuckets := GetConfig().RateMaxBuckets
+	bucketsMu.Lock()
+	defer bucketsMu.Unlock()
+	b, created := bucketFor(key, burst, maxBuckets, now)
+	if created {
 		return true
 	}
 	// refill per minute
@@ -41,3 +174,204 @@ func Allow(site, ip string, burst, refillMins int) bool {
 	b.tokens--
 	return true
 }
+
+// AllowN takes n tokens from the site+client bucket at once, for requests
+// that stand for several submissions. It takes nothing when fewer than n
+// remain.
+func AllowN(site, client string, n, burst, refillMins int) bool {
+	key := site + "|" + client
+	now := nowFunc()
+	maxBuckets := GetConfig().RateMaxBuckets
+	bucketsMu.Lock()
+	defer bucketsMu.Unlock()
+	b, _ := bucketFor(key, burst, maxBuckets, now)
+	if refills := int(now.Sub(b.ts).Minutes()); refills > 0 {
+		b.tokens = min(b.tokens+refills, burst)
+		b.ts = now
+	}
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// sendBucketIP stands in for the client IP in the per-site send buckets,
+// which count emails rather than requests.
+const sendBucketIP = "*"
+
+// allowSend takes a token from the site's email-send budget. It is checked
+// right before sending, separately from the per-IP request limit, so a site
+// can accept lots of requests while capping what it mails out.
+func allowSend(cfg *Config, cs *SiteCfg) bool {
+	if cs.SendBurst <= 0 {
+		return true
+	}
+	return takeBudget(sendBudgetKey(cs), 1, cs.SendBurst, cfg.sendRefillFor(cs))
+}
+
+// refundSend gives back the token allowSend took for an email that won't
+// be sent.
+func refundSend(cs *SiteCfg) {
+	if cs.SendBurst > 0 {
+		refundBudget(sendBudgetKey(cs), 1)
+	}
+}
+
+func sendBudgetKey(cs *SiteCfg) string {
+	return "send:" + cs.Key + "|" + sendBucketIP
+}
+
+// globalSend is the process-wide outbound email budget
+// (GLOBAL_SEND_RATE_PER_MINUTE), refilled continuously. It protects the shared
+// SMTP reputation regardless of which site is busy.
+var globalSend = &sendRate{}
+
+type sendRate struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	rate   int // per minute; tracks config reloads
+}
+
+// take spends one token, or reports how long until one is available.
+func (s *sendRate) take(perMinute int, now time.Time) (bool, time.Duration) {
+	if perMinute <= 0 {
+		return true, 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rate != perMinute || s.last.IsZero() {
+		s.rate, s.tokens, s.last = perMinute, float64(perMinute), now
+	}
+	s.tokens = min(s.tokens+now.Sub(s.last).Minutes()*float64(perMinute), float64(perMinute))
+	s.last = now
+	if s.tokens < 1 {
+		wait := time.Duration((1 - s.tokens) / float64(perMinute) * float64(time.Minute))
+		return false, wait
+	}
+	s.tokens--
+	return true, 0
+}
+
+// available returns the whole tokens left, for metrics.
+func (s *sendRate) available() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return float64(int(s.tokens))
+}
+
+// allowGlobalSend spends from the global budget; on refusal it returns the
+// wait to advertise in Retry-After.
+func allowGlobalSend(cfg *Config) (bool, time.Duration) {
+	ok, wait := globalSend.take(cfg.GlobalSendRate, nowFunc())
+	if !ok {
+		globalSendThrottled.Inc()
+	}
+	return ok, wait
+}
+
+// BucketCount returns the number of rate-limit buckets and budgets held in
+// memory.
+func BucketCount() int {
+	bucketsMu.Lock()
+	defer bucketsMu.Unlock()
+	return len(buckets) + len(budgets)
+}
+
+// ResetBuckets clears rate-limit state and returns how many buckets were
+// removed. Empty site or ip act as wildcards. A site's send and auto-reply
+// budgets go with it; the global auto-reply budget only with every site.
+func ResetBuckets(site, ip string) int {
+	bucketsMu.Lock()
+	defer bucketsMu.Unlock()
+	cleared := 0
+	for key, b := range buckets {
+		s, i, _ := strings.Cut(key, "|")
+		if (site == "" || s == site) && (ip == "" || i == ip) {
+			if b.elem != nil {
+				bucketLRU.Remove(b.elem)
+			}
+			delete(buckets, key)
+			cleared++
+		}
+	}
+	for key := range budgets {
+		s, i, _ := strings.Cut(key, "|")
+		_, s, _ = strings.Cut(s, ":") // send:<site> or autoreply:<site>
+		if (site == "" || s == site) && (ip == "" || i == ip) {
+			delete(budgets, key)
+			cleared++
+		}
+	}
+	return cleared
+}
+
+type bucketState struct {
+	Tokens int       `json:"tokens"`
+	TS     time.Time `json:"ts"`
+}
+
+// SaveBuckets writes the rate-limit state to path (RATE_LIMIT_STATE_FILE) so
+// a restart doesn't hand every blocked client a fresh budget. The file is
+// replaced atomically.
+func SaveBuckets(path string) error {
+	bucketsMu.Lock()
+	state := make(map[string]bucketState, len(buckets)+len(budgets))
+	for key, b := range buckets {
+		state[key] = bucketState{Tokens: b.tokens, TS: b.ts}
+	}
+	for key, b := range budgets {
+		state[key] = bucketState{Tokens: b.tokens, TS: b.ts}
+	}
+	bucketsMu.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadBuckets replaces the rate-limit state with the one saved at path. On
+// any error, including a missing file, the current state is kept.
+func LoadBuckets(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var state map[string]bucketState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0, fmt.Errorf("corrupt rate limit state %s: %w", path, err)
+	}
+	loadedBudgets := map[string]*budget{}
+	for key, s := range state {
+		if isBudgetKey(key) {
+			loadedBudgets[key] = &budget{tokens: s.Tokens, ts: s.TS}
+			delete(state, key)
+		}
+	}
+	// Without use times on file, the last refill stands in for recency
+	keys := slices.SortedFunc(maps.Keys(state), func(a, b string) int {
+		return state[a].TS.Compare(state[b].TS)
+	})
+	maxBuckets := GetConfig().RateMaxBuckets
+	if maxBuckets > 0 && len(keys) > maxBuckets {
+		keys = keys[len(keys)-maxBuckets:]
+	}
+	loaded := make(map[string]*Bucket, len(keys))
+	lru := list.New()
+	for _, key := range keys {
+		s := state[key]
+		loaded[key] = &Bucket{tokens: s.Tokens, ts: s.TS, elem: lru.PushBack(key)}
+	}
+	bucketsMu.Lock()
+	buckets, bucketLRU, budgets = loaded, lru, loadedBudgets
+	budgetSweepAt = max(minBudgetSweep, 2*len(budgets))
+	bucketsMu.Unlock()
+	return len(loaded) + len(loadedBudgets), nil
+}
@@ -0,0 +1,202 @@
+package form_mailer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendRateTake(t *testing.T) {
+	s := &sendRate{}
+	now := time.Now()
+
+	for i := range 3 {
+		if ok, _ := s.take(3, now); !ok {
+			t.Fatalf("send %d refused within the budget", i+1)
+		}
+	}
+	ok, wait := s.take(3, now)
+	if ok {
+		t.Fatal("expected the 4th send in the same instant to be refused")
+	}
+	if wait <= 0 || wait > 20*time.Second {
+		t.Fatalf("wait = %s, want about 20s for 3/min", wait)
+	}
+	if ok, _ := s.take(3, now.Add(20*time.Second)); !ok {
+		t.Fatal("expected a token after 20s at 3/min")
+	}
+	if ok, _ := s.take(0, now); !ok {
+		t.Fatal("a zero rate means unlimited")
+	}
+}
+
+func TestSaveLoadBuckets(t *testing.T) {
+	setupTestConfig(t)
+	path := filepath.Join(t.TempDir(), "ratelimit.json")
+
+	for i := 0; Allow("acme", "203.0.113.9", 1, 10); i++ {
+		if i > 3 {
+			t.Fatal("expected the bucket to run out")
+		}
+	}
+	if err := SaveBuckets(path); err != nil {
+		t.Fatal(err)
+	}
+	ResetBuckets("", "")
+
+	n, err := LoadBuckets(path)
+	if err != nil || n != 1 {
+		t.Fatalf("LoadBuckets = %d, %v", n, err)
+	}
+	if Allow("acme", "203.0.113.9", 1, 10) {
+		t.Fatal("expected the limit to survive a save and load")
+	}
+
+	if err := os.WriteFile(path, []byte("{not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadBuckets(path); err == nil {
+		t.Fatal("expected an error for a corrupt state file")
+	}
+	if BucketCount() != 1 {
+		t.Fatal("expected a failed load to keep the current state")
+	}
+}
+
+func TestRateLimitMaxBuckets(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateMaxBuckets = 3
+
+	for _, ip := range []string{"198.51.100.1", "198.51.100.2", "198.51.100.3"} {
+		Allow("acme", ip, 1, 10)
+	}
+	// Touch the oldest so the second becomes least recently used
+	Allow("acme", "198.51.100.1", 1, 10)
+	Allow("acme", "198.51.100.4", 1, 10)
+
+	if BucketCount() != 3 {
+		t.Fatalf("expected the cap to hold 3 buckets, got %d", BucketCount())
+	}
+	bucketsMu.Lock()
+	_, second := buckets["acme|198.51.100.2"]
+	_, first := buckets["acme|198.51.100.1"]
+	var order []string
+	for e := bucketLRU.Front(); e != nil; e = e.Next() {
+		order = append(order, e.Value.(string))
+	}
+	bucketsMu.Unlock()
+	if second || !first {
+		t.Fatalf("expected the least recently used bucket evicted, got %v", order)
+	}
+	want := []string{"acme|198.51.100.3", "acme|198.51.100.1", "acme|198.51.100.4"}
+	if strings.Join(order, " ") != strings.Join(want, " ") {
+		t.Fatalf("recency order = %v, want %v", order, want)
+	}
+
+	// An evicted client starts over with a full bucket
+	if !Allow("acme", "198.51.100.2", 1, 10) {
+		t.Fatal("expected an evicted client to be allowed again")
+	}
+	if BucketCount() != 3 {
+		t.Fatalf("expected the cap to hold after re-adding, got %d", BucketCount())
+	}
+
+	ResetBuckets("", "")
+	bucketsMu.Lock()
+	n := bucketLRU.Len()
+	bucketsMu.Unlock()
+	if n != 0 {
+		t.Fatalf("expected a reset to empty the recency list, got %d", n)
+	}
+}
+
+func TestBudgetsSurviveBucketEviction(t *testing.T) {
+	setupTestConfig(t)
+	useFakeClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	path := filepath.Join(t.TempDir(), "ratelimit.json")
+	conf.RateMaxBuckets = 2
+	cs := conf.Sites["acme"]
+	cs.SendBurst = 1
+
+	if !allowSend(conf, cs) || allowSend(conf, cs) {
+		t.Fatal("expected a send budget of one")
+	}
+	for _, ip := range []string{"198.51.100.1", "198.51.100.2", "198.51.100.3"} {
+		Allow("acme", ip, 1, 10)
+	}
+	if allowSend(conf, cs) {
+		t.Fatal("expected evicting request buckets to leave the send budget spent")
+	}
+
+	if err := SaveBuckets(path); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := LoadBuckets(path); err != nil || n != 3 {
+		t.Fatalf("LoadBuckets = %d, %v", n, err)
+	}
+	if allowSend(conf, cs) {
+		t.Fatal("expected the send budget to survive a save and load")
+	}
+}
+
+func TestSweepBudgets(t *testing.T) {
+	setupTestConfig(t)
+	clock := useFakeClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+
+	takeBudget("autoreply:acme|a@example.com", 1, 1, time.Minute)
+	takeBudget("autoreply:acme|b@example.com", 1, 2, time.Hour)
+	clock.Advance(2 * time.Minute)
+	bucketsMu.Lock()
+	sweepBudgets(nowFunc())
+	_, refilled := budgets["autoreply:acme|a@example.com"]
+	_, spent := budgets["autoreply:acme|b@example.com"]
+	bucketsMu.Unlock()
+	if refilled || !spent {
+		t.Fatalf("expected only the refilled budget dropped, got refilled %v spent %v", refilled, spent)
+	}
+}
+
+func TestSendBudgetRefill(t *testing.T) {
+	setupTestConfig(t)
+	clock := useFakeClock(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	cs := conf.Sites["acme"]
+	cs.SendBurst = 1
+
+	// RATE_LIMIT_REFILL_MINUTES (10) applies without a site setting
+	allowSend(conf, cs)
+	clock.Advance(9 * time.Minute)
+	if allowSend(conf, cs) {
+		t.Fatal("expected no send token before RATE_LIMIT_REFILL_MINUTES")
+	}
+	clock.Advance(time.Minute)
+	if !allowSend(conf, cs) {
+		t.Fatal("expected a send token after RATE_LIMIT_REFILL_MINUTES")
+	}
+
+	cs.SendRefill = time.Hour
+	clock.Advance(30 * time.Minute)
+	if allowSend(conf, cs) {
+		t.Fatal("expected <SITE>_SEND_REFILL_MINUTES to override the global refill")
+	}
+	clock.Advance(30 * time.Minute)
+	if !allowSend(conf, cs) {
+		t.Fatal("expected a send token after <SITE>_SEND_REFILL_MINUTES")
+	}
+}
+
+func TestResetBucketsClearsSiteBudgets(t *testing.T) {
+	setupTestConfig(t)
+	takeBudget("send:acme|*", 1, 1, time.Minute)
+	takeBudget("autoreply:acme|alice@example.com", 1, 1, time.Minute)
+	takeBudget("autoreply:other|bob@example.com", 1, 1, time.Minute)
+	takeBudget("autoreply|*", 1, 1, time.Minute)
+
+	if n := ResetBuckets("acme", ""); n != 2 {
+		t.Fatalf("expected acme's send and auto-reply budgets cleared, got %d", n)
+	}
+	if n := ResetBuckets("", ""); n != 2 {
+		t.Fatalf("expected the rest cleared with every site, got %d", n)
+	}
+}
@@ -0,0 +1,88 @@
+package form_mailer
+
+// RejectReason is the stable code of a rejected request. It is the access
+// log's reason, the reason_code of the rejection log line, the "code" of
+// JSON error bodies (JSON_ERRORS), the form_courier_submissions_total
+// reason label and the key of REJECT_STATUS_CODES, so alerts and
+// dashboards can match on it rather than on messages. The values are part
+// of the API: add new ones, never rename or reuse them.
+type RejectReason string
+
+const (
+	// Routing and site lookup
+	RejectBadSiteKey        RejectReason = "bad_site_key"
+	RejectUnknownSite       RejectReason = "unknown_site"
+	RejectSiteMisconfigured RejectReason = "site_misconfigured"
+	RejectNotEchoSite       RejectReason = "not_echo_site"
+	RejectNotFound          RejectReason = "not_found"
+	RejectMethodNotAllowed  RejectReason = "method_not_allowed"
+	RejectHeadersTooLarge   RejectReason = "headers_too_large"
+
+	// Admin endpoints
+	RejectAdminDisabled     RejectReason = "admin_disabled"
+	RejectAdminUnauthorized RejectReason = "admin_unauthorized"
+
+	// Caller checks
+	RejectOriginNotAllowed  RejectReason = "origin_not_allowed"
+	RejectRefererNotAllowed RejectReason = "referer_not_allowed"
+	RejectBlockedUserAgent  RejectReason = "blocked_user_agent"
+	RejectMaintenance       RejectReason = "maintenance"
+	RejectOutsideHours      RejectReason = "outside_hours"
+	RejectIdempotencyBusy   RejectReason = "idempotency_conflict"
+	RejectBadIdempotencyKey RejectReason = "bad_idempotency_key"
+	RejectIdempotencyReused RejectReason = "idempotency_key_reused"
+	RejectInvalidAPIKey     RejectReason = "invalid_api_key"
+	RejectRateLimited       RejectReason = "rate_limited"
+	RejectInvalidSignature  RejectReason = "invalid_signature"
+	RejectInvalidToken      RejectReason = "invalid_token"
+
+	// Reading the body
+	RejectLengthRequired       RejectReason = "length_required"
+	RejectPayloadTooLarge      RejectReason = "payload_too_large"
+	RejectBodyReadError        RejectReason = "body_read_error"
+	RejectJSONTooComplex       RejectReason = "json_too_complex"
+	RejectBadJSON              RejectReason = "bad_json"
+	RejectBadForm              RejectReason = "bad_form"
+	RejectDuplicateField       RejectReason = "duplicate_field"
+	RejectUnsupportedType      RejectReason = "unsupported_content_type"
+	RejectAttachmentNotAllowed RejectReason = "attachment_not_allowed"
+	RejectAttachmentsTooLarge  RejectReason = "attachments_too_large"
+	RejectBatchTooLarge        RejectReason = "batch_too_large"
+
+	// Validating the submission
+	RejectHoneypot              RejectReason = "honeypot"
+	RejectHoneypotToken         RejectReason = "honeypot_token"
+	RejectInvalidSubmission     RejectReason = "invalid_submission"
+	RejectInvalidName           RejectReason = "invalid_name"
+	RejectInvalidEmailDomain    RejectReason = "invalid_email_domain"
+	RejectEmailCooldown         RejectReason = "email_cooldown"
+	RejectInvalidField          RejectReason = "invalid_field"
+	RejectValidationRejected    RejectReason = "validation_rejected"
+	RejectValidationUnavailable RejectReason = "validation_unavailable"
+	RejectVirusFound            RejectReason = "virus_found"
+	RejectScanFailed            RejectReason = "scan_failed"
+
+	// Sending
+	RejectSendRateLimited   RejectReason = "send_rate_limited"
+	RejectGlobalSendLimited RejectReason = "global_send_limited"
+	RejectWarmupLimited     RejectReason = "warmup_limited"
+	RejectSendUnavailable   RejectReason = "send_unavailable"
+	RejectSendFailed        RejectReason = "send_failed"
+)
+
+// Outcome is the access log reason of a request that wasn't rejected, in
+// the same places as a RejectReason. The same rules apply: add, never
+// rename.
+type Outcome string
+
+const (
+	OutcomeSent                 Outcome = "sent"
+	OutcomeDigestBuffered       Outcome = "digest_buffered"
+	OutcomeIdempotentReplay     Outcome = "idempotent_replay"
+	OutcomePreflight            Outcome = "preflight"
+	OutcomePreflightUnknownSite Outcome = "preflight_unknown_site"
+	OutcomeBatch                Outcome = "batch"
+	OutcomeTokenIssued          Outcome = "token_issued"
+	OutcomeOK                   Outcome = "ok" // admin, echo and stats reads
+	OutcomePanic                Outcome = "panic"
+)
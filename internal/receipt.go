@@ -0,0 +1,62 @@
+package form_mailer
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"time"
+)
+
+// Submission receipts (<SITE>_SUBMISSION_RECEIPT): the success response
+// also carries received_at and a hash of the submission, repeated in an
+// ETag header, so the submitter can later prove what was accepted. The
+// hash is an HMAC-SHA256 keyed with the site's first secret, or a plain
+// SHA-256 when it has none. It covers receiptPayload, which anyone holding
+// the submitted fields, the submission ID and received_at can rebuild.
+
+const (
+	receiptHMAC   = "hmac-sha256"
+	receiptSHA256 = "sha256"
+)
+
+type submissionReceipt struct {
+	ReceivedAt string // RFC 3339, as hashed
+	Alg        string
+	Hash       string // hex
+}
+
+// receiptPayload is the canonical form of sub a receipt hashes: compact
+// JSON of {"fields","received_at","site","submission_id"} with keys,
+// including those of fields, in sorted order and HTML left unescaped.
+func receiptPayload(sub *Submission, receivedAt string) []byte {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(map[string]any{
+		"fields":        sub.Fields,
+		"received_at":   receivedAt,
+		"site":          sub.Site,
+		"submission_id": sub.SubmissionID,
+	})
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n"))
+}
+
+// newReceipt returns the receipt for sub, or nil when cs doesn't give them.
+func newReceipt(cs *SiteCfg, sub *Submission) *submissionReceipt {
+	if !cs.Receipts {
+		return nil
+	}
+	rc := &submissionReceipt{ReceivedAt: sub.Meta.ReceivedAt.UTC().Format(time.RFC3339Nano), Alg: receiptSHA256}
+	var h hash.Hash
+	if len(cs.Secrets) > 0 && cs.Secrets[0] != "" {
+		h, rc.Alg = hmac.New(sha256.New, []byte(cs.Secrets[0])), receiptHMAC
+	} else {
+		h = sha256.New()
+	}
+	h.Write(receiptPayload(sub, rc.ReceivedAt))
+	rc.Hash = hex.EncodeToString(h.Sum(nil))
+	return rc
+}
@@ -0,0 +1,59 @@
+package form_mailer
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// redactEmail keeps the first character of the local part and the domain,
+// e.g. alice@example.com -> a***@example.com.
+func redactEmail(addr string) string {
+	local, domain, ok := strings.Cut(addr, "@")
+	if !ok {
+		return redactName(addr)
+	}
+	return redactName(local) + "@" + domain
+}
+
+// redactName keeps only the first character, e.g. Alice -> A***.
+func redactName(s string) string {
+	if s == "" {
+		return ""
+	}
+	for _, r := range s {
+		return string(r) + "***"
+	}
+	return ""
+}
+
+// logEmail returns addr as it may appear in logs under cfg.
+func logEmail(cfg *Config, addr string) string {
+	if cfg.RedactPII {
+		return redactEmail(addr)
+	}
+	return addr
+}
+
+// emailIP returns the submitter IP as the team email shows it: left out
+// with <SITE>_INCLUDE_IP=false, and cut to its network with <SITE>_MASK_IP,
+// the last IPv4 octet or all but the first 48 bits of IPv6 zeroed. An
+// address that doesn't parse can't be masked and is left out too.
+func emailIP(cs *SiteCfg, ip string) string {
+	if cs.HideIP {
+		return ""
+	}
+	if !cs.MaskIP {
+		return ip
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap().WithZone("")
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+	p, _ := addr.Prefix(bits)
+	return p.Addr().String()
+}
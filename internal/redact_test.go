@@ -0,0 +1,55 @@
+package form_mailer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactEmail(t *testing.T) {
+	cases := map[string]string{
+		"alice@example.com": "a***@example.com",
+		"élodie@example.fr": "é***@example.fr",
+		"not-an-email":      "n***",
+		"":                  "",
+	}
+	for in, want := range cases {
+		if got := redactEmail(in); got != want {
+			t.Fatalf("redactEmail(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestEmailIP(t *testing.T) {
+	tests := []struct {
+		cs   SiteCfg
+		ip   string
+		want string
+	}{
+		{SiteCfg{}, "203.0.113.7", "203.0.113.7"},
+		{SiteCfg{HideIP: true, MaskIP: true}, "203.0.113.7", ""},
+		{SiteCfg{MaskIP: true}, "203.0.113.7", "203.0.113.0"},
+		{SiteCfg{MaskIP: true}, "::ffff:203.0.113.7", "203.0.113.0"},
+		{SiteCfg{MaskIP: true}, "2001:db8:1:2:3:4:5:6", "2001:db8:1::"},
+		{SiteCfg{MaskIP: true}, "fe80::1%eth0", "fe80::"},
+		{SiteCfg{MaskIP: true}, "not-an-ip", ""},
+	}
+	for _, tt := range tests {
+		if got := emailIP(&tt.cs, tt.ip); got != tt.want {
+			t.Errorf("emailIP(hide=%v, mask=%v, %q) = %q, want %q", tt.cs.HideIP, tt.cs.MaskIP, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestComposeEmailIPLine(t *testing.T) {
+	cs := &SiteCfg{Key: "acme", To: "ops@example.com", MaskIP: true}
+	p := ContactRequest{Name: "Jane", Email: "jane@example.org", Message: "hi"}
+	e, _ := composeEmail(cs, "id-1", "198.51.100.7", p)
+	if !strings.Contains(string(e.Text), "IP: 198.51.100.0\n") {
+		t.Fatalf("expected a masked IP line, got:\n%s", e.Text)
+	}
+	cs.HideIP = true
+	e, _ = composeEmail(cs, "id-1", "198.51.100.7", p)
+	if strings.Contains(string(e.Text), "IP:") || strings.Contains(string(e.Text), "198.51.100") {
+		t.Fatalf("expected no IP in the email, got:\n%s", e.Text)
+	}
+}
@@ -0,0 +1,76 @@
+package form_mailer
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// <SITE>_SANITIZE_SUBJECT modes, for mail gateways that mangle or reject
+// non-ASCII subjects. The default keeps Unicode, which goes out RFC 2047
+// encoded.
+const (
+	sanitizeSubjectOff      = "off"
+	sanitizeSubjectStrip    = "strip"         // drop non-ASCII
+	sanitizeSubjectTranslit = "transliterate" // accented Latin to ASCII, drop the rest
+)
+
+var translit = buildTranslit(
+	"ÀÁÂÃÄÅàáâãäåÇçÈÉÊËèéêëÌÍÎÏìíîïÑñÒÓÔÕÖòóôõöÙÚÛÜùúûüÝýÿ"+
+		"ĀāĂăĄąĆćĈĉĊċČčĎďĒēĔĕĖėĘęĚěĜĝĞğĠġĢģĤĥĨĩĪīĬĭĮįİıĴĵĶķĹĺĻļĽľŃńŅņŇňŌōŎŏŐőŔŕŖŗŘřŚśŜŝŞşŠšŢţŤťŨũŪūŬŭŮůŰűŲųŴŵŶŷŸŹźŻżŽž",
+	"AAAAAAaaaaaaCcEEEEeeeeIIIIiiiiNnOOOOOoooooUUUUuuuuYyy"+
+		"AaAaAaCcCcCcCcDdEeEeEeEeEeGgGgGgGgHhIiIiIiIiIiJjKkLlLlLlNnNnNnOoOoOoRrRrRrSsSsSsSsTtTtUuUuUuUuUuUuWwYyYZzZzZz",
+	map[rune]string{
+		'ß': "ss", 'Æ': "AE", 'æ': "ae", 'Œ': "OE", 'œ': "oe", 'Ø': "O", 'ø': "o",
+		'Þ': "Th", 'þ': "th", 'Ð': "D", 'ð': "d", 'Đ': "D", 'đ': "d", 'Ł': "L", 'ł': "l",
+		'‘': "'", '’': "'", '‚': "'", '“': `"`, '”': `"`, '„': `"`, '«': `"`, '»': `"`,
+		'–': "-", '—': "-", '…': "...", '€': "EUR", '£': "GBP", '•': "-",
+	},
+)
+
+func buildTranslit(from, to string, extra map[rune]string) map[rune]string {
+	m := extra
+	tr := []rune(to)
+	for i, r := range []rune(from) {
+		m[r] = string(tr[i])
+	}
+	return m
+}
+
+// isASCII reports whether s has only ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeSubject applies the site's <SITE>_SANITIZE_SUBJECT mode to the
+// final subject. Removed characters leave no double spaces behind.
+func sanitizeSubject(cs *SiteCfg, subject string) string {
+	if cs.SanitizeSubject == "" || cs.SanitizeSubject == sanitizeSubjectOff {
+		return subject
+	}
+	var b strings.Builder
+	for _, r := range subject {
+		if r < utf8.RuneSelf {
+			b.WriteRune(r)
+			continue
+		}
+		if cs.SanitizeSubject == sanitizeSubjectTranslit {
+			if s, ok := translit[r]; ok {
+				b.WriteString(s)
+			} else if s := norm.NFKC.String(string(r)); isASCII(s) {
+				b.WriteString(s)
+			}
+		}
+	}
+	out := strings.Join(strings.Fields(b.String()), " ")
+	if out == "" {
+		return "New submission"
+	}
+	return out
+}
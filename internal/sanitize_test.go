@@ -0,0 +1,62 @@
+package form_mailer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jordan-wright/email"
+)
+
+func TestSanitizeSubject(t *testing.T) {
+	tests := []struct {
+		mode, in, want string
+	}{
+		{sanitizeSubjectOff, "[Contact] Party 🎉", "[Contact] Party 🎉"},
+		{"", "[Contact] Party 🎉", "[Contact] Party 🎉"},
+		{sanitizeSubjectStrip, "[Contact] Party 🎉 time", "[Contact] Party time"},
+		{sanitizeSubjectStrip, "[Contact] Müller", "[Contact] Mller"},
+		{sanitizeSubjectTranslit, "[Contact] Müller – Anfrage „dringend“ 🔥", `[Contact] Muller - Anfrage "dringend"`},
+		{sanitizeSubjectTranslit, "[Contact] Straße, Łódź, Œuvre", "[Contact] Strasse, Lodz, OEuvre"},
+		{sanitizeSubjectTranslit, "[Contact] ＦＵＬＬ", "[Contact] FULL"},
+		// Right-to-left text has no ASCII form, and neither do its bidi marks.
+		{sanitizeSubjectTranslit, "[Contact] ‏שלום עולם [#a1b2c3]", "[Contact] [#a1b2c3]"},
+		{sanitizeSubjectStrip, "مرحبا", "New submission"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeSubject(&SiteCfg{SanitizeSubject: tt.mode}, tt.in); got != tt.want {
+			t.Errorf("%s(%q) = %q, want %q", tt.mode, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestHandleContactSanitizeSubject(t *testing.T) {
+	setupTestConfig(t)
+	cs := conf.Sites["acme"]
+	cs.SubmitterSubject = true
+	cs.SanitizeSubject = sanitizeSubjectStrip
+
+	var captured *email.Email
+	sendEmailFunc = func(_ context.Context, site *SiteCfg, e *email.Email) error {
+		captured = e
+		return nil
+	}
+	body, _ := json.Marshal(map[string]string{"name": "Alice", "email": "alice@example.com", "message": "Great work 👍", "subject": "Feedback 🚀"})
+	req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	HandleContact(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if captured.Subject != "[Contact] Feedback" {
+		t.Fatalf("unexpected subject %q", captured.Subject)
+	}
+	if !strings.Contains(string(captured.Text), "Great work 👍") {
+		t.Fatalf("the body must keep its emoji: %q", captured.Text)
+	}
+}
@@ -0,0 +1,62 @@
+package form_mailer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// With SEND_RETRY_503, a send that failed for a reason likely to pass (an
+// SMTP 4xx reply, a timeout, a refused or dropped connection, no free
+// SMTP_MAX_CONCURRENT_PER_HOST slot) gets a 503 with Retry-After instead
+// of a 500, so well-behaved clients back off and retry while the mail
+// server recovers. The delay doubles with each
+// consecutive transient failure, across all sites, from SEND_RETRY_AFTER
+// up to SEND_RETRY_AFTER_MAX, and resets on the next successful send.
+
+var transientSendFailures atomic.Int64
+
+// isTransientSendError reports whether err looks temporary. A mail host
+// whose name doesn't resolve (NXDOMAIN) is a configuration error and stays
+// permanent; other lookup failures may pass.
+func isTransientSendError(err error) bool {
+	var tp *textproto.Error
+	if errors.As(err, &tp) {
+		return tp.Code >= 400 && tp.Code < 500
+	}
+	var dns *net.DNSError
+	if errors.As(err, &dns) {
+		return !dns.IsNotFound
+	}
+	var ne net.Error
+	return errors.As(err, &ne) || errors.Is(err, errSMTPSlotTimeout) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// noteSendResult keeps the count of consecutive transient failures.
+func noteSendResult(err error) {
+	switch {
+	case err == nil:
+		transientSendFailures.Store(0)
+	case isTransientSendError(err):
+		transientSendFailures.Add(1)
+	}
+}
+
+// sendBackoff returns the Retry-After delay for the current run of
+// transient failures, and the X-Courier-Backoff hint describing it.
+func sendBackoff(cfg *Config) (time.Duration, string) {
+	n := transientSendFailures.Load()
+	delay := cfg.SendRetryAfter
+	for i := int64(1); i < n && delay < cfg.SendRetryAfterMax; i++ {
+		delay *= 2
+	}
+	delay = min(delay, cfg.SendRetryAfterMax)
+	return delay, fmt.Sprintf("exponential; failures=%d; max=%d", n, int(cfg.SendRetryAfterMax.Seconds()))
+}
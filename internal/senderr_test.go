@@ -0,0 +1,107 @@
+package form_mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/textproto"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jordan-wright/email"
+)
+
+func TestIsTransientSendError(t *testing.T) {
+	tests := map[error]bool{
+		&textproto.Error{Code: 421, Msg: "try again later"}:                                                                              true,
+		&textproto.Error{Code: 451, Msg: "greylisted"}:                                                                                   true,
+		&textproto.Error{Code: 550, Msg: "relay denied"}:                                                                                 false,
+		&textproto.Error{Code: 535, Msg: "authentication failed"}:                                                                        false,
+		&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}:                                                                  true,
+		fmt.Errorf("send: %w", syscall.ECONNRESET):                                                                                       true,
+		errors.New("smtp config missing for site acme"):                                                                                  false,
+		fmt.Errorf("wrapped: %w", &textproto.Error{Code: 452, Msg: "no space"}):                                                          true,
+		&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "smtp.nowhere.example", IsNotFound: true}}:    false,
+		&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "server misbehaving", Name: "smtp.example.com", IsTemporary: true}}: true,
+	}
+	for err, want := range tests {
+		if got := isTransientSendError(err); got != want {
+			t.Errorf("isTransientSendError(%v) = %v, want %v", err, got, want)
+		}
+	}
+}
+
+func TestHandleContactTransientSendFailure(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.SendRetry503 = true
+	conf.SendRetryAfter = 30 * time.Second
+	conf.SendRetryAfterMax = time.Minute
+	transientSendFailures.Store(0)
+	t.Cleanup(func() { transientSendFailures.Store(0) })
+
+	var fail error
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return fail }
+
+	fail = &textproto.Error{Code: 451, Msg: "temporary local problem"}
+	for i, want := range []string{"30", "60", "60"} {
+		rec := postContact(t)
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("attempt %d: expected status 503, got %d", i+1, rec.Code)
+		}
+		if got := rec.Header().Get("Retry-After"); got != want {
+			t.Fatalf("attempt %d: Retry-After = %q, want %q", i+1, got, want)
+		}
+		if hint := rec.Header().Get("X-Courier-Backoff"); hint != fmt.Sprintf("exponential; failures=%d; max=60", i+1) {
+			t.Fatalf("attempt %d: unexpected X-Courier-Backoff %q", i+1, hint)
+		}
+	}
+
+	fail = &textproto.Error{Code: 550, Msg: "relay access denied"}
+	if rec := postContact(t); rec.Code != http.StatusInternalServerError || rec.Header().Get("Retry-After") != "" {
+		t.Fatalf("expected a permanent failure to be a plain 500, got %d", rec.Code)
+	}
+
+	fail = nil
+	if rec := postContact(t); rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if transientSendFailures.Load() != 0 {
+		t.Fatal("expected a successful send to reset the backoff")
+	}
+
+	conf.SendRetry503 = false
+	fail = &textproto.Error{Code: 451, Msg: "temporary local problem"}
+	if rec := postContact(t); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500 with SEND_RETRY_503 off, got %d", rec.Code)
+	}
+}
+
+func TestSendBackoffCountsTeamMailOnly(t *testing.T) {
+	setupTestConfig(t)
+	transientSendFailures.Store(2)
+	t.Cleanup(func() { transientSendFailures.Store(0) })
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return nil }
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cs := conf.Sites["acme"]
+
+	// An auto-reply or test email going through says nothing about the
+	// team mail's backoff
+	if err := sendMail(t.Context(), conf, cs, email.NewEmail()); err != nil {
+		t.Fatal(err)
+	}
+	if n := transientSendFailures.Load(); n != 2 {
+		t.Fatalf("expected the backoff untouched, got %d failures", n)
+	}
+	if err := sendTeamMail(t.Context(), logger, conf, cs, email.NewEmail()); err != nil {
+		t.Fatal(err)
+	}
+	if n := transientSendFailures.Load(); n != 0 {
+		t.Fatalf("expected a team email to reset the backoff, got %d failures", n)
+	}
+}
@@ -0,0 +1,84 @@
+package form_mailer
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/jordan-wright/email"
+)
+
+// Shadow delivery: <SITE>_SHADOW_DELIVERY sends a sample of a site's
+// delivered submissions through a second backend as well, to compare a
+// new backend against real traffic before switching. It runs in the
+// background after the response is decided; its outcome is only logged
+// and counted in form_courier_shadow_deliveries_total. NATS shadows
+// publish without attachments, since uploads are gone by then. Shadow
+// emails count against GLOBAL_SEND_RATE_PER_MINUTE like any other, and are
+// skipped (outcome "throttled") rather than queued when it is used up.
+
+// shadowWG tracks running shadow deliveries, for a graceful shutdown to
+// wait on.
+var shadowWG sync.WaitGroup
+
+// WaitShadowDeliveries waits for running shadow deliveries to finish, or
+// until ctx is done.
+func WaitShadowDeliveries(ctx context.Context) error {
+	return waitGroupCtx(ctx, &shadowWG)
+}
+
+// waitGroupCtx waits for wg, or until ctx is done.
+func waitGroupCtx(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shadowSampled reports whether this submission goes to the shadow too.
+func shadowSampled(percent float64) bool {
+	return percent >= 100 || rand.Float64()*100 < percent
+}
+
+// deliverShadow sends copies of e and sub through cs.Shadow, when the site
+// has one and the sample picks this submission.
+func deliverShadow(ctx context.Context, logger *slog.Logger, cfg *Config, cs *SiteCfg, sub *Submission, e *email.Email) {
+	shadow := cs.Shadow
+	if shadow == nil || !shadowSampled(cs.ShadowPercent) {
+		return
+	}
+	ec, sc := *e, *sub
+	// Nobody but the shadow's recipient may get a second copy
+	ec.To, ec.Cc, ec.Bcc = []string{shadow.To}, nil, nil
+	// The copy outlives the request; only the slot wait bounds it
+	ctx = context.WithoutCancel(ctx)
+	shadowWG.Add(1)
+	go func() {
+		defer shadowWG.Done()
+		if shadow.Delivery == deliverySMTP {
+			if ok, _ := allowGlobalSend(cfg); !ok {
+				shadowDeliveries.Inc(cs.Key, shadow.Delivery, "throttled")
+				logger.Info("shadow delivery", "backend", shadow.Delivery, "outcome", "throttled")
+				return
+			}
+		}
+		start := time.Now()
+		err := deliver(ctx, logger, cfg, shadow, &sc, nil, &ec)
+		outcome := "ok"
+		if err != nil {
+			outcome = "error"
+		}
+		shadowDeliveries.Inc(cs.Key, shadow.Delivery, outcome)
+		logger.Info("shadow delivery", "backend", shadow.Delivery, "outcome", outcome,
+			"duration_ms", time.Since(start).Milliseconds(), "err", err)
+	}()
+}
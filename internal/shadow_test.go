@@ -0,0 +1,114 @@
+package form_mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jordan-wright/email"
+)
+
+func TestHandleContactShadowDelivery(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	cs := conf.Sites["acme"]
+	cs.CCSubmitter = true
+	shadow := *cs
+	shadow.Delivery, shadow.To, shadow.shadow = deliverySMTP, "seed@example.com", true
+	shadow.SMTP = &SmtpCfg{Host: "ses.example.com", Port: 587}
+	cs.Shadow, cs.ShadowPercent = &shadow, 100
+
+	var (
+		mu     sync.Mutex
+		byHost = map[string]*email.Email{}
+		fail   error
+	)
+	sendEmailFunc = func(_ context.Context, site *SiteCfg, e *email.Email) error {
+		mu.Lock()
+		defer mu.Unlock()
+		byHost[site.SMTP.Host] = e
+		if site.SMTP.Host == "ses.example.com" {
+			return fail
+		}
+		return nil
+	}
+
+	if rec := postContact(t); rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	shadowWG.Wait()
+	primary, dup := byHost[cs.SMTP.Host], byHost["ses.example.com"]
+	if primary == nil || dup == nil {
+		t.Fatalf("expected a primary and a shadow email, got %v", byHost)
+	}
+	if len(primary.Cc) != 1 || len(dup.Cc) != 0 || len(dup.To) != 1 || dup.To[0] != "seed@example.com" || dup.Subject != primary.Subject {
+		t.Fatalf("unexpected shadow email: to %v, cc %v, subject %q", dup.To, dup.Cc, dup.Subject)
+	}
+
+	// A failing shadow doesn't affect the response.
+	fail = errors.New("ses: throttled")
+	if rec := postContact(t); rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200 despite the shadow failing, got %d", rec.Code)
+	}
+	shadowWG.Wait()
+	var metrics bytes.Buffer
+	shadowDeliveries.write(&metrics)
+	for _, want := range []string{`site="acme",backend="smtp",outcome="ok"} 1`, `site="acme",backend="smtp",outcome="error"} 1`} {
+		if !strings.Contains(metrics.String(), want) {
+			t.Fatalf("metrics lack %s:\n%s", want, metrics.String())
+		}
+	}
+}
+
+func TestShadowDeliveryGlobalSendRate(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	conf.GlobalSendRate = 1
+	globalSend = &sendRate{}
+	t.Cleanup(func() { globalSend = &sendRate{} })
+	cs := conf.Sites["acme"]
+	shadow := *cs
+	shadow.Delivery, shadow.To, shadow.shadow = deliverySMTP, "seed@example.com", true
+	cs.Shadow, cs.ShadowPercent = &shadow, 100
+	sent := 0
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { sent++; return nil }
+
+	// The team email takes the only token, so the shadow copy is skipped
+	if rec := postContact(t); rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if err := WaitShadowDeliveries(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if sent != 1 {
+		t.Fatalf("expected the shadow copy throttled, got %d emails", sent)
+	}
+	var metrics bytes.Buffer
+	shadowDeliveries.write(&metrics)
+	if !strings.Contains(metrics.String(), `site="acme",backend="smtp",outcome="throttled"} 1`) {
+		t.Fatalf("metrics lack the throttled shadow:\n%s", metrics.String())
+	}
+}
+
+func TestWaitShadowDeliveriesTimeout(t *testing.T) {
+	release := make(chan struct{})
+	shadowWG.Add(1)
+	go func() {
+		<-release
+		shadowWG.Done()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := WaitShadowDeliveries(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the wait to time out, got %v", err)
+	}
+	close(release)
+	if err := WaitShadowDeliveries(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,201 @@
+package form_mailer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errBadSignature = errors.New("invalid signature")
+
+// Reasons a signature is refused, for logs and
+// form_courier_signature_failures_total.
+const (
+	sigMissing          = "missing_header"
+	sigBadEncoding      = "bad_encoding" // not 64 hex characters
+	sigMismatch         = "mismatch"
+	sigBadTimestamp     = "bad_timestamp"
+	sigExpiredTimestamp = "expired_timestamp"
+	sigFutureTimestamp  = "future_timestamp"
+)
+
+// <SITE>_SIGNATURE_REQUIRED policies: who must sign when the site has a
+// secret.
+const (
+	signRequireAlways   = "always"
+	signRequireNoOrigin = "no_origin" // unsigned posts pass from an allowed browser Origin
+)
+
+// signatureRequired reports whether r must carry a valid X-Signature for
+// cs. Under signRequireNoOrigin an unsigned request whose Origin is one of
+// the site's allowed origins is left to CORS, so a public widget and a
+// signing backend can share a site; one that sends X-Signature anyway is
+// still verified. Origin is only a browser's word, so this is no stronger
+// than CORS for that traffic.
+func signatureRequired(cs *SiteCfg, r *http.Request) bool {
+	if len(cs.Secrets) == 0 {
+		return false
+	}
+	if cs.SignaturePolicy != signRequireNoOrigin || r.Header.Get("X-Signature") != "" {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" || origin == "null" {
+		return true
+	}
+	_, ok := matchOrigin(origin, cs.AllowedOrigins)
+	return !ok
+}
+
+// signatureError is errBadSignature with the details a client needs to fix
+// its signing. It never carries the signatures themselves.
+type signatureError struct {
+	reason string
+	detail string
+	gotLen int // length of X-Signature as received
+}
+
+func (e *signatureError) Error() string {
+	if e.detail == "" {
+		return fmt.Sprintf("%v: %s", errBadSignature, e.reason)
+	}
+	return fmt.Sprintf("%v: %s", errBadSignature, e.detail)
+}
+
+func (e *signatureError) Unwrap() error { return errBadSignature }
+
+// logSignatureFailure records a refused signature for cs. A length other
+// than 64 usually means the client sent base64 or the raw digest instead
+// of hex.
+func logSignatureFailure(logger *slog.Logger, cs *SiteCfg, err error) {
+	reason := sigMismatch
+	args := []any{"err", err}
+	var se *signatureError
+	if errors.As(err, &se) {
+		reason = se.reason
+		if reason == sigBadEncoding || reason == sigMismatch {
+			args = append(args, "received_len", se.gotLen, "expected_len", hex.EncodedLen(sha256.Size))
+		}
+	}
+	signatureFailures.Inc(cs.Key, reason)
+	logger.Warn("invalid signature", append([]any{"reason_code", RejectInvalidSignature, "reason", reason}, args...)...)
+}
+
+// checkSignature verifies X-Signature and returns the index of the matching
+// secret. With SIGNATURE_MAX_AGE_SECONDS set the signature covers
+// "<X-Signature-Timestamp>.<body>" and the timestamp must be recent, so a
+// captured request can't be replayed later.
+func checkSignature(cfg *Config, cs *SiteCfg, h http.Header, body []byte, now time.Time) (int, error) {
+	signed := body
+	if cfg.SignatureMaxAge > 0 {
+		ts := h.Get("X-Signature-Timestamp")
+		if err := checkSignatureTime(ts, now, cfg.SignatureMaxAge, cfg.SignatureClockSkew); err != nil {
+			return -1, err
+		}
+		signed = append([]byte(ts+"."), body...)
+	}
+	sig := h.Get("X-Signature")
+	idx := verifyHMAC(signed, cs.Secrets, sig)
+	if idx < 0 {
+		return -1, signatureMismatch(sig)
+	}
+	return idx, nil
+}
+
+// signatureMismatch explains why sig, as sent in X-Signature, matched none
+// of the site's secrets.
+func signatureMismatch(sig string) error {
+	reason := sigMismatch
+	if sig == "" {
+		reason = sigMissing
+	} else if _, err := hex.DecodeString(sig); err != nil || len(sig) != hex.EncodedLen(sha256.Size) {
+		reason = sigBadEncoding
+	}
+	return &signatureError{reason: reason, gotLen: len(sig)}
+}
+
+// bodySigner is checkSignature for a body that streams through it instead
+// of being buffered, as multipart uploads do: it hashes the same bytes with
+// every secret as they are written, and verify compares the result once
+// the body has been read to the end.
+type bodySigner struct {
+	macs []hash.Hash // by secret index; nil for empty secrets
+}
+
+// newBodySigner checks X-Signature-Timestamp, which needs no body, and
+// starts the hashes.
+func newBodySigner(cfg *Config, cs *SiteCfg, h http.Header, now time.Time) (*bodySigner, error) {
+	var prefix []byte
+	if cfg.SignatureMaxAge > 0 {
+		ts := h.Get("X-Signature-Timestamp")
+		if err := checkSignatureTime(ts, now, cfg.SignatureMaxAge, cfg.SignatureClockSkew); err != nil {
+			return nil, err
+		}
+		prefix = []byte(ts + ".")
+	}
+	s := &bodySigner{macs: make([]hash.Hash, len(cs.Secrets))}
+	for i, secret := range cs.Secrets {
+		if secret == "" {
+			continue
+		}
+		s.macs[i] = hmac.New(sha256.New, []byte(secret))
+		s.macs[i].Write(prefix)
+	}
+	return s, nil
+}
+
+func (s *bodySigner) Write(p []byte) (int, error) {
+	for _, m := range s.macs {
+		if m != nil {
+			m.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// verify checks X-Signature against the bytes written so far and returns
+// the index of the matching secret.
+func (s *bodySigner) verify(h http.Header) (int, error) {
+	sig := h.Get("X-Signature")
+	have := []byte(strings.ToLower(sig))
+	matched := -1
+	for i, m := range s.macs {
+		if m == nil || sig == "" {
+			continue
+		}
+		want := []byte(hex.EncodeToString(m.Sum(nil)))
+		// constant-time compare
+		if hmac.Equal(want, have) && matched < 0 {
+			matched = i
+		}
+	}
+	if matched < 0 {
+		return -1, signatureMismatch(sig)
+	}
+	return matched, nil
+}
+
+// checkSignatureTime accepts unix-second timestamps no older than maxAge and
+// no further ahead than skew, for clients whose clocks run fast.
+func checkSignatureTime(ts string, now time.Time, maxAge, skew time.Duration) error {
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return &signatureError{reason: sigBadTimestamp, detail: "missing or bad timestamp"}
+	}
+	age := now.Sub(time.Unix(sec, 0))
+	if age > maxAge {
+		return &signatureError{reason: sigExpiredTimestamp, detail: fmt.Sprintf("timestamp %s old", age.Truncate(time.Second))}
+	}
+	if age < -skew {
+		return &signatureError{reason: sigFutureTimestamp, detail: fmt.Sprintf("timestamp %s in the future", (-age).Truncate(time.Second))}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package form_mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jordan-wright/email"
+)
+
+func TestCheckSignatureTime(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	maxAge, skew := 5*time.Minute, 30*time.Second
+
+	tests := []struct {
+		name   string
+		offset time.Duration
+		ok     bool
+	}{
+		{"now", 0, true},
+		{"recent past", -4 * time.Minute, true},
+		{"too old", -6 * time.Minute, false},
+		{"future within skew", 20 * time.Second, true},
+		{"future beyond skew", 45 * time.Second, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := strconv.FormatInt(now.Add(tc.offset).Unix(), 10)
+			err := checkSignatureTime(ts, now, maxAge, skew)
+			if (err == nil) != tc.ok {
+				t.Fatalf("checkSignatureTime(%s) = %v, want ok=%v", tc.offset, err, tc.ok)
+			}
+		})
+	}
+	if err := checkSignatureTime("", now, maxAge, skew); !errors.Is(err, errBadSignature) {
+		t.Fatalf("expected a missing timestamp to fail, got %v", err)
+	}
+}
+
+func TestCheckSignatureWithTimestamp(t *testing.T) {
+	cfg := &Config{SignatureMaxAge: time.Minute, SignatureClockSkew: 10 * time.Second}
+	cs := &SiteCfg{Secrets: []string{"s3cret"}}
+	body := []byte(`{"name":"Alice"}`)
+	now := time.Now()
+	ts := strconv.FormatInt(now.Unix(), 10)
+
+	m := hmac.New(sha256.New, []byte("s3cret"))
+	m.Write([]byte(ts + "."))
+	m.Write(body)
+	h := http.Header{}
+	h.Set("X-Signature", hex.EncodeToString(m.Sum(nil)))
+	h.Set("X-Signature-Timestamp", ts)
+
+	if _, err := checkSignature(cfg, cs, h, body, now); err != nil {
+		t.Fatalf("valid timestamped signature rejected: %v", err)
+	}
+	if _, err := checkSignature(cfg, cs, h, body, now.Add(2*time.Minute)); err == nil {
+		t.Fatal("expected a replay after max age to be rejected")
+	}
+	h.Set("X-Signature-Timestamp", strconv.FormatInt(now.Unix()+1, 10))
+	if _, err := checkSignature(cfg, cs, h, body, now); err == nil {
+		t.Fatal("expected a changed timestamp to break the signature")
+	}
+}
+
+func TestCheckSignatureReasons(t *testing.T) {
+	cfg := &Config{}
+	cs := &SiteCfg{Key: "acme", Secrets: []string{"s3cret"}}
+	body := []byte(`{"name":"Alice"}`)
+	m := hmac.New(sha256.New, []byte("other"))
+	m.Write(body)
+	wrong := m.Sum(nil)
+
+	tests := []struct {
+		name, sig, reason string
+	}{
+		{"missing", "", sigMissing},
+		{"base64", base64.StdEncoding.EncodeToString(wrong), sigBadEncoding},
+		{"truncated hex", hex.EncodeToString(wrong)[:40], sigBadEncoding},
+		{"wrong secret", hex.EncodeToString(wrong), sigMismatch},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h := http.Header{}
+			h.Set("X-Signature", tc.sig)
+			_, err := checkSignature(cfg, cs, h, body, time.Now())
+			var se *signatureError
+			if !errors.As(err, &se) || se.reason != tc.reason || se.gotLen != len(tc.sig) {
+				t.Fatalf("got %v, want reason %s", err, tc.reason)
+			}
+			if !errors.Is(err, errBadSignature) {
+				t.Fatalf("%v should still be errBadSignature", err)
+			}
+		})
+	}
+}
+
+func TestHandleContactSignatureForBrowserOrigins(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 50
+	cs := conf.Sites["acme"]
+	cs.Secrets = []string{"s3cret"}
+	cs.AllowedOrigins = []string{"https://widget.example.com"}
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return nil }
+
+	body := `{"name":"Alice","email":"alice@example.com","message":"Hello"}`
+	m := hmac.New(sha256.New, []byte("s3cret"))
+	m.Write([]byte(body))
+	valid := hex.EncodeToString(m.Sum(nil))
+	post := func(origin, sig string) int {
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if sig != "" {
+			req.Header.Set("X-Signature", sig)
+		}
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		return rec.Code
+	}
+
+	tests := []struct {
+		name, policy, origin, sig string
+		want                      int
+	}{
+		{"always: unsigned browser", signRequireAlways, "https://widget.example.com", "", http.StatusUnauthorized},
+		{"always: signed server", signRequireAlways, "", valid, http.StatusOK},
+		{"no_origin: unsigned browser", signRequireNoOrigin, "https://widget.example.com", "", http.StatusOK},
+		{"no_origin: unsigned server", signRequireNoOrigin, "", "", http.StatusUnauthorized},
+		{"no_origin: signed server", signRequireNoOrigin, "", valid, http.StatusOK},
+		{"no_origin: bad signature from browser", signRequireNoOrigin, "https://widget.example.com", "deadbeef", http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		cs.SignaturePolicy = tc.policy
+		if got := post(tc.origin, tc.sig); got != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestLogSignatureFailure(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	cs := &SiteCfg{Key: "sigsite"}
+
+	logSignatureFailure(logger, cs, &signatureError{reason: sigBadEncoding, gotLen: 44})
+	if out := logs.String(); !strings.Contains(out, "reason=bad_encoding") || !strings.Contains(out, "received_len=44 expected_len=64") {
+		t.Fatalf("unexpected log line: %s", out)
+	}
+
+	var metrics bytes.Buffer
+	signatureFailures.write(&metrics)
+	if want := `form_courier_signature_failures_total{site="sigsite",reason="bad_encoding"} 1`; !strings.Contains(metrics.String(), want) {
+		t.Fatalf("expected %s in:\n%s", want, metrics.String())
+	}
+}
@@ -0,0 +1,53 @@
+package form_mailer
+
+import (
+	"net/smtp"
+	"testing"
+)
+
+func TestLoginAuth(t *testing.T) {
+	a := smtpAuth(&SmtpCfg{Host: "mail.example.com", User: "alice", Pass: "s3cret", Auth: smtpAuthLogin})
+
+	if _, _, err := a.Start(&smtp.ServerInfo{Name: "mail.example.com"}); err == nil {
+		t.Fatal("expected LOGIN to refuse an unencrypted connection")
+	}
+	if _, _, err := a.Start(&smtp.ServerInfo{Name: "other.example.com", TLS: true}); err == nil {
+		t.Fatal("expected LOGIN to refuse another host")
+	}
+
+	for range 2 { // a retried authentication starts over
+		mech, initial, err := a.Start(&smtp.ServerInfo{Name: "mail.example.com", TLS: true})
+		if err != nil || mech != "LOGIN" || initial != nil {
+			t.Fatalf("Start = %q, %q, %v", mech, initial, err)
+		}
+		for _, step := range []struct{ challenge, want string }{
+			{"Username:", "alice"},
+			{"Password:", "s3cret"},
+		} {
+			got, err := a.Next([]byte(step.challenge), true)
+			if err != nil || string(got) != step.want {
+				t.Fatalf("Next(%q) = %q, %v; want %q", step.challenge, got, err, step.want)
+			}
+		}
+		if _, err := a.Next([]byte("Again:"), true); err == nil {
+			t.Fatal("expected a third challenge to fail")
+		}
+		if got, err := a.Next(nil, false); got != nil || err != nil {
+			t.Fatalf("final Next = %q, %v", got, err)
+		}
+	}
+
+	if _, _, err := a.Start(&smtp.ServerInfo{Name: "localhost"}); err == nil {
+		t.Fatal("expected the host check to apply to localhost too")
+	}
+}
+
+func TestSMTPAuthMechanism(t *testing.T) {
+	for auth, want := range map[string]string{"": "PLAIN", smtpAuthPlain: "PLAIN", smtpAuthLogin: "LOGIN", smtpAuthCRAMMD5: "CRAM-MD5"} {
+		a := smtpAuth(&SmtpCfg{Host: "localhost", User: "u", Pass: "p", Auth: auth})
+		mech, _, err := a.Start(&smtp.ServerInfo{Name: "localhost"})
+		if err != nil || mech != want {
+			t.Errorf("%q: mechanism %q, %v; want %q", auth, mech, err, want)
+		}
+	}
+}
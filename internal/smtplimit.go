@@ -0,0 +1,52 @@
+package form_mailer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// hostSlots caps concurrent SMTP sends per host:port across every site that
+// shares the relay, so a busy period can't trip "too many connections".
+var (
+	hostSlotsMu sync.Mutex
+	hostSlots   = map[string]chan struct{}{}
+)
+
+// errSMTPSlotTimeout is returned when every slot for the host stayed busy
+// for SMTP_SLOT_TIMEOUT.
+var errSMTPSlotTimeout = errors.New("timed out waiting for an SMTP connection slot")
+
+// acquireSMTPSlot waits until a send to addr may start and returns the func
+// that frees the slot. It gives up when ctx is done or, with wait above 0,
+// after wait. A limit of 0 or less disables the cap.
+func acquireSMTPSlot(ctx context.Context, addr string, limit int, wait time.Duration) (func(), error) {
+	if limit <= 0 {
+		return func() {}, nil
+	}
+	hostSlotsMu.Lock()
+	slots, ok := hostSlots[addr]
+	if !ok || cap(slots) != limit {
+		// New host, or the limit changed on reload; in-flight sends keep
+		// releasing into the old channel.
+		slots = make(chan struct{}, limit)
+		hostSlots[addr] = slots
+	}
+	hostSlotsMu.Unlock()
+
+	var timeout <-chan time.Time
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timeout:
+		return nil, errSMTPSlotTimeout
+	}
+}
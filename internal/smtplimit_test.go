@@ -0,0 +1,79 @@
+package form_mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAcquireSMTPSlotLimitsPerHost(t *testing.T) {
+	var (
+		wg            sync.WaitGroup
+		active, peak  atomic.Int32
+		otherHostDone = make(chan struct{})
+	)
+	for range 6 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := acquireSMTPSlot(t.Context(), "relay.test:587", 2, 0)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer release()
+			n := active.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			active.Add(-1)
+		}()
+	}
+
+	// A different host has its own slots and isn't held up.
+	go func() {
+		if release, err := acquireSMTPSlot(t.Context(), "other.test:587", 2, 0); err == nil {
+			release()
+		}
+		close(otherHostDone)
+	}()
+	select {
+	case <-otherHostDone:
+	case <-time.After(time.Second):
+		t.Fatal("send to another host was blocked")
+	}
+
+	wg.Wait()
+	if got := peak.Load(); got > 2 {
+		t.Fatalf("expected at most 2 concurrent sends, saw %d", got)
+	}
+}
+
+func TestAcquireSMTPSlotGivesUp(t *testing.T) {
+	release, err := acquireSMTPSlot(t.Context(), "busy.test:587", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	if _, err := acquireSMTPSlot(t.Context(), "busy.test:587", 1, 20*time.Millisecond); !errors.Is(err, errSMTPSlotTimeout) {
+		t.Fatalf("expected errSMTPSlotTimeout, got %v", err)
+	}
+	if !isTransientSendError(fmt.Errorf("smtp busy.test:587: %w", errSMTPSlotTimeout)) {
+		t.Fatal("expected a slot timeout to be transient")
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if _, err := acquireSMTPSlot(ctx, "busy.test:587", 1, time.Minute); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package form_mailer
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Hit counters for GET /v1/stats: per-site contact outcomes since startup,
+// for a small dashboard without a metrics stack. They are kept apart from
+// the Prometheus registry, so they count whether METRICS_ENABLED is on or
+// not.
+
+var processStart = time.Now()
+
+type siteStats struct {
+	total    atomic.Int64
+	sent     atomic.Int64
+	buffered atomic.Int64 // held for a digest
+	replayed atomic.Int64 // idempotent replays
+	rejected sync.Map     // reason -> *atomic.Int64
+}
+
+var contactStats sync.Map // site -> *siteStats
+
+// countContact records the outcome of a contact request once it has been
+// matched to a site. Preflights aren't submissions and aren't counted, nor
+// are processed batches, whose items count one by one.
+func countContact(info *RequestInfo) {
+	if info.Site == "" || info.Reason() == string(OutcomePreflight) || info.Reason() == string(OutcomeBatch) {
+		return
+	}
+	countOutcome(info.Site, info.Reason())
+}
+
+// countOutcome records one submission to site, ending with reason (a
+// RejectReason or an Outcome).
+func countOutcome(site, reason string) {
+	v, _ := contactStats.LoadOrStore(site, &siteStats{})
+	st := v.(*siteStats)
+	st.total.Add(1)
+	switch Outcome(reason) {
+	case OutcomeSent:
+		st.sent.Add(1)
+	case OutcomeDigestBuffered:
+		st.buffered.Add(1)
+	case OutcomeIdempotentReplay:
+		st.replayed.Add(1)
+	default:
+		n, _ := st.rejected.LoadOrStore(reason, new(atomic.Int64))
+		n.(*atomic.Int64).Add(1)
+	}
+}
+
+type siteStatsView struct {
+	Total    int64            `json:"total"`
+	Sent     int64            `json:"sent"`
+	Buffered int64            `json:"digest_buffered"`
+	Replayed int64            `json:"idempotent_replays"`
+	Rejected map[string]int64 `json:"rejected"`
+}
+
+func (st *siteStats) view() siteStatsView {
+	v := siteStatsView{
+		Total:    st.total.Load(),
+		Sent:     st.sent.Load(),
+		Buffered: st.buffered.Load(),
+		Replayed: st.replayed.Load(),
+		Rejected: map[string]int64{},
+	}
+	st.rejected.Range(func(reason, n any) bool {
+		v.Rejected[reason.(string)] = n.(*atomic.Int64).Load()
+		return true
+	})
+	return v
+}
+
+// HandleStats reports the contact counters of every site that has had a
+// request, and the process uptime. GET /v1/stats
+func HandleStats(w http.ResponseWriter, r *http.Request) {
+	info := RequestInfoFromContext(r.Context())
+	if !requireAdmin(w, r, info) {
+		return
+	}
+	sites := map[string]siteStatsView{}
+	contactStats.Range(func(site, st any) bool {
+		sites[site.(string)] = st.(*siteStats).view()
+		return true
+	})
+	info.SetOutcome(OutcomeOK)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"started_at":     processStart.UTC().Format(time.RFC3339),
+		"uptime_seconds": int64(math.Round(time.Since(processStart).Seconds())),
+		"sites":          sites,
+	})
+}
@@ -0,0 +1,144 @@
+package form_mailer
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// SchemaVersion is the schema_version of every Submission payload, and of
+// the X-Schema-Version header on webhooks. Bump it for any change an
+// existing consumer could trip over: removing or renaming a key, or
+// changing a type. Adding an optional key doesn't need a bump.
+const SchemaVersion = "1"
+
+// Envelope events.
+const (
+	eventSubmission     = "submission"
+	eventDeliveryFailed = "delivery_failed"
+	eventValidate       = "validate"
+)
+
+// Submission is the versioned JSON envelope for a validated submission,
+// shared by everything that hands submissions to other systems: the NATS
+// backend and the failure webhook. testdata/submission_v1.json pins it.
+type Submission struct {
+	SchemaVersion string                 `json:"schema_version"`
+	Event         string                 `json:"event"`
+	Site          string                 `json:"site"`
+	SubmissionID  string                 `json:"submission_id"`
+	Fields        map[string]any         `json:"fields"` // name, email, message, subject and any custom fields
+	Meta          SubmissionMeta         `json:"meta"`
+	Attachments   []submissionAttachment `json:"attachments,omitempty"`
+}
+
+type SubmissionMeta struct {
+	ReceivedAt time.Time `json:"received_at"`
+	IP         string    `json:"ip"`
+	Priority   string    `json:"priority,omitempty"`
+	Language   string    `json:"detected_language,omitempty"`
+	Preference string    `json:"contact_preference,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"` // shared by a batch; key on SubmissionID
+	Error      string    `json:"error,omitempty"`      // delivery_failed only
+}
+
+type submissionAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"data"` // base64 in JSON
+}
+
+func newSubmission(cs *SiteCfg, id, ip string, p ContactRequest) *Submission {
+	fields := map[string]any{"name": p.Name, "email": p.Email, "message": p.Message}
+	if p.Subject != "" {
+		fields["subject"] = p.Subject
+	}
+	for k, v := range p.Fields {
+		fields[k] = v
+	}
+	return &Submission{
+		SchemaVersion: SchemaVersion,
+		Event:         eventSubmission,
+		Site:          cs.Key,
+		SubmissionID:  id,
+		Fields:        fields,
+		Meta: SubmissionMeta{
+			ReceivedAt: nowFunc().UTC(),
+			IP:         ip,
+			Priority:   p.Priority,
+			Language:   p.Language,
+			Preference: p.ContactPreference,
+		},
+	}
+}
+
+// failed returns the delivery_failed event for s, without attachments.
+func (s *Submission) failed(err error) *Submission {
+	ev := *s
+	ev.Event = eventDeliveryFailed
+	ev.Meta.Error = err.Error()
+	ev.Attachments = nil
+	return &ev
+}
+
+// csvFormulaPrefix is put in front of values a spreadsheet would run as a
+// formula, the usual defence: the cell then shows the text as typed.
+const csvFormulaPrefix = "'"
+
+// csvSafe neutralizes a value a spreadsheet would read as a formula: one
+// starting with =, +, -, @, a tab or a carriage return.
+func csvSafe(v string) string {
+	if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+		return csvFormulaPrefix + v
+	}
+	return v
+}
+
+// exported returns s as it may leave the service for other systems with
+// SANITIZE_CSV on: submitted text values and attachment names pass
+// through csvSafe, so an export of the NATS stream or failure webhook to a
+// spreadsheet can't run them. s itself, and so the email, is left as is.
+func (s *Submission) exported(cfg *Config) *Submission {
+	if !cfg.SanitizeCSV {
+		return s
+	}
+	ev := *s
+	ev.Fields = make(map[string]any, len(s.Fields))
+	for k, v := range s.Fields {
+		switch tv := v.(type) {
+		case string:
+			v = csvSafe(tv)
+		case []any:
+			multi := make([]any, len(tv))
+			for i, e := range tv {
+				if str, ok := e.(string); ok {
+					e = csvSafe(str)
+				}
+				multi[i] = e
+			}
+			v = multi
+		}
+		ev.Fields[k] = v
+	}
+	if len(s.Attachments) > 0 {
+		ev.Attachments = slices.Clone(s.Attachments)
+		for i := range ev.Attachments {
+			ev.Attachments[i].Filename = csvSafe(ev.Attachments[i].Filename)
+		}
+	}
+	return &ev
+}
+
+// attach loads the uploaded files into the envelope. It is left to the
+// backends that publish the envelope, since spooled uploads are read back
+// into memory here.
+func (s *Submission) attach(atts []attachment) error {
+	for _, a := range atts {
+		data, err := a.bytes()
+		if err != nil {
+			return err
+		}
+		s.Attachments = append(s.Attachments, submissionAttachment{Filename: a.Filename, ContentType: a.ContentType, Data: data})
+	}
+	return nil
+}
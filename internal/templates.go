@@ -0,0 +1,140 @@
+package form_mailer
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	texttemplate "text/template"
+
+	"github.com/nazarhussain/form-courier/env"
+)
+
+// Templates come in two sets rendered over the same submission: internal
+// ones (<SITE>_INTERNAL_TEXT_TEMPLATE and _HTML_TEMPLATE, formerly without
+// INTERNAL_) for the team email, and external ones (<SITE>_EXTERNAL_*) for
+// the auto-reply to the submitter, which never see the IP.
+
+// templateData is what the templates are rendered with. Body is the
+// built-in text body, or the auto-reply text for external templates, for
+// templates that only want to wrap it.
+type templateData struct {
+	Site          string
+	SubmissionID  string
+	Name          string
+	Email         string
+	Message       string
+	IP            string
+	Priority      string
+	Language      string
+	Subject       string
+	Preference    string // contact_preference, or ""
+	Fields        map[string]any
+	Body          string
+	RequestedSite string // unknown site key served by DEFAULT_SITE_KEY, or ""
+}
+
+// sampleTemplateData exercises every field, so a template that refers to
+// one that doesn't exist fails at startup rather than on a submission.
+var sampleTemplateData = templateData{
+	Site:         "site",
+	SubmissionID: "00000000-0000-0000-0000-000000000000",
+	Name:         "Jane Doe",
+	Email:        "jane@example.com",
+	Message:      "Hello",
+	IP:           "192.0.2.1",
+	Fields:       map[string]any{},
+	Body:         "Hello",
+}
+
+func loadTextTemplate(path string) (*texttemplate.Template, error) {
+	if path == "" {
+		return nil, nil
+	}
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := texttemplate.New(path).Parse(string(src))
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Execute(&bytes.Buffer{}, sampleTemplateData); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func loadHTMLTemplate(path string) (*htmltemplate.Template, error) {
+	if path == "" {
+		return nil, nil
+	}
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := htmltemplate.New(path).Parse(string(src))
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Execute(&bytes.Buffer{}, sampleTemplateData); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// internalTemplatePath returns the path in <SITE>_INTERNAL_<kind>, or in
+// the <SITE>_<kind> it replaces, and the variable it came from.
+func internalTemplatePath(p *env.Parser, uc, kind string) (path, name string, err error) {
+	name = uc + "_INTERNAL_" + kind
+	path = p.Get(name)
+	if legacy := p.Get(uc + "_" + kind); legacy != "" {
+		if path != "" && path != legacy {
+			return "", name, fmt.Errorf("%s and %s_%s are set to different files", name, uc, kind)
+		}
+		path, name = legacy, uc+"_"+kind
+	}
+	return path, name, nil
+}
+
+// newTemplateData collects what templates see of a submission.
+func newTemplateData(cs *SiteCfg, submissionID, ip string, p ContactRequest, body string) templateData {
+	return templateData{
+		Site:          cs.Key,
+		SubmissionID:  submissionID,
+		Name:          p.Name,
+		Email:         p.Email,
+		Message:       p.Message,
+		IP:            ip,
+		Priority:      p.Priority,
+		Language:      p.Language,
+		Subject:       p.Subject,
+		Preference:    p.ContactPreference,
+		Fields:        p.Fields,
+		Body:          body,
+		RequestedSite: p.RequestedSite,
+	}
+}
+
+// renderBodies returns the text and HTML bodies of an email from one set
+// of templates. Without a text template the text part is data.Body, so an
+// HTML-only site still sends multipart/alternative with a readable
+// plain-text version. html is nil without an HTML template.
+func renderBodies(textT *texttemplate.Template, htmlT *htmltemplate.Template, data templateData) (text, html []byte, err error) {
+	text = []byte(data.Body)
+	if textT != nil {
+		var b bytes.Buffer
+		if err := textT.Execute(&b, data); err != nil {
+			return nil, nil, fmt.Errorf("text template: %w", err)
+		}
+		text = b.Bytes()
+	}
+	if htmlT != nil {
+		var b bytes.Buffer
+		if err := htmlT.Execute(&b, data); err != nil {
+			return nil, nil, fmt.Errorf("html template: %w", err)
+		}
+		html = b.Bytes()
+	}
+	return text, html, nil
+}
@@ -0,0 +1,185 @@
+package form_mailer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jordan-wright/email"
+)
+
+func writeTemplate(t *testing.T, name, src string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(src), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHandleContactTemplatesMultipartAlternative(t *testing.T) {
+	setupTestConfig(t)
+	var err error
+	cs := conf.Sites["acme"]
+	if cs.TextTemplate, err = loadTextTemplate(writeTemplate(t, "body.txt", "Text from {{.Name}}: {{.Message}}\n")); err != nil {
+		t.Fatal(err)
+	}
+	if cs.HTMLTemplate, err = loadHTMLTemplate(writeTemplate(t, "body.html", "<p>From {{.Name}}</p><p>{{.Message}}</p>")); err != nil {
+		t.Fatal(err)
+	}
+
+	var captured *email.Email
+	sendEmailFunc = func(_ context.Context, _ *SiteCfg, e *email.Email) error {
+		captured = e
+		return nil
+	}
+	body := `{"name":"Alice","email":"alice@example.com","message":"<script>alert(1)</script> & co"}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	HandleContact(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	if got := string(captured.Text); got != "Text from Alice: <script>alert(1)</script> & co\n" {
+		t.Fatalf("unexpected text part %q", got)
+	}
+	if got := string(captured.HTML); got != "<p>From Alice</p><p>&lt;script&gt;alert(1)&lt;/script&gt; &amp; co</p>" {
+		t.Fatalf("unexpected html part %q", got)
+	}
+	raw, err := captured.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"multipart/alternative", "Content-Type: text/plain", "Content-Type: text/html"} {
+		if !strings.Contains(string(raw), want) {
+			t.Fatalf("message lacks %q:\n%s", want, raw)
+		}
+	}
+}
+
+func TestComposeEmailHTMLOnlyKeepsDefaultText(t *testing.T) {
+	t.Setenv("TPL_TO", "ops@example.com")
+	t.Setenv("TPL_HTML_TEMPLATE", writeTemplate(t, "body.html", "<pre>{{.Body}}</pre>"))
+	cs, err := loadSiteFromEnv(nil, "tpl", relaySMTP, "[Contact]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := composeEmail(cs, "id-1", "198.51.100.7", ContactRequest{Name: "Jane", Email: "jane@example.org", Message: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(e.Text), "From: Jane <jane@example.org>") {
+		t.Fatalf("expected the built-in text body, got %q", e.Text)
+	}
+	if !strings.Contains(string(e.HTML), "From: Jane &lt;jane@example.org&gt;") {
+		t.Fatalf("unexpected html part %q", e.HTML)
+	}
+}
+
+func TestComposeEmailRequestedSite(t *testing.T) {
+	t.Setenv("TPL_TO", "ops@example.com")
+	t.Setenv("TPL_HTML_TEMPLATE", writeTemplate(t, "body.html", "<p>Posted to {{.RequestedSite}}</p>"))
+	cs, err := loadSiteFromEnv(nil, "tpl", relaySMTP, "[Contact]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := ContactRequest{Name: "Jane", Email: "jane@example.org", Message: "hi", RequestedSite: "unknown"}
+	e, err := composeEmail(cs, "id-1", "198.51.100.7", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(e.Text), "Requested site key: unknown\n") {
+		t.Fatalf("text part missing the requested key: %q", e.Text)
+	}
+	if got := string(e.HTML); got != "<p>Posted to unknown</p>" {
+		t.Fatalf("unexpected html part %q", got)
+	}
+	if !strings.HasSuffix(e.Subject, `(site key "unknown")`) {
+		t.Fatalf("subject missing the requested key: %q", e.Subject)
+	}
+}
+
+func TestLoadSiteRejectsBadTemplates(t *testing.T) {
+	t.Setenv("TPL_TO", "ops@example.com")
+	for _, src := range []string{"{{.Name", "{{.Nickname}}"} {
+		t.Setenv("TPL_TEXT_TEMPLATE", writeTemplate(t, "body.txt", src))
+		if _, err := loadSiteFromEnv(nil, "tpl", relaySMTP, ""); err == nil {
+			t.Fatalf("expected template %q to be rejected", src)
+		}
+	}
+	t.Setenv("TPL_TEXT_TEMPLATE", filepath.Join(t.TempDir(), "missing.txt"))
+	if _, err := loadSiteFromEnv(nil, "tpl", relaySMTP, ""); err == nil {
+		t.Fatal("expected a missing template file to be rejected")
+	}
+}
+
+func TestLoadSiteInternalExternalTemplates(t *testing.T) {
+	t.Setenv("TPL_TO", "ops@example.com")
+	t.Setenv("TPL_INTERNAL_TEXT_TEMPLATE", writeTemplate(t, "team.txt", "{{.Name}} from {{.IP}}"))
+	t.Setenv("TPL_EXTERNAL_HTML_TEMPLATE", writeTemplate(t, "reply.html", "<p>Hi {{.Name}}</p>"))
+	cs, err := loadSiteFromEnv(nil, "tpl", relaySMTP, "")
+	if err != nil {
+		t.Fatalf("load site: %v", err)
+	}
+	if cs.TextTemplate == nil || cs.ExternalHTMLTemplate == nil || cs.ExternalTextTemplate != nil || !cs.autoReplies() {
+		t.Fatalf("unexpected templates: %+v", cs)
+	}
+
+	t.Setenv("TPL_TEXT_TEMPLATE", writeTemplate(t, "other.txt", "{{.Name}}"))
+	if _, err := loadSiteFromEnv(nil, "tpl", relaySMTP, ""); err == nil {
+		t.Fatal("expected an error for two different internal text templates")
+	}
+
+	t.Setenv("TPL_TEXT_TEMPLATE", "")
+	t.Setenv("TPL_EXTERNAL_TEXT_TEMPLATE", writeTemplate(t, "bad.txt", "{{.Nickname}}"))
+	if _, err := loadSiteFromEnv(nil, "tpl", relaySMTP, ""); err == nil {
+		t.Fatal("expected a bad external template to be rejected at load")
+	}
+}
+
+func TestHandleContactExternalTemplate(t *testing.T) {
+	setupTestConfig(t)
+	cs := conf.Sites["acme"]
+	cs.AutoReplyText, cs.AutoReplyBurst = "We'll be in touch.", 1
+	conf.AutoReplyGlobalBurst = 1
+	var err error
+	if cs.TextTemplate, err = loadTextTemplate(writeTemplate(t, "team.txt", "Team: {{.Name}} {{.IP}}")); err != nil {
+		t.Fatal(err)
+	}
+	if cs.ExternalTextTemplate, err = loadTextTemplate(writeTemplate(t, "reply.txt", "Hi {{.Name}}, re {{.SubmissionID}}: {{.Body}} [{{.IP}}]")); err != nil {
+		t.Fatal(err)
+	}
+	if cs.ExternalHTMLTemplate, err = loadHTMLTemplate(writeTemplate(t, "reply.html", "<p>Hi {{.Name}}</p>")); err != nil {
+		t.Fatal(err)
+	}
+
+	var team, reply *email.Email
+	sendEmailFunc = func(_ context.Context, _ *SiteCfg, e *email.Email) error {
+		if e.Headers.Get("Auto-Submitted") != "" {
+			reply = e
+		} else {
+			team = e
+		}
+		return nil
+	}
+	rec := postContact(t)
+	if err := WaitAutoReplies(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || team == nil || reply == nil {
+		t.Fatalf("expected a team email and an auto-reply, got %d", rec.Code)
+	}
+	if !strings.HasPrefix(string(team.Text), "Team: Alice 192.0.2.1") {
+		t.Fatalf("unexpected team body %q", team.Text)
+	}
+	id := team.Headers.Get("X-Submission-ID")
+	if string(reply.Text) != "Hi Alice, re "+id+": We'll be in touch. []" || string(reply.HTML) != "<p>Hi Alice</p>" {
+		t.Fatalf("unexpected auto-reply %q / %q", reply.Text, reply.HTML)
+	}
+}
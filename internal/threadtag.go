@@ -0,0 +1,71 @@
+package form_mailer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jordan-wright/email"
+)
+
+// maxSubjectLength caps the team email's subject, in characters. Submitter
+// data can end up in it (FROM_STRICT), and some relays reject or fold very
+// long subjects.
+const maxSubjectLength = 200
+
+// threadTag derives the <SITE>_THREAD_TAG_FIELDS tag for a submission, e.g.
+// "[#a1b2c3]", so that helpdesks threading by subject group submissions
+// from the same person (and topic). It is "" when the site has no tag
+// fields or none of them has a value.
+func threadTag(cs *SiteCfg, p ContactRequest) string {
+	if len(cs.ThreadTagFields) == 0 {
+		return ""
+	}
+	h := sha256.New()
+	empty := true
+	for _, field := range cs.ThreadTagFields {
+		var v string
+		switch field {
+		case "email":
+			v = p.Email
+		case "name":
+			v = p.Name
+		default:
+			if f, ok := p.Fields[field]; ok {
+				v = fmt.Sprint(f)
+			}
+		}
+		v = strings.ToLower(strings.TrimSpace(v))
+		empty = empty && v == ""
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	if empty {
+		return ""
+	}
+	return strings.ReplaceAll(cs.ThreadTagFormat, "{hash}", hex.EncodeToString(h.Sum(nil))[:6])
+}
+
+// applyThreadTag appends the thread tag to the subject, shortening what
+// comes before it so the tag survives the maxSubjectLength cap. Notify-only
+// notices get no tag: it is derived from submitter data.
+func applyThreadTag(e *email.Email, cs *SiteCfg, p ContactRequest) {
+	tag := ""
+	if !cs.NotifyOnly {
+		tag = threadTag(cs, p)
+	}
+	e.Subject = capSubject(e.Subject, tag)
+}
+
+func capSubject(subject, tag string) string {
+	if tag != "" {
+		tag = " " + tag
+	}
+	room := maxSubjectLength - utf8.RuneCountInString(tag)
+	if utf8.RuneCountInString(subject) > room {
+		subject = string([]rune(subject)[:max(room-1, 0)]) + "…"
+	}
+	return subject + tag
+}
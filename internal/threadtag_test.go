@@ -0,0 +1,41 @@
+package form_mailer
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestThreadTag(t *testing.T) {
+	cs := &SiteCfg{Key: "acme", ThreadTagFields: []string{"email", "topic"}, ThreadTagFormat: "[#{hash}]"}
+	p := ContactRequest{Email: "Jane@Example.org", Fields: map[string]any{"topic": "Billing"}}
+
+	tag := threadTag(cs, p)
+	if len(tag) != len("[#a1b2c3]") || !strings.HasPrefix(tag, "[#") {
+		t.Fatalf("unexpected tag %q", tag)
+	}
+	if again := threadTag(cs, ContactRequest{Email: "jane@example.org ", Fields: map[string]any{"topic": "billing"}}); again != tag {
+		t.Fatalf("tag not stable across case and spacing: %q vs %q", again, tag)
+	}
+	p.Fields["topic"] = "Support"
+	if other := threadTag(cs, p); other == tag {
+		t.Fatal("expected a different topic to change the tag")
+	}
+	if got := threadTag(cs, ContactRequest{}); got != "" {
+		t.Fatalf("expected no tag without values, got %q", got)
+	}
+}
+
+func TestCapSubjectKeepsTag(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	got := capSubject(long, "[#abcdef]")
+	if n := utf8.RuneCountInString(got); n != maxSubjectLength {
+		t.Fatalf("subject length = %d, want %d", n, maxSubjectLength)
+	}
+	if !strings.HasSuffix(got, "… [#abcdef]") {
+		t.Fatalf("expected the tag after the shortened subject, got %q", got[len(got)-20:])
+	}
+	if got := capSubject("[Contact] New contact", "[#abcdef]"); got != "[Contact] New contact [#abcdef]" {
+		t.Fatalf("unexpected subject %q", got)
+	}
+}
@@ -0,0 +1,60 @@
+package form_mailer
+
+import (
+	"crypto/tls"
+	"sync"
+)
+
+// CertReloader serves the TLS_CERT_FILE/TLS_KEY_FILE pair to the listener
+// and can re-read it, so renewed certificates are picked up on SIGHUP
+// without dropping connections.
+type CertReloader struct {
+	certFile, keyFile string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads the key pair again. On error the current certificate stays
+// in use.
+func (c *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// ServerTLSConfig returns the listener's TLS settings: at least minVersion
+// (TLS 1.2 or 1.3) and, for TLS 1.2, only forward-secret AEAD suites.
+func ServerTLSConfig(c *CertReloader, minVersion uint16) *tls.Config {
+	return &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: c.GetCertificate,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+	}
+}
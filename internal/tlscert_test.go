@@ -0,0 +1,56 @@
+package form_mailer
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestKeyPair(t, dir)
+
+	c, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := c.GetCertificate(nil)
+
+	// A renewal writes a new pair to the same paths.
+	newCert, newKey := writeTestKeyPair(t, t.TempDir())
+	for src, dst := range map[string]string{newCert: certFile, newKey: keyFile} {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(dst, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := c.GetCertificate(nil)
+	if string(first.Certificate[0]) == string(second.Certificate[0]) {
+		t.Fatal("expected the renewed certificate after Reload")
+	}
+
+	// A broken file keeps the certificate in use.
+	if err := os.WriteFile(certFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Reload(); err == nil {
+		t.Fatal("expected an error for a broken certificate")
+	}
+	if cur, _ := c.GetCertificate(nil); cur != second {
+		t.Fatal("expected the previous certificate to stay in use")
+	}
+
+	if _, err := NewCertReloader(filepath.Join(dir, "missing.pem"), keyFile); err == nil {
+		t.Fatal("expected an error for a missing certificate")
+	}
+	if cfg := ServerTLSConfig(c, tls.VersionTLS12); cfg.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("MinVersion = %x", cfg.MinVersion)
+	}
+}
@@ -0,0 +1,93 @@
+package form_mailer
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/nazarhussain/form-courier/env"
+)
+
+// User-Agent denylist (BLOCKED_USER_AGENTS, <SITE>_BLOCKED_USER_AGENTS):
+// posts from a matching client get a 403, or a fake success with
+// HONEYPOT_FAKE_SUCCESS, before they spend any rate limit. Entries are
+// comma-separated and case-insensitive; one wrapped in slashes is a
+// regular expression (so `/^$/` catches a missing header), anything else
+// a substring. A site's own list replaces the global one; "none" turns
+// it off for the site.
+
+type uaRules struct {
+	subs []string // lowercased
+	res  []*regexp.Regexp
+	raw  []string // rules as configured: subs then res, for logs
+}
+
+// parseUserAgentRules parses a denylist. An empty one gives nil, and
+// "none" an empty list that matches nothing.
+func parseUserAgentRules(s string) (*uaRules, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	rules := &uaRules{}
+	if strings.EqualFold(strings.TrimSpace(s), "none") {
+		return rules, nil
+	}
+	var res []string
+	for _, rule := range splitString(s) {
+		if len(rule) > 2 && strings.HasPrefix(rule, "/") && strings.HasSuffix(rule, "/") {
+			re, err := regexp.Compile("(?i)" + rule[1:len(rule)-1])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", rule, err)
+			}
+			rules.res = append(rules.res, re)
+			res = append(res, rule)
+			continue
+		}
+		rules.subs = append(rules.subs, strings.ToLower(rule))
+		rules.raw = append(rules.raw, rule)
+	}
+	rules.raw = append(rules.raw, res...)
+	return rules, nil
+}
+
+// match returns the first rule that ua matches.
+func (u *uaRules) match(ua string) (string, bool) {
+	if u == nil {
+		return "", false
+	}
+	lower := strings.ToLower(ua)
+	for i, sub := range u.subs {
+		if strings.Contains(lower, sub) {
+			return u.raw[i], true
+		}
+	}
+	for i, re := range u.res {
+		if re.MatchString(ua) {
+			return u.raw[len(u.subs)+i], true
+		}
+	}
+	return "", false
+}
+
+func (u *uaRules) len() int {
+	if u == nil {
+		return 0
+	}
+	return len(u.raw)
+}
+
+func loadBlockedUserAgents(p *env.Parser) *uaRules {
+	rules, err := parseUserAgentRules(p.Get("BLOCKED_USER_AGENTS"))
+	if err != nil {
+		p.Failf("invalid BLOCKED_USER_AGENTS: %v", err)
+	}
+	return rules
+}
+
+// blockedUserAgentsFor returns the denylist that applies to cs.
+func (c *Config) blockedUserAgentsFor(cs *SiteCfg) *uaRules {
+	if cs.BlockedUAs != nil {
+		return cs.BlockedUAs
+	}
+	return c.BlockedUserAgents
+}
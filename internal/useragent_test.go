@@ -0,0 +1,81 @@
+package form_mailer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jordan-wright/email"
+)
+
+func TestUserAgentRules(t *testing.T) {
+	rules, err := parseUserAgentRules("python-requests, /^curl/[0-9.]+$/, /^$/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"python-requests/2.31.0":          "python-requests",
+		"Python-Requests/2.31.0":          "python-requests",
+		"curl/8.4.0":                      "/^curl/[0-9.]+$/",
+		"":                                "/^$/",
+		"Mozilla/5.0 (X11; Linux x86_64)": "",
+		"curl/8.4.0 (custom)":             "",
+	}
+	for ua, want := range tests {
+		got, ok := rules.match(ua)
+		if got != want || ok != (want != "") {
+			t.Errorf("match(%q) = %q, %v, want %q", ua, got, ok, want)
+		}
+	}
+
+	if rules, err := parseUserAgentRules(""); rules != nil || err != nil {
+		t.Errorf("empty list = %v, %v, want nil", rules, err)
+	}
+	if rules, err := parseUserAgentRules("none"); err != nil || rules == nil || rules.len() != 0 {
+		t.Errorf("none = %v, %v, want an empty list", rules, err)
+	}
+	if _, err := parseUserAgentRules("/[a-/"); err == nil {
+		t.Error("expected an error for a bad regexp")
+	}
+}
+
+func TestHandleContactBlockedUserAgent(t *testing.T) {
+	setupTestConfig(t)
+	conf.RateBurst = 10
+	calls := 0
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { calls++; return nil }
+	conf.BlockedUserAgents, _ = parseUserAgentRules("python-requests")
+
+	post := func(ua string) int {
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(`{"name":"Alice","email":"alice@example.com","message":"Hello"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", ua)
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		return rec.Code
+	}
+
+	if code := post("Python-Requests/2.31"); code != http.StatusForbidden {
+		t.Fatalf("expected status 403, got %d", code)
+	}
+	conf.HoneypotFakeSuccess = true
+	if code := post("python-requests/2.31"); code != http.StatusOK || calls != 0 {
+		t.Fatalf("expected a fake success without sending, got %d with %d sends", code, calls)
+	}
+	if code := post("Mozilla/5.0"); code != http.StatusOK || calls != 1 {
+		t.Fatalf("expected a real send, got %d with %d sends", code, calls)
+	}
+
+	// The site's own list replaces the global one
+	conf.HoneypotFakeSuccess = false
+	conf.Sites["acme"].BlockedUAs, _ = parseUserAgentRules("none")
+	if code := post("python-requests/2.31"); code != http.StatusOK {
+		t.Fatalf("expected the site to opt out, got %d", code)
+	}
+	conf.Sites["acme"].BlockedUAs, _ = parseUserAgentRules("/mozilla/")
+	if code := post("Mozilla/5.0"); code != http.StatusForbidden {
+		t.Fatalf("expected the site list to block, got %d", code)
+	}
+}
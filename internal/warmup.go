@@ -0,0 +1,117 @@
+package form_mailer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Sender warmup (<SITE>_WARMUP_DAYS, <SITE>_WARMUP_MAX_DAILY): a new sending
+// domain may send MAX_DAILY*d/DAYS submissions on day d of the ramp, counted
+// in UTC days from the site's first send. Once the ramp is over the cap
+// goes away. Counters are written to WARMUP_STATE_FILE on every send, so
+// neither a restart nor a crash hands out a fresh day.
+
+type warmupState struct {
+	Start string `json:"start"` // first day of the ramp, 2006-01-02
+	Day   string `json:"day"`   // day Count belongs to
+	Count int    `json:"count"`
+}
+
+var (
+	warmupMu sync.Mutex
+	warmup   = map[string]*warmupState{}
+)
+
+// warmupCap returns the number of sends allowed on day (1-based) of a
+// DAYS-day ramp, or -1 once the ramp is over.
+func warmupCap(cs *SiteCfg, day int) int {
+	if day > cs.WarmupDays {
+		return -1
+	}
+	return (cs.WarmupMaxDaily*day + cs.WarmupDays - 1) / cs.WarmupDays
+}
+
+// takeWarmup counts one send against cs's warmup cap. When the cap is used
+// up it returns false and the time until the next UTC day. A failure to
+// save the counters is returned alongside ok, for logging only.
+func takeWarmup(cfg *Config, cs *SiteCfg, now time.Time) (bool, time.Duration, error) {
+	if cs.WarmupDays <= 0 {
+		return true, 0, nil
+	}
+	now = now.UTC()
+	today := now.Format(time.DateOnly)
+
+	warmupMu.Lock()
+	defer warmupMu.Unlock()
+	s, ok := warmup[cs.Key]
+	if !ok {
+		s = &warmupState{Start: today, Day: today}
+		warmup[cs.Key] = s
+	}
+	if s.Day != today {
+		s.Day, s.Count = today, 0
+	}
+	start, err := time.Parse(time.DateOnly, s.Start)
+	if err != nil {
+		start, s.Start = now, today
+	}
+	limit := warmupCap(cs, int(now.Sub(start)/(24*time.Hour))+1)
+	if limit >= 0 && s.Count >= limit {
+		tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		return false, tomorrow.Sub(now), nil
+	}
+	s.Count++
+	return true, 0, saveWarmupLocked(cfg.WarmupStateFile)
+}
+
+// refundWarmup gives back a send counted by takeWarmup at taken that
+// failed. A send taken on a UTC day that has since ended is not refunded:
+// that day's count is gone and the new day's isn't its to give back.
+func refundWarmup(cfg *Config, cs *SiteCfg, taken time.Time) error {
+	if cs.WarmupDays <= 0 {
+		return nil
+	}
+	warmupMu.Lock()
+	defer warmupMu.Unlock()
+	s, ok := warmup[cs.Key]
+	if !ok || s.Day != taken.UTC().Format(time.DateOnly) || s.Count == 0 {
+		return nil
+	}
+	s.Count--
+	return saveWarmupLocked(cfg.WarmupStateFile)
+}
+
+func saveWarmupLocked(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.Marshal(warmup)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadWarmup restores the warmup counters saved at path. On any error,
+// including a missing file, the current state is kept.
+func LoadWarmup(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var state map[string]*warmupState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0, fmt.Errorf("corrupt warmup state %s: %w", path, err)
+	}
+	warmupMu.Lock()
+	warmup = state
+	warmupMu.Unlock()
+	return len(state), nil
+}
@@ -0,0 +1,176 @@
+package form_mailer
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jordan-wright/email"
+)
+
+func resetWarmup(t *testing.T) {
+	t.Helper()
+	warmupMu.Lock()
+	warmup = map[string]*warmupState{}
+	warmupMu.Unlock()
+	t.Cleanup(func() {
+		warmupMu.Lock()
+		warmup = map[string]*warmupState{}
+		warmupMu.Unlock()
+	})
+}
+
+func TestWarmupCap(t *testing.T) {
+	cs := &SiteCfg{WarmupDays: 3, WarmupMaxDaily: 100}
+	for day, want := range map[int]int{1: 34, 2: 67, 3: 100, 4: -1} {
+		if got := warmupCap(cs, day); got != want {
+			t.Errorf("day %d: got cap %d, want %d", day, got, want)
+		}
+	}
+}
+
+func TestTakeWarmup(t *testing.T) {
+	resetWarmup(t)
+	path := filepath.Join(t.TempDir(), "warmup.json")
+	cfg := &Config{WarmupStateFile: path}
+	cs := &SiteCfg{Key: "acme", WarmupDays: 2, WarmupMaxDaily: 4}
+
+	day1 := time.Date(2024, 5, 1, 22, 0, 0, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		if ok, _, err := takeWarmup(cfg, cs, day1); !ok || err != nil {
+			t.Fatalf("send %d on day 1 refused: %v", i+1, err)
+		}
+	}
+	ok, wait, _ := takeWarmup(cfg, cs, day1)
+	if ok || wait != 2*time.Hour {
+		t.Fatalf("expected day 1 cap of 2 with 2h wait, got ok=%v wait=%v", ok, wait)
+	}
+
+	// A restart restores the count instead of starting the day over.
+	warmupMu.Lock()
+	warmup = map[string]*warmupState{}
+	warmupMu.Unlock()
+	if n, err := LoadWarmup(path); err != nil || n != 1 {
+		t.Fatalf("load: n=%d err=%v", n, err)
+	}
+	if ok, _, _ := takeWarmup(cfg, cs, day1); ok {
+		t.Fatal("restored counter should still be at the cap")
+	}
+	if err := refundWarmup(cfg, cs, day1); err != nil {
+		t.Fatalf("refund: %v", err)
+	}
+	if ok, _, _ := takeWarmup(cfg, cs, day1); !ok {
+		t.Fatal("refunded send should be available again")
+	}
+
+	day2 := day1.Add(24 * time.Hour)
+	for i := 0; i < 4; i++ {
+		if ok, _, _ := takeWarmup(cfg, cs, day2); !ok {
+			t.Fatalf("send %d on day 2 refused", i+1)
+		}
+	}
+	if ok, _, _ := takeWarmup(cfg, cs, day2); ok {
+		t.Fatal("expected day 2 cap of 4")
+	}
+	// A send taken on day 1 that fails after midnight isn't refunded
+	// from day 2's count.
+	if err := refundWarmup(cfg, cs, day1); err != nil {
+		t.Fatalf("refund: %v", err)
+	}
+	if ok, _, _ := takeWarmup(cfg, cs, day2); ok {
+		t.Fatal("expected a day 1 refund to leave day 2 at its cap")
+	}
+
+	// After the ramp the cap is gone.
+	for i := 0; i < 10; i++ {
+		if ok, _, _ := takeWarmup(cfg, cs, day2.Add(24*time.Hour)); !ok {
+			t.Fatal("expected no cap once the warmup is over")
+		}
+	}
+}
+
+func TestHandleContactWarmupLimited(t *testing.T) {
+	setupTestConfig(t)
+	resetWarmup(t)
+	conf.RateBurst = 10
+	conf.WarmupStateFile = filepath.Join(t.TempDir(), "warmup.json")
+	conf.Sites["acme"].WarmupDays = 30
+	conf.Sites["acme"].WarmupMaxDaily = 30
+	sendEmailFunc = func(context.Context, *SiteCfg, *email.Email) error { return nil }
+
+	post := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/contact/acme", strings.NewReader(`{"name":"Alice","email":"alice@example.com","message":"Hello"}`))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		HandleContact(rec, req)
+		return rec
+	}
+	if rec := post(); rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	rec := post()
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 503 with Retry-After on the first warmup day's second send, got %d", rec.Code)
+	}
+}
+
+func TestCheckSendBudgetWarmupFirst(t *testing.T) {
+	setupTestConfig(t)
+	resetWarmup(t)
+	cs := conf.Sites["acme"]
+	cs.SendBurst = 2
+	cs.WarmupDays = 30
+	cs.WarmupMaxDaily = 30
+	t.Cleanup(func() { globalSend = &sendRate{} })
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	if _, rej := checkSendBudget(logger, conf, &RequestInfo{}, cs); rej != nil {
+		t.Fatalf("first send refused: %v", rej.reason)
+	}
+	// The warmup cap refuses before the site's send budget is touched
+	if _, rej := checkSendBudget(logger, conf, &RequestInfo{}, cs); rej == nil || rej.reason != RejectWarmupLimited {
+		t.Fatalf("expected the warmup cap, got %+v", rej)
+	}
+	cs.WarmupDays = 0
+	if _, rej := checkSendBudget(logger, conf, &RequestInfo{}, cs); rej != nil {
+		t.Fatalf("expected a send token left, got %v", rej.reason)
+	}
+
+	// A refusal further on hands the warmup slot back
+	cs.WarmupDays = 30
+	resetWarmup(t)
+	conf.GlobalSendRate = 1
+	globalSend = &sendRate{}
+	globalSend.take(1, nowFunc())
+	cs.SendBurst = 0
+	if _, rej := checkSendBudget(logger, conf, &RequestInfo{}, cs); rej == nil || rej.reason != RejectGlobalSendLimited {
+		t.Fatalf("expected the global limit, got %+v", rej)
+	}
+	if ok, _, _ := takeWarmup(conf, cs, nowFunc()); !ok {
+		t.Fatal("expected the warmup slot refunded")
+	}
+}
+
+func TestCheckSendBudgetRefundsSiteToken(t *testing.T) {
+	setupTestConfig(t)
+	cs := conf.Sites["acme"]
+	cs.SendBurst = 1
+	conf.GlobalSendRate = 1
+	globalSend = &sendRate{}
+	t.Cleanup(func() { globalSend = &sendRate{} })
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	globalSend.take(1, nowFunc())
+	if _, rej := checkSendBudget(logger, conf, &RequestInfo{}, cs); rej == nil || rej.reason != RejectGlobalSendLimited {
+		t.Fatalf("expected the global limit, got %+v", rej)
+	}
+	if !allowSend(conf, cs) {
+		t.Fatal("expected the site's send token refunded")
+	}
+}
@@ -0,0 +1,128 @@
+package form_mailer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+	"unicode/utf8"
+)
+
+// webhookClient is shared by best-effort outbound notifications; the short
+// timeout keeps a slow receiver from piling up goroutines.
+var webhookClient = &http.Client{Timeout: 5 * time.Second}
+
+// notifyFailure posts ev, a delivery_failed envelope, to url in the
+// background. Errors are only logged.
+func notifyFailure(logger *slog.Logger, url string, ev *Submission) {
+	if url == "" {
+		return
+	}
+	go func() {
+		body, err := json.Marshal(ev)
+		if err != nil {
+			logger.Error("failure webhook encode failed", "err", err)
+			return
+		}
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			logger.Error("failure webhook request invalid", "err", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Schema-Version", ev.SchemaVersion)
+		resp, err := webhookClient.Do(req)
+		if err != nil {
+			logger.Warn("failure webhook request failed", "err", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			logger.Warn("failure webhook rejected", "status", resp.StatusCode)
+		}
+	}()
+}
+
+var errValidationUnavailable = errors.New("validation webhook unavailable")
+
+// maxValidationMessage caps the webhook's message, which is passed on to
+// the client, in characters.
+const maxValidationMessage = 200
+
+type validationReply struct {
+	Accept  bool   `json:"accept"`
+	Message string `json:"message"` // optional, shown to the client on rejection
+}
+
+// validateSubmission asks cs's <SITE>_VALIDATION_WEBHOOK_URL whether to
+// accept sub. A 2xx answer is decoded as a validationReply and a 4xx
+// rejects; a 5xx, a timeout or an unreadable answer returns an error
+// wrapping errValidationUnavailable, for the site's fail-open setting.
+func validateSubmission(ctx context.Context, cs *SiteCfg, sub *Submission) (validationReply, error) {
+	ev := *sub
+	ev.Event = eventValidate
+	ev.Attachments = nil
+	body, err := json.Marshal(&ev)
+	if err != nil {
+		return validationReply{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, cs.ValidationTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cs.ValidationURL, bytes.NewReader(body))
+	if err != nil {
+		return validationReply{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Schema-Version", ev.SchemaVersion)
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return validationReply{}, fmt.Errorf("%w: %v", errValidationUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	var reply validationReply
+	dec := json.NewDecoder(io.LimitReader(resp.Body, 64<<10))
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		if err := dec.Decode(&reply); err != nil {
+			return validationReply{}, fmt.Errorf("%w: bad reply: %v", errValidationUnavailable, err)
+		}
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		_ = dec.Decode(&reply) // the message is optional here
+		reply.Accept = false
+	default:
+		return validationReply{}, fmt.Errorf("%w: status %d", errValidationUnavailable, resp.StatusCode)
+	}
+	if !utf8.ValidString(reply.Message) || utf8.RuneCountInString(reply.Message) > maxValidationMessage {
+		reply.Message = ""
+	}
+	return reply, nil
+}
+
+// checkValidation runs the site's validation webhook, if any, and returns
+// the rejection reason, message and status, or "" to go ahead.
+func checkValidation(ctx context.Context, logger *slog.Logger, cs *SiteCfg, sub *Submission) (reason RejectReason, msg string, status int) {
+	if cs.ValidationURL == "" {
+		return "", "", 0
+	}
+	reply, err := validateSubmission(ctx, cs, sub)
+	switch {
+	case err != nil && cs.ValidationFailOpen:
+		logger.Warn("validation webhook failed, accepting unvalidated", "err", err)
+	case err != nil:
+		logger.Error("validation webhook failed", "reason_code", RejectValidationUnavailable, "err", err)
+		return RejectValidationUnavailable, "temporarily unavailable", http.StatusServiceUnavailable
+	case !reply.Accept:
+		logger.Warn("rejected by validation webhook", "reason_code", RejectValidationRejected, "message", reply.Message)
+		if reply.Message == "" {
+			reply.Message = "submission rejected"
+		}
+		return RejectValidationRejected, reply.Message, cs.ValidationStatus
+	}
+	return "", "", 0
+}